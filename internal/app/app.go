@@ -2,6 +2,10 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
@@ -10,8 +14,13 @@ import (
 	"messenger/internal/config"
 	"messenger/internal/crypto"
 	httphandlers "messenger/internal/http"
+	"messenger/internal/model"
+	"messenger/internal/relay"
 	"messenger/internal/service"
+	"messenger/internal/sfu"
 	"messenger/internal/storage"
+	"messenger/internal/storage/blob"
+	"messenger/internal/storage/memory"
 	"messenger/internal/storage/postgres"
 	"messenger/internal/ws"
 )
@@ -19,8 +28,15 @@ import (
 type App struct {
 	config  *config.Config
 	storage *postgres.Storage
+	memory  *memory.Storage
 	hub     *ws.Hub
 	router  http.Handler
+	// stopJobs cancels background jobs such as re-encryption
+	stopJobs context.CancelFunc
+	// relay is the embedded STUN/TURN server, if enabled
+	relay *relay.Server
+	// sfu forwards the media of group calls, if enabled
+	sfu *sfu.SFU
 }
 
 func New(cfg *config.Config) *App {
@@ -30,45 +46,68 @@ func New(cfg *config.Config) *App {
 }
 
 func (a *App) Init(ctx context.Context, migrationsFS fs.FS) error {
-	pgStorage, err := postgres.New(a.config.DB.DSN())
-	if err != nil {
-		log.Printf("warning: database connection failed: %v", err)
-		log.Println("application starting without database - some features unavailable")
-	} else if err := pgStorage.Ping(ctx); err != nil {
-		pgStorage.Close()
-		log.Printf("warning: database ping failed: %v", err)
-		log.Println("application starting without database - some features unavailable")
-	} else {
-		a.storage = pgStorage
-		log.Println("database connected")
-
-		if err := a.storage.RunMigrations(ctx, migrationsFS); err != nil {
-			log.Printf("warning: migrations failed: %v", err)
-		} else {
-			log.Println("migrations applied successfully")
-		}
+	switch a.config.StorageBackend {
+	case "memory":
+		a.memory = memory.New()
+		log.Println("using in-memory storage - data will be lost on restart")
+	case "", "postgres":
+		a.connectPostgres(ctx, migrationsFS)
+	default:
+		log.Printf("warning: unknown STORAGE_BACKEND %q - using postgres", a.config.StorageBackend)
+		a.connectPostgres(ctx, migrationsFS)
 	}
 
 	// Initialize services with storage (may be nil)
 	var userRepo storage.UserRepository
 	var messageRepo storage.MessageRepository
+	var conversationRepo storage.ConversationRepository
 	var callRepo storage.CallRepository
-	if pgStorage != nil {
-		userRepo = pgStorage.User()
-		messageRepo = pgStorage.Message()
-		callRepo = pgStorage.Call()
+	var attachmentRepo storage.AttachmentRepository
+	var sessionRepo storage.SessionRepository
+	var keyRepo storage.KeyRepository
+	var dataKeyRepo storage.DataKeyRepository
+	var txManager storage.TransactionManager
+	switch {
+	case a.storage != nil:
+		userRepo = a.storage.User()
+		messageRepo = a.storage.Message()
+		conversationRepo = a.storage.Conversation()
+		callRepo = a.storage.Call()
+		attachmentRepo = a.storage.Attachment()
+		sessionRepo = a.storage.Session()
+		keyRepo = a.storage.Key()
+		dataKeyRepo = a.storage.DataKey()
+		txManager = a.storage
+	case a.memory != nil:
+		userRepo = a.memory.User()
+		messageRepo = a.memory.Message()
+		conversationRepo = a.memory.Conversation()
+		callRepo = a.memory.Call()
+		attachmentRepo = a.memory.Attachment()
+		sessionRepo = a.memory.Session()
+		keyRepo = a.memory.Key()
+		dataKeyRepo = a.memory.DataKey()
+		txManager = a.memory
 	}
 
 	// Initialize encryptor for message encryption
-	encryptor, err := crypto.NewEncryptor(a.config.EncryptionKey)
+	encryptor, err := a.newEncryptor(dataKeyRepo)
 	if err != nil {
 		log.Printf("warning: failed to initialize encryptor: %v", err)
 	}
 
-	authService := auth.NewService(userRepo, a.config.JWTSecret, a.config.JWTDuration)
+	authService := auth.NewService(userRepo, sessionRepo, a.config.JWTSecret, a.config.JWTDuration, a.config.RefreshDuration)
 	userService := service.NewUserService(userRepo)
-	messageService := service.NewMessageService(messageRepo, userRepo, encryptor)
-	callService, err := service.NewCallService(callRepo, userRepo, pgStorage)
+	blobs := a.newBlobStore()
+	attachmentService := service.NewAttachmentService(attachmentRepo, userRepo, conversationRepo, blobs, encryptor, a.config.AttachmentMaxSize)
+	messageService := service.NewMessageService(messageRepo, userRepo, conversationRepo, attachmentService, txManager, encryptor)
+	conversationService := service.NewConversationService(conversationRepo, userRepo, txManager)
+	syncService := service.NewSyncService(messageRepo, callRepo, attachmentService, encryptor)
+	adminService := service.NewAdminService(userRepo, messageRepo, callRepo, attachmentService, authService)
+	keyService := service.NewKeyService(keyRepo, userRepo, txManager)
+	presenceService := service.NewPresenceService(userRepo, conversationRepo)
+	iceService := a.newICEService()
+	callService, err := service.NewCallService(callRepo, userRepo, txManager)
 	if err != nil {
 		log.Printf("warning: failed to initialize call service: %v", err)
 		log.Println("call functionality will be unavailable")
@@ -76,22 +115,44 @@ func (a *App) Init(ctx context.Context, migrationsFS fs.FS) error {
 
 	// Create default user if configured
 	if a.config.DefaultUser != "" && a.config.DefaultPassword != "" {
-		if err := a.ensureDefaultUser(ctx, authService); err != nil {
+		if err := a.ensureDefaultUser(ctx, authService, userRepo); err != nil {
 			log.Printf("warning: failed to create default user: %v", err)
 		}
 	}
 
-	a.hub = ws.NewHub()
+	a.hub = a.newHub()
+	a.hub.SetPresenceService(presenceService)
 	go a.hub.Run()
 
-	httpHandler := httphandlers.NewHandler(authService, userService, messageService, callService, a.config.CORSAllowed, a.config.ICEServers)
+	jobCtx, stopJobs := context.WithCancel(context.Background())
+	a.stopJobs = stopJobs
+	if a.config.EncryptionRekey && encryptor != nil && messageRepo != nil {
+		go runRekey(jobCtx, service.NewRekeyService(messageRepo, attachmentRepo, blobs, encryptor))
+	}
+
+	httpHandler := httphandlers.NewHandler(authService, userService, messageService, conversationService, callService, syncService, attachmentService, adminService, keyService, presenceService, a.hub, a.config.CORSAllowed, iceService)
+	if a.relay != nil {
+		httpHandler.SetRelay(a.relay)
+	}
 	router := httpHandler.Router()
 
 	// Create CallSignaling for WebSocket call handling
 	callSignaling := ws.NewCallSignaling(a.hub, callService, userService, messageService, a.config.CallTimeout)
+	if callService != nil {
+		callService.SetTimeline(messageService, func(entry *model.Message) {
+			a.hub.Broadcast(ws.NewCallEntry(entry))
+		})
+		go ws.NewCallSupervisor(a.hub, callService, a.config.CallRingTimeout).Run(jobCtx)
+		if a.config.SFU.Enabled {
+			a.sfu = a.newSFU()
+		}
+		if a.sfu != nil {
+			callSignaling.SetSFU(a.sfu, a.config.SFU.MinParticipants)
+		}
+	}
 
 	// Register WebSocket handler BEFORE static file catch-all
-	wsHandler := ws.NewHandler(a.hub, authService, messageService, userService, callSignaling)
+	wsHandler := ws.NewHandler(a.hub, authService, messageService, userService, conversationService, syncService, callSignaling)
 	router.Handle("/ws", wsHandler)
 
 	// Static files handler - must be registered last (catch-all)
@@ -107,27 +168,266 @@ func (a *App) Router() http.Handler {
 }
 
 func (a *App) Shutdown(ctx context.Context) {
+	if a.stopJobs != nil {
+		a.stopJobs()
+	}
+	if a.hub != nil {
+		a.hub.Stop()
+	}
+	if a.relay != nil {
+		a.relay.Close()
+	}
+	if a.sfu != nil {
+		a.sfu.Close()
+	}
 	if a.storage != nil {
 		a.storage.Close()
 	}
 }
 
-func (a *App) ensureDefaultUser(ctx context.Context, authService *auth.Service) error {
-	if a.storage == nil {
+// connectPostgres opens the database and applies migrations; on failure the app runs without storage
+func (a *App) connectPostgres(ctx context.Context, migrationsFS fs.FS) {
+	pgStorage, err := postgres.New(a.config.DB.DSN())
+	if err != nil {
+		log.Printf("warning: database connection failed: %v", err)
+		log.Println("application starting without database - some features unavailable")
+	} else if err := pgStorage.Ping(ctx); err != nil {
+		pgStorage.Close()
+		log.Printf("warning: database ping failed: %v", err)
+		log.Println("application starting without database - some features unavailable")
+	} else {
+		a.storage = pgStorage
+		log.Println("database connected")
+
+		if err := a.storage.RunMigrations(ctx, migrationsFS); err != nil {
+			log.Printf("warning: migrations failed: %v", err)
+		} else {
+			log.Println("migrations applied successfully")
+		}
+	}
+}
+
+// newHub creates the WebSocket hub with the configured backplane
+func (a *App) newHub() *ws.Hub {
+	switch a.config.HubBackplane {
+	case "postgres":
+		if a.storage == nil {
+			log.Println("warning: postgres backplane requires a database - falling back to local backplane")
+			return ws.NewHub()
+		}
+		log.Println("using postgres LISTEN/NOTIFY hub backplane")
+		return ws.NewHubWithBackplane(a.storage.Backplane("messenger_hub"))
+	case "", "local":
+		return ws.NewHub()
+	default:
+		log.Printf("warning: unknown HUB_BACKPLANE %q - using local backplane", a.config.HubBackplane)
+		return ws.NewHub()
+	}
+}
+
+// newICEService creates the ICE service and, with TURN_ENABLED, starts the embedded
+// STUN/TURN server and advertises it. Without TURN_SECRET the relay gets a random
+// secret, which only works as long as every instance serves its own relay.
+func (a *App) newICEService() *service.ICEService {
+	cfg := a.config.TURN
+	secret := a.config.TURNSecret
+	if cfg.Enabled && secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			log.Printf("warning: failed to generate TURN secret: %v", err)
+		}
+		secret = hex.EncodeToString(buf)
+		log.Println("no TURN_SECRET set - using a random secret for the embedded TURN server")
+	}
+
+	iceService := service.NewICEService(a.config.ICEServers, secret, a.config.TURNCredentialTTL)
+	if !cfg.Enabled {
+		return iceService
+	}
+
+	port, err := relay.Port(cfg.Listen)
+	if err != nil {
+		log.Printf("warning: invalid TURN_LISTEN %q - embedded TURN server disabled: %v", cfg.Listen, err)
+		return iceService
+	}
+	server, err := relay.New(relay.Config{
+		Listen:       cfg.Listen,
+		PublicIP:     cfg.PublicIP,
+		Realm:        cfg.Realm,
+		RelayPortMin: cfg.RelayPortMin,
+		RelayPortMax: cfg.RelayPortMax,
+		UserQuota:    cfg.UserQuota,
+		Secret:       secret,
+	})
+	if err != nil {
+		log.Printf("warning: embedded TURN server disabled: %v", err)
+		return iceService
+	}
+	a.relay = server
+
+	host := cfg.Host
+	if host == "" {
+		host = cfg.PublicIP
+	}
+	iceService.Advertise(host, port)
+	log.Printf("embedded STUN/TURN server listening on %s, advertised as %s:%d", cfg.Listen, host, port)
+	return iceService
+}
+
+// newSFU starts the selective forwarding unit for group calls, which answers
+// participants from this instance
+func (a *App) newSFU() *sfu.SFU {
+	// A call's room lives on the instance that started it, which participants
+	// connected elsewhere could not publish to
+	if a.hub.Distributed() {
+		log.Println("warning: SFU disabled: it requires the local hub backplane - group calls use a mesh")
+		return nil
+	}
+	cfg := a.config.SFU
+	publicIP := cfg.PublicIP
+	if publicIP == "" {
+		publicIP = a.config.TURN.PublicIP
+	}
+	server, err := sfu.New(sfu.Config{PublicIP: publicIP, UDPPort: cfg.UDPPort}, ws.NewSFUSignaler(a.hub))
+	if err != nil {
+		log.Printf("warning: SFU disabled: %v", err)
+		return nil
+	}
+	log.Printf("SFU forwarding the media of calls with %d or more participants", cfg.MinParticipants)
+	return server
+}
+
+// newBlobStore creates the attachment blob store; nil leaves attachments unavailable
+func (a *App) newBlobStore() storage.BlobStore {
+	switch a.config.BlobBackend {
+	case "s3":
+		s3, err := blob.NewS3(a.config.S3.Endpoint, a.config.S3.Bucket, a.config.S3.Region, a.config.S3.AccessKey, a.config.S3.SecretKey)
+		if err != nil {
+			log.Printf("warning: s3 blob store unavailable: %v", err)
+			log.Println("attachments will be unavailable")
+			return nil
+		}
+		log.Printf("storing attachments in s3 bucket %q", a.config.S3.Bucket)
+		return s3
+	case "", "filesystem":
+	default:
+		log.Printf("warning: unknown BLOB_BACKEND %q - using filesystem", a.config.BlobBackend)
+	}
+
+	fsStore, err := blob.NewFilesystem(a.config.BlobDir)
+	if err != nil {
+		log.Printf("warning: filesystem blob store unavailable: %v", err)
+		log.Println("attachments will be unavailable")
+		return nil
+	}
+	return fsStore
+}
+
+// newEncryptor builds the keyring from ENCRYPTION_KEYS, with ENCRYPTION_KEY added under
+// crypto.DefaultKeyID. The first key of ENCRYPTION_KEYS is primary; without it ENCRYPTION_KEY is.
+// With KMS_PROVIDER set, new data is sealed with wrapped data keys and the keyring
+// only opens older data.
+func (a *App) newEncryptor(dataKeys storage.DataKeyRepository) (*crypto.Encryptor, error) {
+	keys, err := crypto.ParseKeys(a.config.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	if a.config.EncryptionKey != "" {
+		keys = append(keys, crypto.Key{ID: crypto.DefaultKeyID, Secret: a.config.EncryptionKey})
+	}
+	if a.config.KMS.Provider != "" {
+		provider, err := a.newKeyProvider()
+		if err != nil {
+			return nil, err
+		}
+		if dataKeys == nil {
+			return nil, fmt.Errorf("envelope encryption needs storage for data keys")
+		}
+		encryptor, err := crypto.NewEnvelope(provider, dataKeys, keys)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("envelope encryption with key provider %q (%d keys in keyring for older data)", provider.ID(), len(keys))
+		return encryptor, nil
+	}
+	if len(keys) == 0 && a.memory != nil {
+		// Nothing outlives the process in memory mode, so a throwaway key is enough for demos
+		log.Println("no ENCRYPTION_KEY set - using an ephemeral key for in-memory storage")
+		keys = append(keys, crypto.Key{ID: crypto.DefaultKeyID, Secret: randomKey()})
+	}
+	encryptor, err := crypto.NewKeyring(keys)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("encrypting with key %q (%d keys in keyring)", encryptor.PrimaryKeyID(), len(keys))
+	return encryptor, nil
+}
+
+// newKeyProvider returns the key-encryption key selected by KMS_PROVIDER
+func (a *App) newKeyProvider() (crypto.KeyProvider, error) {
+	kms := a.config.KMS
+	switch kms.Provider {
+	case "file":
+		return crypto.NewFileKeyProvider(kms.KeyFile)
+	case "vault":
+		return crypto.NewVaultTransit(kms.VaultAddr, kms.VaultToken, kms.VaultMount, kms.VaultKey)
+	default:
+		return nil, fmt.Errorf("unknown KMS_PROVIDER %q", kms.Provider)
+	}
+}
+
+// runRekey migrates stored messages, their edit history and attachments to the primary encryption key
+func runRekey(ctx context.Context, rekey *service.RekeyService) {
+	log.Println("re-encrypting stored messages, edit history and attachments with the primary key")
+	stats, err := rekey.Run(ctx)
+	if err != nil {
+		log.Printf("warning: re-encryption stopped after %d payloads: %v", stats.Scanned, err)
+		return
+	}
+	log.Printf("re-encryption done: %d payloads scanned, %d re-encrypted, %d undecryptable", stats.Scanned, stats.Rekeyed, stats.Failed)
+}
+
+// ensureDefaultUser creates DEFAULT_USER if needed and makes it a superadmin
+func (a *App) ensureDefaultUser(ctx context.Context, authService *auth.Service, userRepo storage.UserRepository) error {
+	if a.storage == nil && a.memory == nil {
 		return nil
 	}
 
 	// Try to register the default user
 	user, err := authService.Register(ctx, a.config.DefaultUser, a.config.DefaultPassword)
 	if err != nil {
-		// If user already exists, that's fine
-		if err.Error() == "username already taken" {
-			log.Printf("default user '%s' already exists", a.config.DefaultUser)
+		if !errors.Is(err, auth.ErrUsernameTaken) {
+			return err
+		}
+		log.Printf("default user '%s' already exists", a.config.DefaultUser)
+		if user, err = userRepo.GetByUsername(ctx, a.config.DefaultUser); err != nil {
+			return err
+		}
+		// Anyone may have registered the name first; only the holder of the
+		// configured password is the operator
+		if user.Role != model.RoleSuperadmin && !authService.CheckPassword(a.config.DefaultPassword, user.PasswordHash) {
+			log.Printf("WARNING: existing user '%s' does not have DEFAULT_PASSWORD, refusing to grant it the superadmin role; "+
+				"someone else may have registered this username, rename or delete that account", user.Username)
 			return nil
 		}
-		return err
+	} else {
+		log.Printf("default user '%s' created with ID: %s", user.Username, user.ID)
 	}
 
-	log.Printf("default user '%s' created with ID: %s", user.Username, user.ID)
+	if user.Role != model.RoleSuperadmin {
+		if err := userRepo.UpdateRole(ctx, user.ID, model.RoleSuperadmin); err != nil {
+			return fmt.Errorf("failed to grant superadmin: %w", err)
+		}
+		log.Printf("default user '%s' granted the superadmin role", user.Username)
+	}
 	return nil
 }
+
+// randomKey returns a hex-encoded 32-byte key
+func randomKey() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -2,15 +2,19 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"messenger/internal/model"
 )
 
 type contextKey struct{}
 
+type sessionContextKey struct{}
+
 func ContextKey() contextKey {
 	return contextKey{}
 }
@@ -30,14 +34,42 @@ func Middleware(authService *Service) mux.MiddlewareFunc {
 				return
 			}
 
-			userID, err := authService.ValidateToken(token)
-			if err != nil {
+			claims, err := authService.Authenticate(r.Context(), token)
+			if errors.Is(err, ErrInvalidToken) {
 				http.Error(w, `{"error":"invalid token"}`, http.StatusUnauthorized)
 				return
 			}
+			if err != nil {
+				http.Error(w, `{"error":"failed to authenticate"}`, http.StatusServiceUnavailable)
+				return
+			}
 
-			ctx := context.WithValue(r.Context(), contextKey{}, userID)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// RequirePermission rejects requests of users whose role lacks permission.
+// It must run after Middleware.
+func RequirePermission(authService *Service, permission model.Permission) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "OPTIONS" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			err := authService.Authorize(r.Context(), UserIDFromContext(r.Context()), permission)
+			if errors.Is(err, ErrForbidden) {
+				http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, `{"error":"failed to authorize"}`, http.StatusServiceUnavailable)
+				return
+			}
+
+			next.ServeHTTP(w, r)
 		})
 	}
 }
@@ -56,3 +88,17 @@ func UserIDFromContext(ctx context.Context) uuid.UUID {
 	}
 	return uuid.Nil
 }
+
+// SessionIDFromContext returns the session the request was authenticated with
+func SessionIDFromContext(ctx context.Context) uuid.UUID {
+	if id, ok := ctx.Value(sessionContextKey{}).(uuid.UUID); ok {
+		return id
+	}
+	return uuid.Nil
+}
+
+// WithClaims stores the authenticated user and session in ctx
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	ctx = context.WithValue(ctx, contextKey{}, claims.UserID)
+	return context.WithValue(ctx, sessionContextKey{}, claims.SessionID)
+}
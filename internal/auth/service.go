@@ -2,8 +2,14 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -13,25 +19,76 @@ import (
 	"messenger/internal/storage"
 )
 
+var (
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrAccountDisabled     = errors.New("account disabled")
+	ErrUsernameTaken       = errors.New("username already taken")
+	// ErrForbidden is returned when the user's role lacks a permission
+	ErrForbidden = errors.New("forbidden")
+)
+
+// refreshReuseGrace is how long a rotated-out refresh token is answered with a plain
+// rejection instead of revoking the session: within it, a second use is most likely
+// a concurrent refresh from another tab rather than a replayed token
+const refreshReuseGrace = 10 * time.Second
+
+const maxUserAgentLength = 512
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// ReusedTokenError is returned when a refresh token that was already rotated out is
+// presented again. Either the client or someone who stole the token holds the newer
+// one, so the session has been revoked.
+type ReusedTokenError struct {
+	UserID    uuid.UUID
+	SessionID uuid.UUID
+}
+
+func (e *ReusedTokenError) Error() string {
+	return "refresh token reuse detected"
+}
+
 type Service struct {
-	userRepo    storage.UserRepository
-	jwtSecret   []byte
-	jwtDuration time.Duration
+	userRepo        storage.UserRepository
+	sessionRepo     storage.SessionRepository
+	jwtSecret       []byte
+	jwtDuration     time.Duration
+	refreshDuration time.Duration
 }
 
-func NewService(userRepo storage.UserRepository, secret []byte, duration time.Duration) *Service {
+// NewService creates the auth service; access tokens live for duration and
+// sessions expire after refreshDuration without a refresh
+func NewService(userRepo storage.UserRepository, sessionRepo storage.SessionRepository, secret []byte, duration, refreshDuration time.Duration) *Service {
 	return &Service{
-		userRepo:    userRepo,
-		jwtSecret:   secret,
-		jwtDuration: duration,
+		userRepo:        userRepo,
+		sessionRepo:     sessionRepo,
+		jwtSecret:       secret,
+		jwtDuration:     duration,
+		refreshDuration: refreshDuration,
 	}
 }
 
 type Claims struct {
-	UserID uuid.UUID `json:"user_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	SessionID uuid.UUID `json:"sid"`
 	jwt.RegisteredClaims
 }
 
+// TokenPair is issued on login and on every refresh. The refresh token can be used once.
+type TokenPair struct {
+	AccessToken  string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// ClientInfo describes the device a session is opened from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
 func (s *Service) HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	return string(bytes), err
@@ -42,11 +99,12 @@ func (s *Service) CheckPassword(password, hash string) bool {
 	return err == nil
 }
 
-func (s *Service) GenerateToken(userID uuid.UUID) (string, error) {
+func (s *Service) generateToken(userID, sessionID uuid.UUID, expiresAt time.Time) (string, error) {
 	claims := Claims{
-		UserID: userID,
+		UserID:    userID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.jwtDuration)),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -54,7 +112,7 @@ func (s *Service) GenerateToken(userID uuid.UUID) (string, error) {
 	return token.SignedString(s.jwtSecret)
 }
 
-func (s *Service) ValidateToken(tokenString string) (uuid.UUID, error) {
+func (s *Service) parseToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -62,34 +120,264 @@ func (s *Service) ValidateToken(tokenString string) (uuid.UUID, error) {
 		return s.jwtSecret, nil
 	})
 	if err != nil {
-		return uuid.Nil, err
+		return nil, ErrInvalidToken
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims.UserID, nil
+	// Tokens issued before sessions existed carry no session and cannot be revoked
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.SessionID != uuid.Nil {
+		return claims, nil
 	}
-	return uuid.Nil, fmt.Errorf("invalid token claims")
+	return nil, ErrInvalidToken
 }
 
-func (s *Service) Register(ctx context.Context, username, password string) (*model.User, error) {
+// Authenticate validates an access token and checks that its session has not been
+// revoked. It returns ErrInvalidToken for any token that must not be accepted.
+func (s *Service) Authenticate(ctx context.Context, tokenString string) (*Claims, error) {
+	if s.sessionRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	claims, err := s.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.sessionRepo.GetByID(ctx, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || session.UserID != claims.UserID || !session.Active(time.Now()) {
+		return nil, ErrInvalidToken
+	}
+
+	// Disabling revokes sessions too; this check keeps a lagging revocation from letting the user in
+	if err := s.checkEnabled(ctx, claims.UserID); err != nil {
+		if errors.Is(err, ErrAccountDisabled) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkEnabled returns ErrAccountDisabled when the user is disabled or no longer exists
+func (s *Service) checkEnabled(ctx context.Context, userID uuid.UUID) error {
 	if s.userRepo == nil {
+		return fmt.Errorf("database unavailable")
+	}
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.DisabledAt != nil {
+		return ErrAccountDisabled
+	}
+	return nil
+}
+
+// StartSession opens a new session for an authenticated user and issues its first token pair
+func (s *Service) StartSession(ctx context.Context, userID uuid.UUID, client ClientInfo) (*TokenPair, error) {
+	if s.sessionRepo == nil {
 		return nil, fmt.Errorf("database unavailable")
 	}
 
-	// Validate username length: 5-16 characters
-	if len(username) < 5 || len(username) > 16 {
-		return nil, fmt.Errorf("username must be between 5 and 16 characters")
+	secret, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &model.Session{
+		ID:          uuid.New(),
+		UserID:      userID,
+		RefreshHash: hashRefreshSecret(secret),
+		UserAgent:   truncate(client.UserAgent, maxUserAgentLength),
+		IP:          client.IP,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+		ExpiresAt:   now.Add(s.refreshDuration),
+	}
+	if err := s.sessionRepo.Create(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return s.issue(session, secret, now)
+}
+
+// Refresh exchanges a refresh token for a new token pair, rotating the refresh token
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	if s.sessionRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	sessionID, secret, ok := parseRefreshToken(refreshToken)
+	if !ok {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	session, err := s.sessionRepo.GetByID(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if session == nil || !session.Active(now) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err := s.checkEnabled(ctx, session.UserID); err != nil {
+		return nil, err
 	}
 
-	// Validate username format: latin letters and digits only
-	usernameRegex := regexp.MustCompile(`^[a-zA-Z0-9]+$`)
-	if !usernameRegex.MatchString(username) {
-		return nil, fmt.Errorf("username must contain only latin letters and digits")
+	hash := hashRefreshSecret(secret)
+	if hash != session.RefreshHash {
+		if session.PreviousHash == "" || hash != session.PreviousHash || now.Sub(session.LastUsedAt) < refreshReuseGrace {
+			return nil, ErrInvalidRefreshToken
+		}
+		if err := s.sessionRepo.Revoke(ctx, session.ID, now); err != nil {
+			return nil, err
+		}
+		return nil, &ReusedTokenError{UserID: session.UserID, SessionID: session.ID}
+	}
+
+	newSecret, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := s.sessionRepo.Rotate(ctx, session.ID, hash, hashRefreshSecret(newSecret), now, now.Add(s.refreshDuration))
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		// Another request rotated the same token first
+		return nil, ErrInvalidRefreshToken
 	}
 
-	// Validate password length: minimum 5 characters
+	return s.issue(session, newSecret, now)
+}
+
+func (s *Service) issue(session *model.Session, secret string, now time.Time) (*TokenPair, error) {
+	expiresAt := now.Add(s.jwtDuration)
+	token, err := s.generateToken(session.UserID, session.ID, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  token,
+		RefreshToken: session.ID.String() + "." + secret,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+// Authorize returns ErrForbidden unless the user's role grants permission
+func (s *Service) Authorize(ctx context.Context, userID uuid.UUID, permission model.Permission) error {
+	if s.userRepo == nil {
+		return fmt.Errorf("database unavailable")
+	}
+
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil || !user.Can(permission) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of a user
+func (s *Service) ListSessions(ctx context.Context, userID uuid.UUID) ([]model.Session, error) {
+	if s.sessionRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	return s.sessionRepo.GetActiveByUserID(ctx, userID)
+}
+
+// RevokeSession ends one of the user's own sessions
+func (s *Service) RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	if s.sessionRepo == nil {
+		return fmt.Errorf("database unavailable")
+	}
+
+	session, err := s.sessionRepo.GetByID(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.UserID != userID || !session.Active(time.Now()) {
+		return ErrSessionNotFound
+	}
+	return s.sessionRepo.Revoke(ctx, sessionID, time.Now())
+}
+
+// RevokeAllSessions logs a user out everywhere and returns the revoked session IDs
+func (s *Service) RevokeAllSessions(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	if s.sessionRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	return s.sessionRepo.RevokeByUserID(ctx, userID, uuid.Nil, time.Now())
+}
+
+// newRefreshSecret returns the random part of a refresh token
+func newRefreshSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseRefreshToken splits a "<session id>.<secret>" refresh token
+func parseRefreshToken(token string) (uuid.UUID, string, bool) {
+	id, secret, found := strings.Cut(token, ".")
+	if !found || secret == "" {
+		return uuid.Nil, "", false
+	}
+	sessionID, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, "", false
+	}
+	return sessionID, secret, true
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return strings.ToValidUTF8(s[:max], "")
+}
+
+// ValidateUsername checks that a username is 5-16 latin letters and digits
+func ValidateUsername(username string) error {
+	if len(username) < 5 || len(username) > 16 {
+		return fmt.Errorf("username must be between 5 and 16 characters")
+	}
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("username must contain only latin letters and digits")
+	}
+	return nil
+}
+
+// ValidatePassword checks the minimum password length of 5 characters
+func ValidatePassword(password string) error {
 	if len(password) < 5 {
-		return nil, fmt.Errorf("password must be at least 5 characters")
+		return fmt.Errorf("password must be at least 5 characters")
+	}
+	return nil
+}
+
+func (s *Service) Register(ctx context.Context, username, password string) (*model.User, error) {
+	if s.userRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if err := ValidatePassword(password); err != nil {
+		return nil, err
 	}
 
 	existing, err := s.userRepo.GetByUsername(ctx, username)
@@ -97,7 +385,7 @@ func (s *Service) Register(ctx context.Context, username, password string) (*mod
 		return nil, err
 	}
 	if existing != nil {
-		return nil, fmt.Errorf("username already taken")
+		return nil, ErrUsernameTaken
 	}
 
 	hash, err := s.HashPassword(password)
@@ -109,6 +397,7 @@ func (s *Service) Register(ctx context.Context, username, password string) (*mod
 		ID:           uuid.New(),
 		Username:     username,
 		PasswordHash: hash,
+		Role:         model.RoleUser,
 		CreatedAt:    time.Now(),
 	}
 
@@ -119,56 +408,87 @@ func (s *Service) Register(ctx context.Context, username, password string) (*mod
 	return user, nil
 }
 
-func (s *Service) Login(ctx context.Context, username, password string) (string, error) {
+func (s *Service) Login(ctx context.Context, username, password string, client ClientInfo) (*TokenPair, error) {
 	if s.userRepo == nil {
-		return "", fmt.Errorf("database unavailable")
+		return nil, fmt.Errorf("database unavailable")
 	}
 
 	user, err := s.userRepo.GetByUsername(ctx, username)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if user == nil {
-		return "", fmt.Errorf("invalid credentials")
+		return nil, fmt.Errorf("invalid credentials")
 	}
 
 	if !s.CheckPassword(password, user.PasswordHash) {
-		return "", fmt.Errorf("invalid credentials")
+		return nil, fmt.Errorf("invalid credentials")
+	}
+	// Checked after the password so the flag does not reveal which usernames exist
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
 	}
 
-	return s.GenerateToken(user.ID)
+	return s.StartSession(ctx, user.ID, client)
 }
 
-func (s *Service) ChangePassword(ctx context.Context, userID uuid.UUID, oldPassword, newPassword string) error {
-	if s.userRepo == nil {
-		return fmt.Errorf("database unavailable")
+// ChangePassword updates the password and signs out every other session of the user.
+// It returns the IDs of the revoked sessions.
+func (s *Service) ChangePassword(ctx context.Context, userID, sessionID uuid.UUID, oldPassword, newPassword string) ([]uuid.UUID, error) {
+	if s.userRepo == nil || s.sessionRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
 	}
 
 	// Validate new password length
 	if len(newPassword) < 5 {
-		return fmt.Errorf("new password must be at least 5 characters")
+		return nil, fmt.Errorf("new password must be at least 5 characters")
 	}
 
 	// Get user
 	user, err := s.userRepo.GetByID(ctx, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if user == nil {
-		return fmt.Errorf("user not found")
+		return nil, fmt.Errorf("user not found")
 	}
 
 	// Verify old password
 	if !s.CheckPassword(oldPassword, user.PasswordHash) {
-		return fmt.Errorf("current password is incorrect")
+		return nil, fmt.Errorf("current password is incorrect")
 	}
 
 	// Hash new password
 	newHash, err := s.HashPassword(newPassword)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Update password
-	return s.userRepo.UpdatePassword(ctx, userID, newHash)
+	if err := s.userRepo.UpdatePassword(ctx, userID, newHash); err != nil {
+		return nil, err
+	}
+
+	// Whoever knew the old password may still hold a session
+	return s.sessionRepo.RevokeByUserID(ctx, userID, sessionID, time.Now())
+}
+
+// ResetPassword sets a new password without the old one and signs out every session
+// of the user. It returns the IDs of the revoked sessions.
+func (s *Service) ResetPassword(ctx context.Context, userID uuid.UUID, newPassword string) ([]uuid.UUID, error) {
+	if s.userRepo == nil || s.sessionRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	if err := ValidatePassword(newPassword); err != nil {
+		return nil, err
+	}
+
+	newHash, err := s.HashPassword(newPassword)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.userRepo.UpdatePassword(ctx, userID, newHash); err != nil {
+		return nil, err
+	}
+	return s.sessionRepo.RevokeByUserID(ctx, userID, uuid.Nil, time.Now())
 }
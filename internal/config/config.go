@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,13 +13,90 @@ type Config struct {
 	HTTPAddr        string
 	JWTSecret       []byte
 	JWTDuration     time.Duration
+	RefreshDuration time.Duration
 	DB              DatabaseConfig
 	DefaultUser     string
 	DefaultPassword string
 	CORSAllowed     []string
 	EncryptionKey   string
+	// EncryptionKeys is a keyring of comma-separated "id:secret" pairs, primary key first
+	EncryptionKeys string
+	// EncryptionRekey re-encrypts stored messages with the primary key in the background
+	EncryptionRekey bool
 	ICEServers      string
-	CallTimeout     time.Duration
+	// TURNSecret is the secret shared with the TURN server for minting credentials
+	TURNSecret string
+	// TURNCredentialTTL is how long minted TURN credentials are valid
+	TURNCredentialTTL time.Duration
+	CallTimeout       time.Duration
+	// CallRingTimeout is how long invitees may leave a call unanswered before they missed it
+	CallRingTimeout time.Duration
+	// HubBackplane selects how WebSocket events reach other instances: "local" or "postgres"
+	HubBackplane string
+	// StorageBackend selects where data lives: "postgres" or "memory" (non-persistent demo mode)
+	StorageBackend string
+	// BlobBackend selects where encrypted attachment bytes live: "filesystem" or "s3"
+	BlobBackend string
+	BlobDir     string
+	S3          S3Config
+	// AttachmentMaxSize is the largest accepted upload in bytes
+	AttachmentMaxSize int64
+	// KMS enables envelope encryption with data keys wrapped by a key provider
+	KMS KMSConfig
+	// TURN configures the embedded STUN/TURN server
+	TURN TURNConfig
+	// SFU configures the selective forwarding unit for group calls
+	SFU SFUConfig
+}
+
+// S3Config points at an S3-compatible bucket (AWS, MinIO, Yandex Object Storage)
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// KMSConfig selects the key-encryption key for envelope encryption
+type KMSConfig struct {
+	// Provider is "file", "vault" or empty to seal with ENCRYPTION_KEY(S) directly
+	Provider string
+	KeyFile  string
+	// VaultAddr, VaultToken, VaultMount and VaultKey point at a Vault transit key
+	VaultAddr  string
+	VaultToken string
+	VaultMount string
+	VaultKey   string
+}
+
+// TURNConfig configures the embedded STUN/TURN server, an alternative to coturn
+type TURNConfig struct {
+	Enabled bool
+	// Listen is the UDP and TCP address of the server
+	Listen string
+	// PublicIP is the address clients reach relayed transport addresses at
+	PublicIP string
+	// Host is advertised to clients in ICE servers; defaults to PublicIP
+	Host  string
+	Realm string
+	// RelayPortMin and RelayPortMax bound relay ports; zero uses any port
+	RelayPortMin int
+	RelayPortMax int
+	// UserQuota caps the allocations of one user
+	UserQuota int
+}
+
+// SFUConfig configures the selective forwarding unit, which carries the media of group
+// calls through the server instead of a mesh between participants
+type SFUConfig struct {
+	Enabled bool
+	// MinParticipants is the call size, the caller included, from which calls use the SFU
+	MinParticipants int
+	// PublicIP is advertised to clients instead of the server's addresses; defaults to TURN_PUBLIC_IP
+	PublicIP string
+	// UDPPort carries all media on one port; zero uses a port per connection
+	UDPPort int
 }
 
 type DatabaseConfig struct {
@@ -42,7 +120,8 @@ func Load() *Config {
 	return &Config{
 		HTTPAddr:        getEnv("HTTP_ADDR", ":8080"),
 		JWTSecret:       []byte(getEnv("JWT_SECRET", "default-secret-change-in-production")),
-		JWTDuration:     parseDuration(getEnv("JWT_DURATION", "24h")),
+		JWTDuration:     parseDuration(getEnv("JWT_DURATION", "15m")),
+		RefreshDuration: parseDuration(getEnv("REFRESH_DURATION", "720h")),
 		DefaultUser:     getEnv("DEFAULT_USER", ""),
 		DefaultPassword: getEnv("DEFAULT_PASSWORD", ""),
 		CORSAllowed:     allowedOrigins,
@@ -54,9 +133,50 @@ func Load() *Config {
 			DBName:   getEnv("DB_NAME", ""),
 			SSLMode:  getEnv("DB_SSLMODE", "disable"),
 		},
-		EncryptionKey: getEnv("ENCRYPTION_KEY", ""),
-		ICEServers:    getEnv("ICE_SERVERS", ""),
-		CallTimeout:   parseDuration(getEnv("CALL_TIMEOUT", "5s")),
+		EncryptionKey:     getEnv("ENCRYPTION_KEY", ""),
+		EncryptionKeys:    getEnv("ENCRYPTION_KEYS", ""),
+		EncryptionRekey:   getEnv("ENCRYPTION_REKEY", "false") == "true",
+		ICEServers:        getEnv("ICE_SERVERS", ""),
+		TURNSecret:        getEnv("TURN_SECRET", ""),
+		TURNCredentialTTL: parseDuration(getEnv("TURN_CREDENTIAL_TTL", "12h")),
+		CallTimeout:       parseDuration(getEnv("CALL_TIMEOUT", "5s")),
+		CallRingTimeout:   parseDuration(getEnv("CALL_RING_TIMEOUT", "45s")),
+		HubBackplane:      getEnv("HUB_BACKPLANE", "local"),
+		StorageBackend:    getEnv("STORAGE_BACKEND", "postgres"),
+		BlobBackend:       getEnv("BLOB_BACKEND", "filesystem"),
+		BlobDir:           getEnv("BLOB_DIR", "./data/attachments"),
+		S3: S3Config{
+			Endpoint:  getEnv("S3_ENDPOINT", ""),
+			Bucket:    getEnv("S3_BUCKET", ""),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			AccessKey: getEnv("S3_ACCESS_KEY", ""),
+			SecretKey: getEnv("S3_SECRET_KEY", ""),
+		},
+		AttachmentMaxSize: int64(parseInt(getEnv("ATTACHMENT_MAX_MB", "25"), 25)) << 20,
+		KMS: KMSConfig{
+			Provider:   getEnv("KMS_PROVIDER", ""),
+			KeyFile:    getEnv("KMS_KEY_FILE", ""),
+			VaultAddr:  getEnv("VAULT_ADDR", "http://127.0.0.1:8200"),
+			VaultToken: getEnv("VAULT_TOKEN", ""),
+			VaultMount: getEnv("VAULT_TRANSIT_MOUNT", "transit"),
+			VaultKey:   getEnv("VAULT_TRANSIT_KEY", "messenger"),
+		},
+		TURN: TURNConfig{
+			Enabled:      getEnv("TURN_ENABLED", "false") == "true",
+			Listen:       getEnv("TURN_LISTEN", ":3478"),
+			PublicIP:     getEnv("TURN_PUBLIC_IP", ""),
+			Host:         getEnv("TURN_HOST", ""),
+			Realm:        getEnv("TURN_REALM", "messenger"),
+			RelayPortMin: parseInt(getEnv("TURN_RELAY_PORT_MIN", "0"), 0),
+			RelayPortMax: parseInt(getEnv("TURN_RELAY_PORT_MAX", "0"), 0),
+			UserQuota:    parseInt(getEnv("TURN_USER_QUOTA", "10"), 10),
+		},
+		SFU: SFUConfig{
+			Enabled:         getEnv("SFU_ENABLED", "false") == "true",
+			MinParticipants: parseInt(getEnv("SFU_MIN_PARTICIPANTS", "3"), 3),
+			PublicIP:        getEnv("SFU_PUBLIC_IP", ""),
+			UDPPort:         parseInt(getEnv("SFU_UDP_PORT", "0"), 0),
+		},
 	}
 }
 
@@ -85,6 +205,14 @@ func splitEnv(s string) []string {
 	return result
 }
 
+func parseInt(s string, defaultVal int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return defaultVal
+	}
+	return n
+}
+
 func parseDuration(s string) time.Duration {
 	d, _ := time.ParseDuration(s)
 	if d == 0 {
@@ -1,93 +1,345 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
 )
 
+// DefaultKeyID names the key configured through ENCRYPTION_KEY
+const DefaultKeyID = "default"
+
+// textPrefix starts text ciphertext in the current format "v2:<key id>:<base64>".
+// Older formats are handled by the legacy reader in legacy.go.
+const textPrefix = "v2:"
+
+// binaryMagic starts binary ciphertext in the current format
+// magic || len(key id) || key id || nonce || sealed. A legacy blob whose random nonce
+// happens to match the magic is still opened, because a failed open falls back to
+// the legacy reader.
+var binaryMagic = []byte{0xE5, 'k', 'r', 2}
+
+// Secrets shorter than minRandomKeyLength are treated as passphrases
+const minRandomKeyLength = 32
+
+// kdfContext is the HKDF info and Argon2 salt. It is fixed because every instance
+// has to derive the same key from the same secret.
+const kdfContext = "messenger/encryptor/v2"
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ErrUnknownKey is returned for ciphertext sealed with a key that is not in the keyring
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Key is a named key of the keyring
+type Key struct {
+	ID     string
+	Secret string
+}
+
+// keyMaterial holds the keys derived from one secret
+type keyMaterial struct {
+	// aead seals and opens the current format
+	aead cipher.AEAD
+	// legacy opens formats written before key derivation, see legacy.go
+	legacy cipher.AEAD
+}
+
+// Encryptor seals data with the primary key of its keyring and opens data sealed
+// with any key of it, so keys can be rotated without losing history. Every
+// ciphertext is bound to additional data naming what it belongs to; opening it
+// with different additional data fails.
 type Encryptor struct {
-	key []byte
+	primary string
+	keys    map[string]keyMaterial
+	// order lists key IDs, primary first, for data that does not name its key
+	order []string
+	// envelope, when set, seals new data with wrapped data keys instead of the
+	// primary key; the keyring is then only used to open older data
+	envelope *envelope
 }
 
+// NewEncryptor creates an encryptor with a single key
 func NewEncryptor(key string) (*Encryptor, error) {
 	if key == "" {
 		return nil, fmt.Errorf("encryption key is required")
 	}
-	
-	// Use SHA-256 hash of the key to get 32 bytes for AES-256
-	// Or pad/truncate to 32 bytes
-	keyBytes := []byte(key)
-	if len(keyBytes) < 32 {
-		// Pad key to 32 bytes
-		padded := make([]byte, 32)
-		copy(padded, keyBytes)
-		keyBytes = padded
-	} else if len(keyBytes) > 32 {
-		// Truncate to 32 bytes
-		keyBytes = keyBytes[:32]
+	return NewKeyring([]Key{{ID: DefaultKeyID, Secret: key}})
+}
+
+// NewKeyring creates an encryptor from several keys. The first key is the primary
+// one and seals all new data.
+func NewKeyring(keys []Key) (*Encryptor, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("encryption key is required")
+	}
+	return newKeyring(keys)
+}
+
+func newKeyring(keys []Key) (*Encryptor, error) {
+	e := &Encryptor{keys: make(map[string]keyMaterial, len(keys))}
+	if len(keys) > 0 {
+		e.primary = keys[0].ID
+	}
+	for _, key := range keys {
+		if !keyIDPattern.MatchString(key.ID) {
+			return nil, fmt.Errorf("invalid encryption key id %q", key.ID)
+		}
+		if key.Secret == "" {
+			return nil, fmt.Errorf("encryption key %q is empty", key.ID)
+		}
+		if _, ok := e.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate encryption key id %q", key.ID)
+		}
+
+		derived, err := deriveKey(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newGCM(derived)
+		if err != nil {
+			return nil, err
+		}
+		legacy, err := newGCM(legacyKey(key.Secret))
+		if err != nil {
+			return nil, err
+		}
+		e.keys[key.ID] = keyMaterial{aead: aead, legacy: legacy}
+		e.order = append(e.order, key.ID)
+	}
+	return e, nil
+}
+
+// ParseKeys reads a keyring spec of comma-separated "id:secret" pairs, primary key first
+func ParseKeys(spec string) ([]Key, error) {
+	var keys []Key
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, secret, found := strings.Cut(part, ":")
+		if !found {
+			return nil, fmt.Errorf("encryption key %q must be given as id:secret", part)
+		}
+		keys = append(keys, Key{ID: strings.TrimSpace(id), Secret: strings.TrimSpace(secret)})
+	}
+	return keys, nil
+}
+
+// deriveKey turns a configured secret into an AES-256 key. Long secrets are taken
+// to be random and expanded with HKDF-SHA256; short ones are taken to be passphrases
+// and stretched with Argon2id so they cannot be brute-forced cheaply.
+func deriveKey(secret string) ([]byte, error) {
+	if len(secret) < minRandomKeyLength {
+		return argon2.IDKey([]byte(secret), []byte(kdfContext), 3, 64*1024, 4, 32), nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(kdfContext)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
 	}
-	
-	return &Encryptor{key: keyBytes}, nil
+	return key, nil
 }
 
-func (e *Encryptor) Encrypt(plaintext []byte) (string, error) {
+// PrimaryKeyID returns the ID of the key new data is sealed with
+func (e *Encryptor) PrimaryKeyID() string {
+	return e.primary
+}
+
+// Current reports whether text ciphertext is in the current format and sealed with
+// the primary key, i.e. whether re-encrypting it would change nothing. With envelope
+// encryption any data key is current.
+func (e *Encryptor) Current(ciphertext string) bool {
+	if e.envelope != nil {
+		return strings.HasPrefix(ciphertext, textPrefix+dataKeyPrefix)
+	}
+	return strings.HasPrefix(ciphertext, textPrefix+e.primary+":")
+}
+
+// Encrypt seals plaintext with the primary key, bound to ad
+func (e *Encryptor) Encrypt(plaintext, ad []byte) (string, error) {
 	if e == nil {
 		return "", fmt.Errorf("encryptor not initialized")
 	}
-	
-	block, err := aes.NewCipher(e.key)
+
+	id, key, err := e.sealingKey()
 	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %w", err)
+		return "", err
 	}
-	
-	gcm, err := cipher.NewGCM(block)
+	sealed, err := seal(key.aead, plaintext, ad)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+		return "", err
 	}
-	
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("failed to generate nonce: %w", err)
-	}
-	
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	return textPrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
 }
 
-func (e *Encryptor) Decrypt(ciphertext string) ([]byte, error) {
+// Decrypt opens text ciphertext that was sealed with the same ad
+func (e *Encryptor) Decrypt(ciphertext string, ad []byte) ([]byte, error) {
 	if e == nil {
 		return nil, fmt.Errorf("encryptor not initialized")
 	}
-	
-	data, err := base64.StdEncoding.DecodeString(ciphertext)
+
+	if !strings.HasPrefix(ciphertext, textPrefix) {
+		return e.decryptLegacy(ciphertext)
+	}
+
+	id, encoded, found := strings.Cut(ciphertext[len(textPrefix):], ":")
+	if !found {
+		return nil, fmt.Errorf("malformed ciphertext")
+	}
+	key, err := e.key(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode base64: %w", err)
 	}
-	
-	block, err := aes.NewCipher(e.key)
+	return open(key.aead, data, ad)
+}
+
+// Reencrypt opens text ciphertext and seals it again with the primary key, in the
+// current format and bound to ad
+func (e *Encryptor) Reencrypt(ciphertext string, ad []byte) (string, error) {
+	plaintext, err := e.Decrypt(ciphertext, ad)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return "", err
 	}
-	
-	gcm, err := cipher.NewGCM(block)
+	return e.Encrypt(plaintext, ad)
+}
+
+// CurrentBinary is Current for binary ciphertext produced by Seal
+func (e *Encryptor) CurrentBinary(data []byte) bool {
+	if !bytes.HasPrefix(data, binaryMagic) || len(data) <= len(binaryMagic) {
+		return false
+	}
+	rest := data[len(binaryMagic):]
+	n := int(rest[0])
+	if len(rest) <= n {
+		return false
+	}
+	id := string(rest[1 : 1+n])
+	if e.envelope != nil {
+		return strings.HasPrefix(id, dataKeyPrefix)
+	}
+	return id == e.primary
+}
+
+// Reseal is Reencrypt for binary ciphertext produced by Seal
+func (e *Encryptor) Reseal(data, ad []byte) ([]byte, error) {
+	plaintext, err := e.Open(data, ad)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, err
+	}
+	return e.Seal(plaintext, ad)
+}
+
+// Seal encrypts binary data such as attachments, without text encoding, bound to ad
+func (e *Encryptor) Seal(plaintext, ad []byte) ([]byte, error) {
+	if e == nil {
+		return nil, fmt.Errorf("encryptor not initialized")
+	}
+
+	id, key, err := e.sealingKey()
+	if err != nil {
+		return nil, err
 	}
-	
-	nonceSize := gcm.NonceSize()
+	sealed, err := seal(key.aead, plaintext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(binaryMagic)+1+len(id)+len(sealed))
+	out = append(out, binaryMagic...)
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	return append(out, sealed...), nil
+}
+
+// Open decrypts data produced by Seal with the same ad
+func (e *Encryptor) Open(data, ad []byte) ([]byte, error) {
+	if e == nil {
+		return nil, fmt.Errorf("encryptor not initialized")
+	}
+
+	if bytes.HasPrefix(data, binaryMagic) && len(data) > len(binaryMagic) {
+		rest := data[len(binaryMagic):]
+		if n := int(rest[0]); len(rest) > n {
+			if key, err := e.key(string(rest[1 : 1+n])); err == nil {
+				if plaintext, err := open(key.aead, rest[1+n:], ad); err == nil {
+					return plaintext, nil
+				}
+			}
+		}
+	}
+	return e.openLegacy(data)
+}
+
+// sealingKey returns the key new data is sealed with: today's data key with envelope
+// encryption, the primary key of the keyring otherwise
+func (e *Encryptor) sealingKey() (string, keyMaterial, error) {
+	if e.envelope != nil {
+		return e.envelope.current()
+	}
+	return e.primary, e.keys[e.primary], nil
+}
+
+// key looks up a key of the keyring or, with envelope encryption, a data key
+func (e *Encryptor) key(id string) (keyMaterial, error) {
+	if key, ok := e.keys[id]; ok {
+		return key, nil
+	}
+	if e.envelope != nil && strings.HasPrefix(id, dataKeyPrefix) {
+		return e.envelope.get(id)
+	}
+	return keyMaterial{}, fmt.Errorf("%w %q", ErrUnknownKey, id)
+}
+
+func seal(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func open(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
 	if len(data) < nonceSize {
 		return nil, fmt.Errorf("ciphertext too short")
 	}
-	
+
 	nonce, ciphertextBytes := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertextBytes, nil)
+	plaintext, err := aead.Open(nil, nonce, ciphertextBytes, ad)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt: %w", err)
 	}
-	
+
 	return plaintext, nil
 }
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,243 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"messenger/internal/model"
+)
+
+// Envelope encryption: data is sealed with data keys, and data keys are stored
+// wrapped by a key-encryption key that stays inside a KeyProvider. A new data key is
+// made per UTC day, so compromising one only exposes a day of data, and the KMS is
+// asked to wrap at most once a day and to unwrap once per key and cache lifetime.
+const (
+	// dataKeyPrefix starts the key IDs of data keys, e.g. "dk-20260131"
+	dataKeyPrefix = "dk-"
+	// dataKeyCacheTTL bounds how long an unwrapped data key stays in memory
+	dataKeyCacheTTL = time.Hour
+	// dataKeyCacheSize bounds how many unwrapped data keys are kept
+	dataKeyCacheSize = 256
+	// kmsTimeout bounds a single KMS or store round trip
+	kmsTimeout = 10 * time.Second
+)
+
+// errDataKeyMissing is returned by load for a data key that was never created
+var errDataKeyMissing = errors.New("data key not found")
+
+// KeyProvider holds a key-encryption key that wraps and unwraps data keys. The
+// key-encryption key itself never leaves the provider.
+type KeyProvider interface {
+	// ID names the key-encryption key; it is stored with every data key it wraps
+	ID() string
+	Wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// DataKeyStore persists wrapped data keys, shared by every instance
+type DataKeyStore interface {
+	// GetByID returns nil, nil when the key does not exist
+	GetByID(ctx context.Context, id string) (*model.DataKey, error)
+	// Create stores a data key unless one with its ID exists and reports whether it did
+	Create(ctx context.Context, key *model.DataKey) (bool, error)
+}
+
+type envelope struct {
+	provider KeyProvider
+	store    DataKeyStore
+	// loads makes concurrent misses of the same key share one KMS round trip
+	loads singleflight.Group
+
+	// mu guards cache only; it is never held across KMS or store calls
+	mu    sync.Mutex
+	cache map[string]cachedKey
+}
+
+type cachedKey struct {
+	key     keyMaterial
+	expires time.Time
+}
+
+// NewEnvelope creates an encryptor that seals new data with data keys wrapped by
+// provider. keys may be empty; if given, they still open data sealed before envelope
+// encryption was enabled. Today's data key is set up right away so a misconfigured
+// provider fails at startup.
+func NewEnvelope(provider KeyProvider, store DataKeyStore, keys []Key) (*Encryptor, error) {
+	if provider == nil || store == nil {
+		return nil, fmt.Errorf("key provider and data key store are required")
+	}
+	e, err := newKeyring(keys)
+	if err != nil {
+		return nil, err
+	}
+	e.envelope = &envelope{
+		provider: provider,
+		store:    store,
+		cache:    make(map[string]cachedKey),
+	}
+	if _, _, err := e.envelope.current(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// current returns today's data key, creating it if no instance has yet
+func (v *envelope) current() (string, keyMaterial, error) {
+	id := dataKeyPrefix + time.Now().UTC().Format("20060102")
+
+	key, err := v.fetch(id)
+	if err == nil {
+		return id, key, nil
+	}
+	if !errors.Is(err, errDataKeyMissing) {
+		return "", keyMaterial{}, err
+	}
+
+	result, err, _ := v.loads.Do("create:"+id, func() (interface{}, error) {
+		if key, ok := v.cached(id); ok {
+			return key, nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+		defer cancel()
+		return v.create(ctx, id)
+	})
+	if err != nil {
+		return "", keyMaterial{}, err
+	}
+	return id, result.(keyMaterial), nil
+}
+
+// get returns a data key, unwrapping it unless it is cached
+func (v *envelope) get(id string) (keyMaterial, error) {
+	key, err := v.fetch(id)
+	if errors.Is(err, errDataKeyMissing) {
+		return keyMaterial{}, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	return key, err
+}
+
+// fetch returns a data key from the cache or else loads it; concurrent loads of the
+// same key share one
+func (v *envelope) fetch(id string) (keyMaterial, error) {
+	if key, ok := v.cached(id); ok {
+		return key, nil
+	}
+
+	result, err, _ := v.loads.Do(id, func() (interface{}, error) {
+		// A load that finished just before this one started may have cached it
+		if key, ok := v.cached(id); ok {
+			return key, nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+		defer cancel()
+		return v.load(ctx, id)
+	})
+	if err != nil {
+		return keyMaterial{}, err
+	}
+	return result.(keyMaterial), nil
+}
+
+// create makes, wraps and stores a data key and caches it. If another instance
+// stored one with the same ID first, that one is loaded instead.
+func (v *envelope) create(ctx context.Context, id string) (keyMaterial, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return keyMaterial{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := v.provider.Wrap(ctx, secret)
+	if err != nil {
+		return keyMaterial{}, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	created, err := v.store.Create(ctx, &model.DataKey{
+		ID:        id,
+		Provider:  v.provider.ID(),
+		Wrapped:   wrapped,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return keyMaterial{}, fmt.Errorf("failed to store data key: %w", err)
+	}
+	if !created {
+		// Another instance made today's key first
+		return v.load(ctx, id)
+	}
+
+	aead, err := newGCM(secret)
+	if err != nil {
+		return keyMaterial{}, err
+	}
+	key := keyMaterial{aead: aead}
+	v.put(id, key)
+	return key, nil
+}
+
+// load reads and unwraps a stored data key and caches it
+func (v *envelope) load(ctx context.Context, id string) (keyMaterial, error) {
+	stored, err := v.store.GetByID(ctx, id)
+	if err != nil {
+		return keyMaterial{}, fmt.Errorf("failed to load data key %q: %w", id, err)
+	}
+	if stored == nil {
+		return keyMaterial{}, errDataKeyMissing
+	}
+	if stored.Provider != v.provider.ID() {
+		return keyMaterial{}, fmt.Errorf("data key %q was wrapped by %q, not %q", id, stored.Provider, v.provider.ID())
+	}
+
+	secret, err := v.provider.Unwrap(ctx, stored.Wrapped)
+	if err != nil {
+		return keyMaterial{}, fmt.Errorf("failed to unwrap data key %q: %w", id, err)
+	}
+	if len(secret) != 32 {
+		return keyMaterial{}, fmt.Errorf("data key %q has %d bytes, want 32", id, len(secret))
+	}
+	aead, err := newGCM(secret)
+	if err != nil {
+		return keyMaterial{}, err
+	}
+	key := keyMaterial{aead: aead}
+	v.put(id, key)
+	return key, nil
+}
+
+// cached returns an unexpired cache entry
+func (v *envelope) cached(id string) (keyMaterial, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	entry, ok := v.cache[id]
+	if !ok || time.Now().After(entry.expires) {
+		return keyMaterial{}, false
+	}
+	return entry.key, true
+}
+
+// put caches an unwrapped key, making room by dropping expired entries and, if that
+// is not enough, an arbitrary one
+func (v *envelope) put(id string, key keyMaterial) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if len(v.cache) >= dataKeyCacheSize {
+		for cachedID, entry := range v.cache {
+			if now.After(entry.expires) {
+				delete(v.cache, cachedID)
+			}
+		}
+	}
+	if len(v.cache) >= dataKeyCacheSize {
+		for cachedID := range v.cache {
+			delete(v.cache, cachedID)
+			break
+		}
+	}
+	v.cache[id] = cachedKey{key: key, expires: now.Add(dataKeyCacheTTL)}
+}
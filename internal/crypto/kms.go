@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// FileKeyProvider keeps the key-encryption key in a local file, in the spirit of an
+// age identity file: lines starting with '#' are comments, the first other line is
+// the base64 of 32 random bytes (e.g. from `openssl rand -base64 32`). Keep the file
+// out of the database backups it protects.
+type FileKeyProvider struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewFileKeyProvider reads the key-encryption key from path
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	var encoded []byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) > 0 && line[0] != '#' {
+			encoded = line
+			break
+		}
+	}
+	if encoded == nil {
+		return nil, fmt.Errorf("key file %s contains no key", path)
+	}
+	kek, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil || len(kek) != 32 {
+		return nil, fmt.Errorf("key file %s must contain 32 base64-encoded bytes", path)
+	}
+
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	// The ID is a fingerprint, so data keys wrapped by another key file are recognized
+	sum := sha256.Sum256(kek)
+	return &FileKeyProvider{id: "file:" + hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+func (p *FileKeyProvider) ID() string {
+	return p.id
+}
+
+func (p *FileKeyProvider) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return seal(p.aead, dataKey, []byte(p.id))
+}
+
+func (p *FileKeyProvider) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return open(p.aead, wrapped, []byte(p.id))
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Formats written before keys were derived with HKDF/Argon2 and bound to additional
+// data. They used the secret zero-padded or truncated to 32 bytes and no additional
+// data, and are only ever read:
+//
+//	text:   base64(nonce||sealed)           no key ID, every key is tried
+//	text:   v1:<key id>:base64(nonce||sealed)
+//	binary: nonce||sealed                   no key ID, every key is tried
+//	binary: legacyBinaryMagic || len(key id) || key id || nonce || sealed
+//
+// Re-encrypting moves such data to the current format.
+const legacyTextPrefix = "v1:"
+
+var legacyBinaryMagic = []byte{0xE5, 'k', 'r', 1}
+
+// legacyKey zero-pads or truncates a secret to 32 bytes, as keys used to be made
+func legacyKey(secret string) []byte {
+	key := make([]byte, 32)
+	copy(key, secret)
+	return key
+}
+
+func (e *Encryptor) decryptLegacy(ciphertext string) ([]byte, error) {
+	if strings.HasPrefix(ciphertext, legacyTextPrefix) {
+		id, encoded, found := strings.Cut(ciphertext[len(legacyTextPrefix):], ":")
+		if !found {
+			return nil, fmt.Errorf("malformed ciphertext")
+		}
+		key, ok := e.keys[id]
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64: %w", err)
+		}
+		return open(key.legacy, data, nil)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64: %w", err)
+	}
+	return e.tryLegacyKeys(data)
+}
+
+func (e *Encryptor) openLegacy(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, legacyBinaryMagic) && len(data) > len(legacyBinaryMagic) {
+		rest := data[len(legacyBinaryMagic):]
+		if n := int(rest[0]); len(rest) > n {
+			if key, ok := e.keys[string(rest[1:1+n])]; ok {
+				if plaintext, err := open(key.legacy, rest[1+n:], nil); err == nil {
+					return plaintext, nil
+				}
+			}
+		}
+	}
+	return e.tryLegacyKeys(data)
+}
+
+// tryLegacyKeys opens data that does not name its key by trying every key of the
+// keyring; GCM authentication rejects the wrong ones
+func (e *Encryptor) tryLegacyKeys(data []byte) ([]byte, error) {
+	var lastErr error
+	for _, id := range e.order {
+		plaintext, err := open(e.keys[id].legacy, data, nil)
+		if err == nil {
+			return plaintext, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// VaultTransit wraps data keys with a key of HashiCorp Vault's transit secrets
+// engine, so the key-encryption key never leaves Vault. For local testing:
+//
+//	vault server -dev -dev-root-token-id=root
+//	vault secrets enable transit && vault write -f transit/keys/messenger
+type VaultTransit struct {
+	addr   *url.URL
+	token  string
+	mount  string
+	key    string
+	client *http.Client
+}
+
+// NewVaultTransit creates a provider for the transit key at mount/keys/key; addr is
+// the Vault base URL such as http://127.0.0.1:8200
+func NewVaultTransit(addr, token, mount, key string) (*VaultTransit, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid vault address %q", addr)
+	}
+	if token == "" || key == "" {
+		return nil, fmt.Errorf("vault token and transit key are required")
+	}
+	if mount == "" {
+		mount = "transit"
+	}
+	return &VaultTransit{
+		addr:   u,
+		token:  token,
+		mount:  strings.Trim(mount, "/"),
+		key:    key,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (v *VaultTransit) ID() string {
+	return "vault:" + v.mount + "/" + v.key
+}
+
+// Wrap returns Vault's "vault:v<n>:..." ciphertext, which names the version of the
+// transit key, so rotating the key in Vault keeps older data keys readable
+func (v *VaultTransit) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}
+	if err := v.do(ctx, "encrypt", req, &resp); err != nil {
+		return nil, err
+	}
+	return []byte(resp.Ciphertext), nil
+}
+
+func (v *VaultTransit) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.do(ctx, "decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+// do calls a transit endpoint and decodes the "data" object of the response into out
+func (v *VaultTransit) do(ctx context.Context, op string, body interface{}, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	u := *v.addr
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/" + v.mount + "/" + op + "/" + url.PathEscape(v.key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("vault %s: %s: %s", op, resp.Status, bytes.TrimSpace(msg))
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("vault %s: invalid response: %w", op, err)
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
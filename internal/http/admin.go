@@ -0,0 +1,225 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"messenger/internal/auth"
+	"messenger/internal/model"
+	"messenger/internal/relay"
+	"messenger/internal/service"
+)
+
+// adminRoutes registers the user management API under /api/admin. Every route
+// requires model.PermManageUsers.
+func (h *Handler) adminRoutes(api *mux.Router) {
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(auth.RequirePermission(h.authService, model.PermManageUsers))
+	admin.HandleFunc("/users", h.adminListUsers).Methods("GET")
+	admin.HandleFunc("/users/{id}", h.adminDeleteUser).Methods("DELETE")
+	admin.HandleFunc("/users/{id}/disable", h.adminDisableUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/enable", h.adminEnableUser).Methods("POST")
+	admin.HandleFunc("/users/{id}/username", h.adminRenameUser).Methods("PUT")
+	admin.HandleFunc("/users/{id}/password", h.adminResetPassword).Methods("POST")
+	admin.HandleFunc("/users/{id}/logout", h.adminLogoutUser).Methods("POST")
+	admin.HandleFunc("/stats", h.adminStats).Methods("GET")
+}
+
+func (h *Handler) adminListUsers(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	users, nextCursor, err := h.adminService.ListUsers(r.Context(), page)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to get users")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, pageResponse("users", users, nextCursor))
+}
+
+func (h *Handler) adminDisableUser(w http.ResponseWriter, r *http.Request) {
+	h.adminSetDisabled(w, r, true)
+}
+
+func (h *Handler) adminEnableUser(w http.ResponseWriter, r *http.Request) {
+	h.adminSetDisabled(w, r, false)
+}
+
+// adminSetDisabled disables or re-enables an account; disabling also disconnects it
+func (h *Handler) adminSetDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	revoked, err := h.adminService.SetDisabled(r.Context(), actorID, userID, disabled)
+	if err != nil {
+		respondServiceError(w, adminErrorStatus(err), err)
+		return
+	}
+	h.hub.CloseSessions(userID, revoked)
+
+	h.respondUser(w, r, userID)
+}
+
+type RenameUserRequest struct {
+	Username string `json:"username"`
+}
+
+func (h *Handler) adminRenameUser(w http.ResponseWriter, r *http.Request) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	var req RenameUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if err := h.adminService.Rename(r.Context(), actorID, userID, req.Username); err != nil {
+		respondServiceError(w, adminErrorStatus(err), err)
+		return
+	}
+
+	h.respondUser(w, r, userID)
+}
+
+type ResetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// adminResetPassword sets a new password and signs the user out everywhere
+func (h *Handler) adminResetPassword(w http.ResponseWriter, r *http.Request) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	revoked, err := h.adminService.ResetPassword(r.Context(), actorID, userID, req.Password)
+	if err != nil {
+		respondServiceError(w, adminErrorStatus(err), err)
+		return
+	}
+	h.hub.CloseSessions(userID, revoked)
+
+	respondJSON(w, http.StatusOK, map[string]int{"revoked": len(revoked)})
+}
+
+// adminLogoutUser revokes every session of a user
+func (h *Handler) adminLogoutUser(w http.ResponseWriter, r *http.Request) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	revoked, err := h.adminService.Logout(r.Context(), actorID, userID)
+	if err != nil {
+		respondServiceError(w, adminErrorStatus(err), err)
+		return
+	}
+	h.hub.CloseSessions(userID, revoked)
+
+	respondJSON(w, http.StatusOK, map[string]int{"revoked": len(revoked)})
+}
+
+func (h *Handler) adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	revoked, err := h.adminService.DeleteUser(r.Context(), actorID, userID)
+	if err != nil {
+		respondServiceError(w, adminErrorStatus(err), err)
+		return
+	}
+	h.hub.CloseSessions(userID, revoked)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StatsResponse combines the stored counts with the connections of this instance
+type StatsResponse struct {
+	service.AdminStats
+	// ConnectedClients and OnlineUsers only cover WebSocket connections to this instance
+	ConnectedClients int `json:"connected_clients"`
+	OnlineUsers      int `json:"online_users"`
+	// Relay is the usage of the embedded STUN/TURN server of this instance, if enabled
+	Relay *relay.Stats `json:"relay,omitempty"`
+}
+
+func (h *Handler) adminStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.adminService.Stats(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to get stats")
+		return
+	}
+
+	connections, users := h.hub.ClientCount()
+	resp := StatsResponse{
+		AdminStats:       *stats,
+		ConnectedClients: connections,
+		OnlineUsers:      users,
+	}
+	if h.relay != nil {
+		relayStats := h.relay.Stats()
+		resp.Relay = &relayStats
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// respondUser writes the current state of a user after an admin change
+func (h *Handler) respondUser(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	user, err := h.userService.GetByID(r.Context(), userID)
+	if err != nil || user == nil {
+		respondError(w, http.StatusInternalServerError, "failed to get user")
+		return
+	}
+	respondJSON(w, http.StatusOK, user)
+}
+
+// adminErrorStatus maps admin service errors to HTTP status codes
+func adminErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrPrivilegedUser):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrUsernameTaken):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrOwnAccount), errors.Is(err, service.ErrInvalidInput):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
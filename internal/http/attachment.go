@@ -0,0 +1,113 @@
+package http
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"messenger/internal/auth"
+	"messenger/internal/model"
+	"messenger/internal/service"
+)
+
+// multipartMemory is how much of an upload is buffered in memory before spilling to a temp file
+const multipartMemory = 8 << 20
+
+// uploadAttachment accepts a multipart form with a "file" part and either
+// "conversation_id" or "receiver_id" (direct chat) naming where it will be sent
+func (h *Handler) uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	// Leave room for the multipart framing and the other form fields
+	r.Body = http.MaxBytesReader(w, r.Body, h.attachmentService.MaxSize()+1<<20)
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(w, http.StatusRequestEntityTooLarge, service.ErrAttachmentTooLarge.Error())
+			return
+		}
+		respondError(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	defer file.Close()
+
+	contentType := header.Header.Get("Content-Type")
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		contentType = ""
+	}
+
+	var att *model.Attachment
+	switch {
+	case r.FormValue("conversation_id") != "":
+		conversationID, parseErr := uuid.Parse(r.FormValue("conversation_id"))
+		if parseErr != nil {
+			respondError(w, http.StatusBadRequest, "invalid conversation id")
+			return
+		}
+		att, err = h.attachmentService.Upload(r.Context(), userID, conversationID, header.Filename, contentType, file)
+	case r.FormValue("receiver_id") != "":
+		receiverID, parseErr := uuid.Parse(r.FormValue("receiver_id"))
+		if parseErr != nil {
+			respondError(w, http.StatusBadRequest, "invalid receiver id")
+			return
+		}
+		att, err = h.attachmentService.UploadDirect(r.Context(), userID, receiverID, header.Filename, contentType, file)
+	default:
+		respondError(w, http.StatusBadRequest, "conversation_id or receiver_id is required")
+		return
+	}
+	if err != nil {
+		respondServiceError(w, attachmentErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, att)
+}
+
+// downloadAttachment streams the decrypted file to conversation members
+func (h *Handler) downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	attachmentID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid attachment id")
+		return
+	}
+
+	att, data, err := h.attachmentService.Download(r.Context(), attachmentID, userID)
+	if err != nil {
+		respondServiceError(w, attachmentErrorStatus(err), err)
+		return
+	}
+
+	// Never let the browser render uploaded content as a page of this origin
+	w.Header().Set("Content-Type", att.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// attachmentErrorStatus maps attachment service errors to HTTP status codes
+func attachmentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrAttachmentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrAttachmentTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return conversationErrorStatus(err)
+	}
+}
@@ -0,0 +1,304 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"messenger/internal/auth"
+	"messenger/internal/model"
+	"messenger/internal/service"
+)
+
+// conversationErrorStatus maps conversation service errors to HTTP status codes
+func conversationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrNotConversationMember), errors.Is(err, service.ErrInsufficientRole):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrConversationNotFound), errors.Is(err, service.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrInvalidInput), errors.Is(err, service.ErrInvalidAttachment):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type CreateConversationRequest struct {
+	Title   string   `json:"title"`
+	Members []string `json:"members"`
+}
+
+func (h *Handler) createConversation(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	var req CreateConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	memberIDs := make([]uuid.UUID, 0, len(req.Members))
+	for _, id := range req.Members {
+		parsedID, err := uuid.Parse(id)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid member id")
+			return
+		}
+		memberIDs = append(memberIDs, parsedID)
+	}
+
+	info, err := h.conversationService.CreateGroup(r.Context(), userID, req.Title, memberIDs)
+	if err != nil {
+		respondServiceError(w, conversationErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, info)
+}
+
+func (h *Handler) getConversation(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	conversationID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	info, err := h.conversationService.GetConversation(r.Context(), conversationID, userID)
+	if err != nil {
+		respondServiceError(w, conversationErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, info)
+}
+
+func (h *Handler) getConversationMembers(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	conversationID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	info, err := h.conversationService.GetConversation(r.Context(), conversationID, userID)
+	if err != nil {
+		respondServiceError(w, conversationErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, info.Members)
+}
+
+type AddMemberRequest struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+func (h *Handler) addConversationMember(w http.ResponseWriter, r *http.Request) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	conversationID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	var req AddMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	memberID, err := uuid.Parse(req.UserID)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	member, err := h.conversationService.AddMember(r.Context(), conversationID, actorID, memberID, model.ConversationRole(req.Role))
+	if err != nil {
+		respondServiceError(w, conversationErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, member)
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+func (h *Handler) updateConversationMember(w http.ResponseWriter, r *http.Request) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	vars := mux.Vars(r)
+	conversationID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	memberID, err := uuid.Parse(vars["user_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	var req UpdateMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if err := h.conversationService.UpdateMemberRole(r.Context(), conversationID, actorID, memberID, model.ConversationRole(req.Role)); err != nil {
+		respondServiceError(w, conversationErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "member role updated"})
+}
+
+func (h *Handler) removeConversationMember(w http.ResponseWriter, r *http.Request) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	vars := mux.Vars(r)
+	conversationID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	memberID, err := uuid.Parse(vars["user_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := h.conversationService.RemoveMember(r.Context(), conversationID, actorID, memberID); err != nil {
+		respondServiceError(w, conversationErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "member removed"})
+}
+
+func (h *Handler) getConversationMessages(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	conversationID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	page, err := parsePage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	messages, nextCursor, err := h.messageService.GetConversationHistory(r.Context(), conversationID, userID, page)
+	if err != nil {
+		respondServiceError(w, conversationErrorStatus(err), err)
+		return
+	}
+
+	apiMessages := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		item := map[string]interface{}{
+			"id":              msg.ID,
+			"conversation_id": msg.ConversationID,
+			"sender_id":       msg.SenderID,
+			"receiver_id":     msg.ReceiverID,
+			"payload":         string(msg.Payload),
+			"created_at":      msg.CreatedAt.Format(time.RFC3339),
+			"is_read":         msg.IsRead,
+			"is_delivered":    msg.IsDelivered,
+			"read_by":         msg.ReadBy,
+		}
+		if msg.EditedAt != nil {
+			item["edited_at"] = msg.EditedAt.Format(time.RFC3339)
+		}
+		if msg.DeletedAt != nil {
+			item["deleted_at"] = msg.DeletedAt.Format(time.RFC3339)
+		}
+		if len(msg.Attachments) > 0 {
+			item["attachments"] = msg.Attachments
+		}
+		if msg.E2E {
+			item["e2e"] = true
+		}
+		if msg.Undecryptable {
+			item["undecryptable"] = true
+		}
+		if msg.Kind != "" && msg.Kind != model.MessageKindText {
+			item["kind"] = msg.Kind
+			item["call_id"] = msg.CallID
+		}
+		apiMessages[i] = item
+	}
+
+	respondJSON(w, http.StatusOK, pageResponse("messages", apiMessages, nextCursor))
+}
+
+type SendConversationMessageRequest struct {
+	Payload       []byte      `json:"payload"`
+	AttachmentIDs []uuid.UUID `json:"attachment_ids"`
+	// E2E marks a payload encrypted end-to-end by the client
+	E2E bool `json:"e2e"`
+	// ClientMsgID lets a client retry a send without creating a duplicate
+	ClientMsgID string `json:"client_msg_id"`
+}
+
+func (h *Handler) sendConversationMessage(w http.ResponseWriter, r *http.Request) {
+	senderID := auth.UserIDFromContext(r.Context())
+
+	conversationID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	var req SendConversationMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	msg, created, err := h.messageService.SendToConversation(r.Context(), senderID, conversationID, req.Payload, req.AttachmentIDs, req.E2E, req.ClientMsgID)
+	if err != nil {
+		respondServiceError(w, conversationErrorStatus(err), err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"id":              msg.ID,
+		"conversation_id": msg.ConversationID,
+		"sender_id":       msg.SenderID,
+		"payload":         string(msg.Payload),
+		"created_at":      msg.CreatedAt.Format(time.RFC3339),
+	}
+	if len(msg.Attachments) > 0 {
+		resp["attachments"] = msg.Attachments
+	}
+	if msg.E2E {
+		resp["e2e"] = true
+	}
+	if msg.Undecryptable {
+		resp["undecryptable"] = true
+	}
+	if msg.ClientMsgID != "" {
+		resp["client_msg_id"] = msg.ClientMsgID
+	}
+
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	respondJSON(w, status, resp)
+}
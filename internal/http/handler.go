@@ -1,10 +1,12 @@
 package http
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,26 +15,44 @@ import (
 	"github.com/rs/cors"
 	"messenger/internal/auth"
 	"messenger/internal/model"
+	"messenger/internal/relay"
 	"messenger/internal/service"
+	"messenger/internal/ws"
 )
 
 type Handler struct {
-	authService    *auth.Service
-	userService    *service.UserService
-	messageService *service.MessageService
-	callService    *service.CallService
-	corsAllowed    []string
-	iceServers     string
-}
-
-func NewHandler(authSvc *auth.Service, userSvc *service.UserService, msgSvc *service.MessageService, callSvc *service.CallService, corsAllowed []string, iceServers string) *Handler {
+	authService         *auth.Service
+	userService         *service.UserService
+	messageService      *service.MessageService
+	conversationService *service.ConversationService
+	callService         *service.CallService
+	syncService         *service.SyncService
+	attachmentService   *service.AttachmentService
+	adminService        *service.AdminService
+	keyService          *service.KeyService
+	presenceService     *service.PresenceService
+	hub                 *ws.Hub
+	corsAllowed         []string
+	iceService          *service.ICEService
+	// relay is the embedded STUN/TURN server, if enabled
+	relay *relay.Server
+}
+
+func NewHandler(authSvc *auth.Service, userSvc *service.UserService, msgSvc *service.MessageService, convSvc *service.ConversationService, callSvc *service.CallService, syncSvc *service.SyncService, attachmentSvc *service.AttachmentService, adminSvc *service.AdminService, keySvc *service.KeyService, presenceSvc *service.PresenceService, hub *ws.Hub, corsAllowed []string, iceSvc *service.ICEService) *Handler {
 	return &Handler{
-		authService:    authSvc,
-		userService:    userSvc,
-		messageService: msgSvc,
-		callService:    callSvc,
-		corsAllowed:    corsAllowed,
-		iceServers:     iceServers,
+		authService:         authSvc,
+		userService:         userSvc,
+		messageService:      msgSvc,
+		conversationService: convSvc,
+		callService:         callSvc,
+		syncService:         syncSvc,
+		attachmentService:   attachmentSvc,
+		adminService:        adminSvc,
+		keyService:          keySvc,
+		presenceService:     presenceSvc,
+		hub:                 hub,
+		corsAllowed:         corsAllowed,
+		iceService:          iceSvc,
 	}
 }
 
@@ -44,33 +64,62 @@ func (h *Handler) Router() *mux.Router {
 	r.HandleFunc("/api/health", h.healthCheck).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/auth/register", h.register).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/auth/login", h.login).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/auth/refresh", h.refresh).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/auth/logout", h.authMiddleware(h.logout)).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/auth/change-password", h.authMiddleware(h.changePassword)).Methods("POST", "OPTIONS")
 
-	// ICE config endpoint - accessible without authentication
-	r.HandleFunc("/api/calls/ice-config", h.getICEConfig).Methods("GET")
-
 	api := r.PathPrefix("/api").Subrouter()
 	api.Use(auth.Middleware(h.authService))
 	api.HandleFunc("/me", h.getCurrentUser).Methods("GET")
+	api.HandleFunc("/me/settings", h.updateSettings).Methods("PUT")
+	api.HandleFunc("/presence", h.getPresence).Methods("GET")
 	api.HandleFunc("/users", h.listUsers).Methods("GET")
 	api.HandleFunc("/users/search", h.searchUsers).Methods("GET")
 	api.HandleFunc("/users/{id}", h.getUser).Methods("GET")
+	api.Handle("/users/{id}/role", auth.RequirePermission(h.authService, model.PermManageRoles)(http.HandlerFunc(h.setUserRole))).Methods("PUT")
 	api.HandleFunc("/conversations", h.getConversations).Methods("GET")
+	api.HandleFunc("/conversations", h.createConversation).Methods("POST")
+	api.HandleFunc("/conversations/{id}", h.getConversation).Methods("GET")
+	api.HandleFunc("/conversations/{id}/messages", h.getConversationMessages).Methods("GET")
+	api.HandleFunc("/conversations/{id}/messages", h.sendConversationMessage).Methods("POST")
+	api.HandleFunc("/conversations/{id}/members", h.getConversationMembers).Methods("GET")
+	api.HandleFunc("/conversations/{id}/members", h.addConversationMember).Methods("POST")
+	api.HandleFunc("/conversations/{id}/members/{user_id}", h.updateConversationMember).Methods("PUT")
+	api.HandleFunc("/conversations/{id}/members/{user_id}", h.removeConversationMember).Methods("DELETE")
 	api.HandleFunc("/chats", h.getChats).Methods("GET")
 	api.HandleFunc("/messages", h.sendMessage).Methods("POST")
 	api.HandleFunc("/messages/{user_id}", h.getMessages).Methods("GET")
+	api.HandleFunc("/messages/{id}", h.editMessage).Methods("PUT")
+	api.HandleFunc("/messages/{id}", h.deleteMessage).Methods("DELETE")
+	api.HandleFunc("/messages/{id}/edits", h.getMessageEdits).Methods("GET")
+	api.HandleFunc("/messages/{id}/reads", h.getMessageReads).Methods("GET")
+	api.HandleFunc("/sync", h.getSync).Methods("GET")
+	api.HandleFunc("/sessions", h.listSessions).Methods("GET")
+	api.HandleFunc("/sessions", h.revokeAllSessions).Methods("DELETE")
+	api.HandleFunc("/sessions/{id}", h.revokeSession).Methods("DELETE")
+	api.HandleFunc("/attachments", h.uploadAttachment).Methods("POST")
+	api.HandleFunc("/attachments/{id}", h.downloadAttachment).Methods("GET")
+	h.adminRoutes(api)
+	h.keyRoutes(api)
 
 	// Call endpoints
 	api.HandleFunc("/calls", h.createCall).Methods("POST")
+	api.HandleFunc("/calls/history", h.getCallHistory).Methods("GET")
+	api.HandleFunc("/calls/ice-config", h.getICEConfig).Methods("GET")
 	api.HandleFunc("/calls/{id}", h.getCall).Methods("GET")
 	api.HandleFunc("/calls/{id}/join", h.joinCall).Methods("POST")
 	api.HandleFunc("/calls/{id}/leave", h.leaveCall).Methods("POST")
 	api.HandleFunc("/calls/{id}/end", h.endCall).Methods("POST")
-	api.HandleFunc("/calls/history", h.getCallHistory).Methods("GET")
 
 	return r
 }
 
+// SetRelay adds the usage counters of the embedded STUN/TURN server to admin stats.
+// Call it before Router.
+func (h *Handler) SetRelay(r *relay.Server) {
+	h.relay = r
+}
+
 func (h *Handler) corsMiddleware() mux.MiddlewareFunc {
 	allowedOrigins := h.corsAllowed
 	if len(allowedOrigins) == 0 {
@@ -100,14 +149,17 @@ func (h *Handler) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		userID, err := h.authService.ValidateToken(token)
-		if err != nil {
+		claims, err := h.authService.Authenticate(r.Context(), token)
+		if errors.Is(err, auth.ErrInvalidToken) {
 			respondError(w, http.StatusUnauthorized, "invalid token")
 			return
 		}
+		if err != nil {
+			respondError(w, http.StatusServiceUnavailable, "failed to authenticate")
+			return
+		}
 
-		ctx := context.WithValue(r.Context(), auth.ContextKey(), userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r.WithContext(auth.WithClaims(r.Context(), claims)))
 	}
 }
 
@@ -133,6 +185,17 @@ func respondError(w http.ResponseWriter, status int, message string) {
 	respondJSON(w, status, map[string]string{"error": message})
 }
 
+// respondServiceError describes a failed service call to the client, except for
+// server errors, which are logged instead as they may leak internals
+func respondServiceError(w http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		log.Printf("request failed: %v", err)
+		respondError(w, status, "internal error")
+		return
+	}
+	respondError(w, status, err.Error())
+}
+
 func (h *Handler) healthCheck(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
@@ -160,15 +223,17 @@ func (h *Handler) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := h.authService.GenerateToken(user.ID)
+	tokens, err := h.authService.StartSession(r.Context(), user.ID, clientInfo(r))
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "failed to generate token")
 		return
 	}
 
 	respondJSON(w, http.StatusCreated, map[string]interface{}{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_at":    tokens.ExpiresAt,
 	})
 }
 
@@ -184,13 +249,17 @@ func (h *Handler) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := h.authService.Login(r.Context(), req.Username, req.Password)
+	tokens, err := h.authService.Login(r.Context(), req.Username, req.Password, clientInfo(r))
+	if errors.Is(err, auth.ErrAccountDisabled) {
+		respondError(w, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		respondError(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]string{"token": token})
+	respondJSON(w, http.StatusOK, tokens)
 }
 
 func (h *Handler) getCurrentUser(w http.ResponseWriter, r *http.Request) {
@@ -207,8 +276,10 @@ func (h *Handler) getCurrentUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"id":       user.ID,
-		"username": user.Username,
+		"id":             user.ID,
+		"username":       user.Username,
+		"role":           user.Role,
+		"hide_last_seen": user.HideLastSeen,
 	})
 }
 
@@ -326,9 +397,59 @@ func (h *Handler) getUser(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, user)
 }
 
+type SetRoleRequest struct {
+	Role model.Role `json:"role"`
+}
+
+// setUserRole changes the system role of a user (requires PermManageRoles)
+func (h *Handler) setUserRole(w http.ResponseWriter, r *http.Request) {
+	actorID := auth.UserIDFromContext(r.Context())
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	var req SetRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if err := h.userService.SetRole(r.Context(), actorID, userID, req.Role); err != nil {
+		respondError(w, userErrorStatus(err), err.Error())
+		return
+	}
+
+	user, err := h.userService.GetByID(r.Context(), userID)
+	if err != nil || user == nil {
+		respondError(w, http.StatusInternalServerError, "failed to get user")
+		return
+	}
+	respondJSON(w, http.StatusOK, user)
+}
+
+// userErrorStatus maps user service errors to HTTP status codes
+func userErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrInvalidRole), errors.Is(err, service.ErrOwnRole):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 type SendMessageRequest struct {
-	ReceiverID string `json:"receiver_id"`
-	Payload    []byte `json:"payload"`
+	ReceiverID    string      `json:"receiver_id"`
+	Payload       []byte      `json:"payload"`
+	AttachmentIDs []uuid.UUID `json:"attachment_ids"`
+	// E2E marks a payload encrypted end-to-end by the client
+	E2E bool `json:"e2e"`
+	// ClientMsgID lets a client retry a send without creating a duplicate
+	ClientMsgID string `json:"client_msg_id"`
 }
 
 func (h *Handler) sendMessage(w http.ResponseWriter, r *http.Request) {
@@ -346,20 +467,40 @@ func (h *Handler) sendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg, err := h.messageService.Send(r.Context(), senderID, receiverID, req.Payload)
+	msg, created, err := h.messageService.Send(r.Context(), senderID, receiverID, req.Payload, req.AttachmentIDs, req.E2E, req.ClientMsgID)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	// Return message with string payload
-	respondJSON(w, http.StatusCreated, map[string]interface{}{
-		"id":          msg.ID,
-		"sender_id":   msg.SenderID,
-		"receiver_id": msg.ReceiverID,
-		"payload":     string(msg.Payload), // Convert []byte to string
-		"created_at":  msg.CreatedAt.Format(time.RFC3339),
-	})
+	resp := map[string]interface{}{
+		"id":              msg.ID,
+		"conversation_id": msg.ConversationID,
+		"sender_id":       msg.SenderID,
+		"receiver_id":     msg.ReceiverID,
+		"payload":         string(msg.Payload), // Convert []byte to string
+		"created_at":      msg.CreatedAt.Format(time.RFC3339),
+	}
+	if len(msg.Attachments) > 0 {
+		resp["attachments"] = msg.Attachments
+	}
+	if msg.E2E {
+		resp["e2e"] = true
+	}
+	if msg.Undecryptable {
+		resp["undecryptable"] = true
+	}
+	if msg.ClientMsgID != "" {
+		resp["client_msg_id"] = msg.ClientMsgID
+	}
+
+	// A retried send answers with the message stored the first time
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	respondJSON(w, status, resp)
 }
 
 func (h *Handler) getMessages(w http.ResponseWriter, r *http.Request) {
@@ -372,10 +513,13 @@ func (h *Handler) getMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	limit := 50
-	offset := 0
+	page, err := parsePage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	messages, err := h.messageService.GetHistoryWithReadStatus(r.Context(), userID, otherID, limit, offset)
+	messages, nextCursor, err := h.messageService.GetHistoryWithReadStatus(r.Context(), userID, otherID, page)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "failed to get messages")
 		return
@@ -384,17 +528,39 @@ func (h *Handler) getMessages(w http.ResponseWriter, r *http.Request) {
 	// Convert messages to API format with string payload
 	apiMessages := make([]interface{}, len(messages))
 	for i, msg := range messages {
-		apiMessages[i] = map[string]interface{}{
-			"id":          msg.ID,
-			"sender_id":   msg.SenderID,
-			"receiver_id": msg.ReceiverID,
-			"payload":     string(msg.Payload),
-			"created_at":  msg.CreatedAt.Format(time.RFC3339),
-			"is_read":     msg.IsRead,
+		item := map[string]interface{}{
+			"id":              msg.ID,
+			"conversation_id": msg.ConversationID,
+			"sender_id":       msg.SenderID,
+			"receiver_id":     msg.ReceiverID,
+			"payload":         string(msg.Payload),
+			"created_at":      msg.CreatedAt.Format(time.RFC3339),
+			"is_read":         msg.IsRead,
+			"read_by":         msg.ReadBy,
+		}
+		if msg.EditedAt != nil {
+			item["edited_at"] = msg.EditedAt.Format(time.RFC3339)
+		}
+		if msg.DeletedAt != nil {
+			item["deleted_at"] = msg.DeletedAt.Format(time.RFC3339)
 		}
+		if len(msg.Attachments) > 0 {
+			item["attachments"] = msg.Attachments
+		}
+		if msg.E2E {
+			item["e2e"] = true
+		}
+		if msg.Undecryptable {
+			item["undecryptable"] = true
+		}
+		if msg.Kind != "" && msg.Kind != model.MessageKindText {
+			item["kind"] = msg.Kind
+			item["call_id"] = msg.CallID
+		}
+		apiMessages[i] = item
 	}
 
-	respondJSON(w, http.StatusOK, apiMessages)
+	respondJSON(w, http.StatusOK, pageResponse("messages", apiMessages, nextCursor))
 }
 
 type ChangePasswordRequest struct {
@@ -428,11 +594,12 @@ func (h *Handler) changePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.authService.ChangePassword(r.Context(), userID, req.OldPassword, req.NewPassword)
+	revoked, err := h.authService.ChangePassword(r.Context(), userID, auth.SessionIDFromContext(r.Context()), req.OldPassword, req.NewPassword)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	h.hub.CloseSessions(userID, revoked)
 
 	respondJSON(w, http.StatusOK, map[string]string{"message": "password changed successfully"})
 }
@@ -573,58 +740,69 @@ func (h *Handler) endCall(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) getCallHistory(w http.ResponseWriter, r *http.Request) {
 	userID := auth.UserIDFromContext(r.Context())
 
-	limit := 50
-	offset := 0
+	page, err := parsePage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	history, err := h.callService.GetCallHistory(r.Context(), userID, limit, offset)
+	history, nextCursor, err := h.callService.GetCallHistory(r.Context(), userID, page)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "failed to get call history")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, history)
+	respondJSON(w, http.StatusOK, pageResponse("calls", history, nextCursor))
 }
 
-func (h *Handler) getICEConfig(w http.ResponseWriter, r *http.Request) {
-	// Default ICE servers (public STUN servers only - no credentials)
-	defaultICEServers := []map[string]interface{}{
-		{"urls": "stun:stun.l.google.com:19302"},
-		{"urls": "stun:stun1.l.google.com:19302"},
-	}
-
-	var iceServers []map[string]interface{}
-
-	if h.iceServers != "" {
-		// Parse and validate the ICE servers configuration
-		if err := json.Unmarshal([]byte(h.iceServers), &iceServers); err != nil {
-			log.Printf("invalid ICE_SERVERS config, using defaults: %v", err)
-			iceServers = defaultICEServers
-		} else {
-			// Security: Remove credentials from ICE servers before sending to clients
-			// Only return urls, username, and credential for TURN servers that require them
-			// For STUN servers, only return urls (they don't need credentials)
-			sanitizedServers := make([]map[string]interface{}, 0, len(iceServers))
-			for _, server := range iceServers {
-				sanitized := make(map[string]interface{})
-				if urls, ok := server["urls"]; ok {
-					sanitized["urls"] = urls
-				}
-				// Only include username/credential for TURN servers (they have credential fields)
-				// This allows TURN servers to work while not exposing unnecessary credential info
-				// Note: In production, consider using time-limited TURN credentials
-				if username, ok := server["username"]; ok && username != "" {
-					sanitized["username"] = username
-				}
-				if credential, ok := server["credential"]; ok && credential != "" {
-					sanitized["credential"] = credential
-				}
-				sanitizedServers = append(sanitizedServers, sanitized)
-			}
-			iceServers = sanitizedServers
+// parsePage reads the keyset pagination parameters: before, after (opaque
+// cursors from a previous next_cursor) and limit
+func parsePage(r *http.Request) (model.PageRequest, error) {
+	var page model.PageRequest
+	query := r.URL.Query()
+
+	if v := query.Get("before"); v != "" {
+		cursor, err := model.ParseCursor(v)
+		if err != nil {
+			return page, fmt.Errorf("invalid before cursor")
 		}
-	} else {
-		iceServers = defaultICEServers
+		page.Before = cursor
+	}
+	if v := query.Get("after"); v != "" {
+		cursor, err := model.ParseCursor(v)
+		if err != nil {
+			return page, fmt.Errorf("invalid after cursor")
+		}
+		page.After = cursor
 	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return page, fmt.Errorf("invalid limit")
+		}
+		page.Limit = limit
+	}
+	return page, nil
+}
+
+// pageResponse wraps a page of items; next_cursor is omitted on the last page
+func pageResponse(key string, items interface{}, nextCursor string) map[string]interface{} {
+	resp := map[string]interface{}{key: items}
+	if nextCursor != "" {
+		resp["next_cursor"] = nextCursor
+	}
+	return resp
+}
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{"iceServers": iceServers})
+// getICEConfig returns the ICE servers for calls, with TURN credentials minted for
+// the current user. ttl is how many seconds the credentials are valid.
+func (h *Handler) getICEConfig(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	servers, ttl := h.iceService.Servers(userID, time.Now())
+	resp := map[string]interface{}{"iceServers": servers}
+	if ttl > 0 {
+		resp["ttl"] = int(ttl / time.Second)
+	}
+	respondJSON(w, http.StatusOK, resp)
 }
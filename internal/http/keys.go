@@ -0,0 +1,146 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"messenger/internal/auth"
+	"messenger/internal/model"
+	"messenger/internal/service"
+)
+
+// keyRoutes registers the public key directory for end-to-end encryption under /api/keys.
+// Keys travel as base64 in JSON.
+func (h *Handler) keyRoutes(api *mux.Router) {
+	api.HandleFunc("/keys/devices", h.listDevices).Methods("GET")
+	api.HandleFunc("/keys/devices/{device_id}", h.registerDevice).Methods("PUT")
+	api.HandleFunc("/keys/devices/{device_id}", h.deleteDevice).Methods("DELETE")
+	api.HandleFunc("/keys/devices/{device_id}/prekeys", h.uploadPrekeys).Methods("POST")
+	api.HandleFunc("/keys/{user_id}", h.getPrekeyBundles).Methods("GET")
+}
+
+type RegisterDeviceRequest struct {
+	IdentityKey           []byte `json:"identity_key"`
+	SignedPrekeyID        int    `json:"signed_prekey_id"`
+	SignedPrekey          []byte `json:"signed_prekey"`
+	SignedPrekeySignature []byte `json:"signed_prekey_signature"`
+}
+
+// registerDevice creates a device of the current user or replaces its keys
+func (h *Handler) registerDevice(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	deviceID, err := uuid.Parse(mux.Vars(r)["device_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+
+	var req RegisterDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	device, err := h.keyService.RegisterDevice(r.Context(), userID, deviceID, req.IdentityKey, req.SignedPrekeyID, req.SignedPrekey, req.SignedPrekeySignature)
+	if err != nil {
+		respondServiceError(w, keyErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, device)
+}
+
+type UploadPrekeysRequest struct {
+	Prekeys []model.OneTimePrekey `json:"prekeys"`
+}
+
+func (h *Handler) uploadPrekeys(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	deviceID, err := uuid.Parse(mux.Vars(r)["device_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+
+	var req UploadPrekeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	count, err := h.keyService.AddPrekeys(r.Context(), userID, deviceID, req.Prekeys)
+	if err != nil {
+		respondServiceError(w, keyErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]int{"prekey_count": count})
+}
+
+func (h *Handler) listDevices(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	devices, err := h.keyService.ListDevices(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to get devices")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, devices)
+}
+
+func (h *Handler) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	deviceID, err := uuid.Parse(mux.Vars(r)["device_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid device id")
+		return
+	}
+
+	if err := h.keyService.DeleteDevice(r.Context(), userID, deviceID); err != nil {
+		respondServiceError(w, keyErrorStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getPrekeyBundles returns a bundle per device of a user to start encrypted sessions
+// with. Every call consumes one-time prekeys.
+func (h *Handler) getPrekeyBundles(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["user_id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	bundles, err := h.keyService.GetBundles(r.Context(), userID)
+	if err != nil {
+		respondServiceError(w, keyErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, bundles)
+}
+
+// keyErrorStatus maps key directory errors to HTTP status codes
+func keyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrDeviceNotFound), errors.Is(err, service.ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrDeviceTaken):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrTooManyDevices):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrInvalidKey):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
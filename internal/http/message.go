@@ -0,0 +1,172 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"messenger/internal/auth"
+	"messenger/internal/service"
+	"messenger/internal/ws"
+)
+
+type EditMessageRequest struct {
+	Payload []byte `json:"payload"`
+}
+
+func (h *Handler) editMessage(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	messageID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	change, err := h.messageService.EditMessage(r.Context(), messageID, userID, req.Payload)
+	if err != nil {
+		respondServiceError(w, messageErrorStatus(err), err)
+		return
+	}
+
+	msg := change.Message
+	if h.hub != nil {
+		h.hub.SendMessageUpdate(ws.MessageUpdate{
+			Type:           "message_edited",
+			MessageID:      msg.ID,
+			ConversationID: msg.ConversationID,
+			SenderID:       msg.SenderID,
+			Payload:        string(msg.Payload),
+			EditedAt:       msg.EditedAt,
+			Recipients:     change.Recipients,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"id":              msg.ID,
+		"conversation_id": msg.ConversationID,
+		"sender_id":       msg.SenderID,
+		"receiver_id":     msg.ReceiverID,
+		"payload":         string(msg.Payload),
+		"created_at":      msg.CreatedAt.Format(time.RFC3339),
+		"edited_at":       msg.EditedAt.Format(time.RFC3339),
+		"e2e":             msg.E2E,
+	})
+}
+
+// deleteMessage deletes for the caller only, or for everyone with ?for=everyone
+func (h *Handler) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	messageID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	var forEveryone bool
+	switch r.URL.Query().Get("for") {
+	case "", "me":
+	case "everyone":
+		forEveryone = true
+	default:
+		respondError(w, http.StatusBadRequest, "for must be me or everyone")
+		return
+	}
+
+	change, err := h.messageService.DeleteMessage(r.Context(), messageID, userID, forEveryone)
+	if err != nil {
+		respondServiceError(w, messageErrorStatus(err), err)
+		return
+	}
+
+	msg := change.Message
+	if h.hub != nil {
+		h.hub.SendMessageUpdate(ws.MessageUpdate{
+			Type:           "message_deleted",
+			MessageID:      msg.ID,
+			ConversationID: msg.ConversationID,
+			SenderID:       msg.SenderID,
+			DeletedAt:      msg.DeletedAt,
+			ForMe:          !forEveryone,
+			Recipients:     change.Recipients,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "message deleted"})
+}
+
+func (h *Handler) getMessageEdits(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	messageID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	edits, err := h.messageService.GetEditHistory(r.Context(), messageID, userID)
+	if err != nil {
+		respondServiceError(w, messageErrorStatus(err), err)
+		return
+	}
+
+	apiEdits := make([]interface{}, len(edits))
+	for i, edit := range edits {
+		item := map[string]interface{}{
+			"message_id": edit.MessageID,
+			"payload":    string(edit.Payload),
+			"edited_at":  edit.EditedAt.Format(time.RFC3339),
+		}
+		if edit.Undecryptable {
+			item["undecryptable"] = true
+		}
+		apiEdits[i] = item
+	}
+
+	respondJSON(w, http.StatusOK, apiEdits)
+}
+
+// getMessageReads returns who other than the sender has read a message and when
+func (h *Handler) getMessageReads(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	messageID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	reads, err := h.messageService.GetReads(r.Context(), messageID, userID)
+	if err != nil {
+		respondServiceError(w, messageErrorStatus(err), err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, reads)
+}
+
+// messageErrorStatus maps message service errors to HTTP status codes
+func messageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrMessageNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrReceiverNotFound):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrNotMessageSender):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrMessageDeleted), errors.Is(err, service.ErrCallEntry):
+		return http.StatusConflict
+	default:
+		return conversationErrorStatus(err)
+	}
+}
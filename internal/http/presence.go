@@ -0,0 +1,93 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"messenger/internal/auth"
+	"messenger/internal/model"
+	"messenger/internal/service"
+)
+
+// getPresence returns the state of the users in the comma-separated ids parameter,
+// with the last-seen time of offline users who do not hide it
+func (h *Handler) getPresence(w http.ResponseWriter, r *http.Request) {
+	userIDs, err := parseIDList(r.URL.Query().Get("ids"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(userIDs) > service.MaxPresenceLookup {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("at most %d ids", service.MaxPresenceLookup))
+		return
+	}
+
+	states := h.hub.Presence(userIDs)
+	lastSeen, err := h.presenceService.LastSeen(r.Context(), userIDs)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to get presence")
+		return
+	}
+
+	presence := make([]model.Presence, 0, len(userIDs))
+	for _, id := range userIDs {
+		p := model.Presence{UserID: id, State: states[id]}
+		if at, ok := lastSeen[id]; ok && p.State == model.PresenceOffline {
+			p.LastSeenAt = &at
+		}
+		presence = append(presence, p)
+	}
+
+	respondJSON(w, http.StatusOK, presence)
+}
+
+type SettingsRequest struct {
+	HideLastSeen *bool `json:"hide_last_seen"`
+}
+
+// updateSettings changes the privacy settings of the current user; omitted fields stay as they are
+func (h *Handler) updateSettings(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	var req SettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if req.HideLastSeen != nil {
+		if err := h.presenceService.SetHideLastSeen(r.Context(), userID, *req.HideLastSeen); err != nil {
+			respondError(w, http.StatusInternalServerError, "failed to update settings")
+			return
+		}
+	}
+
+	h.getCurrentUser(w, r)
+}
+
+// parseIDList parses comma-separated UUIDs, skipping duplicates
+func parseIDList(value string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	seen := make(map[uuid.UUID]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := uuid.Parse(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", part)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("ids required")
+	}
+	return ids, nil
+}
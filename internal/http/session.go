@@ -0,0 +1,149 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"messenger/internal/auth"
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refresh exchanges a refresh token for a new token pair. The old refresh token stops working.
+func (h *Handler) refresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		respondError(w, http.StatusBadRequest, "refresh_token required")
+		return
+	}
+
+	tokens, err := h.authService.Refresh(r.Context(), req.RefreshToken)
+	if err != nil {
+		var reused *auth.ReusedTokenError
+		switch {
+		case errors.As(err, &reused):
+			h.hub.CloseSessions(reused.UserID, []uuid.UUID{reused.SessionID})
+			respondError(w, http.StatusUnauthorized, auth.ErrInvalidRefreshToken.Error())
+		case errors.Is(err, auth.ErrInvalidRefreshToken):
+			respondError(w, http.StatusUnauthorized, err.Error())
+		case errors.Is(err, auth.ErrAccountDisabled):
+			respondError(w, http.StatusForbidden, err.Error())
+		default:
+			respondError(w, http.StatusInternalServerError, "failed to refresh token")
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, tokens)
+}
+
+// logout ends the session the request was made with
+func (h *Handler) logout(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+	sessionID := auth.SessionIDFromContext(r.Context())
+
+	if err := h.authService.RevokeSession(r.Context(), userID, sessionID); err != nil {
+		respondServiceError(w, sessionErrorStatus(err), err)
+		return
+	}
+	h.hub.CloseSessions(userID, []uuid.UUID{sessionID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionResponse is a session as listed to its owner
+type SessionResponse struct {
+	ID         uuid.UUID `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current marks the session the list was requested with
+	Current bool `json:"current"`
+}
+
+func (h *Handler) listSessions(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+	currentID := auth.SessionIDFromContext(r.Context())
+
+	sessions, err := h.authService.ListSessions(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to get sessions")
+		return
+	}
+
+	response := make([]SessionResponse, len(sessions))
+	for i, session := range sessions {
+		response[i] = SessionResponse{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.ID == currentID,
+		}
+	}
+
+	respondJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) revokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	sessionID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid session id")
+		return
+	}
+
+	if err := h.authService.RevokeSession(r.Context(), userID, sessionID); err != nil {
+		respondServiceError(w, sessionErrorStatus(err), err)
+		return
+	}
+	h.hub.CloseSessions(userID, []uuid.UUID{sessionID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeAllSessions logs the user out everywhere, including the calling session
+func (h *Handler) revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	revoked, err := h.authService.RevokeAllSessions(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to revoke sessions")
+		return
+	}
+	h.hub.CloseSessions(userID, revoked)
+
+	respondJSON(w, http.StatusOK, map[string]int{"revoked": len(revoked)})
+}
+
+// sessionErrorStatus maps session errors to HTTP status codes
+func sessionErrorStatus(err error) int {
+	if errors.Is(err, auth.ErrSessionNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// clientInfo describes the device a login request comes from
+func clientInfo(r *http.Request) auth.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return auth.ClientInfo{
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"net/http"
+
+	"messenger/internal/auth"
+	"messenger/internal/model"
+)
+
+// getSync returns everything the user missed since the cursor of a previous sync
+func (h *Handler) getSync(w http.ResponseWriter, r *http.Request) {
+	userID := auth.UserIDFromContext(r.Context())
+
+	var since *model.SyncPosition
+	if v := r.URL.Query().Get("since"); v != "" {
+		cursor, err := model.ParseSyncPosition(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid since cursor")
+			return
+		}
+		since = cursor
+	}
+
+	batch, err := h.syncService.Since(r.Context(), userID, since)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "failed to sync")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, batch)
+}
@@ -0,0 +1,58 @@
+-- conversations table (direct chats and groups)
+CREATE TABLE IF NOT EXISTS conversations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    type VARCHAR(10) NOT NULL CHECK (type IN ('direct', 'group')),
+    title VARCHAR(100),
+    direct_key VARCHAR(73) UNIQUE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- conversation_members table
+CREATE TABLE IF NOT EXISTS conversation_members (
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member')),
+    joined_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_read_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_members_user ON conversation_members(user_id);
+
+-- messages belong to a conversation; receiver_id is only set for direct chats
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS conversation_id UUID REFERENCES conversations(id) ON DELETE CASCADE;
+ALTER TABLE messages ALTER COLUMN receiver_id DROP NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_created ON messages(conversation_id, created_at DESC);
+
+-- Backfill: every existing 1:1 pair becomes a two-member direct conversation
+INSERT INTO conversations (type, direct_key, created_at)
+SELECT 'direct',
+       LEAST(sender_id, receiver_id)::text || ':' || GREATEST(sender_id, receiver_id)::text,
+       MIN(created_at)
+FROM messages
+WHERE receiver_id IS NOT NULL
+GROUP BY LEAST(sender_id, receiver_id), GREATEST(sender_id, receiver_id)
+ON CONFLICT (direct_key) DO NOTHING;
+
+INSERT INTO conversation_members (conversation_id, user_id, role, joined_at)
+SELECT id, split_part(direct_key, ':', 1)::uuid, 'member', created_at FROM conversations WHERE type = 'direct'
+UNION
+SELECT id, split_part(direct_key, ':', 2)::uuid, 'member', created_at FROM conversations WHERE type = 'direct'
+ON CONFLICT (conversation_id, user_id) DO NOTHING;
+
+UPDATE messages m
+SET conversation_id = c.id
+FROM conversations c
+WHERE m.conversation_id IS NULL
+  AND c.direct_key = LEAST(m.sender_id, m.receiver_id)::text || ':' || GREATEST(m.sender_id, m.receiver_id)::text;
+
+-- Carry the per-partner read watermark over to conversation membership
+UPDATE conversation_members cm
+SET last_read_at = cr.last_read_at
+FROM chat_reads cr, conversations c
+WHERE c.id = cm.conversation_id
+  AND c.type = 'direct'
+  AND cr.user_id = cm.user_id
+  AND c.direct_key = LEAST(cr.user_id, cr.partner_id)::text || ':' || GREATEST(cr.user_id, cr.partner_id)::text;
@@ -0,0 +1,8 @@
+-- Spill table for hub backplane events larger than the NOTIFY payload limit
+CREATE TABLE IF NOT EXISTS backplane_events (
+    id BIGSERIAL PRIMARY KEY,
+    payload BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_backplane_events_created_at ON backplane_events(created_at);
@@ -0,0 +1,8 @@
+-- Track when a call or any of its participants last changed so reconnecting
+-- clients can fetch call state changes they missed
+ALTER TABLE calls ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW();
+UPDATE calls SET updated_at = GREATEST(created_at, started_at, ended_at);
+
+CREATE INDEX IF NOT EXISTS idx_calls_updated_at ON calls(updated_at);
+CREATE INDEX IF NOT EXISTS idx_message_deliveries_delivered_at ON message_deliveries(delivered_at);
+CREATE INDEX IF NOT EXISTS idx_conversation_members_last_read_at ON conversation_members(last_read_at);
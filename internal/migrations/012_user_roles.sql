@@ -0,0 +1,2 @@
+-- System-wide user roles (see model.Role). DEFAULT_USER is promoted to superadmin on startup.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user';
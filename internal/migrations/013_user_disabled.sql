@@ -0,0 +1,2 @@
+-- Accounts disabled by an administrator cannot log in or use existing tokens
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,24 @@
+-- Messages encrypted end-to-end by the clients; their payload is stored exactly as received
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS e2e BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Public keys of client devices taking part in end-to-end encryption
+CREATE TABLE IF NOT EXISTS e2e_devices (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    identity_key BYTEA NOT NULL,
+    signed_prekey_id INTEGER NOT NULL,
+    signed_prekey BYTEA NOT NULL,
+    signed_prekey_signature BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_e2e_devices_user ON e2e_devices(user_id);
+
+-- One-time prekeys; each is deleted when a bundle hands it out
+CREATE TABLE IF NOT EXISTS e2e_prekeys (
+    device_id UUID NOT NULL REFERENCES e2e_devices(id) ON DELETE CASCADE,
+    key_id INTEGER NOT NULL,
+    public_key BYTEA NOT NULL,
+    PRIMARY KEY (device_id, key_id)
+);
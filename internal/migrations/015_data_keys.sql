@@ -0,0 +1,7 @@
+-- Data keys for envelope encryption, wrapped by the key-encryption key of a KMS provider
+CREATE TABLE IF NOT EXISTS data_keys (
+    id VARCHAR(32) PRIMARY KEY,
+    provider VARCHAR(255) NOT NULL,
+    wrapped BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
@@ -0,0 +1,22 @@
+-- Read state is a watermark on a message: everything up to (created_at, id) of
+-- last_read_message_id counts as read. last_read_at stays as the time it last moved.
+ALTER TABLE conversation_members ADD COLUMN IF NOT EXISTS last_read_message_id UUID;
+ALTER TABLE conversation_members ADD COLUMN IF NOT EXISTS last_read_message_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE conversation_members cm
+SET (last_read_message_id, last_read_message_at) = (
+    SELECT m.id, m.created_at FROM messages m
+    WHERE m.conversation_id = cm.conversation_id AND m.created_at <= cm.last_read_at
+    ORDER BY m.created_at DESC, m.id DESC LIMIT 1
+)
+WHERE cm.last_read_at IS NOT NULL AND cm.last_read_message_id IS NULL;
+
+-- Who read which group message and when
+CREATE TABLE IF NOT EXISTS message_reads (
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    read_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_reads_user ON message_reads(user_id);
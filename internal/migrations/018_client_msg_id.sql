@@ -0,0 +1,3 @@
+-- Client-generated message IDs: a resent message with the same ID is not stored twice
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_msg_id VARCHAR(64);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_sender_client_msg_id ON messages(sender_id, client_msg_id) WHERE client_msg_id IS NOT NULL;
@@ -0,0 +1,5 @@
+-- Call entries the server writes into chat timelines, next to regular messages
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'text';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS call_id UUID REFERENCES calls(id) ON DELETE SET NULL;
+-- One entry per call and invitee
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_call_entry ON messages(call_id, receiver_id) WHERE call_id IS NOT NULL;
@@ -0,0 +1,49 @@
+-- Sync cursors are positions the database assigns instead of timestamps: a change
+-- is at (sync_txn, sync_seq), the transaction that made it and a number every
+-- change draws. Sync only returns changes of transactions older than the oldest
+-- one still running, so a change that commits late still sorts after every cursor
+-- handed out before it, whatever the clocks of the servers say.
+-- Rows written before this migration have no position; clients start from the
+-- current head anyway.
+CREATE SEQUENCE IF NOT EXISTS sync_seq;
+
+CREATE OR REPLACE FUNCTION set_sync_position() RETURNS trigger AS $$
+BEGIN
+    NEW.sync_txn := pg_current_xact_id()::text::bigint;
+    NEW.sync_seq := nextval('sync_seq');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS sync_txn BIGINT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS sync_seq BIGINT;
+ALTER TABLE message_deliveries ADD COLUMN IF NOT EXISTS sync_txn BIGINT;
+ALTER TABLE message_deliveries ADD COLUMN IF NOT EXISTS sync_seq BIGINT;
+ALTER TABLE conversation_members ADD COLUMN IF NOT EXISTS sync_txn BIGINT;
+ALTER TABLE conversation_members ADD COLUMN IF NOT EXISTS sync_seq BIGINT;
+ALTER TABLE calls ADD COLUMN IF NOT EXISTS sync_txn BIGINT;
+ALTER TABLE calls ADD COLUMN IF NOT EXISTS sync_seq BIGINT;
+
+-- Re-encrypting a payload does not change a message for clients, only edits and deletions do
+DROP TRIGGER IF EXISTS messages_sync_position ON messages;
+CREATE TRIGGER messages_sync_position BEFORE INSERT OR UPDATE OF edited_at, deleted_at ON messages
+    FOR EACH ROW EXECUTE FUNCTION set_sync_position();
+
+DROP TRIGGER IF EXISTS message_deliveries_sync_position ON message_deliveries;
+CREATE TRIGGER message_deliveries_sync_position BEFORE INSERT ON message_deliveries
+    FOR EACH ROW EXECUTE FUNCTION set_sync_position();
+
+-- Only moving the read watermark is a change sync hands out
+DROP TRIGGER IF EXISTS conversation_members_sync_position ON conversation_members;
+CREATE TRIGGER conversation_members_sync_position BEFORE INSERT OR UPDATE OF last_read_message_id ON conversation_members
+    FOR EACH ROW EXECUTE FUNCTION set_sync_position();
+
+-- Participant changes touch the call, which moves it too
+DROP TRIGGER IF EXISTS calls_sync_position ON calls;
+CREATE TRIGGER calls_sync_position BEFORE INSERT OR UPDATE ON calls
+    FOR EACH ROW EXECUTE FUNCTION set_sync_position();
+
+CREATE INDEX IF NOT EXISTS idx_messages_sync_position ON messages(sync_txn, sync_seq);
+CREATE INDEX IF NOT EXISTS idx_message_deliveries_sync_position ON message_deliveries(sync_txn, sync_seq);
+CREATE INDEX IF NOT EXISTS idx_conversation_members_sync_position ON conversation_members(sync_txn, sync_seq);
+CREATE INDEX IF NOT EXISTS idx_calls_sync_position ON calls(sync_txn, sync_seq);
@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Attachment is a file uploaded to a conversation. Its encrypted bytes live in the
+// blob store under the attachment ID; MessageID is set once a message references it.
+type Attachment struct {
+	ID             uuid.UUID  `json:"id"`
+	ConversationID uuid.UUID  `json:"conversation_id"`
+	UploaderID     uuid.UUID  `json:"uploader_id"`
+	MessageID      *uuid.UUID `json:"message_id,omitempty"`
+	FileName       string     `json:"file_name"`
+	ContentType    string     `json:"content_type"`
+	Size           int64      `json:"size"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
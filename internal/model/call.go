@@ -29,6 +29,9 @@ type Call struct {
 	StartedAt   *time.Time `json:"started_at,omitempty"`
 	EndedAt     *time.Time `json:"ended_at,omitempty"`
 	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	// SyncPos is where the latest change of the call or its participants sorts among changes
+	SyncPos SyncPosition `json:"-"`
 }
 
 type CallParticipantStatus string
@@ -38,6 +41,9 @@ const (
 	CallParticipantStatusActive   CallParticipantStatus = "active"
 	CallParticipantStatusLeft     CallParticipantStatus = "left"
 	CallParticipantStatusRejected CallParticipantStatus = "rejected"
+	// CallParticipantStatusMissed is an invitee who did not answer before the call
+	// stopped ringing
+	CallParticipantStatusMissed CallParticipantStatus = "missed"
 )
 
 type CallParticipant struct {
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ConversationType string
+
+const (
+	ConversationTypeDirect ConversationType = "direct"
+	ConversationTypeGroup  ConversationType = "group"
+)
+
+type ConversationRole string
+
+const (
+	ConversationRoleOwner  ConversationRole = "owner"
+	ConversationRoleAdmin  ConversationRole = "admin"
+	ConversationRoleMember ConversationRole = "member"
+)
+
+type Conversation struct {
+	ID        uuid.UUID        `json:"id"`
+	Type      ConversationType `json:"type"`
+	Title     string           `json:"title,omitempty"`
+	CreatedBy *uuid.UUID       `json:"created_by,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+type ConversationMember struct {
+	ConversationID uuid.UUID        `json:"conversation_id"`
+	UserID         uuid.UUID        `json:"user_id"`
+	Role           ConversationRole `json:"role"`
+	JoinedAt       time.Time        `json:"joined_at"`
+	LastReadAt     *time.Time       `json:"last_read_at,omitempty"`
+
+	// LastReadMessageID is the newest message the member has read; it and every
+	// message before it count as read. LastReadMessageAt is its creation time.
+	LastReadMessageID *uuid.UUID `json:"last_read_message_id,omitempty"`
+	LastReadMessageAt *time.Time `json:"-"`
+}
+
+// ReadUpTo returns the position of the member's read watermark, or nil if they
+// have not read anything
+func (m ConversationMember) ReadUpTo() *Cursor {
+	if m.LastReadMessageID == nil || m.LastReadMessageAt == nil {
+		return nil
+	}
+	return &Cursor{CreatedAt: *m.LastReadMessageAt, ID: *m.LastReadMessageID}
+}
+
+type ConversationInfo struct {
+	Conversation Conversation         `json:"conversation"`
+	Members      []ConversationMember `json:"members"`
+}
@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// DataKey is a data encryption key as stored: wrapped by the key-encryption key of
+// a KMS provider, never in plaintext
+type DataKey struct {
+	ID string `json:"id"`
+	// Provider names the key-encryption key that wrapped it
+	Provider  string    `json:"provider"`
+	Wrapped   []byte    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
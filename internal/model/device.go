@@ -0,0 +1,39 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Device is a client installation taking part in end-to-end encryption. The server
+// only keeps its public keys: an Ed25519 identity key and an X25519 signed prekey,
+// signed by the identity key.
+type Device struct {
+	ID                    uuid.UUID `json:"id"`
+	UserID                uuid.UUID `json:"user_id"`
+	IdentityKey           []byte    `json:"identity_key"`
+	SignedPrekeyID        int       `json:"signed_prekey_id"`
+	SignedPrekey          []byte    `json:"signed_prekey"`
+	SignedPrekeySignature []byte    `json:"signed_prekey_signature"`
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+// OneTimePrekey is an X25519 public key handed out at most once
+type OneTimePrekey struct {
+	KeyID     int    `json:"key_id"`
+	PublicKey []byte `json:"public_key"`
+}
+
+// PrekeyBundle is what a sender needs to start an encrypted session with one device
+type PrekeyBundle struct {
+	UserID                uuid.UUID `json:"user_id"`
+	DeviceID              uuid.UUID `json:"device_id"`
+	IdentityKey           []byte    `json:"identity_key"`
+	SignedPrekeyID        int       `json:"signed_prekey_id"`
+	SignedPrekey          []byte    `json:"signed_prekey"`
+	SignedPrekeySignature []byte    `json:"signed_prekey_signature"`
+	// OneTimePrekey is nil once the device has run out of them
+	OneTimePrekey *OneTimePrekey `json:"one_time_prekey,omitempty"`
+}
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cursor is a position in a list ordered by (created_at, id)
+type Cursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// Encode returns the opaque string form handed out to clients
+func (c Cursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// Compare orders cursors by CreatedAt, then ID, returning -1, 0 or 1
+func (c Cursor) Compare(other Cursor) int {
+	if c.CreatedAt.Before(other.CreatedAt) {
+		return -1
+	}
+	if c.CreatedAt.After(other.CreatedAt) {
+		return 1
+	}
+	return bytes.Compare(c.ID[:], other.ID[:])
+}
+
+// ParseCursor decodes a cursor produced by Cursor.Encode
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &Cursor{CreatedAt: t, ID: uid}, nil
+}
+
+// PageRequest selects a keyset page. Before and After are exclusive bounds;
+// pages are always returned newest first.
+type PageRequest struct {
+	Before *Cursor
+	After  *Cursor
+	Limit  int
+}
+
+// Forward reports whether the page walks towards newer items, i.e. it is
+// anchored by After alone and must be read oldest first from storage.
+func (p PageRequest) Forward() bool {
+	return p.After != nil && p.Before == nil
+}
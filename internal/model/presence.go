@@ -0,0 +1,25 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PresenceState is whether a user is connected and active
+type PresenceState string
+
+const (
+	PresenceOnline PresenceState = "online"
+	// PresenceAway means connected but idle, or the client reported it is in the background
+	PresenceAway    PresenceState = "away"
+	PresenceOffline PresenceState = "offline"
+)
+
+// Presence is the state of a user as seen by others. LastSeenAt is only set for
+// offline users who do not hide it.
+type Presence struct {
+	UserID     uuid.UUID     `json:"user_id"`
+	State      PresenceState `json:"state"`
+	LastSeenAt *time.Time    `json:"last_seen_at,omitempty"`
+}
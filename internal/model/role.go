@@ -0,0 +1,46 @@
+package model
+
+// Role is the system-wide role of a user. It is unrelated to the owner/admin/member
+// roles users hold inside group conversations.
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+	// RoleSuperadmin is seeded for DEFAULT_USER and is the only role that can grant roles
+	RoleSuperadmin Role = "superadmin"
+)
+
+// Permission names a privileged operation
+type Permission string
+
+const (
+	// PermBroadcast allows sending @all messages to every user
+	PermBroadcast Permission = "broadcast"
+	// PermManageUsers allows disabling, renaming, resetting and deleting accounts
+	PermManageUsers Permission = "manage_users"
+	// PermManageRoles allows changing the role of other users
+	PermManageRoles Permission = "manage_roles"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleUser:       {},
+	RoleAdmin:      {PermBroadcast, PermManageUsers},
+	RoleSuperadmin: {PermBroadcast, PermManageUsers, PermManageRoles},
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// Can reports whether the role grants permission
+func (r Role) Can(permission Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
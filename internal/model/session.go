@@ -0,0 +1,28 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is one login of a user on one device. Access tokens name the session they
+// were issued for, so revoking it invalidates them before they expire. Only hashes of
+// refresh tokens are stored; PreviousHash is the hash replaced by the last rotation.
+type Session struct {
+	ID           uuid.UUID  `json:"id"`
+	UserID       uuid.UUID  `json:"user_id"`
+	RefreshHash  string     `json:"-"`
+	PreviousHash string     `json:"-"`
+	UserAgent    string     `json:"user_agent"`
+	IP           string     `json:"ip"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   time.Time  `json:"last_used_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the session can still authenticate requests at now
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
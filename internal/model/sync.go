@@ -0,0 +1,91 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReadReceipt is a member's read watermark in a conversation: MessageID and every
+// message before it have been read
+type ReadReceipt struct {
+	ConversationID uuid.UUID    `json:"conversation_id"`
+	ReaderID       uuid.UUID    `json:"reader_id"`
+	MessageID      uuid.UUID    `json:"message_id"`
+	ReadAt         time.Time    `json:"read_at"`
+	SyncPos        SyncPosition `json:"-"`
+}
+
+// MessageRead records when a member read a single group message
+type MessageRead struct {
+	MessageID uuid.UUID `json:"message_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+// DeliveryReceipt records that a message reached one of its receivers
+type DeliveryReceipt struct {
+	MessageID      uuid.UUID    `json:"message_id"`
+	ConversationID uuid.UUID    `json:"conversation_id"`
+	SenderID       uuid.UUID    `json:"sender_id"`
+	ReceiverID     uuid.UUID    `json:"receiver_id"`
+	DeliveredAt    time.Time    `json:"delivered_at"`
+	SyncPos        SyncPosition `json:"-"`
+}
+
+// SyncPosition orders changes the way the database committed them: by the
+// transaction that made a change, then by a sequence number every change draws.
+// Sync only hands out changes of transactions that have finished, so unlike a
+// timestamp, no change can commit behind a position already handed out.
+type SyncPosition struct {
+	Txn int64
+	Seq int64
+}
+
+// Compare orders positions by Txn, then Seq, returning -1, 0 or 1
+func (p SyncPosition) Compare(other SyncPosition) int {
+	if p.Txn != other.Txn {
+		return compareInt(p.Txn, other.Txn)
+	}
+	return compareInt(p.Seq, other.Seq)
+}
+
+func compareInt(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// Encode returns the opaque string form handed out to clients
+func (p SyncPosition) Encode() string {
+	raw := strconv.FormatInt(p.Txn, 10) + "." + strconv.FormatInt(p.Seq, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseSyncPosition decodes a position produced by SyncPosition.Encode
+func ParseSyncPosition(s string) (*SyncPosition, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sync cursor")
+	}
+	txn, seq, ok := strings.Cut(string(raw), ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid sync cursor")
+	}
+	p := &SyncPosition{}
+	if p.Txn, err = strconv.ParseInt(txn, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid sync cursor")
+	}
+	if p.Seq, err = strconv.ParseInt(seq, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid sync cursor")
+	}
+	return p, nil
+}
@@ -10,19 +10,87 @@ type User struct {
 	ID           uuid.UUID `json:"id"`
 	Username     string    `json:"username"`
 	PasswordHash string    `json:"-"`
-	CreatedAt    time.Time `json:"created_at"`
+	Role         Role      `json:"role"`
+	// DisabledAt is set while an administrator has disabled the account
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	// LastSeenAt is when the user was last connected and HideLastSeen whether others
+	// may see it. Both are only exposed through presence and the user's own settings.
+	LastSeenAt   *time.Time `json:"-"`
+	HideLastSeen bool       `json:"-"`
+}
+
+// Can reports whether the user's role grants permission
+func (u *User) Can(permission Permission) bool {
+	return u.Role.Can(permission)
 }
 
 type Message struct {
-	ID         uuid.UUID `json:"id"`
-	SenderID   uuid.UUID `json:"sender_id"`
-	ReceiverID uuid.UUID `json:"receiver_id"`
-	Payload    []byte    `json:"payload"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID             uuid.UUID  `json:"id"`
+	ConversationID uuid.UUID  `json:"conversation_id"`
+	SenderID       uuid.UUID  `json:"sender_id"`
+	ReceiverID     uuid.UUID  `json:"receiver_id,omitempty"`
+	Payload        []byte     `json:"payload"`
+	CreatedAt      time.Time  `json:"created_at"`
+	EditedAt       *time.Time `json:"edited_at,omitempty"`
+	// DeletedAt is set once the message was deleted for everyone; its payload is then empty
+	DeletedAt   *time.Time   `json:"deleted_at,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// E2E marks a payload encrypted by the clients; the server stores and relays it as is
+	E2E bool `json:"e2e,omitempty"`
+	// Undecryptable marks a payload no key of the keyring opens; Payload is empty then
+	Undecryptable bool `json:"undecryptable,omitempty"`
+	// ClientMsgID is the ID the sender's client chose for the message, unique per sender,
+	// so a resent message is recognized instead of stored twice
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// Kind tells regular messages from call entries the server writes
+	Kind MessageKind `json:"kind,omitempty"`
+	// CallID is the call a call entry is about
+	CallID *uuid.UUID `json:"call_id,omitempty"`
+	// SyncPos is where the latest creation, edit or deletion of the message sorts among changes
+	SyncPos SyncPosition `json:"-"`
+}
+
+type MessageKind string
+
+const (
+	MessageKindText MessageKind = "text"
+	// MessageKindCall summarizes a call in the chat of the caller and an invitee,
+	// such as "Video call, 12:34" or "Call declined"
+	MessageKindCall MessageKind = "call"
+	// MessageKindMissedCall is a call the invitee missed; unlike other call entries it
+	// counts as unread
+	MessageKindMissedCall MessageKind = "missed_call"
+)
+
+// ChangedAt returns the time of the latest creation, edit or deletion of the message
+func (m Message) ChangedAt() time.Time {
+	changed := m.CreatedAt
+	if m.EditedAt != nil && m.EditedAt.After(changed) {
+		changed = *m.EditedAt
+	}
+	if m.DeletedAt != nil && m.DeletedAt.After(changed) {
+		changed = *m.DeletedAt
+	}
+	return changed
+}
+
+// MessageEdit is a previous version of an edited message
+type MessageEdit struct {
+	MessageID uuid.UUID `json:"message_id"`
+	Payload   []byte    `json:"payload"`
+	// EditedAt is when this version was replaced
+	EditedAt time.Time `json:"edited_at"`
+	// Undecryptable marks a version no key of the keyring opens; Payload is empty then
+	Undecryptable bool `json:"undecryptable,omitempty"`
 }
 
 type MessageWithRead struct {
 	Message
 	IsRead      bool `json:"is_read"`
 	IsDelivered bool `json:"is_delivered"`
+
+	// ReadBy lists the members other than the sender who have read the message
+	ReadBy []uuid.UUID `json:"read_by"`
 }
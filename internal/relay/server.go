@@ -0,0 +1,343 @@
+// Package relay runs an embedded STUN/TURN server for calls, so a deployment does not
+// need coturn next to the messenger.
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/turn/v4"
+)
+
+// reservationTimeout is how long an allocation request that passed the quota holds
+// its place before the allocation is made. One that fails to be made never is.
+const reservationTimeout = time.Minute
+
+// Config configures the embedded server
+type Config struct {
+	// Listen is the UDP and TCP address the server listens on
+	Listen string
+	// PublicIP is the address of relayed transport addresses, reachable by clients
+	PublicIP string
+	Realm    string
+	// RelayPortMin and RelayPortMax bound the ports of relayed transport addresses;
+	// zero leaves the choice to the operating system
+	RelayPortMin int
+	RelayPortMax int
+	// UserQuota caps how many allocations one user may hold at a time
+	UserQuota int
+	// Secret is shared with the ICE service, which mints the credentials clients
+	// authenticate with
+	Secret string
+}
+
+// Stats are the usage counters of the embedded server since it started
+type Stats struct {
+	ActiveAllocations int64 `json:"active_allocations"`
+	Allocations       int64 `json:"allocations"`
+	// RelayedBytesIn is received from peers, RelayedBytesOut sent to them
+	RelayedBytesIn  int64 `json:"relayed_bytes_in"`
+	RelayedBytesOut int64 `json:"relayed_bytes_out"`
+	// ActiveUsers hold at least one allocation
+	ActiveUsers int `json:"active_users"`
+	// AuthFailures counts malformed and expired usernames; wrong passwords are
+	// rejected by the TURN server itself
+	AuthFailures    int64 `json:"auth_failures"`
+	QuotaRejections int64 `json:"quota_rejections"`
+}
+
+// Server is the embedded STUN/TURN server. It accepts the credentials of the TURN
+// REST API scheme, minted by the ICE service for authenticated users.
+type Server struct {
+	turn     *turn.Server
+	secret   []byte
+	quota    int
+	publicIP net.IP
+
+	mu sync.Mutex
+	// held counts the allocations of each user, including reserved ones
+	held map[uuid.UUID]int
+	// reserved are allocation requests that passed the quota and whose allocation is
+	// not made yet, by client transport address
+	reserved map[string]reservation
+	prunedAt time.Time
+
+	active          atomic.Int64
+	allocations     atomic.Int64
+	bytesIn         atomic.Int64
+	bytesOut        atomic.Int64
+	authFailures    atomic.Int64
+	quotaRejections atomic.Int64
+}
+
+type reservation struct {
+	userID uuid.UUID
+	at     time.Time
+}
+
+// New starts the server on cfg.Listen
+func New(cfg Config) (*Server, error) {
+	publicIP := net.ParseIP(cfg.PublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("invalid public IP %q", cfg.PublicIP)
+	}
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("shared secret is required")
+	}
+
+	s := &Server{
+		secret:   []byte(cfg.Secret),
+		quota:    cfg.UserQuota,
+		publicIP: publicIP,
+		held:     make(map[uuid.UUID]int),
+		reserved: make(map[string]reservation),
+	}
+
+	udp, err := net.ListenPacket("udp4", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on udp %s: %w", cfg.Listen, err)
+	}
+	tcp, err := net.Listen("tcp4", cfg.Listen)
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("failed to listen on tcp %s: %w", cfg.Listen, err)
+	}
+
+	s.turn, err = turn.NewServer(turn.ServerConfig{
+		Realm:        cfg.Realm,
+		AuthHandler:  s.authenticate,
+		QuotaHandler: s.reserve,
+		EventHandler: turn.EventHandler{
+			OnAllocationCreated: s.allocated,
+			OnAllocationDeleted: s.released,
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udp,
+			RelayAddressGenerator: s.generator(cfg),
+			PermissionHandler:     s.permit,
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcp,
+			RelayAddressGenerator: s.generator(cfg),
+			PermissionHandler:     s.permit,
+		}},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, fmt.Errorf("failed to start TURN server: %w", err)
+	}
+	return s, nil
+}
+
+// Close stops the server and releases every allocation
+func (s *Server) Close() error {
+	return s.turn.Close()
+}
+
+// Stats returns the usage counters
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	s.pruneLocked(time.Now())
+	users := len(s.held)
+	s.mu.Unlock()
+
+	return Stats{
+		ActiveAllocations: s.active.Load(),
+		Allocations:       s.allocations.Load(),
+		RelayedBytesIn:    s.bytesIn.Load(),
+		RelayedBytesOut:   s.bytesOut.Load(),
+		ActiveUsers:       users,
+		AuthFailures:      s.authFailures.Load(),
+		QuotaRejections:   s.quotaRejections.Load(),
+	}
+}
+
+// Port returns the port of an address such as ":3478"
+func Port(listen string) (int, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
+
+// authenticate returns the long-term credential key of a TURN REST API username,
+// "<expiry unix time>:<user id>", whose password is the base64 HMAC-SHA1 of the
+// username keyed with the shared secret. The server then checks the request with it.
+func (s *Server) authenticate(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	expiry, _, _ := strings.Cut(username, ":")
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if _, ok := userOf(username); !ok || err != nil || time.Now().Unix() > expiresAt {
+		s.authFailures.Add(1)
+		return nil, false
+	}
+
+	mac := hmac.New(sha1.New, s.secret)
+	mac.Write([]byte(username))
+	password := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return turn.GenerateAuthKey(username, realm, password), true
+}
+
+// userOf returns the user a TURN REST API username was minted for
+func userOf(username string) (uuid.UUID, bool) {
+	_, id, found := strings.Cut(username, ":")
+	if !found {
+		return uuid.Nil, false
+	}
+	userID, err := uuid.Parse(id)
+	return userID, err == nil
+}
+
+// reserve holds a user to their quota. It runs for verified allocation requests
+// only, before the allocation is made, and keeps a place for it until then.
+func (s *Server) reserve(username, realm string, srcAddr net.Addr) bool {
+	userID, ok := userOf(username)
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+
+	addr := addressKey(srcAddr)
+	if previous, ok := s.reserved[addr]; ok {
+		// A retransmitted request replaces the reservation it made before
+		s.releaseLocked(previous.userID)
+		delete(s.reserved, addr)
+	}
+	if s.quota > 0 && s.held[userID] >= s.quota {
+		s.quotaRejections.Add(1)
+		log.Printf("relay: user %s reached the quota of %d allocations", userID, s.quota)
+		return false
+	}
+	s.held[userID]++
+	s.reserved[addr] = reservation{userID: userID, at: now}
+	return true
+}
+
+// allocated turns the reservation of a client transport address into an allocation
+func (s *Server) allocated(srcAddr, dstAddr net.Addr, protocol, username, realm string, relayAddr net.Addr, requestedPort int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reserved, addressKey(srcAddr))
+}
+
+// released gives a user's place back once their allocation expired or was deleted
+func (s *Server) released(srcAddr, dstAddr net.Addr, protocol, username, realm string) {
+	userID, ok := userOf(username)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked(userID)
+}
+
+// releaseLocked frees one place of a user. Caller must hold s.mu.
+func (s *Server) releaseLocked(userID uuid.UUID) {
+	if s.held[userID] <= 1 {
+		delete(s.held, userID)
+		return
+	}
+	s.held[userID]--
+}
+
+// permit decides whether a client may relay to a peer. Peers on loopback, private
+// and link-local networks are refused so the relay cannot reach into the server's
+// network.
+func (s *Server) permit(clientAddr net.Addr, peerIP net.IP) bool {
+	return peerIP.Equal(s.publicIP) || !(peerIP.IsLoopback() || peerIP.IsPrivate() || peerIP.IsLinkLocalUnicast() ||
+		peerIP.IsUnspecified() || peerIP.IsMulticast())
+}
+
+// addressKey identifies a client transport address; UDP and TCP ones may share a port
+func addressKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
+// pruneLocked gives back the places of reservations whose allocation was never made,
+// at most once a minute. Caller must hold s.mu.
+func (s *Server) pruneLocked(now time.Time) {
+	if now.Sub(s.prunedAt) < time.Minute {
+		return
+	}
+	s.prunedAt = now
+
+	for addr, r := range s.reserved {
+		if now.Sub(r.at) > reservationTimeout {
+			s.releaseLocked(r.userID)
+			delete(s.reserved, addr)
+		}
+	}
+}
+
+// generator allocates relayed transport addresses on the public IP, counting them
+func (s *Server) generator(cfg Config) turn.RelayAddressGenerator {
+	var gen turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{
+		RelayAddress: s.publicIP,
+		Address:      "0.0.0.0",
+	}
+	if cfg.RelayPortMin > 0 && cfg.RelayPortMax >= cfg.RelayPortMin {
+		gen = &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: s.publicIP,
+			Address:      "0.0.0.0",
+			MinPort:      uint16(cfg.RelayPortMin),
+			MaxPort:      uint16(cfg.RelayPortMax),
+		}
+	}
+	return countingGenerator{RelayAddressGenerator: gen, s: s}
+}
+
+type countingGenerator struct {
+	turn.RelayAddressGenerator
+	s *Server
+}
+
+func (g countingGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	g.s.allocations.Add(1)
+	g.s.active.Add(1)
+	return &countingConn{PacketConn: conn, s: g.s}, addr, nil
+}
+
+// countingConn is a relayed transport address that counts the bytes relayed through it
+type countingConn struct {
+	net.PacketConn
+	s      *Server
+	closed atomic.Bool
+}
+
+func (c *countingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	c.s.bytesIn.Add(int64(n))
+	return n, addr, err
+}
+
+func (c *countingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.s.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.s.active.Add(-1)
+	}
+	return c.PacketConn.Close()
+}
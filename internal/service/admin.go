@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/auth"
+	"messenger/internal/model"
+	"messenger/internal/storage"
+)
+
+var (
+	// ErrOwnAccount prevents admins from disabling or deleting themselves
+	ErrOwnAccount = errors.New("cannot do this to your own account")
+	// ErrPrivilegedUser is returned when an admin without model.PermManageRoles targets another admin
+	ErrPrivilegedUser = errors.New("only a superadmin can manage admin accounts")
+	ErrUsernameTaken  = auth.ErrUsernameTaken
+	ErrInvalidInput   = errors.New("invalid input")
+)
+
+// AdminStats is a snapshot of instance-wide counts
+type AdminStats struct {
+	Users    int `json:"users"`
+	Messages int `json:"messages"`
+	// ActiveCalls counts calls that are ringing or in progress
+	ActiveCalls int `json:"active_calls"`
+}
+
+// AdminService manages user accounts on behalf of admins. Callers must check that the
+// actor holds model.PermManageUsers; the methods check everything else.
+type AdminService struct {
+	userRepo    storage.UserRepository
+	messageRepo storage.MessageRepository
+	callRepo    storage.CallRepository
+	attachments *AttachmentService
+	auth        *auth.Service
+}
+
+func NewAdminService(userRepo storage.UserRepository, messageRepo storage.MessageRepository, callRepo storage.CallRepository, attachments *AttachmentService, authService *auth.Service) *AdminService {
+	return &AdminService{
+		userRepo:    userRepo,
+		messageRepo: messageRepo,
+		callRepo:    callRepo,
+		attachments: attachments,
+		auth:        authService,
+	}
+}
+
+// ListUsers returns a keyset page of users, newest first, and the cursor of the
+// next page ("" when there is none)
+func (s *AdminService) ListUsers(ctx context.Context, page model.PageRequest) ([]model.User, string, error) {
+	if s.userRepo == nil {
+		return nil, "", fmt.Errorf("database unavailable")
+	}
+
+	page, limit := withLookahead(page)
+	users, err := s.userRepo.GetPage(ctx, page)
+	if err != nil {
+		return nil, "", err
+	}
+	users, next := trimPage(users, limit, page, func(user model.User) model.Cursor {
+		return model.Cursor{CreatedAt: user.CreatedAt, ID: user.ID}
+	})
+	return users, next, nil
+}
+
+// SetDisabled disables or re-enables an account. Disabling signs the user out
+// everywhere; the IDs of the revoked sessions are returned.
+func (s *AdminService) SetDisabled(ctx context.Context, actorID, targetID uuid.UUID, disabled bool) ([]uuid.UUID, error) {
+	if s.userRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	if actorID == targetID {
+		return nil, ErrOwnAccount
+	}
+	if _, err := s.target(ctx, actorID, targetID); err != nil {
+		return nil, err
+	}
+
+	if !disabled {
+		return nil, s.userRepo.SetDisabled(ctx, targetID, nil)
+	}
+	now := time.Now()
+	if err := s.userRepo.SetDisabled(ctx, targetID, &now); err != nil {
+		return nil, err
+	}
+	return s.auth.RevokeAllSessions(ctx, targetID)
+}
+
+// Rename changes the username of an account
+func (s *AdminService) Rename(ctx context.Context, actorID, targetID uuid.UUID, username string) error {
+	if s.userRepo == nil {
+		return fmt.Errorf("database unavailable")
+	}
+	if err := auth.ValidateUsername(username); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	if _, err := s.target(ctx, actorID, targetID); err != nil {
+		return err
+	}
+
+	existing, err := s.userRepo.GetByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.ID != targetID {
+		return ErrUsernameTaken
+	}
+	return s.userRepo.UpdateUsername(ctx, targetID, username)
+}
+
+// ResetPassword sets a new password and signs the user out everywhere. It returns
+// the IDs of the revoked sessions.
+func (s *AdminService) ResetPassword(ctx context.Context, actorID, targetID uuid.UUID, password string) ([]uuid.UUID, error) {
+	if s.userRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	if err := auth.ValidatePassword(password); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	if _, err := s.target(ctx, actorID, targetID); err != nil {
+		return nil, err
+	}
+	return s.auth.ResetPassword(ctx, targetID, password)
+}
+
+// Logout signs a user out of every session and returns the revoked session IDs
+func (s *AdminService) Logout(ctx context.Context, actorID, targetID uuid.UUID) ([]uuid.UUID, error) {
+	if s.userRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	if _, err := s.target(ctx, actorID, targetID); err != nil {
+		return nil, err
+	}
+	return s.auth.RevokeAllSessions(ctx, targetID)
+}
+
+// DeleteUser removes an account with its direct messages, memberships, calls and
+// attachments. Its sessions are revoked first; their IDs are returned so live
+// connections can be closed.
+func (s *AdminService) DeleteUser(ctx context.Context, actorID, targetID uuid.UUID) ([]uuid.UUID, error) {
+	if s.userRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	if actorID == targetID {
+		return nil, ErrOwnAccount
+	}
+	if _, err := s.target(ctx, actorID, targetID); err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.auth.RevokeAllSessions(ctx, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rows go with the user; the blobs have to be collected beforehand
+	attachments, err := s.attachments.userAttachments(ctx, targetID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.userRepo.Delete(ctx, targetID); err != nil {
+		return nil, err
+	}
+	s.attachments.deleteBlobs(ctx, attachments)
+
+	return revoked, nil
+}
+
+// Stats counts users, messages and active calls
+func (s *AdminService) Stats(ctx context.Context) (*AdminStats, error) {
+	if s.userRepo == nil || s.messageRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	var stats AdminStats
+	var err error
+	if stats.Users, err = s.userRepo.Count(ctx); err != nil {
+		return nil, err
+	}
+	if stats.Messages, err = s.messageRepo.Count(ctx); err != nil {
+		return nil, err
+	}
+	if s.callRepo != nil {
+		for _, status := range []model.CallStatus{model.CallStatusRinging, model.CallStatusActive} {
+			calls, err := s.callRepo.GetByStatus(ctx, string(status))
+			if err != nil {
+				return nil, err
+			}
+			stats.ActiveCalls += len(calls)
+		}
+	}
+	return &stats, nil
+}
+
+// target loads the user an admin action applies to. Admin accounts can only be
+// managed by users who may also change roles.
+func (s *AdminService) target(ctx context.Context, actorID, targetID uuid.UUID) (*model.User, error) {
+	user, err := s.userRepo.GetByID(ctx, targetID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	if user.Role == model.RoleUser {
+		return user, nil
+	}
+
+	actor, err := s.userRepo.GetByID(ctx, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if actor == nil || !actor.Can(model.PermManageRoles) {
+		return nil, ErrPrivilegedUser
+	}
+	return user, nil
+}
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/crypto"
+	"messenger/internal/model"
+	"messenger/internal/storage"
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	// ErrInvalidAttachment is returned when a message references attachments that were uploaded
+	// by someone else, to another conversation, or are already part of another message
+	ErrInvalidAttachment = errors.New("invalid attachment")
+)
+
+const (
+	maxAttachmentsPerMessage = 10
+	maxFileNameLength        = 255
+)
+
+type AttachmentService struct {
+	repo      storage.AttachmentRepository
+	userRepo  storage.UserRepository
+	convRepo  storage.ConversationRepository
+	blobs     storage.BlobStore
+	encryptor *crypto.Encryptor
+	maxSize   int64
+}
+
+func NewAttachmentService(repo storage.AttachmentRepository, userRepo storage.UserRepository, convRepo storage.ConversationRepository, blobs storage.BlobStore, encryptor *crypto.Encryptor, maxSize int64) *AttachmentService {
+	return &AttachmentService{
+		repo:      repo,
+		userRepo:  userRepo,
+		convRepo:  convRepo,
+		blobs:     blobs,
+		encryptor: encryptor,
+		maxSize:   maxSize,
+	}
+}
+
+func (s *AttachmentService) available() bool {
+	return s != nil && s.repo != nil && s.userRepo != nil && s.convRepo != nil && s.blobs != nil
+}
+
+// MaxSize returns the largest accepted upload in bytes
+func (s *AttachmentService) MaxSize() int64 {
+	return s.maxSize
+}
+
+// Upload encrypts a file and stores it for a conversation the uploader belongs to.
+// The attachment is sent by referencing its ID from a message.
+func (s *AttachmentService) Upload(ctx context.Context, uploaderID, conversationID uuid.UUID, fileName, contentType string, r io.Reader) (*model.Attachment, error) {
+	if !s.available() {
+		return nil, fmt.Errorf("attachments unavailable")
+	}
+
+	member, err := s.convRepo.GetMember(ctx, conversationID, uploaderID)
+	if err != nil {
+		return nil, err
+	}
+	if member == nil {
+		return nil, ErrNotConversationMember
+	}
+
+	// Read one byte past the limit to detect oversized files without trusting Content-Length
+	data, err := io.ReadAll(io.LimitReader(r, s.maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	if int64(len(data)) > s.maxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: file is empty", ErrInvalidAttachment)
+	}
+
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(data)
+	}
+	att := &model.Attachment{
+		ID:             uuid.New(),
+		ConversationID: conversationID,
+		UploaderID:     uploaderID,
+		FileName:       cleanFileName(fileName),
+		ContentType:    contentType,
+		Size:           int64(len(data)),
+		CreatedAt:      time.Now(),
+	}
+
+	// Binding the blob to the attachment ID keeps it from being served under another one
+	sealed, err := s.encryptor.Seal(data, att.ID[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt attachment: %w", err)
+	}
+	if err := s.blobs.Put(ctx, att.ID.String(), sealed); err != nil {
+		return nil, fmt.Errorf("failed to store attachment: %w", err)
+	}
+	if err := s.repo.Create(ctx, att); err != nil {
+		if delErr := s.blobs.Delete(ctx, att.ID.String()); delErr != nil {
+			log.Printf("failed to remove orphaned attachment blob %s: %v", att.ID, delErr)
+		}
+		return nil, err
+	}
+
+	return att, nil
+}
+
+// UploadDirect stores a file for the direct chat with receiverID, creating the chat on first use
+func (s *AttachmentService) UploadDirect(ctx context.Context, uploaderID, receiverID uuid.UUID, fileName, contentType string, r io.Reader) (*model.Attachment, error) {
+	if !s.available() {
+		return nil, fmt.Errorf("attachments unavailable")
+	}
+
+	receiver, err := s.userRepo.GetByID(ctx, receiverID)
+	if err != nil {
+		return nil, err
+	}
+	if receiver == nil {
+		return nil, ErrReceiverNotFound
+	}
+
+	conv, err := s.convRepo.GetOrCreateDirect(ctx, uploaderID, receiverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation: %w", err)
+	}
+
+	return s.Upload(ctx, uploaderID, conv.ID, fileName, contentType, r)
+}
+
+// Download returns an attachment and its decrypted content. Only members of the
+// conversation it was uploaded to may fetch it; others get ErrAttachmentNotFound.
+func (s *AttachmentService) Download(ctx context.Context, attachmentID, userID uuid.UUID) (*model.Attachment, []byte, error) {
+	if !s.available() {
+		return nil, nil, fmt.Errorf("attachments unavailable")
+	}
+
+	att, err := s.repo.GetByID(ctx, attachmentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if att == nil {
+		return nil, nil, ErrAttachmentNotFound
+	}
+
+	member, err := s.convRepo.GetMember(ctx, att.ConversationID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if member == nil {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	// Until it is sent, an upload is only visible to its uploader
+	if att.MessageID == nil && att.UploaderID != userID {
+		return nil, nil, ErrAttachmentNotFound
+	}
+
+	sealed, err := s.blobs.Get(ctx, att.ID.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read attachment: %w", err)
+	}
+	if sealed == nil {
+		return nil, nil, ErrAttachmentNotFound
+	}
+
+	data, err := s.encryptor.Open(sealed, att.ID[:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt attachment: %w", err)
+	}
+	return att, data, nil
+}
+
+// check validates that the sender may attach the given uploads to a message in
+// conversationID and returns the IDs without duplicates
+func (s *AttachmentService) check(ctx context.Context, ids []uuid.UUID, senderID, conversationID uuid.UUID) ([]uuid.UUID, error) {
+	if !s.available() {
+		return nil, fmt.Errorf("attachments unavailable")
+	}
+
+	seen := make(map[uuid.UUID]bool, len(ids))
+	unique := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) > maxAttachmentsPerMessage {
+		return nil, fmt.Errorf("%w: at most %d attachments per message", ErrInvalidAttachment, maxAttachmentsPerMessage)
+	}
+
+	attachments, err := s.repo.GetByIDs(ctx, unique)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) != len(unique) {
+		return nil, ErrInvalidAttachment
+	}
+	for _, att := range attachments {
+		if att.UploaderID != senderID || att.ConversationID != conversationID || att.MessageID != nil {
+			return nil, ErrInvalidAttachment
+		}
+	}
+	return unique, nil
+}
+
+// attach links checked uploads to a stored message; it fails if another message claimed one first
+func (s *AttachmentService) attach(ctx context.Context, ids []uuid.UUID, messageID uuid.UUID) ([]model.Attachment, error) {
+	linked, err := s.repo.AttachToMessage(ctx, ids, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if linked != len(ids) {
+		return nil, ErrInvalidAttachment
+	}
+	return s.repo.GetByMessageIDs(ctx, []uuid.UUID{messageID})
+}
+
+// fill sets the Attachments of each message
+func (s *AttachmentService) fill(ctx context.Context, messages []*model.Message) error {
+	if !s.available() || len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(messages))
+	byID := make(map[uuid.UUID]*model.Message, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+		byID[msg.ID] = msg
+	}
+
+	attachments, err := s.repo.GetByMessageIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, att := range attachments {
+		if msg := byID[*att.MessageID]; msg != nil {
+			msg.Attachments = append(msg.Attachments, att)
+		}
+	}
+	return nil
+}
+
+// purge deletes the attachments of a message deleted for everyone, including their blobs
+func (s *AttachmentService) purge(ctx context.Context, messageID uuid.UUID) error {
+	if !s.available() {
+		return nil
+	}
+
+	attachments, err := s.repo.DeleteByMessageID(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	s.deleteBlobs(ctx, attachments)
+	return nil
+}
+
+// userAttachments returns the attachments that go away when a user is deleted
+func (s *AttachmentService) userAttachments(ctx context.Context, userID uuid.UUID) ([]model.Attachment, error) {
+	if !s.available() {
+		return nil, nil
+	}
+	return s.repo.GetByUserID(ctx, userID)
+}
+
+// deleteBlobs removes the stored bytes of attachments whose rows are already gone
+func (s *AttachmentService) deleteBlobs(ctx context.Context, attachments []model.Attachment) {
+	if !s.available() {
+		return
+	}
+	for _, att := range attachments {
+		if err := s.blobs.Delete(ctx, att.ID.String()); err != nil {
+			log.Printf("failed to delete attachment blob %s: %v", att.ID, err)
+		}
+	}
+}
+
+// cleanFileName keeps only the base name so downloads cannot suggest paths
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if len(name) > maxFileNameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFileNameLength-len(ext)], "") + ext
+	}
+	return name
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,11 +17,21 @@ type CallService struct {
 	repo     storage.CallRepository
 	userRepo storage.UserRepository
 	txm      storage.TransactionManager
+	// timeline and onEntry are set by SetTimeline
+	timeline *MessageService
+	onEntry  func(*model.Message)
 }
 
 // ErrInvalidDependency is returned when a required dependency is nil
 var ErrInvalidDependency = errors.New("required dependency is nil")
 
+var (
+	ErrCallNotFound       = errors.New("call not found")
+	ErrNotCallParticipant = errors.New("user is not a participant of this call")
+	// ErrCallEnded is returned when rejoining a call that is over
+	ErrCallEnded = errors.New("call has ended")
+)
+
 func NewCallService(repo storage.CallRepository, userRepo storage.UserRepository, txm storage.TransactionManager) (*CallService, error) {
 	if repo == nil {
 		return nil, fmt.Errorf("%w: CallRepository", ErrInvalidDependency)
@@ -37,6 +49,14 @@ func NewCallService(repo storage.CallRepository, userRepo storage.UserRepository
 	}, nil
 }
 
+// SetTimeline makes the service write an entry into the chat of the caller and each
+// invitee when a call ends or the invitee declines it, and pass every new entry to
+// onEntry, which may be nil
+func (s *CallService) SetTimeline(messages *MessageService, onEntry func(*model.Message)) {
+	s.timeline = messages
+	s.onEntry = onEntry
+}
+
 func (s *CallService) CreateCall(ctx context.Context, initiatorID uuid.UUID, callType model.CallType, participantIDs []uuid.UUID) (*model.Call, error) {
 
 	// Deduplicate participant IDs and exclude initiator
@@ -64,17 +84,19 @@ func (s *CallService) CreateCall(ctx context.Context, initiatorID uuid.UUID, cal
 		// Check all participants were found
 		for _, pid := range uniqueParticipants {
 			if !foundIDs[pid] {
-				return nil, fmt.Errorf("participant %s does not exist", pid)
+				return nil, fmt.Errorf("%w: participant %s", ErrUserNotFound, pid)
 			}
 		}
 	}
 
+	now := time.Now()
 	call := &model.Call{
 		ID:          uuid.New(),
 		InitiatorID: initiatorID,
 		CallType:    callType,
 		Status:      model.CallStatusRinging,
-		CreatedAt:   time.Now(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 
 	// Transaction support is required for atomic call creation
@@ -135,7 +157,7 @@ func (s *CallService) GetCall(ctx context.Context, callID uuid.UUID) (*model.Cal
 		return nil, fmt.Errorf("failed to get call: %w", err)
 	}
 	if call == nil {
-		return nil, fmt.Errorf("call not found")
+		return nil, ErrCallNotFound
 	}
 
 	participants, err := s.repo.GetParticipantsByCallID(ctx, callID)
@@ -149,13 +171,25 @@ func (s *CallService) GetCall(ctx context.Context, callID uuid.UUID) (*model.Cal
 	}, nil
 }
 
+// JoinCall makes a user an active participant. It locks the call, like every change
+// the call supervisor competes with.
 func (s *CallService) JoinCall(ctx context.Context, callID, userID uuid.UUID) error {
-	call, err := s.repo.GetByID(ctx, callID)
+	return s.txm.WithTx(ctx, func(txCtx context.Context) error {
+		return s.joinCall(txCtx, callID, userID)
+	})
+}
+
+func (s *CallService) joinCall(ctx context.Context, callID, userID uuid.UUID) error {
+	call, err := s.repo.GetByIDForUpdate(ctx, callID)
 	if err != nil {
 		return fmt.Errorf("failed to get call: %w", err)
 	}
 	if call == nil {
-		return fmt.Errorf("call not found")
+		return ErrCallNotFound
+	}
+
+	if call.Status == model.CallStatusEnded {
+		return ErrCallEnded
 	}
 
 	// Check if user is already a participant
@@ -176,7 +210,7 @@ func (s *CallService) JoinCall(ctx context.Context, callID, userID uuid.UUID) er
 					return fmt.Errorf("failed to update joined_at: %w", err)
 				}
 			} else {
-				return fmt.Errorf("cannot rejoin a call that has ended")
+				return ErrCallEnded
 			}
 		} else if participant.Status == model.CallParticipantStatusActive {
 			return nil // Already joined
@@ -192,7 +226,7 @@ func (s *CallService) JoinCall(ctx context.Context, callID, userID uuid.UUID) er
 		}
 	} else {
 		// User not in call - check if they were invited
-		return fmt.Errorf("user not invited to this call")
+		return ErrNotCallParticipant
 	}
 
 	// Update call status to active if ringing
@@ -210,48 +244,61 @@ func (s *CallService) JoinCall(ctx context.Context, callID, userID uuid.UUID) er
 }
 
 func (s *CallService) LeaveCall(ctx context.Context, callID, userID uuid.UUID) error {
-	participant, err := s.repo.GetParticipant(ctx, callID, userID)
-	if err != nil {
-		return fmt.Errorf("failed to get participant: %w", err)
-	}
-	if participant == nil {
-		return fmt.Errorf("user is not a participant of this call")
-	}
-
-	if err := s.repo.UpdateParticipantStatus(ctx, callID, userID, string(model.CallParticipantStatusLeft)); err != nil {
-		return fmt.Errorf("failed to update participant status: %w", err)
-	}
+	var ended bool
+	err := s.txm.WithTx(ctx, func(txCtx context.Context) error {
+		if _, err := s.repo.GetByIDForUpdate(txCtx, callID); err != nil {
+			return fmt.Errorf("failed to lock call: %w", err)
+		}
+		participant, err := s.repo.GetParticipant(txCtx, callID, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get participant: %w", err)
+		}
+		if participant == nil {
+			return ErrNotCallParticipant
+		}
 
-	leftAt := time.Now()
-	if err := s.repo.UpdateParticipantLeftAt(ctx, callID, userID, &leftAt); err != nil {
-		return fmt.Errorf("failed to update left_at: %w", err)
-	}
+		if err := s.repo.UpdateParticipantStatus(txCtx, callID, userID, string(model.CallParticipantStatusLeft)); err != nil {
+			return fmt.Errorf("failed to update participant status: %w", err)
+		}
 
-	// Check if call should be ended
-	participants, err := s.repo.GetParticipantsByCallID(ctx, callID)
-	if err != nil {
-		return fmt.Errorf("failed to get participants: %w", err)
-	}
+		leftAt := time.Now()
+		if err := s.repo.UpdateParticipantLeftAt(txCtx, callID, userID, &leftAt); err != nil {
+			return fmt.Errorf("failed to update left_at: %w", err)
+		}
 
-	// Count active participants
-	activeCount := 0
-	for _, p := range participants {
-		if p.Status == model.CallParticipantStatusActive {
-			activeCount++
+		// Check if call should be ended
+		participants, err := s.repo.GetParticipantsByCallID(txCtx, callID)
+		if err != nil {
+			return fmt.Errorf("failed to get participants: %w", err)
 		}
-	}
 
-	// If no active participants left, end the call
-	if activeCount == 0 {
-		if err := s.repo.UpdateStatus(ctx, callID, string(model.CallStatusEnded)); err != nil {
-			return fmt.Errorf("failed to update call status: %w", err)
+		// Count active participants
+		activeCount := 0
+		for _, p := range participants {
+			if p.Status == model.CallParticipantStatusActive {
+				activeCount++
+			}
 		}
-		endedAt := time.Now()
-		if err := s.repo.UpdateEndedAt(ctx, callID, &endedAt); err != nil {
-			return fmt.Errorf("failed to update ended_at: %w", err)
+
+		// If no active participants left, end the call
+		if activeCount == 0 {
+			if err := s.repo.UpdateStatus(txCtx, callID, string(model.CallStatusEnded)); err != nil {
+				return fmt.Errorf("failed to update call status: %w", err)
+			}
+			endedAt := time.Now()
+			if err := s.repo.UpdateEndedAt(txCtx, callID, &endedAt); err != nil {
+				return fmt.Errorf("failed to update ended_at: %w", err)
+			}
+			ended = true
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ended {
+		s.summarize(ctx, callID)
 	}
-
 	return nil
 }
 
@@ -261,7 +308,7 @@ func (s *CallService) EndCall(ctx context.Context, callID, userID uuid.UUID) err
 		return fmt.Errorf("failed to get call: %w", err)
 	}
 	if call == nil {
-		return fmt.Errorf("call not found")
+		return ErrCallNotFound
 	}
 
 	// Check if user is the initiator or an active participant in the call
@@ -274,22 +321,24 @@ func (s *CallService) EndCall(ctx context.Context, callID, userID uuid.UUID) err
 	isInitiator := call.InitiatorID == userID
 
 	if participant == nil && !isInitiator {
-		return fmt.Errorf("user is not a participant of this call")
+		return ErrNotCallParticipant
 	}
 	if participant != nil && participant.Status != model.CallParticipantStatusActive && !isInitiator {
-		return fmt.Errorf("only active participants or the initiator can end the call")
-	}
-
-	// Get all participants before the transaction
-	participants, err := s.repo.GetParticipantsByCallID(ctx, callID)
-	if err != nil {
-		return fmt.Errorf("failed to get participants: %w", err)
+		return fmt.Errorf("%w: only active participants or the initiator can end the call", ErrNotCallParticipant)
 	}
 
 	leftAt := time.Now()
 
 	// Transaction support is required for atomic call ending
-	return s.txm.WithTx(ctx, func(txCtx context.Context) error {
+	err = s.txm.WithTx(ctx, func(txCtx context.Context) error {
+		if _, err := s.repo.GetByIDForUpdate(txCtx, callID); err != nil {
+			return fmt.Errorf("failed to lock call: %w", err)
+		}
+		// Read under the lock, so a participant joining meanwhile is not left active
+		participants, err := s.repo.GetParticipantsByCallID(txCtx, callID)
+		if err != nil {
+			return fmt.Errorf("failed to get participants: %w", err)
+		}
 		for _, p := range participants {
 			if p.Status == model.CallParticipantStatusActive {
 				if err := s.repo.UpdateParticipantStatus(txCtx, callID, p.UserID, string(model.CallParticipantStatusLeft)); err != nil {
@@ -309,17 +358,25 @@ func (s *CallService) EndCall(ctx context.Context, callID, userID uuid.UUID) err
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	s.summarize(ctx, callID)
+	return nil
 }
 
 func (s *CallService) RejectCall(ctx context.Context, callID, userID uuid.UUID) error {
 	// Transaction support is required for atomic reject operation
-	return s.txm.WithTx(ctx, func(txCtx context.Context) error {
+	err := s.txm.WithTx(ctx, func(txCtx context.Context) error {
+		if _, err := s.repo.GetByIDForUpdate(txCtx, callID); err != nil {
+			return fmt.Errorf("failed to lock call: %w", err)
+		}
 		participant, err := s.repo.GetParticipant(txCtx, callID, userID)
 		if err != nil {
 			return fmt.Errorf("failed to get participant: %w", err)
 		}
 		if participant == nil {
-			return fmt.Errorf("user is not a participant of this call")
+			return ErrNotCallParticipant
 		}
 
 		// Skip if already rejected
@@ -358,10 +415,213 @@ func (s *CallService) RejectCall(ctx context.Context, callID, userID uuid.UUID)
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	s.summarize(ctx, callID)
+	return nil
+}
+
+// OpenCalls returns the calls that are ringing or active
+func (s *CallService) OpenCalls(ctx context.Context) ([]model.Call, error) {
+	ringing, err := s.repo.GetByStatus(ctx, string(model.CallStatusRinging))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ringing calls: %w", err)
+	}
+	active, err := s.repo.GetByStatus(ctx, string(model.CallStatusActive))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active calls: %w", err)
+	}
+	return append(ringing, active...), nil
+}
+
+// ExpireInvites marks the participants of a call that are still invited as missed.
+// A call nobody answered is ended. It returns the users marked missed and whether
+// the call ended. The call is locked while it is read and changed, so when several
+// instances expire the same call, only the first reports anything.
+func (s *CallService) ExpireInvites(ctx context.Context, callID uuid.UUID) ([]uuid.UUID, bool, error) {
+	var missed []uuid.UUID
+	var ended bool
+	err := s.txm.WithTx(ctx, func(txCtx context.Context) error {
+		call, err := s.repo.GetByIDForUpdate(txCtx, callID)
+		if err != nil {
+			return fmt.Errorf("failed to get call: %w", err)
+		}
+		if call == nil || call.Status == model.CallStatusEnded {
+			return nil
+		}
+
+		participants, err := s.repo.GetParticipantsByCallID(txCtx, callID)
+		if err != nil {
+			return fmt.Errorf("failed to get participants: %w", err)
+		}
+		for _, p := range participants {
+			if p.Status != model.CallParticipantStatusInvited {
+				continue
+			}
+			if err := s.repo.UpdateParticipantStatus(txCtx, callID, p.UserID, string(model.CallParticipantStatusMissed)); err != nil {
+				return fmt.Errorf("failed to update participant %s status: %w", p.UserID, err)
+			}
+			missed = append(missed, p.UserID)
+		}
+
+		// Still ringing means nobody joined, so the caller is left alone
+		if call.Status == model.CallStatusRinging {
+			ended = true
+			return s.finishCall(txCtx, callID, participants, time.Now())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	s.summarize(ctx, callID)
+	return missed, ended, nil
+}
+
+// EndAbandonedCall ends a call on behalf of participants that are gone: active ones
+// are marked left and invited ones missed. It returns every participant of the call,
+// or nothing if the call had already ended, also when another instance just ended it.
+func (s *CallService) EndAbandonedCall(ctx context.Context, callID uuid.UUID) ([]uuid.UUID, error) {
+	var userIDs []uuid.UUID
+	err := s.txm.WithTx(ctx, func(txCtx context.Context) error {
+		call, err := s.repo.GetByIDForUpdate(txCtx, callID)
+		if err != nil {
+			return fmt.Errorf("failed to get call: %w", err)
+		}
+		if call == nil || call.Status == model.CallStatusEnded {
+			return nil
+		}
+
+		participants, err := s.repo.GetParticipantsByCallID(txCtx, callID)
+		if err != nil {
+			return fmt.Errorf("failed to get participants: %w", err)
+		}
+		for _, p := range participants {
+			userIDs = append(userIDs, p.UserID)
+			if p.Status != model.CallParticipantStatusInvited {
+				continue
+			}
+			if err := s.repo.UpdateParticipantStatus(txCtx, callID, p.UserID, string(model.CallParticipantStatusMissed)); err != nil {
+				return fmt.Errorf("failed to update participant %s status: %w", p.UserID, err)
+			}
+		}
+		return s.finishCall(txCtx, callID, participants, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.summarize(ctx, callID)
+	return userIDs, nil
+}
+
+// finishCall marks the active participants of a call as left and the call as ended
+func (s *CallService) finishCall(ctx context.Context, callID uuid.UUID, participants []model.CallParticipant, at time.Time) error {
+	for _, p := range participants {
+		if p.Status != model.CallParticipantStatusActive {
+			continue
+		}
+		if err := s.repo.UpdateParticipantStatus(ctx, callID, p.UserID, string(model.CallParticipantStatusLeft)); err != nil {
+			return fmt.Errorf("failed to update participant %s status: %w", p.UserID, err)
+		}
+		if err := s.repo.UpdateParticipantLeftAt(ctx, callID, p.UserID, &at); err != nil {
+			return fmt.Errorf("failed to update participant %s left_at: %w", p.UserID, err)
+		}
+	}
+
+	if err := s.repo.UpdateStatus(ctx, callID, string(model.CallStatusEnded)); err != nil {
+		return fmt.Errorf("failed to update call status: %w", err)
+	}
+	if err := s.repo.UpdateEndedAt(ctx, callID, &at); err != nil {
+		return fmt.Errorf("failed to update ended_at: %w", err)
+	}
+	return nil
+}
+
+// summarize writes the timeline entries of a call that are settled: declined and
+// missed invites while the call goes on, and an entry for every invitee once it has
+// ended. Entries go into the direct chat of the caller and the invitee; ones already
+// written are skipped, so it is safe to call after every change. Failures are logged
+// and do not fail the call operation.
+func (s *CallService) summarize(ctx context.Context, callID uuid.UUID) {
+	if s.timeline == nil {
+		return
+	}
+
+	call, err := s.repo.GetByID(ctx, callID)
+	if err != nil || call == nil {
+		log.Printf("call timeline: failed to get call %s: %v", callID, err)
+		return
+	}
+	participants, err := s.repo.GetParticipantsByCallID(ctx, callID)
+	if err != nil {
+		log.Printf("call timeline: failed to get participants of call %s: %v", callID, err)
+		return
+	}
+
+	ended := call.Status == model.CallStatusEnded
+	for _, p := range participants {
+		if p.UserID == call.InitiatorID {
+			continue
+		}
+
+		var kind model.MessageKind
+		var text string
+		switch {
+		case p.Status == model.CallParticipantStatusRejected:
+			kind, text = model.MessageKindCall, "Call declined"
+		case p.Status == model.CallParticipantStatusMissed,
+			ended && p.Status == model.CallParticipantStatusInvited:
+			kind, text = model.MessageKindMissedCall, "Missed "+string(call.CallType)+" call"
+		case ended && p.JoinedAt != nil:
+			kind, text = model.MessageKindCall, callSummary(call)
+		default:
+			continue
+		}
+
+		entry, err := s.timeline.RecordCall(ctx, callID, call.InitiatorID, p.UserID, kind, text)
+		if err != nil {
+			log.Printf("call timeline: failed to record call %s for %s: %v", callID, p.UserID, err)
+			continue
+		}
+		if entry != nil && s.onEntry != nil {
+			s.onEntry(entry)
+		}
+	}
 }
 
-func (s *CallService) GetCallHistory(ctx context.Context, userID uuid.UUID, limit, offset int) ([]model.CallHistoryItem, error) {
-	return s.repo.GetCallHistory(ctx, userID, limit, offset)
+// callSummary describes a call that took place, such as "Video call, 12:34"
+func callSummary(call *model.Call) string {
+	text := "Call"
+	if kind := string(call.CallType); kind != "" {
+		text = strings.ToUpper(kind[:1]) + kind[1:] + " call"
+	}
+	if call.StartedAt == nil || call.EndedAt == nil {
+		return text
+	}
+
+	seconds := int(call.EndedAt.Sub(*call.StartedAt).Round(time.Second) / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	if seconds >= 3600 {
+		return fmt.Sprintf("%s, %d:%02d:%02d", text, seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%s, %d:%02d", text, seconds/60, seconds%60)
+}
+
+// GetCallHistory returns a keyset page of the user's calls, newest first, and
+// the cursor of the next page ("" when there is none)
+func (s *CallService) GetCallHistory(ctx context.Context, userID uuid.UUID, page model.PageRequest) ([]model.CallHistoryItem, string, error) {
+	page, limit := withLookahead(page)
+	history, err := s.repo.GetCallHistoryPage(ctx, userID, page)
+	if err != nil {
+		return nil, "", err
+	}
+	history, next := trimPage(history, limit, page, func(item model.CallHistoryItem) model.Cursor {
+		return model.Cursor{CreatedAt: item.CallCreatedAt, ID: item.CallID}
+	})
+	return history, next, nil
 }
 
 func (s *CallService) UpdateParticipantMediaSettings(ctx context.Context, callID, userID uuid.UUID, audioEnabled, videoEnabled bool) error {
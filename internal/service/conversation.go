@@ -0,0 +1,357 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/model"
+	"messenger/internal/storage"
+)
+
+// ErrNotConversationMember is returned when a user acts on a conversation they do not belong to
+var ErrNotConversationMember = errors.New("not a member of this conversation")
+
+// ErrConversationNotFound is returned for a conversation that does not exist
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// ErrInsufficientRole is returned when a member's role does not allow the requested change
+var ErrInsufficientRole = errors.New("insufficient conversation role")
+
+const maxGroupTitleLength = 100
+
+type ConversationService struct {
+	repo     storage.ConversationRepository
+	userRepo storage.UserRepository
+	txm      storage.TransactionManager
+}
+
+func NewConversationService(repo storage.ConversationRepository, userRepo storage.UserRepository, txm storage.TransactionManager) *ConversationService {
+	return &ConversationService{
+		repo:     repo,
+		userRepo: userRepo,
+		txm:      txm,
+	}
+}
+
+func (s *ConversationService) available() bool {
+	return s.repo != nil && s.userRepo != nil && s.txm != nil
+}
+
+// CreateGroup creates a group conversation owned by creatorID with the given members
+func (s *ConversationService) CreateGroup(ctx context.Context, creatorID uuid.UUID, title string, memberIDs []uuid.UUID) (*model.ConversationInfo, error) {
+	if !s.available() {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return nil, fmt.Errorf("%w: group title is required", ErrInvalidInput)
+	}
+	if len(title) > maxGroupTitleLength {
+		return nil, fmt.Errorf("%w: group title must be at most %d characters", ErrInvalidInput, maxGroupTitleLength)
+	}
+
+	// Deduplicate member IDs and exclude creator
+	seen := make(map[uuid.UUID]bool)
+	uniqueMembers := make([]uuid.UUID, 0, len(memberIDs))
+	for _, id := range memberIDs {
+		if id == creatorID || seen[id] {
+			continue
+		}
+		seen[id] = true
+		uniqueMembers = append(uniqueMembers, id)
+	}
+
+	if len(uniqueMembers) > 0 {
+		users, err := s.userRepo.GetByIDs(ctx, uniqueMembers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup members: %w", err)
+		}
+		if len(users) != len(uniqueMembers) {
+			return nil, fmt.Errorf("%w: one or more members do not exist", ErrInvalidInput)
+		}
+	}
+
+	now := time.Now()
+	conv := &model.Conversation{
+		ID:        uuid.New(),
+		Type:      model.ConversationTypeGroup,
+		Title:     title,
+		CreatedBy: &creatorID,
+		CreatedAt: now,
+	}
+
+	members := make([]model.ConversationMember, 0, len(uniqueMembers)+1)
+	members = append(members, model.ConversationMember{
+		ConversationID: conv.ID,
+		UserID:         creatorID,
+		Role:           model.ConversationRoleOwner,
+		JoinedAt:       now,
+		LastReadAt:     &now,
+	})
+	for _, id := range uniqueMembers {
+		members = append(members, model.ConversationMember{
+			ConversationID: conv.ID,
+			UserID:         id,
+			Role:           model.ConversationRoleMember,
+			JoinedAt:       now,
+			LastReadAt:     &now,
+		})
+	}
+
+	err := s.txm.WithTx(ctx, func(txCtx context.Context) error {
+		if err := s.repo.Create(txCtx, conv); err != nil {
+			return fmt.Errorf("failed to create conversation: %w", err)
+		}
+		for i := range members {
+			if err := s.addMember(txCtx, &members[i]); err != nil {
+				return fmt.Errorf("failed to add member %s: %w", members[i].UserID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.ConversationInfo{Conversation: *conv, Members: members}, nil
+}
+
+// GetConversation returns a conversation with its members if userID belongs to it
+func (s *ConversationService) GetConversation(ctx context.Context, conversationID, userID uuid.UUID) (*model.ConversationInfo, error) {
+	if !s.available() {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	conv, err := s.repo.GetByID(ctx, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation: %w", err)
+	}
+	if conv == nil {
+		return nil, ErrConversationNotFound
+	}
+
+	members, err := s.repo.GetMembers(ctx, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members: %w", err)
+	}
+
+	isMember := false
+	for _, m := range members {
+		if m.UserID == userID {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		return nil, ErrNotConversationMember
+	}
+
+	return &model.ConversationInfo{Conversation: *conv, Members: members}, nil
+}
+
+// GetMemberIDs returns the user IDs of all members, used for real-time fan-out
+func (s *ConversationService) GetMemberIDs(ctx context.Context, conversationID uuid.UUID) ([]uuid.UUID, error) {
+	if !s.available() {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	return s.repo.GetMemberIDs(ctx, conversationID)
+}
+
+// AddMember adds userID to a group. Owners and admins may add members; only the owner may add admins.
+func (s *ConversationService) AddMember(ctx context.Context, conversationID, actorID, userID uuid.UUID, role model.ConversationRole) (*model.ConversationMember, error) {
+	if !s.available() {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	if role == "" {
+		role = model.ConversationRoleMember
+	}
+	if role != model.ConversationRoleMember && role != model.ConversationRoleAdmin {
+		return nil, fmt.Errorf("%w: invalid role %s", ErrInvalidInput, role)
+	}
+
+	if _, err := s.getGroup(ctx, conversationID); err != nil {
+		return nil, err
+	}
+
+	actor, err := s.requireMember(ctx, conversationID, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if actor.Role == model.ConversationRoleMember {
+		return nil, ErrInsufficientRole
+	}
+	if role == model.ConversationRoleAdmin && actor.Role != model.ConversationRoleOwner {
+		return nil, ErrInsufficientRole
+	}
+
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	existing, err := s.repo.GetMember(ctx, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("%w: user is already a member", ErrInvalidInput)
+	}
+
+	now := time.Now()
+	member := &model.ConversationMember{
+		ConversationID: conversationID,
+		UserID:         userID,
+		Role:           role,
+		JoinedAt:       now,
+		LastReadAt:     &now,
+	}
+	if err := s.addMember(ctx, member); err != nil {
+		return nil, fmt.Errorf("failed to add member: %w", err)
+	}
+	return member, nil
+}
+
+// addMember stores a new member whose read watermark starts at the newest message, so
+// the history from before they joined does not count as unread
+func (s *ConversationService) addMember(ctx context.Context, member *model.ConversationMember) error {
+	newest, err := s.repo.GetNewestMessage(ctx, member.ConversationID)
+	if err != nil {
+		return err
+	}
+	if newest != nil {
+		member.LastReadMessageID = &newest.ID
+		member.LastReadMessageAt = &newest.CreatedAt
+	}
+	return s.repo.AddMember(ctx, member)
+}
+
+// RemoveMember removes userID from a group. Any member may leave; admins may remove
+// plain members and the owner may remove anyone. The owner must hand over ownership before leaving.
+func (s *ConversationService) RemoveMember(ctx context.Context, conversationID, actorID, userID uuid.UUID) error {
+	if !s.available() {
+		return fmt.Errorf("database unavailable")
+	}
+
+	if _, err := s.getGroup(ctx, conversationID); err != nil {
+		return err
+	}
+
+	actor, err := s.requireMember(ctx, conversationID, actorID)
+	if err != nil {
+		return err
+	}
+
+	target, err := s.repo.GetMember(ctx, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return fmt.Errorf("%w: user is not a member", ErrInvalidInput)
+	}
+
+	if target.Role == model.ConversationRoleOwner {
+		return fmt.Errorf("%w: owner must transfer ownership before leaving", ErrInvalidInput)
+	}
+
+	if actorID != userID {
+		switch actor.Role {
+		case model.ConversationRoleOwner:
+		case model.ConversationRoleAdmin:
+			if target.Role != model.ConversationRoleMember {
+				return ErrInsufficientRole
+			}
+		default:
+			return ErrInsufficientRole
+		}
+	}
+
+	return s.repo.RemoveMember(ctx, conversationID, userID)
+}
+
+// UpdateMemberRole changes a member's role. Only the owner may change roles;
+// granting the owner role transfers ownership and demotes the previous owner to admin.
+func (s *ConversationService) UpdateMemberRole(ctx context.Context, conversationID, actorID, userID uuid.UUID, role model.ConversationRole) error {
+	if !s.available() {
+		return fmt.Errorf("database unavailable")
+	}
+	if role != model.ConversationRoleOwner && role != model.ConversationRoleAdmin && role != model.ConversationRoleMember {
+		return fmt.Errorf("%w: invalid role %s", ErrInvalidInput, role)
+	}
+
+	if _, err := s.getGroup(ctx, conversationID); err != nil {
+		return err
+	}
+
+	actor, err := s.requireMember(ctx, conversationID, actorID)
+	if err != nil {
+		return err
+	}
+	if actor.Role != model.ConversationRoleOwner {
+		return ErrInsufficientRole
+	}
+	if actorID == userID {
+		return fmt.Errorf("%w: cannot change your own role", ErrInvalidInput)
+	}
+
+	target, err := s.repo.GetMember(ctx, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return fmt.Errorf("%w: user is not a member", ErrInvalidInput)
+	}
+
+	return s.txm.WithTx(ctx, func(txCtx context.Context) error {
+		if role == model.ConversationRoleOwner {
+			if err := s.repo.UpdateMemberRole(txCtx, conversationID, actorID, string(model.ConversationRoleAdmin)); err != nil {
+				return fmt.Errorf("failed to demote previous owner: %w", err)
+			}
+		}
+		if err := s.repo.UpdateMemberRole(txCtx, conversationID, userID, string(role)); err != nil {
+			return fmt.Errorf("failed to update role: %w", err)
+		}
+		return nil
+	})
+}
+
+// RequireMember returns ErrNotConversationMember unless userID belongs to the conversation
+func (s *ConversationService) RequireMember(ctx context.Context, conversationID, userID uuid.UUID) error {
+	if !s.available() {
+		return fmt.Errorf("database unavailable")
+	}
+	_, err := s.requireMember(ctx, conversationID, userID)
+	return err
+}
+
+func (s *ConversationService) requireMember(ctx context.Context, conversationID, userID uuid.UUID) (*model.ConversationMember, error) {
+	member, err := s.repo.GetMember(ctx, conversationID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get member: %w", err)
+	}
+	if member == nil {
+		return nil, ErrNotConversationMember
+	}
+	return member, nil
+}
+
+func (s *ConversationService) getGroup(ctx context.Context, conversationID uuid.UUID) (*model.Conversation, error) {
+	conv, err := s.repo.GetByID(ctx, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation: %w", err)
+	}
+	if conv == nil {
+		return nil, ErrConversationNotFound
+	}
+	if conv.Type != model.ConversationTypeGroup {
+		return nil, fmt.Errorf("%w: membership of direct conversations cannot be changed", ErrInvalidInput)
+	}
+	return conv, nil
+}
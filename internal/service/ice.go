@@ -0,0 +1,127 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultICEServers are public STUN servers, used when ICE_SERVERS is not set or invalid
+var defaultICEServers = []ICEServer{
+	{URLs: json.RawMessage(`"stun:stun.l.google.com:19302"`)},
+	{URLs: json.RawMessage(`"stun:stun1.l.google.com:19302"`)},
+}
+
+// ICEServer is one entry of an RTCPeerConnection iceServers list
+type ICEServer struct {
+	// URLs is a URL string or an array of them, passed on as configured
+	URLs       json.RawMessage `json:"urls"`
+	Username   string          `json:"username,omitempty"`
+	Credential string          `json:"credential,omitempty"`
+}
+
+// ICEService hands out the ICE servers for calls. With a TURN shared secret it mints
+// short-lived credentials for each user under the TURN REST API scheme, which TURN
+// servers such as coturn check with use-auth-secret, so no long-lived password ever
+// reaches a client.
+type ICEService struct {
+	servers []ICEServer
+	secret  string
+	ttl     time.Duration
+}
+
+// NewICEService parses servers, a JSON array in the RTCIceServer format. TURN
+// servers get credentials minted from secret, valid for ttl, unless secret is empty.
+func NewICEService(servers, secret string, ttl time.Duration) *ICEService {
+	s := &ICEService{servers: defaultICEServers, secret: secret, ttl: ttl}
+	if s.ttl <= 0 {
+		s.ttl = 12 * time.Hour
+	}
+	if servers == "" {
+		return s
+	}
+
+	var parsed []ICEServer
+	if err := json.Unmarshal([]byte(servers), &parsed); err != nil {
+		log.Printf("invalid ICE_SERVERS config, using defaults: %v", err)
+		return s
+	}
+	s.servers = parsed
+
+	for _, server := range parsed {
+		if server.isTURN() && server.Credential != "" {
+			if secret != "" {
+				log.Printf("TURN_SECRET is set: ignoring the static credentials of %s", server.URLs)
+			} else {
+				log.Printf("warning: %s uses static TURN credentials shared by all users; set TURN_SECRET instead", server.URLs)
+			}
+		}
+	}
+	return s
+}
+
+// Advertise adds a STUN and TURN server reachable at host:port over UDP and TCP,
+// such as the embedded relay. Its credentials are minted like those of other TURN
+// servers, so the service needs a secret.
+func (s *ICEService) Advertise(host string, port int) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	stun, _ := json.Marshal("stun:" + addr)
+	turn, _ := json.Marshal([]string{"turn:" + addr + "?transport=udp", "turn:" + addr + "?transport=tcp"})
+	s.servers = append([]ICEServer{{URLs: stun}, {URLs: turn}}, s.servers...)
+}
+
+// Servers returns the ICE servers for userID and how long their credentials are valid,
+// which is zero if no credentials were minted
+func (s *ICEService) Servers(userID uuid.UUID, now time.Time) ([]ICEServer, time.Duration) {
+	servers := make([]ICEServer, 0, len(s.servers))
+	var ttl time.Duration
+	for _, server := range s.servers {
+		if !server.isTURN() {
+			// STUN needs no credentials
+			servers = append(servers, ICEServer{URLs: server.URLs})
+			continue
+		}
+		if s.secret != "" {
+			server.Username, server.Credential = s.credentials(userID, now.Add(s.ttl))
+			ttl = s.ttl
+		}
+		servers = append(servers, server)
+	}
+	return servers, ttl
+}
+
+// credentials mints TURN REST API credentials: the username is the expiry as a Unix
+// timestamp and the user ID, the credential is the base64 HMAC-SHA1 of the username
+// keyed with the shared secret
+func (s *ICEService) credentials(userID uuid.UUID, expiresAt time.Time) (username, credential string) {
+	username = fmt.Sprintf("%d:%s", expiresAt.Unix(), userID)
+	mac := hmac.New(sha1.New, []byte(s.secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isTURN reports whether any URL of the server is a turn: or turns: URL
+func (server ICEServer) isTURN() bool {
+	var urls []string
+	var single string
+	if err := json.Unmarshal(server.URLs, &single); err == nil {
+		urls = []string{single}
+	} else if err := json.Unmarshal(server.URLs, &urls); err != nil {
+		return false
+	}
+	for _, url := range urls {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/model"
+	"messenger/internal/storage"
+)
+
+const (
+	// curve25519KeySize is the size of an X25519 public key
+	curve25519KeySize = 32
+	// MaxPrekeyUpload caps how many one-time prekeys one request may upload
+	MaxPrekeyUpload = 100
+	// MaxDevicesPerUser caps how many devices a user may register
+	MaxDevicesPerUser = 10
+)
+
+var (
+	ErrDeviceNotFound = errors.New("device not found")
+	// ErrDeviceTaken is returned when a device ID is already registered by another user
+	ErrDeviceTaken    = errors.New("device belongs to another user")
+	ErrTooManyDevices = errors.New("too many devices")
+	ErrInvalidKey     = errors.New("invalid key")
+)
+
+// DeviceKeys is a device of the current user together with how many one-time prekeys
+// it has left, so clients know when to upload more
+type DeviceKeys struct {
+	model.Device
+	PrekeyCount int `json:"prekey_count"`
+}
+
+// KeyService is the public key directory for end-to-end encryption. It only stores
+// and hands out public keys; it never sees private keys or decrypts anything.
+type KeyService struct {
+	repo      storage.KeyRepository
+	userRepo  storage.UserRepository
+	txManager storage.TransactionManager
+}
+
+func NewKeyService(repo storage.KeyRepository, userRepo storage.UserRepository, txManager storage.TransactionManager) *KeyService {
+	return &KeyService{repo: repo, userRepo: userRepo, txManager: txManager}
+}
+
+// RegisterDevice creates a device of userID or replaces its keys. The signed prekey
+// must carry a valid Ed25519 signature by the identity key. A new identity key
+// invalidates the one-time prekeys uploaded for the old one.
+func (s *KeyService) RegisterDevice(ctx context.Context, userID, deviceID uuid.UUID, identityKey []byte, signedPrekeyID int, signedPrekey, signature []byte) (*model.Device, error) {
+	if s.repo == nil || s.txManager == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	if len(identityKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: identity key must be %d bytes", ErrInvalidKey, ed25519.PublicKeySize)
+	}
+	if len(signedPrekey) != curve25519KeySize {
+		return nil, fmt.Errorf("%w: signed prekey must be %d bytes", ErrInvalidKey, curve25519KeySize)
+	}
+	if signedPrekeyID < 0 {
+		return nil, fmt.Errorf("%w: negative prekey id", ErrInvalidKey)
+	}
+	if len(signature) != ed25519.SignatureSize || !ed25519.Verify(identityKey, signedPrekey, signature) {
+		return nil, fmt.Errorf("%w: bad signed prekey signature", ErrInvalidKey)
+	}
+
+	now := time.Now()
+	device := &model.Device{
+		ID:                    deviceID,
+		UserID:                userID,
+		IdentityKey:           identityKey,
+		SignedPrekeyID:        signedPrekeyID,
+		SignedPrekey:          signedPrekey,
+		SignedPrekeySignature: signature,
+		CreatedAt:             now,
+		UpdatedAt:             now,
+	}
+	err := s.txManager.WithTx(ctx, func(ctx context.Context) error {
+		existing, err := s.repo.GetDevice(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.UserID != userID {
+			return ErrDeviceTaken
+		}
+		if existing == nil {
+			devices, err := s.repo.GetDevicesByUserID(ctx, userID)
+			if err != nil {
+				return err
+			}
+			if len(devices) >= MaxDevicesPerUser {
+				return ErrTooManyDevices
+			}
+		} else if !bytes.Equal(existing.IdentityKey, identityKey) {
+			if err := s.repo.DeletePrekeys(ctx, deviceID); err != nil {
+				return err
+			}
+		}
+		return s.repo.SaveDevice(ctx, device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// AddPrekeys uploads one-time prekeys for a device of userID. Key IDs the device
+// already has are skipped. It returns how many prekeys the device now has.
+func (s *KeyService) AddPrekeys(ctx context.Context, userID, deviceID uuid.UUID, prekeys []model.OneTimePrekey) (int, error) {
+	if s.repo == nil {
+		return 0, fmt.Errorf("database unavailable")
+	}
+	if len(prekeys) == 0 || len(prekeys) > MaxPrekeyUpload {
+		return 0, fmt.Errorf("%w: upload between 1 and %d prekeys", ErrInvalidKey, MaxPrekeyUpload)
+	}
+	for _, prekey := range prekeys {
+		if prekey.KeyID < 0 || len(prekey.PublicKey) != curve25519KeySize {
+			return 0, fmt.Errorf("%w: prekey %d", ErrInvalidKey, prekey.KeyID)
+		}
+	}
+	if _, err := s.ownDevice(ctx, userID, deviceID); err != nil {
+		return 0, err
+	}
+
+	if _, err := s.repo.AddPrekeys(ctx, deviceID, prekeys); err != nil {
+		return 0, err
+	}
+	return s.repo.CountPrekeys(ctx, deviceID)
+}
+
+// ListDevices returns the devices of userID with their remaining prekey counts
+func (s *KeyService) ListDevices(ctx context.Context, userID uuid.UUID) ([]DeviceKeys, error) {
+	if s.repo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	devices, err := s.repo.GetDevicesByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DeviceKeys, 0, len(devices))
+	for _, device := range devices {
+		count, err := s.repo.CountPrekeys(ctx, device.ID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, DeviceKeys{Device: device, PrekeyCount: count})
+	}
+	return result, nil
+}
+
+// DeleteDevice removes a device of userID and its prekeys
+func (s *KeyService) DeleteDevice(ctx context.Context, userID, deviceID uuid.UUID) error {
+	if s.repo == nil {
+		return fmt.Errorf("database unavailable")
+	}
+	if _, err := s.ownDevice(ctx, userID, deviceID); err != nil {
+		return err
+	}
+	return s.repo.DeleteDevice(ctx, deviceID)
+}
+
+// GetBundles returns a prekey bundle for every device of userID. Each bundle consumes
+// one one-time prekey of its device if any are left.
+func (s *KeyService) GetBundles(ctx context.Context, userID uuid.UUID) ([]model.PrekeyBundle, error) {
+	if s.repo == nil || s.userRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	devices, err := s.repo.GetDevicesByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	bundles := make([]model.PrekeyBundle, 0, len(devices))
+	for _, device := range devices {
+		prekey, err := s.repo.ClaimPrekey(ctx, device.ID)
+		if err != nil {
+			return nil, err
+		}
+		bundles = append(bundles, model.PrekeyBundle{
+			UserID:                device.UserID,
+			DeviceID:              device.ID,
+			IdentityKey:           device.IdentityKey,
+			SignedPrekeyID:        device.SignedPrekeyID,
+			SignedPrekey:          device.SignedPrekey,
+			SignedPrekeySignature: device.SignedPrekeySignature,
+			OneTimePrekey:         prekey,
+		})
+	}
+	return bundles, nil
+}
+
+// ownDevice loads a device and checks that it belongs to userID
+func (s *KeyService) ownDevice(ctx context.Context, userID, deviceID uuid.UUID) (*model.Device, error) {
+	device, err := s.repo.GetDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil || device.UserID != userID {
+		return nil, ErrDeviceNotFound
+	}
+	return device, nil
+}
@@ -2,7 +2,9 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,52 +13,277 @@ import (
 	"messenger/internal/storage"
 )
 
+// MaxClientMsgIDLength caps the length of a client-generated message ID
+const MaxClientMsgIDLength = 64
+
+var (
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotMessageSender = errors.New("only the sender can change this message")
+	ErrMessageDeleted   = errors.New("message was deleted")
+	ErrReceiverNotFound = errors.New("receiver not found")
+	// ErrCallEntry is returned for changes to call entries, which only the server writes
+	ErrCallEntry = errors.New("call entries cannot be edited or deleted")
+)
+
 type MessageService struct {
-	repo      storage.MessageRepository
-	userRepo  storage.UserRepository
-	encryptor *crypto.Encryptor
+	repo        storage.MessageRepository
+	userRepo    storage.UserRepository
+	convRepo    storage.ConversationRepository
+	attachments *AttachmentService
+	txm         storage.TransactionManager
+	encryptor   *crypto.Encryptor
 }
 
-func NewMessageService(repo storage.MessageRepository, userRepo storage.UserRepository, encryptor *crypto.Encryptor) *MessageService {
+func NewMessageService(repo storage.MessageRepository, userRepo storage.UserRepository, convRepo storage.ConversationRepository, attachments *AttachmentService, txm storage.TransactionManager, encryptor *crypto.Encryptor) *MessageService {
 	return &MessageService{
-		repo:      repo,
-		userRepo:  userRepo,
-		encryptor: encryptor,
+		repo:        repo,
+		userRepo:    userRepo,
+		convRepo:    convRepo,
+		attachments: attachments,
+		txm:         txm,
+		encryptor:   encryptor,
 	}
 }
 
-func (s *MessageService) Send(ctx context.Context, senderID, receiverID uuid.UUID, payload []byte) (*model.Message, error) {
-	if s.userRepo == nil || s.repo == nil {
-		return nil, fmt.Errorf("database unavailable")
+// Send stores a 1:1 message, creating the direct conversation for the pair on first use.
+// attachmentIDs reference uploads of the sender to that conversation and may be empty.
+// An e2e payload was encrypted by the sender's client and is stored as it is.
+// clientMsgID, if not empty, makes the send idempotent: when the sender already sent
+// a message with that ID, that message is returned with false instead of a new one.
+func (s *MessageService) Send(ctx context.Context, senderID, receiverID uuid.UUID, payload []byte, attachmentIDs []uuid.UUID, e2e bool, clientMsgID string) (*model.Message, bool, error) {
+	if s.userRepo == nil || s.repo == nil || s.convRepo == nil {
+		return nil, false, fmt.Errorf("database unavailable")
+	}
+
+	if msg, err := s.alreadySent(ctx, senderID, clientMsgID); msg != nil || err != nil {
+		return msg, false, err
 	}
 
 	receiver, err := s.userRepo.GetByID(ctx, receiverID)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if receiver == nil {
-		return nil, fmt.Errorf("receiver not found")
+		return nil, false, ErrReceiverNotFound
 	}
 
-	// Encrypt payload before saving
-	encryptedPayload, err := s.encryptor.Encrypt(payload)
+	conv, err := s.convRepo.GetOrCreateDirect(ctx, senderID, receiverID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get conversation: %w", err)
+	}
+
+	return s.store(ctx, conv.ID, senderID, receiverID, payload, attachmentIDs, e2e, clientMsgID)
+}
+
+// SendToConversation stores a message in any conversation the sender belongs to.
+// clientMsgID works as for Send.
+func (s *MessageService) SendToConversation(ctx context.Context, senderID, conversationID uuid.UUID, payload []byte, attachmentIDs []uuid.UUID, e2e bool, clientMsgID string) (*model.Message, bool, error) {
+	if s.repo == nil || s.convRepo == nil {
+		return nil, false, fmt.Errorf("database unavailable")
+	}
+
+	if msg, err := s.alreadySent(ctx, senderID, clientMsgID); msg != nil || err != nil {
+		return msg, false, err
+	}
+
+	conv, err := s.convRepo.GetByID(ctx, conversationID)
+	if err != nil {
+		return nil, false, err
+	}
+	if conv == nil {
+		return nil, false, ErrConversationNotFound
+	}
+
+	memberIDs, err := s.convRepo.GetMemberIDs(ctx, conversationID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	isMember := false
+	receiverID := uuid.Nil
+	for _, id := range memberIDs {
+		if id == senderID {
+			isMember = true
+		} else if conv.Type == model.ConversationTypeDirect {
+			receiverID = id
+		}
+	}
+	if !isMember {
+		return nil, false, ErrNotConversationMember
+	}
+	if conv.Type == model.ConversationTypeDirect && receiverID == uuid.Nil {
+		receiverID = senderID
+	}
+
+	return s.store(ctx, conversationID, senderID, receiverID, payload, attachmentIDs, e2e, clientMsgID)
+}
+
+// alreadySent validates a client-generated message ID and returns the message the
+// sender already sent with it, decrypted, or nil
+func (s *MessageService) alreadySent(ctx context.Context, senderID uuid.UUID, clientMsgID string) (*model.Message, error) {
+	if clientMsgID == "" {
+		return nil, nil
+	}
+	if len(clientMsgID) > MaxClientMsgIDLength {
+		return nil, fmt.Errorf("%w: client_msg_id longer than %d characters", ErrInvalidInput, MaxClientMsgIDLength)
+	}
+
+	msg, err := s.repo.GetByClientMsgID(ctx, senderID, clientMsgID)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	openMessage(s.encryptor, msg)
+	if err := s.attachments.fill(ctx, []*model.Message{msg}); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// payloadAD is the additional data an encrypted payload is bound to, so a payload
+// copied to another message row no longer decrypts
+func payloadAD(msg *model.Message) []byte {
+	ad := make([]byte, 0, 3*len(msg.ID))
+	ad = append(ad, msg.ID[:]...)
+	ad = append(ad, msg.SenderID[:]...)
+	return append(ad, msg.ReceiverID[:]...)
+}
+
+// sealPayload encrypts a payload of msg for storage. End-to-end encrypted payloads
+// are opaque to the server and stored as they are.
+func sealPayload(encryptor *crypto.Encryptor, msg *model.Message, payload []byte) ([]byte, error) {
+	if msg.E2E {
+		return payload, nil
+	}
+	encrypted, err := encryptor.Encrypt(payload, payloadAD(msg))
 	if err != nil {
 		return nil, fmt.Errorf("failed to encrypt message: %w", err)
 	}
+	return []byte(encrypted), nil
+}
+
+// openPayload decrypts a stored payload of msg, or a previous version of it;
+// end-to-end encrypted payloads are returned as they are
+func openPayload(encryptor *crypto.Encryptor, msg *model.Message, payload []byte) ([]byte, error) {
+	if msg.E2E {
+		return payload, nil
+	}
+	return encryptor.Decrypt(string(payload), payloadAD(msg))
+}
+
+// openMessage decrypts the payload of msg in place. A payload no key opens is not
+// passed on as ciphertext: it is emptied and the message marked undecryptable.
+func openMessage(encryptor *crypto.Encryptor, msg *model.Message) {
+	if msg.DeletedAt != nil {
+		return
+	}
+	decrypted, err := openPayload(encryptor, msg, msg.Payload)
+	if err != nil {
+		log.Printf("failed to decrypt message %s: %v", msg.ID, err)
+		msg.Payload = nil
+		msg.Undecryptable = true
+		return
+	}
+	msg.Payload = decrypted
+}
+
+func (s *MessageService) store(ctx context.Context, conversationID, senderID, receiverID uuid.UUID, payload []byte, attachmentIDs []uuid.UUID, e2e bool, clientMsgID string) (*model.Message, bool, error) {
+	if len(attachmentIDs) > 0 {
+		ids, err := s.attachments.check(ctx, attachmentIDs, senderID, conversationID)
+		if err != nil {
+			return nil, false, err
+		}
+		attachmentIDs = ids
+	}
 
 	msg := &model.Message{
-		ID:         uuid.New(),
-		SenderID:   senderID,
-		ReceiverID: receiverID,
-		Payload:    []byte(encryptedPayload),
-		CreatedAt:  time.Now(),
+		ID:             uuid.New(),
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		ReceiverID:     receiverID,
+		CreatedAt:      time.Now(),
+		E2E:            e2e,
+		ClientMsgID:    clientMsgID,
+	}
+
+	// Encrypt payload before saving
+	encryptedPayload, err := sealPayload(s.encryptor, msg, payload)
+	if err != nil {
+		return nil, false, err
+	}
+	msg.Payload = encryptedPayload
+
+	create := func(ctx context.Context) error {
+		if err := s.repo.Create(ctx, msg); err != nil {
+			return err
+		}
+		if len(attachmentIDs) == 0 {
+			return nil
+		}
+		attachments, err := s.attachments.attach(ctx, attachmentIDs, msg.ID)
+		if err != nil {
+			return err
+		}
+		msg.Attachments = attachments
+		return nil
+	}
+
+	// The message and its attachment links are stored atomically
+	if len(attachmentIDs) > 0 && s.txm != nil {
+		err = s.txm.WithTx(ctx, create)
+	} else {
+		err = create(ctx)
+	}
+	if err != nil {
+		// A concurrent resend may have stored the message first
+		if sent, lookupErr := s.alreadySent(ctx, senderID, clientMsgID); sent != nil && lookupErr == nil {
+			return sent, false, nil
+		}
+		return nil, false, err
+	}
+
+	// Return decrypted payload for the response
+	msg.Payload = payload
+	return msg, true, nil
+}
+
+// RecordCall writes a call entry from the caller into their direct chat with userID.
+// Each call has at most one entry per invitee; if it already exists, RecordCall
+// returns nil.
+func (s *MessageService) RecordCall(ctx context.Context, callID, callerID, userID uuid.UUID, kind model.MessageKind, text string) (*model.Message, error) {
+	if s.repo == nil || s.convRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
 	}
 
+	if existing, err := s.repo.GetCallEntry(ctx, callID, userID); existing != nil || err != nil {
+		return nil, err
+	}
+
+	conv, err := s.convRepo.GetOrCreateDirect(ctx, callerID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation: %w", err)
+	}
+
+	msg := &model.Message{
+		ID:             uuid.New(),
+		ConversationID: conv.ID,
+		SenderID:       callerID,
+		ReceiverID:     userID,
+		CreatedAt:      time.Now(),
+		Kind:           kind,
+		CallID:         &callID,
+	}
+	payload := []byte(text)
+	if msg.Payload, err = sealPayload(s.encryptor, msg, payload); err != nil {
+		return nil, err
+	}
 	if err := s.repo.Create(ctx, msg); err != nil {
+		// Another instance may have written the entry first
+		if existing, lookupErr := s.repo.GetCallEntry(ctx, callID, userID); existing != nil && lookupErr == nil {
+			return nil, nil
+		}
 		return nil, err
 	}
 
-	// Return decrypted payload for the response
 	msg.Payload = payload
 	return msg, nil
 }
@@ -80,58 +307,98 @@ func (s *MessageService) GetHistory(ctx context.Context, user1, user2 uuid.UUID,
 
 	// Decrypt messages
 	for i := range messages {
-		decrypted, err := s.encryptor.Decrypt(string(messages[i].Payload))
-		if err != nil {
-			continue
-		}
-		messages[i].Payload = decrypted
+		openMessage(s.encryptor, &messages[i])
 	}
 
 	return messages, nil
 }
 
-func (s *MessageService) GetHistoryWithReadStatus(ctx context.Context, currentUser, partnerID uuid.UUID, limit, offset int) ([]model.MessageWithRead, error) {
+// GetHistoryWithReadStatus returns a keyset page of the direct chat with partnerID,
+// newest first, and the cursor of the next page ("" when there is none)
+func (s *MessageService) GetHistoryWithReadStatus(ctx context.Context, currentUser, partnerID uuid.UUID, page model.PageRequest) ([]model.MessageWithRead, string, error) {
 	if s.repo == nil {
-		return nil, fmt.Errorf("database unavailable")
+		return nil, "", fmt.Errorf("database unavailable")
 	}
 
-	if limit <= 0 || limit > 100 {
-		limit = 50
+	page, limit := withLookahead(page)
+	messages, err := s.repo.GetByUserPairPage(ctx, currentUser, partnerID, page)
+	if err != nil {
+		return nil, "", err
 	}
-	if offset < 0 {
-		offset = 0
+	messages, next := trimPage(messages, limit, page, messageCursor)
+
+	// Decrypt messages
+	for i := range messages {
+		openMessage(s.encryptor, &messages[i].Message)
 	}
 
-	messages, err := s.repo.GetByUserPairWithReadStatus(ctx, currentUser, partnerID, limit, offset)
+	if err := s.fillAttachments(ctx, messages); err != nil {
+		return nil, "", err
+	}
+
+	return messages, next, nil
+}
+
+// GetConversationHistory returns a keyset page of a conversation the user belongs to,
+// newest first, and the cursor of the next page ("" when there is none)
+func (s *MessageService) GetConversationHistory(ctx context.Context, conversationID, userID uuid.UUID, page model.PageRequest) ([]model.MessageWithRead, string, error) {
+	if s.repo == nil || s.convRepo == nil {
+		return nil, "", fmt.Errorf("database unavailable")
+	}
+
+	member, err := s.convRepo.GetMember(ctx, conversationID, userID)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	if member == nil {
+		return nil, "", ErrNotConversationMember
 	}
 
+	page, limit := withLookahead(page)
+	messages, err := s.repo.GetByConversationPage(ctx, conversationID, userID, page)
+	if err != nil {
+		return nil, "", err
+	}
+	messages, next := trimPage(messages, limit, page, messageCursor)
+
 	// Decrypt messages
 	for i := range messages {
-		decrypted, err := s.encryptor.Decrypt(string(messages[i].Payload))
-		if err != nil {
-			continue
-		}
-		messages[i].Payload = decrypted
+		openMessage(s.encryptor, &messages[i].Message)
 	}
 
-	return messages, nil
+	if err := s.fillAttachments(ctx, messages); err != nil {
+		return nil, "", err
+	}
+
+	return messages, next, nil
 }
 
+// GetConversationPartners returns the users that share a conversation, direct or group,
+// with userID
 func (s *MessageService) GetConversationPartners(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
-	if s.repo == nil {
+	if s.convRepo == nil {
 		return nil, fmt.Errorf("database unavailable")
 	}
-	return s.repo.GetConversationPartners(ctx, userID)
+	return s.convRepo.GetContactIDs(ctx, userID)
 }
 
 type ChatWithUser struct {
-	UserID          string    `json:"user_id"`
-	Username        string    `json:"username"`
-	LastMessage     string    `json:"last_message"`
-	LastMessageTime time.Time `json:"last_message_time"`
-	UnreadCount     int       `json:"unread_count"`
+	ConversationID  string                 `json:"conversation_id"`
+	Type            model.ConversationType `json:"type"`
+	Title           string                 `json:"title,omitempty"`
+	UserID          string                 `json:"user_id,omitempty"`
+	Username        string                 `json:"username,omitempty"`
+	LastMessage     string                 `json:"last_message"`
+	LastMessageTime time.Time              `json:"last_message_time"`
+	// LastMessageEdited marks a preview whose message was edited after sending
+	LastMessageEdited bool `json:"last_message_edited,omitempty"`
+	// LastMessageE2E marks an end-to-end encrypted last message; LastMessage is empty then
+	LastMessageE2E bool `json:"last_message_e2e,omitempty"`
+	// LastMessageUndecryptable marks a last message no key opens; LastMessage is empty then
+	LastMessageUndecryptable bool `json:"last_message_undecryptable,omitempty"`
+	// LastMessageKind is set when the last message is a call entry
+	LastMessageKind model.MessageKind `json:"last_message_kind,omitempty"`
+	UnreadCount     int               `json:"unread_count"`
 }
 
 func (s *MessageService) GetChatList(ctx context.Context, userID uuid.UUID) ([]ChatWithUser, error) {
@@ -149,47 +416,178 @@ func (s *MessageService) GetChatList(ctx context.Context, userID uuid.UUID) ([]C
 		return nil, err
 	}
 
+	lastMessages := make([]*model.Message, 0, len(chats))
+	for _, chat := range chats {
+		if chat.LastMessage != nil {
+			lastMessages = append(lastMessages, chat.LastMessage)
+		}
+	}
+	if err := s.attachments.fill(ctx, lastMessages); err != nil {
+		return nil, err
+	}
+
 	result := []ChatWithUser{}
 	for _, chat := range chats {
-		user, err := s.userRepo.GetByID(ctx, chat.PartnerID)
-		if err != nil {
-			continue
+		item := ChatWithUser{
+			ConversationID: chat.ConversationID.String(),
+			Type:           chat.Type,
+			Title:          chat.Title,
+			UnreadCount:    unreadCounts[chat.ConversationID],
 		}
-		if user == nil {
-			continue
+
+		if chat.Type == model.ConversationTypeDirect {
+			user, err := s.userRepo.GetByID(ctx, chat.PartnerID)
+			if err != nil {
+				continue
+			}
+			if user == nil {
+				continue
+			}
+			item.UserID = user.ID.String()
+			item.Username = user.Username
 		}
 
 		// Decrypt and decode payload to string
-		lastMsgText := ""
 		if chat.LastMessage != nil {
-			decrypted, err := s.encryptor.Decrypt(string(chat.LastMessage.Payload))
-			if err == nil {
-				lastMsgText = string(decrypted)
+			openMessage(s.encryptor, chat.LastMessage)
+			if chat.LastMessage.E2E {
+				// Only the clients can read it; they render their own preview
+				item.LastMessageE2E = true
+			} else if chat.LastMessage.Undecryptable {
+				item.LastMessageUndecryptable = true
 			} else {
-				// Fallback for backward compatibility
-				lastMsgText = string(chat.LastMessage.Payload)
+				item.LastMessage = string(chat.LastMessage.Payload)
+			}
+			if item.LastMessage == "" && !item.LastMessageE2E && !item.LastMessageUndecryptable && len(chat.LastMessage.Attachments) > 0 {
+				item.LastMessage = "📎 " + chat.LastMessage.Attachments[0].FileName
+			}
+			item.LastMessageTime = chat.LastMessage.CreatedAt
+			item.LastMessageEdited = chat.LastMessage.EditedAt != nil
+			if chat.LastMessage.Kind != model.MessageKindText {
+				item.LastMessageKind = chat.LastMessage.Kind
 			}
 		}
 
-		unreadCount := unreadCounts[chat.PartnerID]
-
-		result = append(result, ChatWithUser{
-			UserID:          user.ID.String(),
-			Username:        user.Username,
-			LastMessage:     lastMsgText,
-			LastMessageTime: chat.LastMessage.CreatedAt,
-			UnreadCount:     unreadCount,
-		})
+		result = append(result, item)
 	}
 
 	return result, nil
 }
 
-func (s *MessageService) MarkChatAsRead(ctx context.Context, userID, partnerID uuid.UUID) error {
-	if s.repo == nil {
-		return fmt.Errorf("database unavailable")
+// MarkRead moves the read watermark of userID in the message's conversation up to
+// messageID. In groups every message it passes over also gets a per-message receipt.
+// It returns nil if the watermark already was at or after the message.
+func (s *MessageService) MarkRead(ctx context.Context, userID, messageID uuid.UUID) (*model.ReadReceipt, error) {
+	if s.repo == nil || s.convRepo == nil || s.txm == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	msg, err := s.visibleMessage(ctx, messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.markRead(ctx, userID, msg)
+}
+
+// MarkChatAsRead marks the direct chat with partnerID as read up to its newest message
+func (s *MessageService) MarkChatAsRead(ctx context.Context, userID, partnerID uuid.UUID) (*model.ReadReceipt, error) {
+	if s.repo == nil || s.convRepo == nil || s.txm == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	latest, err := s.repo.GetByUserPairPage(ctx, userID, partnerID, model.PageRequest{Limit: 1})
+	if err != nil || len(latest) == 0 {
+		return nil, err
+	}
+	return s.markRead(ctx, userID, &latest[0].Message)
+}
+
+// MarkConversationAsRead marks a conversation as read up to its newest message
+func (s *MessageService) MarkConversationAsRead(ctx context.Context, userID, conversationID uuid.UUID) (*model.ReadReceipt, error) {
+	if s.repo == nil || s.convRepo == nil || s.txm == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	latest, err := s.repo.GetByConversationPage(ctx, conversationID, userID, model.PageRequest{Limit: 1})
+	if err != nil || len(latest) == 0 {
+		return nil, err
+	}
+	return s.markRead(ctx, userID, &latest[0].Message)
+}
+
+func (s *MessageService) markRead(ctx context.Context, userID uuid.UUID, msg *model.Message) (*model.ReadReceipt, error) {
+	conv, err := s.convRepo.GetByID(ctx, msg.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conv == nil {
+		return nil, ErrConversationNotFound
+	}
+
+	upTo := model.Cursor{CreatedAt: msg.CreatedAt, ID: msg.ID}
+	now := time.Now()
+	moved := false
+	err = s.txm.WithTx(ctx, func(ctx context.Context) error {
+		member, err := s.convRepo.GetMember(ctx, conv.ID, userID)
+		if err != nil {
+			return err
+		}
+		if member == nil {
+			return ErrNotConversationMember
+		}
+
+		moved, err = s.repo.AdvanceReadMarker(ctx, conv.ID, userID, upTo, now)
+		if err != nil || !moved {
+			return err
+		}
+		if conv.Type == model.ConversationTypeGroup {
+			return s.repo.AddReadReceipts(ctx, conv.ID, userID, member.ReadUpTo(), upTo, now)
+		}
+		return nil
+	})
+	if err != nil || !moved {
+		return nil, err
 	}
-	return s.repo.MarkAsRead(ctx, userID, partnerID)
+	return &model.ReadReceipt{ConversationID: conv.ID, ReaderID: userID, MessageID: msg.ID, ReadAt: now}, nil
+}
+
+// GetReads returns who other than the sender has read a message and when. Group
+// messages have a receipt per reader; in direct chats the partner's watermark is
+// used, so ReadAt is when the partner last read up to or past the message.
+func (s *MessageService) GetReads(ctx context.Context, messageID, userID uuid.UUID) ([]model.MessageRead, error) {
+	if s.repo == nil || s.convRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	msg, err := s.visibleMessage(ctx, messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := s.convRepo.GetByID(ctx, msg.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conv == nil {
+		return nil, ErrConversationNotFound
+	}
+	if conv.Type == model.ConversationTypeGroup {
+		return s.repo.GetReadReceipts(ctx, messageID)
+	}
+
+	members, err := s.convRepo.GetMembers(ctx, conv.ID)
+	if err != nil {
+		return nil, err
+	}
+	position := model.Cursor{CreatedAt: msg.CreatedAt, ID: msg.ID}
+	reads := []model.MessageRead{}
+	for _, member := range members {
+		upTo := member.ReadUpTo()
+		if member.UserID == msg.SenderID || upTo == nil || upTo.Compare(position) < 0 || member.LastReadAt == nil {
+			continue
+		}
+		reads = append(reads, model.MessageRead{MessageID: msg.ID, UserID: member.UserID, ReadAt: *member.LastReadAt})
+	}
+	return reads, nil
 }
 
 func (s *MessageService) MarkMessageAsDelivered(ctx context.Context, messageID, receiverID uuid.UUID) error {
@@ -199,9 +597,166 @@ func (s *MessageService) MarkMessageAsDelivered(ctx context.Context, messageID,
 	return s.repo.MarkAsDelivered(ctx, messageID, receiverID)
 }
 
-func (s *MessageService) GetSenderInfo(ctx context.Context, userID uuid.UUID) (*model.User, error) {
-	if s.userRepo == nil {
+// MessageChange is an edited or deleted message together with the users to notify
+type MessageChange struct {
+	Message    *model.Message
+	Recipients []uuid.UUID
+}
+
+// EditMessage replaces the payload of a message sent by userID. The previous
+// version is kept in the edit history. The new payload of an end-to-end encrypted
+// message must be encrypted by the client as well.
+func (s *MessageService) EditMessage(ctx context.Context, messageID, userID uuid.UUID, payload []byte) (*MessageChange, error) {
+	if s.repo == nil || s.convRepo == nil {
 		return nil, fmt.Errorf("database unavailable")
 	}
-	return s.userRepo.GetByID(ctx, userID)
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("%w: payload is required", ErrInvalidInput)
+	}
+
+	msg, err := s.repo.GetByID(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, ErrMessageNotFound
+	}
+	if msg.SenderID != userID {
+		return nil, ErrNotMessageSender
+	}
+	if !isText(msg) {
+		return nil, ErrCallEntry
+	}
+	if msg.DeletedAt != nil {
+		return nil, ErrMessageDeleted
+	}
+
+	encryptedPayload, err := sealPayload(s.encryptor, msg, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	editedAt := time.Now()
+	if err := s.repo.UpdatePayload(ctx, messageID, encryptedPayload, editedAt); err != nil {
+		return nil, err
+	}
+	msg.Payload = payload
+	msg.EditedAt = &editedAt
+
+	recipients, err := s.convRepo.GetMemberIDs(ctx, msg.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageChange{Message: msg, Recipients: recipients}, nil
+}
+
+// isText reports whether msg is a regular message rather than a call entry; messages
+// stored before kinds existed have none
+func isText(msg *model.Message) bool {
+	return msg.Kind == "" || msg.Kind == model.MessageKindText
+}
+
+// DeleteMessage deletes a message for everyone (sender only) or hides it for userID alone
+func (s *MessageService) DeleteMessage(ctx context.Context, messageID, userID uuid.UUID, forEveryone bool) (*MessageChange, error) {
+	if s.repo == nil || s.convRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	msg, err := s.visibleMessage(ctx, messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isText(msg) {
+		return nil, ErrCallEntry
+	}
+
+	if !forEveryone {
+		if err := s.repo.HideForUser(ctx, messageID, userID); err != nil {
+			return nil, err
+		}
+		return &MessageChange{Message: msg, Recipients: []uuid.UUID{userID}}, nil
+	}
+
+	if msg.SenderID != userID {
+		return nil, ErrNotMessageSender
+	}
+	if msg.DeletedAt == nil {
+		deletedAt := time.Now()
+		if err := s.repo.MarkDeleted(ctx, messageID, deletedAt); err != nil {
+			return nil, err
+		}
+		msg.DeletedAt = &deletedAt
+	}
+	msg.Payload = nil
+
+	if err := s.attachments.purge(ctx, messageID); err != nil {
+		return nil, err
+	}
+
+	recipients, err := s.convRepo.GetMemberIDs(ctx, msg.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageChange{Message: msg, Recipients: recipients}, nil
+}
+
+// GetEditHistory returns the previous versions of a message, oldest first
+func (s *MessageService) GetEditHistory(ctx context.Context, messageID, userID uuid.UUID) ([]model.MessageEdit, error) {
+	if s.repo == nil || s.convRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+
+	msg, err := s.visibleMessage(ctx, messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	edits, err := s.repo.GetEdits(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt previous versions; they stay bound to the message they belong to
+	for i := range edits {
+		decrypted, err := openPayload(s.encryptor, msg, edits[i].Payload)
+		if err != nil {
+			log.Printf("failed to decrypt a previous version of message %s: %v", msg.ID, err)
+			edits[i].Payload = nil
+			edits[i].Undecryptable = true
+			continue
+		}
+		edits[i].Payload = decrypted
+	}
+
+	return edits, nil
+}
+
+// fillAttachments sets the attachments of a history page
+func (s *MessageService) fillAttachments(ctx context.Context, messages []model.MessageWithRead) error {
+	ptrs := make([]*model.Message, len(messages))
+	for i := range messages {
+		ptrs[i] = &messages[i].Message
+	}
+	return s.attachments.fill(ctx, ptrs)
+}
+
+// visibleMessage loads a message from a conversation userID belongs to. Messages
+// of other conversations are reported as missing rather than forbidden.
+func (s *MessageService) visibleMessage(ctx context.Context, messageID, userID uuid.UUID) (*model.Message, error) {
+	msg, err := s.repo.GetByID(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	member, err := s.convRepo.GetMember(ctx, msg.ConversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if member == nil {
+		return nil, ErrMessageNotFound
+	}
+	return msg, nil
 }
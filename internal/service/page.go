@@ -0,0 +1,38 @@
+package service
+
+import "messenger/internal/model"
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+// withLookahead clamps the page limit and asks storage for one extra item so
+// trimPage can tell whether another page exists. It returns the clamped limit.
+func withLookahead(page model.PageRequest) (model.PageRequest, int) {
+	limit := page.Limit
+	if limit <= 0 || limit > maxPageLimit {
+		limit = defaultPageLimit
+	}
+	page.Limit = limit + 1
+	return page, limit
+}
+
+// trimPage drops the lookahead item from a newest-first page and returns the
+// encoded cursor continuing in the same direction, or "" on the last page
+func trimPage[T any](items []T, limit int, page model.PageRequest, key func(T) model.Cursor) ([]T, string) {
+	if len(items) <= limit {
+		return items, ""
+	}
+	if page.Forward() {
+		// The lookahead is the newest item; the next page starts after the newest kept one
+		items = items[1:]
+		return items, key(items[0]).Encode()
+	}
+	items = items[:limit]
+	return items, key(items[limit-1]).Encode()
+}
+
+func messageCursor(msg model.MessageWithRead) model.Cursor {
+	return model.Cursor{CreatedAt: msg.CreatedAt, ID: msg.ID}
+}
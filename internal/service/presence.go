@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/storage"
+)
+
+// MaxPresenceLookup caps how many users one presence lookup may ask for
+const MaxPresenceLookup = 100
+
+// PresenceService persists last-seen times and applies the last-seen privacy setting.
+// Who is online is only known to the WebSocket hub.
+type PresenceService struct {
+	userRepo storage.UserRepository
+	convRepo storage.ConversationRepository
+}
+
+func NewPresenceService(userRepo storage.UserRepository, convRepo storage.ConversationRepository) *PresenceService {
+	return &PresenceService{userRepo: userRepo, convRepo: convRepo}
+}
+
+// Contacts returns the users sharing a conversation with userID; they are the ones
+// told about its presence changes
+func (s *PresenceService) Contacts(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	if s.convRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	return s.convRepo.GetContactIDs(ctx, userID)
+}
+
+// RecordLastSeen stores that userID was connected at seenAt
+func (s *PresenceService) RecordLastSeen(ctx context.Context, userID uuid.UUID, seenAt time.Time) error {
+	if s.userRepo == nil {
+		return fmt.Errorf("database unavailable")
+	}
+	return s.userRepo.UpdateLastSeen(ctx, userID, seenAt)
+}
+
+// LastSeen returns the last-seen times of the given users that may be shown to
+// others; users hiding it or never seen are left out
+func (s *PresenceService) LastSeen(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]time.Time, error) {
+	if s.userRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	if len(userIDs) > MaxPresenceLookup {
+		return nil, fmt.Errorf("%w: at most %d users", ErrInvalidInput, MaxPresenceLookup)
+	}
+
+	users, err := s.userRepo.GetByIDs(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[uuid.UUID]time.Time, len(users))
+	for _, user := range users {
+		if user.LastSeenAt != nil && !user.HideLastSeen {
+			result[user.ID] = *user.LastSeenAt
+		}
+	}
+	return result, nil
+}
+
+// SetHideLastSeen changes whether others may see when userID was last online
+func (s *PresenceService) SetHideLastSeen(ctx context.Context, userID uuid.UUID, hide bool) error {
+	if s.userRepo == nil {
+		return fmt.Errorf("database unavailable")
+	}
+	return s.userRepo.SetHideLastSeen(ctx, userID, hide)
+}
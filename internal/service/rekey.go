@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"messenger/internal/crypto"
+	"messenger/internal/model"
+	"messenger/internal/storage"
+)
+
+const rekeyBatchSize = 500
+
+// RekeyStats summarizes a re-encryption run. Message payloads, previous versions of
+// edited messages and attachment blobs all count.
+type RekeyStats struct {
+	Scanned int
+	Rekeyed int
+	// Failed counts payloads no key of the keyring could open; they are left as they are
+	Failed int
+}
+
+// RekeyService migrates stored message payloads, edit history and attachments to the
+// primary encryption key and the current ciphertext format, so older keys can
+// eventually be dropped from the keyring
+type RekeyService struct {
+	repo        storage.MessageRepository
+	attachments storage.AttachmentRepository
+	blobs       storage.BlobStore
+	encryptor   *crypto.Encryptor
+}
+
+// NewRekeyService returns a rekey service; without attachments or blobs, attachments
+// are left as they are
+func NewRekeyService(repo storage.MessageRepository, attachments storage.AttachmentRepository, blobs storage.BlobStore, encryptor *crypto.Encryptor) *RekeyService {
+	return &RekeyService{repo: repo, attachments: attachments, blobs: blobs, encryptor: encryptor}
+}
+
+// Run re-encrypts everything not current with the primary key, in batches, until all
+// messages and attachments were visited or ctx is cancelled. Payloads changed
+// concurrently by an edit or another instance are skipped; they already use the
+// primary key.
+func (s *RekeyService) Run(ctx context.Context) (RekeyStats, error) {
+	var stats RekeyStats
+	if s.repo == nil || s.encryptor == nil {
+		return stats, fmt.Errorf("database unavailable")
+	}
+	if err := s.rekeyMessages(ctx, &stats); err != nil {
+		return stats, err
+	}
+	if s.attachments == nil || s.blobs == nil {
+		return stats, nil
+	}
+	return stats, s.rekeyAttachments(ctx, &stats)
+}
+
+// rekeyMessages re-encrypts message payloads and, batch by batch, the previous
+// versions of those messages
+func (s *RekeyService) rekeyMessages(ctx context.Context, stats *RekeyStats) error {
+	after := uuid.Nil
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		messages, err := s.repo.GetPayloadsAfter(ctx, after, rekeyBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+
+		byID := make(map[uuid.UUID]*model.Message, len(messages))
+		ids := make([]uuid.UUID, len(messages))
+		for i := range messages {
+			msg := &messages[i]
+			byID[msg.ID] = msg
+			ids[i] = msg.ID
+
+			stats.Scanned++
+			rekeyed, ok := s.reencrypt(msg, msg.Payload, stats)
+			if !ok {
+				continue
+			}
+			replaced, err := s.repo.ReplacePayload(ctx, msg.ID, msg.Payload, rekeyed)
+			if err != nil {
+				return err
+			}
+			if replaced {
+				stats.Rekeyed++
+			}
+		}
+
+		// Previous versions are bound to the message they belong to, like its payload
+		edits, err := s.repo.GetEditsByMessageIDs(ctx, ids)
+		if err != nil {
+			return err
+		}
+		for _, edit := range edits {
+			stats.Scanned++
+			rekeyed, ok := s.reencrypt(byID[edit.MessageID], edit.Payload, stats)
+			if !ok {
+				continue
+			}
+			replaced, err := s.repo.ReplaceEditPayload(ctx, edit.MessageID, edit.Payload, rekeyed)
+			if err != nil {
+				return err
+			}
+			if replaced {
+				stats.Rekeyed++
+			}
+		}
+		after = messages[len(messages)-1].ID
+	}
+}
+
+// reencrypt returns payload, a version of msg, sealed with the primary key, and false
+// when it already is or cannot be opened
+func (s *RekeyService) reencrypt(msg *model.Message, payload []byte, stats *RekeyStats) ([]byte, bool) {
+	ciphertext := string(payload)
+	if s.encryptor.Current(ciphertext) {
+		return nil, false
+	}
+	rekeyed, err := s.encryptor.Reencrypt(ciphertext, payloadAD(msg))
+	if err != nil {
+		log.Printf("rekey: cannot decrypt message %s: %v", msg.ID, err)
+		stats.Failed++
+		return nil, false
+	}
+	return []byte(rekeyed), true
+}
+
+// rekeyAttachments re-seals attachment blobs. A blob is rewritten whole, so one
+// whose attachment was deleted meanwhile is removed again.
+func (s *RekeyService) rekeyAttachments(ctx context.Context, stats *RekeyStats) error {
+	after := uuid.Nil
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		attachments, err := s.attachments.GetAfter(ctx, after, rekeyBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(attachments) == 0 {
+			return nil
+		}
+
+		for _, att := range attachments {
+			key := att.ID.String()
+			sealed, err := s.blobs.Get(ctx, key)
+			if err != nil {
+				return err
+			}
+			if sealed == nil {
+				continue
+			}
+			stats.Scanned++
+			if s.encryptor.CurrentBinary(sealed) {
+				continue
+			}
+
+			resealed, err := s.encryptor.Reseal(sealed, att.ID[:])
+			if err != nil {
+				log.Printf("rekey: cannot decrypt attachment %s: %v", att.ID, err)
+				stats.Failed++
+				continue
+			}
+			if err := s.blobs.Put(ctx, key, resealed); err != nil {
+				return err
+			}
+			stats.Rekeyed++
+
+			current, err := s.attachments.GetByID(ctx, att.ID)
+			if err != nil {
+				return err
+			}
+			if current == nil {
+				if err := s.blobs.Delete(ctx, key); err != nil {
+					log.Printf("rekey: failed to remove blob of deleted attachment %s: %v", att.ID, err)
+				}
+			}
+		}
+		after = attachments[len(attachments)-1].ID
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/crypto"
+	"messenger/internal/model"
+	"messenger/internal/storage"
+)
+
+const (
+	SyncEventMessage   = "message"
+	SyncEventDelivered = "delivered"
+	SyncEventRead      = "read"
+	SyncEventCall      = "call"
+)
+
+// syncBatchLimit caps how many changes of each kind one sync call loads
+const syncBatchLimit = 500
+
+// SyncMessage is a message in the same shape as WebSocket message frames
+type SyncMessage struct {
+	ID             uuid.UUID          `json:"id"`
+	ConversationID uuid.UUID          `json:"conversation_id"`
+	SenderID       uuid.UUID          `json:"sender_id"`
+	ReceiverID     uuid.UUID          `json:"receiver_id,omitempty"`
+	Payload        string             `json:"payload"`
+	CreatedAt      time.Time          `json:"created_at"`
+	EditedAt       *time.Time         `json:"edited_at,omitempty"`
+	DeletedAt      *time.Time         `json:"deleted_at,omitempty"`
+	Attachments    []model.Attachment `json:"attachments,omitempty"`
+	E2E            bool               `json:"e2e,omitempty"`
+	Undecryptable  bool               `json:"undecryptable,omitempty"`
+	// Kind and CallID are set for call entries, like in history
+	Kind   model.MessageKind `json:"kind,omitempty"`
+	CallID *uuid.UUID        `json:"call_id,omitempty"`
+}
+
+// SyncEvent is one missed change; exactly one of the payload fields is set, matching Type
+type SyncEvent struct {
+	Type      string                 `json:"type"`
+	At        time.Time              `json:"at"`
+	Message   *SyncMessage           `json:"message,omitempty"`
+	Delivered *model.DeliveryReceipt `json:"delivered,omitempty"`
+	Read      *model.ReadReceipt     `json:"read,omitempty"`
+	Call      *model.CallInfo        `json:"call,omitempty"`
+
+	pos model.SyncPosition
+}
+
+type SyncBatch struct {
+	Events     []SyncEvent `json:"events"`
+	NextCursor string      `json:"next_cursor"`
+	// HasMore is set when the batch was cut short; sync again from NextCursor
+	HasMore bool `json:"has_more"`
+}
+
+type SyncService struct {
+	messageRepo storage.MessageRepository
+	callRepo    storage.CallRepository
+	attachments *AttachmentService
+	encryptor   *crypto.Encryptor
+}
+
+func NewSyncService(messageRepo storage.MessageRepository, callRepo storage.CallRepository, attachments *AttachmentService, encryptor *crypto.Encryptor) *SyncService {
+	return &SyncService{
+		messageRepo: messageRepo,
+		callRepo:    callRepo,
+		attachments: attachments,
+		encryptor:   encryptor,
+	}
+}
+
+// Since returns the messages (new, edited or deleted), receipts and call state changes userID missed after
+// since, in the order they were committed. Without a cursor it only hands out a starting point at the
+// current position, since a fresh client loads state from /api/chats instead.
+func (s *SyncService) Since(ctx context.Context, userID uuid.UUID, since *model.SyncPosition) (*SyncBatch, error) {
+	if s.messageRepo == nil || s.callRepo == nil {
+		return nil, fmt.Errorf("database unavailable")
+	}
+	// Every source reads up to the same head, so one cannot run ahead of a change
+	// another has yet to see committed
+	head, err := s.messageRepo.SyncHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sync head: %w", err)
+	}
+	if since == nil {
+		return &SyncBatch{Events: []SyncEvent{}, NextCursor: head.Encode()}, nil
+	}
+	from := *since
+
+	messages, err := s.messageRepo.GetSince(ctx, userID, from, head, syncBatchLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load messages: %w", err)
+	}
+	deliveries, err := s.messageRepo.GetDeliveryReceiptsSince(ctx, userID, from, head, syncBatchLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load delivery receipts: %w", err)
+	}
+	reads, err := s.messageRepo.GetReadReceiptsSince(ctx, userID, from, head, syncBatchLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load read receipts: %w", err)
+	}
+	calls, err := s.callRepo.GetUpdatedSince(ctx, userID, from, head, syncBatchLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load calls: %w", err)
+	}
+
+	// A source that filled its limit may have more changes right after its last
+	// one, so the batch is only complete up to the earliest such point
+	cutoff := head
+	truncated := false
+	clip := func(n int, last func() model.SyncPosition) {
+		if n < syncBatchLimit {
+			return
+		}
+		if p := last(); p.Compare(cutoff) < 0 {
+			cutoff = p
+			truncated = true
+		}
+	}
+	clip(len(messages), func() model.SyncPosition { return messages[len(messages)-1].SyncPos })
+	clip(len(deliveries), func() model.SyncPosition { return deliveries[len(deliveries)-1].SyncPos })
+	clip(len(reads), func() model.SyncPosition { return reads[len(reads)-1].SyncPos })
+	clip(len(calls), func() model.SyncPosition { return calls[len(calls)-1].SyncPos })
+
+	ptrs := make([]*model.Message, len(messages))
+	for i := range messages {
+		ptrs[i] = &messages[i]
+	}
+	if err := s.attachments.fill(ctx, ptrs); err != nil {
+		return nil, fmt.Errorf("failed to load attachments: %w", err)
+	}
+
+	events := make([]SyncEvent, 0, len(messages)+len(deliveries)+len(reads)+len(calls))
+	for _, msg := range messages {
+		openMessage(s.encryptor, &msg)
+		synced := &SyncMessage{
+			ID:             msg.ID,
+			ConversationID: msg.ConversationID,
+			SenderID:       msg.SenderID,
+			ReceiverID:     msg.ReceiverID,
+			Payload:        string(msg.Payload),
+			CreatedAt:      msg.CreatedAt,
+			EditedAt:       msg.EditedAt,
+			DeletedAt:      msg.DeletedAt,
+			Attachments:    msg.Attachments,
+			E2E:            msg.E2E,
+			Undecryptable:  msg.Undecryptable,
+		}
+		if !isText(&msg) {
+			synced.Kind = msg.Kind
+			synced.CallID = msg.CallID
+		}
+		events = append(events, SyncEvent{Type: SyncEventMessage, At: msg.ChangedAt(), Message: synced, pos: msg.SyncPos})
+	}
+	for i := range deliveries {
+		events = append(events, SyncEvent{Type: SyncEventDelivered, At: deliveries[i].DeliveredAt, Delivered: &deliveries[i], pos: deliveries[i].SyncPos})
+	}
+	for i := range reads {
+		events = append(events, SyncEvent{Type: SyncEventRead, At: reads[i].ReadAt, Read: &reads[i], pos: reads[i].SyncPos})
+	}
+	for _, call := range calls {
+		participants, err := s.callRepo.GetParticipantsByCallID(ctx, call.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load call participants: %w", err)
+		}
+		events = append(events, SyncEvent{Type: SyncEventCall, At: call.UpdatedAt, Call: &model.CallInfo{Call: call, Participants: participants}, pos: call.SyncPos})
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].pos.Compare(events[j].pos) < 0 })
+
+	if truncated {
+		n := sort.Search(len(events), func(i int) bool { return events[i].pos.Compare(cutoff) > 0 })
+		events = events[:n]
+	}
+
+	// Without a cut, everything before the head has been handed out
+	return &SyncBatch{Events: events, NextCursor: cutoff.Encode(), HasMore: truncated}, nil
+}
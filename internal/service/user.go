@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/google/uuid"
@@ -9,6 +10,13 @@ import (
 	"messenger/internal/storage"
 )
 
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrInvalidRole  = errors.New("invalid role")
+	// ErrOwnRole prevents users from changing their own role, so the last superadmin cannot lock themselves out
+	ErrOwnRole = errors.New("cannot change your own role")
+)
+
 type UserService struct {
 	repo storage.UserRepository
 }
@@ -44,3 +52,26 @@ func (s *UserService) SearchUsers(ctx context.Context, prefix string) ([]model.U
 	}
 	return s.repo.SearchUsers(ctx, prefix)
 }
+
+// SetRole changes the system role of targetID. Callers must check that actorID holds
+// model.PermManageRoles.
+func (s *UserService) SetRole(ctx context.Context, actorID, targetID uuid.UUID, role model.Role) error {
+	if s.repo == nil {
+		return fmt.Errorf("database unavailable")
+	}
+	if !role.Valid() {
+		return ErrInvalidRole
+	}
+	if actorID == targetID {
+		return ErrOwnRole
+	}
+
+	user, err := s.repo.GetByID(ctx, targetID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+	return s.repo.UpdateRole(ctx, targetID, role)
+}
@@ -0,0 +1,423 @@
+package sfu
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// speakerInterval is how often a room looks for the participant that speaks
+	speakerInterval = 500 * time.Millisecond
+	// speakerLevel is the mean audio level, in -dBov, a participant must be louder
+	// than to be speaking; levels range from 0, the loudest, to 127, silence
+	speakerLevel = 50
+	// speakerHold is how many intervals in a row a participant must be the loudest
+	// before it is announced, so a cough does not take over
+	speakerHold = 2
+	// roomIdleTimeout closes a room nobody has been connected to for that long, such
+	// as one of a call that was declined or ended by the call supervisor
+	roomIdleTimeout = 2 * time.Minute
+)
+
+// room forwards the media of one call between its connected participants
+type room struct {
+	sfu *SFU
+	id  uuid.UUID
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu        sync.Mutex
+	peers     map[uuid.UUID]*peer
+	idleSince time.Time
+	// size is len(peers), read by forwarding without the lock
+	size atomic.Int32
+
+	// speaker is the participant last announced, loudest the one that was loudest for
+	// the last heldFor intervals. Only run uses them.
+	speaker uuid.UUID
+	loudest uuid.UUID
+	heldFor int
+}
+
+// peer is the connection of one participant. It publishes the tracks the participant
+// sends and carries a down track for each track other participants publish.
+type peer struct {
+	room   *room
+	userID uuid.UUID
+	// connID is the signaling connection the participant published from
+	connID uuid.UUID
+	pc     *webrtc.PeerConnection
+
+	// tracks, downTracks and layers are guarded by room.mu
+	tracks     map[string]*publishedTrack
+	downTracks map[*publishedTrack]*downTrack
+	// layers are the simulcast layers requested per publisher
+	layers map[uuid.UUID]string
+
+	// negotiateMu serializes offers and answers
+	negotiateMu sync.Mutex
+	// negotiating is set while an offer of the server awaits its answer, renegotiate
+	// when the tracks changed meanwhile
+	negotiating bool
+	renegotiate bool
+}
+
+func newRoom(s *SFU, callID uuid.UUID) *room {
+	return &room{
+		sfu:       s,
+		id:        callID,
+		done:      make(chan struct{}),
+		peers:     make(map[uuid.UUID]*peer),
+		idleSince: time.Now(),
+	}
+}
+
+// run detects speakers until the room is closed, which it does itself once the room
+// has been idle for roomIdleTimeout
+func (r *room) run() {
+	ticker := time.NewTicker(speakerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if r.idle(now) {
+				r.sfu.closeRoom(r)
+				return
+			}
+			r.detectSpeaker()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *room) idle(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.peers) == 0 && now.Sub(r.idleSince) >= roomIdleTimeout
+}
+
+// detectSpeaker announces the participant whose audio was the loudest over the last
+// speakerHold intervals. Nobody speaking keeps the last speaker announced.
+func (r *room) detectSpeaker() {
+	r.mu.Lock()
+	participants := make([]uuid.UUID, 0, len(r.peers))
+	loudest, loudestLevel := uuid.Nil, int64(speakerLevel)
+	for userID, p := range r.peers {
+		participants = append(participants, userID)
+		for _, t := range p.tracks {
+			if t.audioLevel == 0 {
+				continue
+			}
+			if level := t.level(); level < loudestLevel {
+				loudest, loudestLevel = userID, level
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	if loudest != r.loudest {
+		r.loudest, r.heldFor = loudest, 0
+	}
+	r.heldFor++
+	if loudest == uuid.Nil || loudest == r.speaker || r.heldFor < speakerHold {
+		return
+	}
+	r.speaker = loudest
+	r.sfu.signaler.Speaker(r.id, participants, loudest)
+}
+
+// publish connects a participant, replacing its previous connection, and subscribes
+// it to every track published so far
+func (r *room) publish(userID, connID uuid.UUID, offer string) error {
+	p, err := r.newPeer(userID, connID)
+	if err != nil {
+		return err
+	}
+	if err := p.answerOffer(offer); err != nil {
+		p.pc.Close()
+		return err
+	}
+
+	r.mu.Lock()
+	old := r.peers[userID]
+	r.mu.Unlock()
+	if old != nil {
+		r.remove(old)
+	}
+
+	r.mu.Lock()
+	select {
+	case <-r.done:
+		r.mu.Unlock()
+		p.pc.Close()
+		return ErrNoRoom
+	default:
+	}
+	r.peers[userID] = p
+	r.size.Store(int32(len(r.peers)))
+	for _, other := range r.peers {
+		if other == p {
+			continue
+		}
+		for _, t := range other.tracks {
+			p.subscribe(t)
+		}
+	}
+	r.mu.Unlock()
+
+	p.negotiate()
+	return nil
+}
+
+func (r *room) newPeer(userID, connID uuid.UUID) (*peer, error) {
+	pc, err := r.sfu.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	p := &peer{
+		room:       r,
+		userID:     userID,
+		connID:     connID,
+		pc:         pc,
+		tracks:     make(map[string]*publishedTrack),
+		downTracks: make(map[*publishedTrack]*downTrack),
+		layers:     make(map[uuid.UUID]string),
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			r.sfu.signaler.Candidate(r.id, userID, connID, candidate.ToJSON())
+		}
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		r.addTrack(p, remote, receiver)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			r.remove(p)
+		}
+	})
+	return p, nil
+}
+
+// addTrack publishes a track, or a simulcast layer of one, to everyone else and
+// forwards its packets until the publisher stops sending it
+func (r *room) addTrack(p *peer, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	r.mu.Lock()
+	if r.peers[p.userID] != p {
+		r.mu.Unlock()
+		return
+	}
+	t, known := p.tracks[remote.ID()]
+	if !known {
+		t = newPublishedTrack(p, remote, receiver)
+		p.tracks[remote.ID()] = t
+	}
+	l := t.addLayer(remote)
+
+	var subscribers []*peer
+	if !known {
+		for _, other := range r.peers {
+			if other != p {
+				other.subscribe(t)
+				subscribers = append(subscribers, other)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, other := range subscribers {
+		other.negotiate()
+	}
+	t.forward(l)
+}
+
+func (r *room) selectLayer(userID, connID, publisherID uuid.UUID, layer string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, err := r.peerLocked(userID, connID)
+	if err != nil {
+		return err
+	}
+	p.layers[publisherID] = layer
+	for t, d := range p.downTracks {
+		if t.owner.userID == publisherID {
+			d.setLayer(layer)
+		}
+	}
+	return nil
+}
+
+// peerLocked returns the connection a participant published from connID. The caller
+// holds r.mu.
+func (r *room) peerLocked(userID, connID uuid.UUID) (*peer, error) {
+	p, ok := r.peers[userID]
+	if !ok || p.connID != connID {
+		return nil, ErrNoPeer
+	}
+	return p, nil
+}
+
+func (r *room) leave(userID uuid.UUID) {
+	r.mu.Lock()
+	p, ok := r.peers[userID]
+	r.mu.Unlock()
+	if ok {
+		r.remove(p)
+	}
+}
+
+// remove disconnects a participant, unless it already reconnected, and takes its
+// tracks away from everyone else
+func (r *room) remove(p *peer) {
+	r.mu.Lock()
+	if r.peers[p.userID] != p {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.peers, p.userID)
+	r.size.Store(int32(len(r.peers)))
+	if len(r.peers) == 0 {
+		r.idleSince = time.Now()
+	}
+
+	affected := make(map[*peer]bool)
+	for _, t := range p.tracks {
+		for _, d := range t.detachAll() {
+			other := d.subscriber
+			delete(other.downTracks, t)
+			if err := other.pc.RemoveTrack(d.sender); err == nil {
+				affected[other] = true
+			}
+		}
+	}
+	for t, d := range p.downTracks {
+		t.detach(d)
+	}
+	r.mu.Unlock()
+
+	p.pc.Close()
+	for other := range affected {
+		other.negotiate()
+	}
+}
+
+// close disconnects everyone
+func (r *room) close() {
+	r.closeOnce.Do(func() { close(r.done) })
+
+	r.mu.Lock()
+	peers := r.peers
+	r.peers = make(map[uuid.UUID]*peer)
+	r.size.Store(0)
+	r.mu.Unlock()
+
+	for _, p := range peers {
+		p.pc.Close()
+	}
+}
+
+// subscribe adds a down track for a track published by someone else. The caller
+// holds room.mu and negotiates afterwards.
+func (p *peer) subscribe(t *publishedTrack) {
+	// Streams are named after their publisher, which is how clients tell them apart
+	local, err := webrtc.NewTrackLocalStaticRTP(t.codec, t.id, t.owner.userID.String())
+	if err != nil {
+		log.Printf("sfu: failed to create track for %s in call %s: %v", p.userID, p.room.id, err)
+		return
+	}
+	sender, err := p.pc.AddTrack(local)
+	if err != nil {
+		log.Printf("sfu: failed to add track for %s in call %s: %v", p.userID, p.room.id, err)
+		return
+	}
+
+	d := newDownTrack(t, p, local, sender, p.layers[t.owner.userID])
+	p.downTracks[t] = d
+	t.attach(d)
+	go d.readRTCP()
+}
+
+// answerOffer answers the offer a participant connects with
+func (p *peer) answerOffer(offer string) error {
+	p.negotiateMu.Lock()
+	defer p.negotiateMu.Unlock()
+
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSDP, err)
+	}
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSDP, err)
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set answer: %w", err)
+	}
+	// Signaled under the lock, so the answer goes out before any offer of the server
+	p.room.sfu.signaler.Answer(p.room.id, p.userID, p.connID, answer.SDP)
+	return nil
+}
+
+// negotiate offers the participant the tracks it should receive now, or, while an
+// offer is outstanding, once that is answered
+func (p *peer) negotiate() {
+	p.negotiateMu.Lock()
+	defer p.negotiateMu.Unlock()
+
+	if p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+	if p.negotiating || p.pc.SignalingState() != webrtc.SignalingStateStable {
+		p.renegotiate = true
+		return
+	}
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("sfu: failed to renegotiate with %s in call %s: %v", p.userID, p.room.id, err)
+		return
+	}
+	p.negotiating = true
+	p.room.sfu.signaler.Offer(p.room.id, p.userID, p.connID, offer.SDP)
+}
+
+// accept completes the outstanding offer with the participant's answer
+func (p *peer) accept(answer string) error {
+	p.negotiateMu.Lock()
+	if !p.negotiating {
+		p.negotiateMu.Unlock()
+		return ErrUnexpectedAnswer
+	}
+	err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+	if err != nil {
+		// Withdraw the offer, the tracks it carried go out with the next one
+		if err := p.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			log.Printf("sfu: failed to withdraw offer to %s in call %s: %v", p.userID, p.room.id, err)
+		}
+		p.negotiating = false
+		p.renegotiate = true
+		p.negotiateMu.Unlock()
+		return fmt.Errorf("%w: %v", ErrInvalidSDP, err)
+	}
+	p.negotiating = false
+	again := p.renegotiate
+	p.renegotiate = false
+	p.negotiateMu.Unlock()
+
+	if again {
+		p.negotiate()
+	}
+	return nil
+}
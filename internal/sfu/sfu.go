@@ -0,0 +1,239 @@
+// Package sfu is a selective forwarding unit for group calls. Every participant sends
+// its media to the server once, over a single peer connection, and receives the media
+// of everyone else over the same connection, instead of keeping a connection to each
+// other participant.
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	// ErrNoRoom is a call whose media this server does not forward
+	ErrNoRoom = errors.New("call media is not forwarded by this server")
+	// ErrNoPeer is a participant that has not sent an offer to the server yet, or
+	// sent it from another device
+	ErrNoPeer = errors.New("participant is not connected to the server")
+	// ErrUnexpectedAnswer is an answer while the server has no offer outstanding
+	ErrUnexpectedAnswer = errors.New("no offer awaits an answer")
+	ErrInvalidSDP       = errors.New("invalid session description")
+	ErrInvalidCandidate = errors.New("invalid ICE candidate")
+	ErrInvalidLayer     = errors.New("invalid simulcast layer")
+)
+
+// Config configures the SFU
+type Config struct {
+	// PublicIP replaces the server's own addresses in its ICE candidates, for servers
+	// behind a 1:1 NAT
+	PublicIP string
+	// UDPPort carries the media of every connection on one UDP port; zero gives each
+	// connection its own port
+	UDPPort int
+}
+
+// Signaler carries the server's side of the signaling to participants. connID is the
+// signaling connection a participant published from, the only one of its devices
+// that takes part in the negotiation.
+type Signaler interface {
+	// Offer renegotiates the connection of a participant when the media it receives
+	// changes; the participant answers through Answer
+	Offer(callID, userID, connID uuid.UUID, sdp string)
+	// Answer accepts the offer a participant connected with
+	Answer(callID, userID, connID uuid.UUID, sdp string)
+	Candidate(callID, userID, connID uuid.UUID, candidate webrtc.ICECandidateInit)
+	// Speaker announces the participant that is speaking to everyone connected
+	Speaker(callID uuid.UUID, participants []uuid.UUID, speakerID uuid.UUID)
+}
+
+// SFU forwards the media of calls it has a room for. The call signaling opens a room
+// when a call is large enough, participants then publish to it with an offer.
+type SFU struct {
+	api      *webrtc.API
+	signaler Signaler
+	mux      ice.UDPMux
+
+	mu    sync.Mutex
+	rooms map[uuid.UUID]*room
+}
+
+// New creates an SFU that signals participants through signaler
+func New(cfg Config, signaler Signaler) (*SFU, error) {
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("failed to register codecs: %w", err)
+	}
+	// Publishers tag audio packets with their level, which speaker detection reads
+	if err := media.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register audio level extension: %w", err)
+	}
+	// NACKs, RTCP reports, the header extensions of simulcast and TWCC feedback, which
+	// publishers estimate their bandwidth with and drop simulcast layers by
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+
+	s := &SFU{
+		signaler: signaler,
+		rooms:    make(map[uuid.UUID]*room),
+	}
+
+	settings := webrtc.SettingEngine{}
+	if cfg.PublicIP != "" {
+		if net.ParseIP(cfg.PublicIP) == nil {
+			return nil, fmt.Errorf("invalid public IP %q", cfg.PublicIP)
+		}
+		settings.SetNAT1To1IPs([]string{cfg.PublicIP}, webrtc.ICECandidateTypeHost)
+	}
+	if cfg.UDPPort > 0 {
+		mux, err := ice.NewMultiUDPMuxFromPort(cfg.UDPPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on udp port %d: %w", cfg.UDPPort, err)
+		}
+		settings.SetICEUDPMux(mux)
+		s.mux = mux
+	}
+
+	s.api = webrtc.NewAPI(
+		webrtc.WithMediaEngine(media),
+		webrtc.WithInterceptorRegistry(interceptors),
+		webrtc.WithSettingEngine(settings),
+	)
+	return s, nil
+}
+
+// Open makes the server forward the media of a call
+func (s *SFU) Open(callID uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[callID]; ok {
+		return
+	}
+	r := newRoom(s, callID)
+	s.rooms[callID] = r
+	go r.run()
+}
+
+// Routes reports whether the server forwards the media of a call
+func (s *SFU) Routes(callID uuid.UUID) bool {
+	_, ok := s.room(callID)
+	return ok
+}
+
+// Publish connects a participant with the offer it sent over the signaling
+// connection connID, which the server answers through the signaler. Every offer
+// starts a new connection and replaces the previous one of the participant;
+// renegotiation is always started by the server.
+func (s *SFU) Publish(callID, userID, connID uuid.UUID, offer string) error {
+	r, ok := s.room(callID)
+	if !ok {
+		return ErrNoRoom
+	}
+	return r.publish(userID, connID, offer)
+}
+
+// Answer completes a renegotiation the server offered
+func (s *SFU) Answer(callID, userID, connID uuid.UUID, answer string) error {
+	p, err := s.peer(callID, userID, connID)
+	if err != nil {
+		return err
+	}
+	return p.accept(answer)
+}
+
+// AddCandidate adds an ICE candidate of a participant
+func (s *SFU) AddCandidate(callID, userID, connID uuid.UUID, candidate webrtc.ICECandidateInit) error {
+	p, err := s.peer(callID, userID, connID)
+	if err != nil {
+		return err
+	}
+	if err := p.pc.AddICECandidate(candidate); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCandidate, err)
+	}
+	return nil
+}
+
+// SelectLayer chooses the simulcast layer a participant receives of the video of a
+// publisher: "l", "m" or "h", or empty to pick one by the size of the call
+func (s *SFU) SelectLayer(callID, userID, connID, publisherID uuid.UUID, layer string) error {
+	if _, ok := layerRank[layer]; !ok && layer != "" {
+		return ErrInvalidLayer
+	}
+	r, ok := s.room(callID)
+	if !ok {
+		return ErrNoRoom
+	}
+	return r.selectLayer(userID, connID, publisherID, layer)
+}
+
+// Leave disconnects a participant
+func (s *SFU) Leave(callID, userID uuid.UUID) {
+	if r, ok := s.room(callID); ok {
+		r.leave(userID)
+	}
+}
+
+// End disconnects everyone from a call and stops forwarding its media
+func (s *SFU) End(callID uuid.UUID) {
+	s.mu.Lock()
+	r, ok := s.rooms[callID]
+	delete(s.rooms, callID)
+	s.mu.Unlock()
+
+	if ok {
+		r.close()
+	}
+}
+
+// Close ends every call
+func (s *SFU) Close() error {
+	s.mu.Lock()
+	rooms := s.rooms
+	s.rooms = make(map[uuid.UUID]*room)
+	s.mu.Unlock()
+
+	for _, r := range rooms {
+		r.close()
+	}
+	if s.mux != nil {
+		return s.mux.Close()
+	}
+	return nil
+}
+
+func (s *SFU) room(callID uuid.UUID) (*room, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[callID]
+	return r, ok
+}
+
+// peer returns the connection a participant published from connID
+func (s *SFU) peer(callID, userID, connID uuid.UUID) (*peer, error) {
+	r, ok := s.room(callID)
+	if !ok {
+		return nil, ErrNoRoom
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.peerLocked(userID, connID)
+}
+
+// closeRoom forgets a room that is still registered and closes it
+func (s *SFU) closeRoom(r *room) {
+	s.mu.Lock()
+	if s.rooms[r.id] == r {
+		delete(s.rooms, r.id)
+	}
+	s.mu.Unlock()
+	r.close()
+}
@@ -0,0 +1,405 @@
+package sfu
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// layerRank orders the simulcast layers clients send, lowest first. Tracks without
+// simulcast have a single layer with an empty RID.
+var layerRank = map[string]int{"l": 0, "m": 1, "h": 2}
+
+const (
+	// layerTimeout is how long a simulcast layer may go without packets before its
+	// subscribers move to another one. Publishers pause the layers their bandwidth
+	// cannot carry.
+	layerTimeout = time.Second
+	// keyframeInterval limits how often a publisher is asked for a keyframe of a layer
+	keyframeInterval = 500 * time.Millisecond
+)
+
+// defaultLayer is the simulcast layer subscribers get unless they ask for another:
+// the more participants, the smaller their videos are shown
+func defaultLayer(participants int) string {
+	switch {
+	case participants <= 4:
+		return "h"
+	case participants <= 8:
+		return "m"
+	default:
+		return "l"
+	}
+}
+
+// publishedTrack is an audio or video track a participant sends, with a layer for
+// each simulcast encoding of it
+type publishedTrack struct {
+	owner *peer
+	id    string
+	kind  webrtc.RTPCodecType
+	codec webrtc.RTPCodecCapability
+	// audioLevel is the ID of the audio level header extension, zero if the publisher
+	// does not send it
+	audioLevel uint8
+	levelSum   atomic.Int64
+	levelCount atomic.Int64
+
+	mu          sync.RWMutex
+	layers      map[string]*layer
+	subscribers map[*downTrack]struct{}
+}
+
+type layer struct {
+	rid    string
+	remote *webrtc.TrackRemote
+	// seen and keyframeAt are Unix times in nanoseconds of the last packet and the
+	// last keyframe request
+	seen       atomic.Int64
+	keyframeAt atomic.Int64
+}
+
+func newPublishedTrack(owner *peer, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) *publishedTrack {
+	t := &publishedTrack{
+		owner:       owner,
+		id:          remote.ID(),
+		kind:        remote.Kind(),
+		codec:       remote.Codec().RTPCodecCapability,
+		layers:      make(map[string]*layer),
+		subscribers: make(map[*downTrack]struct{}),
+	}
+	if t.kind == webrtc.RTPCodecTypeAudio {
+		for _, ext := range receiver.GetParameters().HeaderExtensions {
+			if ext.URI == sdp.AudioLevelURI {
+				t.audioLevel = uint8(ext.ID)
+			}
+		}
+	}
+	return t
+}
+
+func (t *publishedTrack) addLayer(remote *webrtc.TrackRemote) *layer {
+	l := &layer{rid: remote.RID(), remote: remote}
+	l.seen.Store(time.Now().UnixNano())
+
+	t.mu.Lock()
+	t.layers[l.rid] = l
+	t.mu.Unlock()
+	return l
+}
+
+func (t *publishedTrack) attach(d *downTrack) {
+	t.mu.Lock()
+	t.subscribers[d] = struct{}{}
+	t.mu.Unlock()
+	if l := t.pick(d.layer()); l != nil {
+		t.requestKeyframe(l)
+	}
+}
+
+func (t *publishedTrack) detach(d *downTrack) {
+	t.mu.Lock()
+	delete(t.subscribers, d)
+	t.mu.Unlock()
+}
+
+// detachAll removes every subscriber and returns their down tracks
+func (t *publishedTrack) detachAll() []*downTrack {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	downTracks := make([]*downTrack, 0, len(t.subscribers))
+	for d := range t.subscribers {
+		downTracks = append(downTracks, d)
+	}
+	t.subscribers = make(map[*downTrack]struct{})
+	return downTracks
+}
+
+// forward copies the packets of a layer to the subscribers until the publisher
+// stops sending it
+func (t *publishedTrack) forward(l *layer) {
+	video := t.kind == webrtc.RTPCodecTypeVideo
+	for {
+		pkt, _, err := l.remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		l.seen.Store(time.Now().UnixNano())
+		if t.audioLevel != 0 {
+			if ext := pkt.GetExtension(t.audioLevel); len(ext) > 0 {
+				t.levelSum.Add(int64(ext[0] & 0x7f))
+				t.levelCount.Add(1)
+			}
+		}
+		keyframe := video && isKeyframe(t.codec.MimeType, pkt.Payload)
+
+		t.mu.RLock()
+		for d := range t.subscribers {
+			d.write(l, pkt, keyframe)
+		}
+		t.mu.RUnlock()
+	}
+}
+
+// level returns the mean audio level since it was last called, in -dBov
+func (t *publishedTrack) level() int64 {
+	count := t.levelCount.Swap(0)
+	sum := t.levelSum.Swap(0)
+	if count == 0 {
+		return 127
+	}
+	return sum / count
+}
+
+func (t *publishedTrack) pick(requested string) *layer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.pickLocked(requested)
+}
+
+// pickLocked returns the layer for a subscriber that asked for requested: the best
+// one the publisher sends that is not above it, or else the lowest one it sends.
+// The caller holds t.mu.
+func (t *publishedTrack) pickLocked(requested string) *layer {
+	now := time.Now().UnixNano()
+	var best, lowest *layer
+	for _, l := range t.layers {
+		if now-l.seen.Load() > int64(layerTimeout) {
+			continue
+		}
+		rank := layerRank[l.rid]
+		if lowest == nil || rank < layerRank[lowest.rid] {
+			lowest = l
+		}
+		if rank <= layerRank[requested] && (best == nil || rank > layerRank[best.rid]) {
+			best = l
+		}
+	}
+	if best == nil {
+		return lowest
+	}
+	return best
+}
+
+// requestKeyframe asks the publisher for a keyframe of a video layer, which new
+// subscribers and those switching layers have to start with
+func (t *publishedTrack) requestKeyframe(l *layer) {
+	if t.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := l.keyframeAt.Load()
+	if now-last < int64(keyframeInterval) || !l.keyframeAt.CompareAndSwap(last, now) {
+		return
+	}
+	t.owner.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(l.remote.SSRC())}})
+}
+
+// downTrack carries a published track to one subscriber. Of a simulcast track it
+// forwards one layer at a time and renumbers its packets, so the subscriber sees a
+// single continuous stream.
+type downTrack struct {
+	source     *publishedTrack
+	subscriber *peer
+	local      *webrtc.TrackLocalStaticRTP
+	sender     *webrtc.RTPSender
+
+	mu sync.Mutex
+	// requested is the layer the subscriber asked for, empty to pick by call size
+	requested string
+	current   *layer
+	target    *layer
+	// seqOffset and tsOffset map the sequence numbers and timestamps of the current
+	// layer onto those the subscriber sees
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastAt    time.Time
+}
+
+func newDownTrack(source *publishedTrack, subscriber *peer, local *webrtc.TrackLocalStaticRTP, sender *webrtc.RTPSender, requested string) *downTrack {
+	return &downTrack{
+		source:     source,
+		subscriber: subscriber,
+		local:      local,
+		sender:     sender,
+		requested:  requested,
+	}
+}
+
+// layer returns the layer the subscriber should get
+func (d *downTrack) layer() string {
+	if d.requested != "" {
+		return d.requested
+	}
+	return defaultLayer(int(d.subscriber.room.size.Load()))
+}
+
+func (d *downTrack) setLayer(requested string) {
+	d.mu.Lock()
+	d.requested = requested
+	d.mu.Unlock()
+}
+
+// write forwards a packet of layer l if it is the layer the subscriber gets. Video
+// switches layers on a keyframe of the new one, which decodes without the frames of
+// the old one. The caller holds source.mu for reading.
+func (d *downTrack) write(l *layer, pkt *rtp.Packet, keyframe bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if target := d.source.pickLocked(d.layer()); target != nil && target != d.target {
+		d.target = target
+		if target != d.current {
+			go d.source.requestKeyframe(target)
+		}
+	}
+	if l != d.current {
+		if l != d.target || (d.source.kind == webrtc.RTPCodecTypeVideo && !keyframe) {
+			return
+		}
+		if d.current != nil {
+			elapsed := uint32(time.Since(d.lastAt).Seconds() * float64(d.source.codec.ClockRate))
+			if elapsed == 0 {
+				elapsed = 1
+			}
+			d.seqOffset = d.lastSeq + 1 - pkt.SequenceNumber
+			d.tsOffset = d.lastTS + elapsed - pkt.Timestamp
+		}
+		d.current = l
+	}
+	if len(pkt.Payload) == 0 {
+		// Padding that probes bandwidth; dropped without a gap in the numbering
+		d.seqOffset--
+		return
+	}
+
+	header := pkt.Header
+	header.SequenceNumber += d.seqOffset
+	header.Timestamp += d.tsOffset
+	// Extension IDs were negotiated with the publisher, not the subscriber
+	header.Extension = false
+	header.ExtensionProfile = 0
+	header.Extensions = nil
+	header.Padding = false
+	d.lastSeq, d.lastTS, d.lastAt = header.SequenceNumber, header.Timestamp, time.Now()
+
+	// Fails only once the subscriber is gone, which removes the down track
+	d.local.WriteRTP(&rtp.Packet{Header: header, Payload: pkt.Payload})
+}
+
+// readRTCP passes the keyframe requests of the subscriber on to the publisher. It
+// has to read regardless, as interceptors such as the NACK responder need it.
+func (d *downTrack) readRTCP() {
+	for {
+		packets, _, err := d.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range packets {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				d.mu.Lock()
+				current := d.current
+				d.mu.Unlock()
+				if current != nil {
+					d.source.requestKeyframe(current)
+				}
+			}
+		}
+	}
+}
+
+// isKeyframe reports whether a video packet starts a keyframe. Packets of codecs it
+// cannot tell count as keyframes, so their layers still switch.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return vp8Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return vp9Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264Keyframe(payload)
+	default:
+		return true
+	}
+}
+
+// vp8Keyframe reads the payload descriptor of RFC 7741 and the frame header after it
+func vp8Keyframe(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	desc := payload[0]
+	// Only the start of partition 0 carries the frame header
+	if desc&0x10 == 0 || desc&0x07 != 0 {
+		return false
+	}
+	i := 1
+	if desc&0x80 != 0 {
+		if len(payload) <= i {
+			return false
+		}
+		ext := payload[i]
+		i++
+		if ext&0x80 != 0 {
+			// Picture ID of 7 or 15 bits
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 {
+			i++
+		}
+		if ext&0x30 != 0 {
+			i++
+		}
+	}
+	// The inverse key frame flag
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// vp9Keyframe reads the payload descriptor of RFC 9628: the start of a frame that
+// is not inter-picture predicted
+func vp9Keyframe(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+}
+
+// h264Keyframe looks for an IDR slice or a sequence parameter set in single NAL unit,
+// STAP-A and FU-A packets of RFC 6184
+func h264Keyframe(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch payload[0] & 0x1f {
+	case 5, 7:
+		return true
+	case 24:
+		for i := 1; i+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[i:]))
+			i += 2
+			if nal := payload[i] & 0x1f; nal == 5 || nal == 7 {
+				return true
+			}
+			i += size
+		}
+	case 28:
+		if len(payload) > 1 && payload[1]&0x80 != 0 {
+			nal := payload[1] & 0x1f
+			return nal == 5 || nal == 7
+		}
+	}
+	return false
+}
@@ -16,28 +16,110 @@ type UserRepository interface {
 	GetAll(ctx context.Context) ([]model.User, error)
 	SearchUsers(ctx context.Context, prefix string) ([]model.User, error)
 	UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error
+	UpdateRole(ctx context.Context, id uuid.UUID, role model.Role) error
+	UpdateUsername(ctx context.Context, id uuid.UUID, username string) error
+	// SetDisabled disables the account at disabledAt, or enables it when nil
+	SetDisabled(ctx context.Context, id uuid.UUID, disabledAt *time.Time) error
+	// UpdateLastSeen moves LastSeenAt forward to seenAt; it never moves it back
+	UpdateLastSeen(ctx context.Context, id uuid.UUID, seenAt time.Time) error
+	SetHideLastSeen(ctx context.Context, id uuid.UUID, hide bool) error
+	// GetPage returns users newest first
+	GetPage(ctx context.Context, page model.PageRequest) ([]model.User, error)
+	Count(ctx context.Context) (int, error)
+	// Delete removes a user together with their messages, memberships, calls, attachments and sessions
+	Delete(ctx context.Context, id uuid.UUID) error
 }
 
 type MessageRepository interface {
 	Create(ctx context.Context, msg *model.Message) error
+	GetByID(ctx context.Context, id uuid.UUID) (*model.Message, error)
+	// GetByClientMsgID returns the message senderID sent with a client-generated ID
+	GetByClientMsgID(ctx context.Context, senderID uuid.UUID, clientMsgID string) (*model.Message, error)
+	// GetCallEntry returns the timeline entry of a call addressed to receiverID
+	GetCallEntry(ctx context.Context, callID, receiverID uuid.UUID) (*model.Message, error)
+	// UpdatePayload replaces the payload and archives the previous one in the edit history
+	UpdatePayload(ctx context.Context, id uuid.UUID, payload []byte, editedAt time.Time) error
+	GetEdits(ctx context.Context, messageID uuid.UUID) ([]model.MessageEdit, error)
+	// MarkDeleted deletes a message for everyone, dropping its payload and edit history
+	MarkDeleted(ctx context.Context, id uuid.UUID, deletedAt time.Time) error
+	// HideForUser deletes a message for a single user only
+	HideForUser(ctx context.Context, messageID, userID uuid.UUID) error
 	GetByUserPair(ctx context.Context, user1, user2 uuid.UUID, limit, offset int) ([]model.Message, error)
-	GetByUserPairWithReadStatus(ctx context.Context, currentUser, partnerID uuid.UUID, limit, offset int) ([]model.MessageWithRead, error)
-	GetConversationPartners(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
+	GetByUserPairPage(ctx context.Context, currentUser, partnerID uuid.UUID, page model.PageRequest) ([]model.MessageWithRead, error)
+	GetByConversationPage(ctx context.Context, conversationID, currentUser uuid.UUID, page model.PageRequest) ([]model.MessageWithRead, error)
 	GetChatList(ctx context.Context, userID uuid.UUID) ([]ChatInfo, error)
-	MarkAsRead(ctx context.Context, userID, partnerID uuid.UUID) error
+	// AdvanceReadMarker moves the read watermark of a member forward to upTo and reports
+	// whether it moved; it never moves back
+	AdvanceReadMarker(ctx context.Context, conversationID, userID uuid.UUID, upTo model.Cursor, readAt time.Time) (bool, error)
+	// AddReadReceipts records that userID read the messages of a conversation after from
+	// (from the start if nil) up to and including upTo, except their own
+	AddReadReceipts(ctx context.Context, conversationID, userID uuid.UUID, from *model.Cursor, upTo model.Cursor, readAt time.Time) error
+	// GetReadReceipts returns the per-message receipts of a message, oldest first
+	GetReadReceipts(ctx context.Context, messageID uuid.UUID) ([]model.MessageRead, error)
 	MarkAsDelivered(ctx context.Context, messageID, receiverID uuid.UUID) error
+	// Count returns the number of messages not deleted for everyone
+	Count(ctx context.Context) (int, error)
+	// GetPayloadsAfter returns up to limit messages not deleted for everyone whose ID sorts
+	// after the given one, in ID order. Only ID, SenderID, ReceiverID and Payload are set.
+	GetPayloadsAfter(ctx context.Context, after uuid.UUID, limit int) ([]model.Message, error)
+	// ReplacePayload swaps the stored payload for one encrypting the same content, only if it
+	// still equals oldPayload, and reports whether it did. Timestamps and edit history stay as they are.
+	ReplacePayload(ctx context.Context, id uuid.UUID, oldPayload, newPayload []byte) (bool, error)
+	// GetEditsByMessageIDs returns the previous versions of the given messages
+	GetEditsByMessageIDs(ctx context.Context, messageIDs []uuid.UUID) ([]model.MessageEdit, error)
+	// ReplaceEditPayload is ReplacePayload for a previous version of a message
+	ReplaceEditPayload(ctx context.Context, messageID uuid.UUID, oldPayload, newPayload []byte) (bool, error)
+	// GetUnreadCounts returns unread message counts keyed by conversation ID
 	GetUnreadCounts(ctx context.Context, userID uuid.UUID) (map[uuid.UUID]int, error)
+
+	// SyncHead returns the position every change of a finished transaction sorts before;
+	// changes past it may still be uncommitted.
+	SyncHead(ctx context.Context) (model.SyncPosition, error)
+	// The *Since methods return up to limit changes visible to userID positioned after since
+	// and before until, in position order. GetSince covers new, edited and deleted messages.
+	GetSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.Message, error)
+	GetReadReceiptsSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.ReadReceipt, error)
+	GetDeliveryReceiptsSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.DeliveryReceipt, error)
 }
 
 type ChatInfo struct {
+	ConversationID uuid.UUID
+	Type           model.ConversationType
+	Title          string
+	// PartnerID is the other member of a direct conversation (uuid.Nil for groups)
 	PartnerID   uuid.UUID
 	LastMessage *model.Message
 	UnreadCount int
 }
 
+type ConversationRepository interface {
+	Create(ctx context.Context, conv *model.Conversation) error
+	GetByID(ctx context.Context, id uuid.UUID) (*model.Conversation, error)
+	// GetOrCreateDirect returns the two-member direct conversation for a user pair, creating it if needed
+	GetOrCreateDirect(ctx context.Context, user1, user2 uuid.UUID) (*model.Conversation, error)
+	GetByUserID(ctx context.Context, userID uuid.UUID) ([]model.Conversation, error)
+	UpdateTitle(ctx context.Context, id uuid.UUID, title string) error
+	Delete(ctx context.Context, id uuid.UUID) error
+
+	AddMember(ctx context.Context, member *model.ConversationMember) error
+	GetMember(ctx context.Context, conversationID, userID uuid.UUID) (*model.ConversationMember, error)
+	GetMembers(ctx context.Context, conversationID uuid.UUID) ([]model.ConversationMember, error)
+	GetMemberIDs(ctx context.Context, conversationID uuid.UUID) ([]uuid.UUID, error)
+	// GetContactIDs returns every other user sharing a conversation with userID
+	GetContactIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
+	UpdateMemberRole(ctx context.Context, conversationID, userID uuid.UUID, role string) error
+	RemoveMember(ctx context.Context, conversationID, userID uuid.UUID) error
+	// GetNewestMessage returns the position of the newest message of a conversation, or
+	// nil if it has none
+	GetNewestMessage(ctx context.Context, conversationID uuid.UUID) (*model.Cursor, error)
+}
+
 type CallRepository interface {
 	Create(ctx context.Context, call *model.Call) error
 	GetByID(ctx context.Context, id uuid.UUID) (*model.Call, error)
+	// GetByIDForUpdate is GetByID that also locks the call until the transaction of ctx
+	// ends, so changes of the call and its participants made under the lock do not interleave
+	GetByIDForUpdate(ctx context.Context, id uuid.UUID) (*model.Call, error)
 	GetByStatus(ctx context.Context, status string) ([]model.Call, error)
 	UpdateStatus(ctx context.Context, id uuid.UUID, status string) error
 	UpdateStartedAt(ctx context.Context, id uuid.UUID, startedAt *time.Time) error
@@ -53,7 +135,77 @@ type CallRepository interface {
 	UpdateParticipantMediaSettings(ctx context.Context, callID, userID uuid.UUID, audioEnabled, videoEnabled bool) error
 	DeleteParticipant(ctx context.Context, callID, userID uuid.UUID) error
 
-	GetCallHistory(ctx context.Context, userID uuid.UUID, limit, offset int) ([]model.CallHistoryItem, error)
+	GetCallHistoryPage(ctx context.Context, userID uuid.UUID, page model.PageRequest) ([]model.CallHistoryItem, error)
+	// GetUpdatedSince returns up to limit calls of userID changed between the positions since
+	// and until, like MessageRepository.GetSince
+	GetUpdatedSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.Call, error)
+}
+
+type AttachmentRepository interface {
+	Create(ctx context.Context, att *model.Attachment) error
+	GetByID(ctx context.Context, id uuid.UUID) (*model.Attachment, error)
+	GetByIDs(ctx context.Context, ids []uuid.UUID) ([]model.Attachment, error)
+	// GetByMessageIDs returns the attachments of the given messages in upload order
+	GetByMessageIDs(ctx context.Context, messageIDs []uuid.UUID) ([]model.Attachment, error)
+	// GetAfter returns up to limit attachments whose ID sorts after the given one, in ID order
+	GetAfter(ctx context.Context, after uuid.UUID, limit int) ([]model.Attachment, error)
+	// GetByUserID returns the attachments deleting the user removes: their uploads and
+	// the files of direct messages they sent or received
+	GetByUserID(ctx context.Context, userID uuid.UUID) ([]model.Attachment, error)
+	// AttachToMessage links attachments no message references yet and returns how many were linked
+	AttachToMessage(ctx context.Context, ids []uuid.UUID, messageID uuid.UUID) (int, error)
+	// DeleteByMessageID removes the attachments of a message and returns them
+	DeleteByMessageID(ctx context.Context, messageID uuid.UUID) ([]model.Attachment, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+type SessionRepository interface {
+	Create(ctx context.Context, session *model.Session) error
+	GetByID(ctx context.Context, id uuid.UUID) (*model.Session, error)
+	// GetActiveByUserID returns sessions that are neither revoked nor expired, most recently used first
+	GetActiveByUserID(ctx context.Context, userID uuid.UUID) ([]model.Session, error)
+	// Rotate replaces the refresh hash only if it still equals oldHash and reports whether it did
+	Rotate(ctx context.Context, id uuid.UUID, oldHash, newHash string, usedAt, expiresAt time.Time) (bool, error)
+	Revoke(ctx context.Context, id uuid.UUID, revokedAt time.Time) error
+	// RevokeByUserID revokes every active session of a user except one (uuid.Nil for none)
+	// and returns the IDs of the revoked sessions
+	RevokeByUserID(ctx context.Context, userID, except uuid.UUID, revokedAt time.Time) ([]uuid.UUID, error)
+}
+
+// KeyRepository stores the public keys of devices taking part in end-to-end encryption
+type KeyRepository interface {
+	// SaveDevice creates a device or replaces its identity key and signed prekey
+	SaveDevice(ctx context.Context, device *model.Device) error
+	GetDevice(ctx context.Context, id uuid.UUID) (*model.Device, error)
+	// GetDevicesByUserID returns the devices of a user, oldest first
+	GetDevicesByUserID(ctx context.Context, userID uuid.UUID) ([]model.Device, error)
+	// DeleteDevice removes a device with its one-time prekeys
+	DeleteDevice(ctx context.Context, id uuid.UUID) error
+	// AddPrekeys stores one-time prekeys, skipping key IDs the device already has, and
+	// returns how many were added
+	AddPrekeys(ctx context.Context, deviceID uuid.UUID, prekeys []model.OneTimePrekey) (int, error)
+	CountPrekeys(ctx context.Context, deviceID uuid.UUID) (int, error)
+	// ClaimPrekey removes and returns the one-time prekey with the lowest key ID,
+	// or nil, nil when the device has none left
+	ClaimPrekey(ctx context.Context, deviceID uuid.UUID) (*model.OneTimePrekey, error)
+	DeletePrekeys(ctx context.Context, deviceID uuid.UUID) error
+}
+
+// DataKeyRepository stores wrapped data keys for envelope encryption; it satisfies
+// crypto.DataKeyStore
+type DataKeyRepository interface {
+	// GetByID returns nil, nil when the key does not exist
+	GetByID(ctx context.Context, id string) (*model.DataKey, error)
+	// Create stores a data key unless one with its ID exists and reports whether it did
+	Create(ctx context.Context, key *model.DataKey) (bool, error)
+}
+
+// BlobStore keeps opaque attachment bytes by key
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns nil, nil when the key does not exist
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
 }
 
 type TransactionManager interface {
@@ -0,0 +1,1885 @@
+// Package memory implements the storage interfaces in process memory.
+// It mirrors the semantics of the postgres package and is meant for tests
+// and database-less demo mode; nothing survives a restart.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/model"
+	"messenger/internal/storage"
+)
+
+type Storage struct {
+	mu   sync.RWMutex
+	txMu sync.Mutex
+	data *state
+}
+
+type state struct {
+	users         map[uuid.UUID]model.User
+	messages      map[uuid.UUID]model.Message
+	conversations map[uuid.UUID]model.Conversation
+	directKeys    map[string]uuid.UUID
+	// members is keyed by conversation ID, then user ID
+	members map[uuid.UUID]map[uuid.UUID]model.ConversationMember
+	// deliveries is keyed by message ID, then receiver ID
+	deliveries map[uuid.UUID]map[uuid.UUID]delivery
+	// readPos holds the sync position of each read watermark, keyed like members
+	readPos map[uuid.UUID]map[uuid.UUID]model.SyncPosition
+	// reads holds per-message read receipts keyed by message ID, then reader ID
+	reads map[uuid.UUID]map[uuid.UUID]time.Time
+	// edits holds previous versions keyed by message ID, oldest first
+	edits map[uuid.UUID][]model.MessageEdit
+	// hidden is keyed by message ID, then the user who deleted it for themselves
+	hidden map[uuid.UUID]map[uuid.UUID]time.Time
+	calls  map[uuid.UUID]model.Call
+	// participants is keyed by call ID, then user ID
+	participants map[uuid.UUID]map[uuid.UUID]model.CallParticipant
+	attachments  map[uuid.UUID]model.Attachment
+	sessions     map[uuid.UUID]model.Session
+	devices      map[uuid.UUID]model.Device
+	// prekeys is keyed by device ID, then key ID
+	prekeys  map[uuid.UUID]map[int][]byte
+	dataKeys map[string]model.DataKey
+	// syncSeq numbers changes for sync; every write is its own transaction here
+	syncSeq int64
+}
+
+type delivery struct {
+	at  time.Time
+	pos model.SyncPosition
+}
+
+func newState() *state {
+	return &state{
+		users:         make(map[uuid.UUID]model.User),
+		messages:      make(map[uuid.UUID]model.Message),
+		conversations: make(map[uuid.UUID]model.Conversation),
+		directKeys:    make(map[string]uuid.UUID),
+		members:       make(map[uuid.UUID]map[uuid.UUID]model.ConversationMember),
+		deliveries:    make(map[uuid.UUID]map[uuid.UUID]delivery),
+		readPos:       make(map[uuid.UUID]map[uuid.UUID]model.SyncPosition),
+		reads:         make(map[uuid.UUID]map[uuid.UUID]time.Time),
+		edits:         make(map[uuid.UUID][]model.MessageEdit),
+		hidden:        make(map[uuid.UUID]map[uuid.UUID]time.Time),
+		calls:         make(map[uuid.UUID]model.Call),
+		participants:  make(map[uuid.UUID]map[uuid.UUID]model.CallParticipant),
+		attachments:   make(map[uuid.UUID]model.Attachment),
+		sessions:      make(map[uuid.UUID]model.Session),
+		devices:       make(map[uuid.UUID]model.Device),
+		prekeys:       make(map[uuid.UUID]map[int][]byte),
+		dataKeys:      make(map[string]model.DataKey),
+	}
+}
+
+// nextSyncPos positions a change after every change made before it
+func (st *state) nextSyncPos() model.SyncPosition {
+	st.syncSeq++
+	return model.SyncPosition{Txn: st.syncSeq, Seq: st.syncSeq}
+}
+
+// setReadPos positions a change of a member's read watermark
+func (st *state) setReadPos(tx *txLog, conversationID, userID uuid.UUID) {
+	if st.readPos[conversationID] == nil {
+		put(tx, st.readPos, conversationID, make(map[uuid.UUID]model.SyncPosition))
+	}
+	put(tx, st.readPos[conversationID], userID, st.nextSyncPos())
+}
+
+func New() *Storage {
+	return &Storage{data: newState()}
+}
+
+func (s *Storage) User() storage.UserRepository {
+	return &UserRepo{s: s}
+}
+
+func (s *Storage) Message() storage.MessageRepository {
+	return &MessageRepo{s: s}
+}
+
+func (s *Storage) Conversation() storage.ConversationRepository {
+	return &ConversationRepo{s: s}
+}
+
+func (s *Storage) Call() storage.CallRepository {
+	return &CallRepo{s: s}
+}
+
+func (s *Storage) Attachment() storage.AttachmentRepository {
+	return &AttachmentRepo{s: s}
+}
+
+func (s *Storage) Session() storage.SessionRepository {
+	return &SessionRepo{s: s}
+}
+
+func (s *Storage) Key() storage.KeyRepository {
+	return &KeyRepo{s: s}
+}
+
+func (s *Storage) DataKey() storage.DataKeyRepository {
+	return &DataKeyRepo{s: s}
+}
+
+// WithTx runs fn with transactions serialized against each other. The writes fn
+// makes are logged, and undone in reverse if it fails; writes made meanwhile
+// outside the transaction are kept.
+func (s *Storage) WithTx(ctx context.Context, fn func(context.Context) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	tx := &txLog{}
+	if err := fn(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		s.mu.Lock()
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+type txKey struct{}
+
+// txLog holds what undoes each write of a transaction
+type txLog struct {
+	undo []func()
+}
+
+// txFrom returns the log of the transaction ctx runs in, nil outside of one
+func txFrom(ctx context.Context) *txLog {
+	tx, _ := ctx.Value(txKey{}).(*txLog)
+	return tx
+}
+
+// put sets m[k], logging the entry it replaces when tx is not nil
+func put[K comparable, V any](tx *txLog, m map[K]V, k K, v V) {
+	remember(tx, m, k)
+	m[k] = v
+}
+
+// del deletes m[k], logging the entry when tx is not nil
+func del[K comparable, V any](tx *txLog, m map[K]V, k K) {
+	if _, ok := m[k]; !ok {
+		return
+	}
+	remember(tx, m, k)
+	delete(m, k)
+}
+
+func remember[K comparable, V any](tx *txLog, m map[K]V, k K) {
+	if tx == nil {
+		return
+	}
+	old, existed := m[k]
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			m[k] = old
+		} else {
+			delete(m, k)
+		}
+	})
+}
+
+func directKey(user1, user2 uuid.UUID) string {
+	if bytes.Compare(user1[:], user2[:]) > 0 {
+		user1, user2 = user2, user1
+	}
+	return user1.String() + ":" + user2.String()
+}
+
+// newestFirst orders messages like the postgres queries: created_at DESC
+func newestFirst(messages []model.Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].CreatedAt.Equal(messages[j].CreatedAt) {
+			return bytes.Compare(messages[i].ID[:], messages[j].ID[:]) > 0
+		}
+		return messages[i].CreatedAt.After(messages[j].CreatedAt)
+	})
+}
+
+func paginate[T any](items []T, limit, offset int) []T {
+	if offset >= len(items) {
+		return items[:0]
+	}
+	items = items[offset:]
+	if limit >= 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+// compareCursor orders cursors by (created_at, id) like a postgres row comparison
+func compareCursor(a, b model.Cursor) int {
+	if a.CreatedAt.Before(b.CreatedAt) {
+		return -1
+	}
+	if a.CreatedAt.After(b.CreatedAt) {
+		return 1
+	}
+	return bytes.Compare(a.ID[:], b.ID[:])
+}
+
+// keysetPage selects page from items sorted newest first. Forward pages keep
+// the items closest to the After cursor.
+func keysetPage[T any](items []T, key func(T) model.Cursor, page model.PageRequest) []T {
+	selected := make([]T, 0, len(items))
+	for _, item := range items {
+		c := key(item)
+		if page.Before != nil && compareCursor(c, *page.Before) >= 0 {
+			continue
+		}
+		if page.After != nil && compareCursor(c, *page.After) <= 0 {
+			continue
+		}
+		selected = append(selected, item)
+	}
+	if page.Forward() && page.Limit < len(selected) {
+		return selected[len(selected)-page.Limit:]
+	}
+	return paginate(selected, page.Limit, 0)
+}
+
+type UserRepo struct {
+	s *Storage
+}
+
+func (r *UserRepo) Create(ctx context.Context, user *model.User) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.users[user.ID]; ok {
+		return fmt.Errorf("user %s already exists", user.ID)
+	}
+	for _, u := range r.s.data.users {
+		if strings.EqualFold(u.Username, user.Username) {
+			return fmt.Errorf("username %s already exists", user.Username)
+		}
+	}
+	put(tx, r.s.data.users, user.ID, *user)
+	return nil
+}
+
+func (r *UserRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.User, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	user, ok := r.s.data.users[id]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+func (r *UserRepo) GetByIDs(ctx context.Context, ids []uuid.UUID) ([]model.User, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	users := []model.User{}
+	seen := make(map[uuid.UUID]bool)
+	for _, id := range ids {
+		if user, ok := r.s.data.users[id]; ok && !seen[id] {
+			seen[id] = true
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (r *UserRepo) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	for _, user := range r.s.data.users {
+		if strings.EqualFold(user.Username, username) {
+			u := user
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *UserRepo) GetAll(ctx context.Context) ([]model.User, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	users := make([]model.User, 0, len(r.s.data.users))
+	for _, user := range r.s.data.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (r *UserRepo) GetPage(ctx context.Context, page model.PageRequest) ([]model.User, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	users := make([]model.User, 0, len(r.s.data.users))
+	for _, user := range r.s.data.users {
+		users = append(users, user)
+	}
+	key := func(user model.User) model.Cursor {
+		return model.Cursor{CreatedAt: user.CreatedAt, ID: user.ID}
+	}
+	sort.Slice(users, func(i, j int) bool { return compareCursor(key(users[i]), key(users[j])) > 0 })
+	return keysetPage(users, key, page), nil
+}
+
+func (r *UserRepo) Count(ctx context.Context) (int, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	return len(r.s.data.users), nil
+}
+
+func (r *UserRepo) SearchUsers(ctx context.Context, prefix string) ([]model.User, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	lowerPrefix := strings.ToLower(prefix)
+	users := []model.User{}
+	for _, user := range r.s.data.users {
+		if strings.HasPrefix(strings.ToLower(user.Username), lowerPrefix) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return paginate(users, 10, 0), nil
+}
+
+func (r *UserRepo) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if user, ok := r.s.data.users[id]; ok {
+		user.PasswordHash = passwordHash
+		put(tx, r.s.data.users, id, user)
+	}
+	return nil
+}
+
+func (r *UserRepo) UpdateRole(ctx context.Context, id uuid.UUID, role model.Role) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if user, ok := r.s.data.users[id]; ok {
+		user.Role = role
+		put(tx, r.s.data.users, id, user)
+	}
+	return nil
+}
+
+func (r *UserRepo) UpdateUsername(ctx context.Context, id uuid.UUID, username string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	for _, u := range r.s.data.users {
+		if u.ID != id && strings.EqualFold(u.Username, username) {
+			return fmt.Errorf("username %s already exists", username)
+		}
+	}
+	if user, ok := r.s.data.users[id]; ok {
+		user.Username = username
+		put(tx, r.s.data.users, id, user)
+	}
+	return nil
+}
+
+func (r *UserRepo) SetDisabled(ctx context.Context, id uuid.UUID, disabledAt *time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if user, ok := r.s.data.users[id]; ok {
+		user.DisabledAt = disabledAt
+		put(tx, r.s.data.users, id, user)
+	}
+	return nil
+}
+
+func (r *UserRepo) UpdateLastSeen(ctx context.Context, id uuid.UUID, seenAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if user, ok := r.s.data.users[id]; ok && (user.LastSeenAt == nil || user.LastSeenAt.Before(seenAt)) {
+		user.LastSeenAt = &seenAt
+		put(tx, r.s.data.users, id, user)
+	}
+	return nil
+}
+
+func (r *UserRepo) SetHideLastSeen(ctx context.Context, id uuid.UUID, hide bool) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if user, ok := r.s.data.users[id]; ok {
+		user.HideLastSeen = hide
+		put(tx, r.s.data.users, id, user)
+	}
+	return nil
+}
+
+// Delete mirrors the ON DELETE rules of the postgres schema
+func (r *UserRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	st := r.s.data
+	for msgID, msg := range st.messages {
+		if msg.SenderID == id || msg.ReceiverID == id {
+			del(tx, st.messages, msgID)
+			del(tx, st.deliveries, msgID)
+			del(tx, st.reads, msgID)
+			del(tx, st.edits, msgID)
+			del(tx, st.hidden, msgID)
+		}
+	}
+	for _, receivers := range st.deliveries {
+		del(tx, receivers, id)
+	}
+	for _, readers := range st.reads {
+		del(tx, readers, id)
+	}
+	for _, users := range st.hidden {
+		del(tx, users, id)
+	}
+	for convID, conv := range st.conversations {
+		if conv.CreatedBy != nil && *conv.CreatedBy == id {
+			conv.CreatedBy = nil
+			put(tx, st.conversations, convID, conv)
+		}
+	}
+	for _, members := range st.members {
+		del(tx, members, id)
+	}
+	for _, positions := range st.readPos {
+		del(tx, positions, id)
+	}
+	for callID, call := range st.calls {
+		if call.InitiatorID == id {
+			del(tx, st.calls, callID)
+			del(tx, st.participants, callID)
+		}
+	}
+	for _, participants := range st.participants {
+		del(tx, participants, id)
+	}
+	for attID, att := range st.attachments {
+		if att.UploaderID == id {
+			del(tx, st.attachments, attID)
+		} else if att.MessageID != nil {
+			if _, ok := st.messages[*att.MessageID]; !ok {
+				del(tx, st.attachments, attID)
+			}
+		}
+	}
+	for sessionID, session := range st.sessions {
+		if session.UserID == id {
+			del(tx, st.sessions, sessionID)
+		}
+	}
+	for deviceID, device := range st.devices {
+		if device.UserID == id {
+			del(tx, st.devices, deviceID)
+			del(tx, st.prekeys, deviceID)
+		}
+	}
+	del(tx, st.users, id)
+	return nil
+}
+
+type MessageRepo struct {
+	s *Storage
+}
+
+func (r *MessageRepo) Create(ctx context.Context, msg *model.Message) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.messages[msg.ID]; ok {
+		return fmt.Errorf("message %s already exists", msg.ID)
+	}
+	if _, ok := r.s.data.conversations[msg.ConversationID]; !ok {
+		return fmt.Errorf("conversation %s does not exist", msg.ConversationID)
+	}
+	if msg.ClientMsgID != "" {
+		for _, existing := range r.s.data.messages {
+			if existing.SenderID == msg.SenderID && existing.ClientMsgID == msg.ClientMsgID {
+				return fmt.Errorf("client message id %q already used", msg.ClientMsgID)
+			}
+		}
+	}
+	if msg.CallID != nil {
+		for _, existing := range r.s.data.messages {
+			if existing.CallID != nil && *existing.CallID == *msg.CallID && existing.ReceiverID == msg.ReceiverID {
+				return fmt.Errorf("call %s already has an entry for %s", *msg.CallID, msg.ReceiverID)
+			}
+		}
+	}
+	if msg.Kind == "" {
+		msg.Kind = model.MessageKindText
+	}
+	msg.SyncPos = r.s.data.nextSyncPos()
+	put(tx, r.s.data.messages, msg.ID, *msg)
+	return nil
+}
+
+func (r *MessageRepo) GetCallEntry(ctx context.Context, callID, receiverID uuid.UUID) (*model.Message, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	for _, msg := range r.s.data.messages {
+		if msg.CallID != nil && *msg.CallID == callID && msg.ReceiverID == receiverID {
+			return &msg, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MessageRepo) GetByClientMsgID(ctx context.Context, senderID uuid.UUID, clientMsgID string) (*model.Message, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	for _, msg := range r.s.data.messages {
+		if msg.SenderID == senderID && msg.ClientMsgID == clientMsgID {
+			return &msg, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MessageRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Message, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	msg, ok := r.s.data.messages[id]
+	if !ok {
+		return nil, nil
+	}
+	return &msg, nil
+}
+
+func (r *MessageRepo) UpdatePayload(ctx context.Context, id uuid.UUID, payload []byte, editedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	msg, ok := r.s.data.messages[id]
+	if !ok {
+		return nil
+	}
+	put(tx, r.s.data.edits, id, append(r.s.data.edits[id], model.MessageEdit{MessageID: id, Payload: msg.Payload, EditedAt: editedAt}))
+	msg.Payload = payload
+	msg.EditedAt = &editedAt
+	msg.SyncPos = r.s.data.nextSyncPos()
+	put(tx, r.s.data.messages, id, msg)
+	return nil
+}
+
+func (r *MessageRepo) GetEdits(ctx context.Context, messageID uuid.UUID) ([]model.MessageEdit, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	return append([]model.MessageEdit{}, r.s.data.edits[messageID]...), nil
+}
+
+func (r *MessageRepo) MarkDeleted(ctx context.Context, id uuid.UUID, deletedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	msg, ok := r.s.data.messages[id]
+	if !ok {
+		return nil
+	}
+	del(tx, r.s.data.edits, id)
+	msg.Payload = []byte{}
+	msg.DeletedAt = &deletedAt
+	msg.SyncPos = r.s.data.nextSyncPos()
+	put(tx, r.s.data.messages, id, msg)
+	return nil
+}
+
+func (r *MessageRepo) HideForUser(ctx context.Context, messageID, userID uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.messages[messageID]; !ok {
+		return fmt.Errorf("message %s does not exist", messageID)
+	}
+	if r.s.data.hidden[messageID] == nil {
+		put(tx, r.s.data.hidden, messageID, make(map[uuid.UUID]time.Time))
+	}
+	if _, ok := r.s.data.hidden[messageID][userID]; !ok {
+		put(tx, r.s.data.hidden[messageID], userID, time.Now())
+	}
+	return nil
+}
+
+func (r *MessageRepo) GetByUserPair(ctx context.Context, user1, user2 uuid.UUID, limit, offset int) ([]model.Message, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	messages := []model.Message{}
+	for _, msg := range r.s.data.messages {
+		if (msg.SenderID == user1 && msg.ReceiverID == user2) || (msg.SenderID == user2 && msg.ReceiverID == user1) {
+			messages = append(messages, msg)
+		}
+	}
+	newestFirst(messages)
+	return paginate(messages, limit, offset), nil
+}
+
+func (r *MessageRepo) GetByUserPairPage(ctx context.Context, currentUser, partnerID uuid.UUID, page model.PageRequest) ([]model.MessageWithRead, error) {
+	r.s.mu.RLock()
+	conversationID, ok := r.s.data.directKeys[directKey(currentUser, partnerID)]
+	r.s.mu.RUnlock()
+	if !ok {
+		return []model.MessageWithRead{}, nil
+	}
+	return r.GetByConversationPage(ctx, conversationID, currentUser, page)
+}
+
+func (r *MessageRepo) GetByConversationPage(ctx context.Context, conversationID, currentUser uuid.UUID, page model.PageRequest) ([]model.MessageWithRead, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	messages := r.s.data.visibleMessages(conversationID, currentUser)
+	newestFirst(messages)
+	messages = keysetPage(messages, func(m model.Message) model.Cursor {
+		return model.Cursor{CreatedAt: m.CreatedAt, ID: m.ID}
+	}, page)
+
+	result := make([]model.MessageWithRead, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, r.s.data.withReadStatus(msg, currentUser))
+	}
+	return result, nil
+}
+
+func (st *state) conversationMessages(conversationID uuid.UUID) []model.Message {
+	messages := []model.Message{}
+	for _, msg := range st.messages {
+		if msg.ConversationID == conversationID {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// visibleMessages returns the conversation's messages userID has not deleted for themselves
+func (st *state) visibleMessages(conversationID, userID uuid.UUID) []model.Message {
+	messages := []model.Message{}
+	for _, msg := range st.conversationMessages(conversationID) {
+		if !st.isHidden(msg.ID, userID) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func (st *state) isHidden(messageID, userID uuid.UUID) bool {
+	_, ok := st.hidden[messageID][userID]
+	return ok
+}
+
+// withReadStatus mirrors the postgres read/delivery rules: outgoing messages are
+// read once every other member's watermark reached them, incoming ones once
+// currentUser's has
+func (st *state) withReadStatus(msg model.Message, currentUser uuid.UUID) model.MessageWithRead {
+	result := model.MessageWithRead{Message: msg, ReadBy: []uuid.UUID{}}
+	members := st.members[msg.ConversationID]
+	position := model.Cursor{CreatedAt: msg.CreatedAt, ID: msg.ID}
+
+	for id, m := range members {
+		if id != msg.SenderID && hasRead(m, position) {
+			result.ReadBy = append(result.ReadBy, id)
+		}
+	}
+	sort.Slice(result.ReadBy, func(i, j int) bool {
+		return bytes.Compare(result.ReadBy[i][:], result.ReadBy[j][:]) < 0
+	})
+
+	if msg.SenderID == currentUser {
+		others := len(members)
+		if _, ok := members[currentUser]; ok {
+			others--
+		}
+		result.IsRead = len(result.ReadBy) == others
+		result.IsDelivered = len(st.deliveries[msg.ID]) > 0
+	} else {
+		if me, ok := members[currentUser]; ok {
+			result.IsRead = hasRead(me, position)
+		}
+		result.IsDelivered = true
+	}
+	return result
+}
+
+// hasRead reports whether the read watermark of a member is at or after position
+func hasRead(member model.ConversationMember, position model.Cursor) bool {
+	upTo := member.ReadUpTo()
+	return upTo != nil && compareCursor(*upTo, position) >= 0
+}
+
+func (r *MessageRepo) Count(ctx context.Context) (int, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	count := 0
+	for _, msg := range r.s.data.messages {
+		if msg.DeletedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *MessageRepo) GetPayloadsAfter(ctx context.Context, after uuid.UUID, limit int) ([]model.Message, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	messages := []model.Message{}
+	for _, msg := range r.s.data.messages {
+		if msg.DeletedAt == nil && !msg.E2E && bytes.Compare(msg.ID[:], after[:]) > 0 {
+			messages = append(messages, model.Message{ID: msg.ID, SenderID: msg.SenderID, ReceiverID: msg.ReceiverID, Payload: msg.Payload})
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return bytes.Compare(messages[i].ID[:], messages[j].ID[:]) < 0 })
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (r *MessageRepo) ReplacePayload(ctx context.Context, id uuid.UUID, oldPayload, newPayload []byte) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	msg, ok := r.s.data.messages[id]
+	if !ok || msg.DeletedAt != nil || msg.E2E || !bytes.Equal(msg.Payload, oldPayload) {
+		return false, nil
+	}
+	msg.Payload = newPayload
+	put(tx, r.s.data.messages, id, msg)
+	return true, nil
+}
+
+func (r *MessageRepo) GetEditsByMessageIDs(ctx context.Context, messageIDs []uuid.UUID) ([]model.MessageEdit, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	edits := []model.MessageEdit{}
+	for _, id := range messageIDs {
+		edits = append(edits, r.s.data.edits[id]...)
+	}
+	return edits, nil
+}
+
+func (r *MessageRepo) ReplaceEditPayload(ctx context.Context, messageID uuid.UUID, oldPayload, newPayload []byte) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	edits := r.s.data.edits[messageID]
+	for i := range edits {
+		if bytes.Equal(edits[i].Payload, oldPayload) {
+			replaced := append([]model.MessageEdit{}, edits...)
+			replaced[i].Payload = newPayload
+			put(tx, r.s.data.edits, messageID, replaced)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *MessageRepo) GetChatList(ctx context.Context, userID uuid.UUID) ([]storage.ChatInfo, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	type entry struct {
+		chat    storage.ChatInfo
+		sortKey time.Time
+	}
+	var entries []entry
+
+	for convID, members := range r.s.data.members {
+		if _, ok := members[userID]; !ok {
+			continue
+		}
+		conv := r.s.data.conversations[convID]
+
+		var messages []model.Message
+		for _, msg := range r.s.data.visibleMessages(convID, userID) {
+			if msg.DeletedAt == nil {
+				messages = append(messages, msg)
+			}
+		}
+		if len(messages) == 0 && conv.Type != model.ConversationTypeGroup {
+			continue
+		}
+
+		chat := storage.ChatInfo{
+			ConversationID: convID,
+			Type:           conv.Type,
+			Title:          conv.Title,
+		}
+		if conv.Type == model.ConversationTypeDirect {
+			chat.PartnerID = userID
+			for id := range members {
+				if id != userID {
+					chat.PartnerID = id
+				}
+			}
+		}
+
+		sortKey := conv.CreatedAt
+		if len(messages) > 0 {
+			newestFirst(messages)
+			last := messages[0]
+			chat.LastMessage = &last
+			sortKey = last.CreatedAt
+		}
+		entries = append(entries, entry{chat: chat, sortKey: sortKey})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].sortKey.After(entries[j].sortKey) })
+
+	chats := make([]storage.ChatInfo, 0, len(entries))
+	for _, e := range entries {
+		chats = append(chats, e.chat)
+	}
+	return chats, nil
+}
+
+func (r *MessageRepo) AdvanceReadMarker(ctx context.Context, conversationID, userID uuid.UUID, upTo model.Cursor, readAt time.Time) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	member, ok := r.s.data.members[conversationID][userID]
+	if !ok {
+		return false, nil
+	}
+	if current := member.ReadUpTo(); current != nil && compareCursor(*current, upTo) >= 0 {
+		return false, nil
+	}
+	messageID, messageAt := upTo.ID, upTo.CreatedAt
+	member.LastReadMessageID = &messageID
+	member.LastReadMessageAt = &messageAt
+	member.LastReadAt = &readAt
+	put(tx, r.s.data.members[conversationID], userID, member)
+	r.s.data.setReadPos(tx, conversationID, userID)
+	return true, nil
+}
+
+func (r *MessageRepo) AddReadReceipts(ctx context.Context, conversationID, userID uuid.UUID, from *model.Cursor, upTo model.Cursor, readAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	for _, msg := range r.s.data.conversationMessages(conversationID) {
+		position := model.Cursor{CreatedAt: msg.CreatedAt, ID: msg.ID}
+		if msg.SenderID == userID || compareCursor(position, upTo) > 0 || (from != nil && compareCursor(position, *from) <= 0) {
+			continue
+		}
+		if r.s.data.reads[msg.ID] == nil {
+			put(tx, r.s.data.reads, msg.ID, make(map[uuid.UUID]time.Time))
+		}
+		if _, ok := r.s.data.reads[msg.ID][userID]; !ok {
+			put(tx, r.s.data.reads[msg.ID], userID, readAt)
+		}
+	}
+	return nil
+}
+
+func (r *MessageRepo) GetReadReceipts(ctx context.Context, messageID uuid.UUID) ([]model.MessageRead, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	reads := []model.MessageRead{}
+	for userID, at := range r.s.data.reads[messageID] {
+		reads = append(reads, model.MessageRead{MessageID: messageID, UserID: userID, ReadAt: at})
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		return compareCursor(model.Cursor{CreatedAt: reads[i].ReadAt, ID: reads[i].UserID}, model.Cursor{CreatedAt: reads[j].ReadAt, ID: reads[j].UserID}) < 0
+	})
+	return reads, nil
+}
+
+func (r *MessageRepo) MarkAsDelivered(ctx context.Context, messageID, receiverID uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.messages[messageID]; !ok {
+		return fmt.Errorf("message %s does not exist", messageID)
+	}
+	if r.s.data.deliveries[messageID] == nil {
+		put(tx, r.s.data.deliveries, messageID, make(map[uuid.UUID]delivery))
+	}
+	if _, ok := r.s.data.deliveries[messageID][receiverID]; !ok {
+		put(tx, r.s.data.deliveries[messageID], receiverID, delivery{at: time.Now(), pos: r.s.data.nextSyncPos()})
+	}
+	return nil
+}
+
+func (r *MessageRepo) GetUnreadCounts(ctx context.Context, userID uuid.UUID) (map[uuid.UUID]int, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	counts := make(map[uuid.UUID]int)
+	for _, msg := range r.s.data.messages {
+		if msg.SenderID == userID || msg.DeletedAt != nil || msg.Kind == model.MessageKindCall || r.s.data.isHidden(msg.ID, userID) {
+			continue
+		}
+		member, ok := r.s.data.members[msg.ConversationID][userID]
+		if !ok {
+			continue
+		}
+		if !hasRead(member, model.Cursor{CreatedAt: msg.CreatedAt, ID: msg.ID}) {
+			counts[msg.ConversationID]++
+		}
+	}
+	return counts, nil
+}
+
+// SyncHead positions after every change so far; writes here are visible as soon as they are made
+func (r *MessageRepo) SyncHead(ctx context.Context) (model.SyncPosition, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	return model.SyncPosition{Txn: r.s.data.syncSeq + 1}, nil
+}
+
+// between reports whether pos lies strictly between since and until
+func between(pos, since, until model.SyncPosition) bool {
+	return pos.Compare(since) > 0 && pos.Compare(until) < 0
+}
+
+func (r *MessageRepo) GetSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.Message, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	messages := []model.Message{}
+	for _, msg := range r.s.data.messages {
+		if _, ok := r.s.data.members[msg.ConversationID][userID]; !ok || r.s.data.isHidden(msg.ID, userID) {
+			continue
+		}
+		if between(msg.SyncPos, since, until) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].SyncPos.Compare(messages[j].SyncPos) < 0 })
+	return paginate(messages, limit, 0), nil
+}
+
+// GetReadReceiptsSince includes the user's own watermarks so other devices converge too
+func (r *MessageRepo) GetReadReceiptsSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.ReadReceipt, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	receipts := []model.ReadReceipt{}
+	for convID, members := range r.s.data.members {
+		if _, ok := members[userID]; !ok {
+			continue
+		}
+		for id, m := range members {
+			pos, ok := r.s.data.readPos[convID][id]
+			if ok && m.LastReadMessageID != nil && m.LastReadAt != nil && between(pos, since, until) {
+				receipts = append(receipts, model.ReadReceipt{ConversationID: convID, ReaderID: id, MessageID: *m.LastReadMessageID, ReadAt: *m.LastReadAt, SyncPos: pos})
+			}
+		}
+	}
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].SyncPos.Compare(receipts[j].SyncPos) < 0 })
+	return paginate(receipts, limit, 0), nil
+}
+
+// GetDeliveryReceiptsSince returns deliveries of messages sent by the user
+func (r *MessageRepo) GetDeliveryReceiptsSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.DeliveryReceipt, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	receipts := []model.DeliveryReceipt{}
+	for msgID, deliveries := range r.s.data.deliveries {
+		msg := r.s.data.messages[msgID]
+		if msg.SenderID != userID {
+			continue
+		}
+		for receiverID, d := range deliveries {
+			if between(d.pos, since, until) {
+				receipts = append(receipts, model.DeliveryReceipt{
+					MessageID:      msgID,
+					ConversationID: msg.ConversationID,
+					SenderID:       msg.SenderID,
+					ReceiverID:     receiverID,
+					DeliveredAt:    d.at,
+					SyncPos:        d.pos,
+				})
+			}
+		}
+	}
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].SyncPos.Compare(receipts[j].SyncPos) < 0 })
+	return paginate(receipts, limit, 0), nil
+}
+
+type ConversationRepo struct {
+	s *Storage
+}
+
+func (r *ConversationRepo) Create(ctx context.Context, conv *model.Conversation) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.conversations[conv.ID]; ok {
+		return fmt.Errorf("conversation %s already exists", conv.ID)
+	}
+	put(tx, r.s.data.conversations, conv.ID, *conv)
+	put(tx, r.s.data.members, conv.ID, make(map[uuid.UUID]model.ConversationMember))
+	return nil
+}
+
+func (r *ConversationRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Conversation, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	conv, ok := r.s.data.conversations[id]
+	if !ok {
+		return nil, nil
+	}
+	return &conv, nil
+}
+
+func (r *ConversationRepo) GetOrCreateDirect(ctx context.Context, user1, user2 uuid.UUID) (*model.Conversation, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	key := directKey(user1, user2)
+	if id, ok := r.s.data.directKeys[key]; ok {
+		conv := r.s.data.conversations[id]
+		return &conv, nil
+	}
+
+	now := time.Now()
+	conv := model.Conversation{
+		ID:        uuid.New(),
+		Type:      model.ConversationTypeDirect,
+		CreatedAt: now,
+	}
+	put(tx, r.s.data.conversations, conv.ID, conv)
+	put(tx, r.s.data.directKeys, key, conv.ID)
+	put(tx, r.s.data.members, conv.ID, map[uuid.UUID]model.ConversationMember{})
+	for _, id := range []uuid.UUID{user1, user2} {
+		put(tx, r.s.data.members[conv.ID], id, model.ConversationMember{
+			ConversationID: conv.ID,
+			UserID:         id,
+			Role:           model.ConversationRoleMember,
+			JoinedAt:       now,
+		})
+	}
+	return &conv, nil
+}
+
+func (r *ConversationRepo) GetByUserID(ctx context.Context, userID uuid.UUID) ([]model.Conversation, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	conversations := []model.Conversation{}
+	for convID, members := range r.s.data.members {
+		if _, ok := members[userID]; ok {
+			conversations = append(conversations, r.s.data.conversations[convID])
+		}
+	}
+	sort.Slice(conversations, func(i, j int) bool { return conversations[i].CreatedAt.After(conversations[j].CreatedAt) })
+	return conversations, nil
+}
+
+func (r *ConversationRepo) UpdateTitle(ctx context.Context, id uuid.UUID, title string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if conv, ok := r.s.data.conversations[id]; ok {
+		conv.Title = title
+		put(tx, r.s.data.conversations, id, conv)
+	}
+	return nil
+}
+
+func (r *ConversationRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	for key, convID := range r.s.data.directKeys {
+		if convID == id {
+			del(tx, r.s.data.directKeys, key)
+		}
+	}
+	for msgID, msg := range r.s.data.messages {
+		if msg.ConversationID == id {
+			del(tx, r.s.data.messages, msgID)
+			del(tx, r.s.data.deliveries, msgID)
+			del(tx, r.s.data.reads, msgID)
+			del(tx, r.s.data.edits, msgID)
+			del(tx, r.s.data.hidden, msgID)
+		}
+	}
+	for attID, att := range r.s.data.attachments {
+		if att.ConversationID == id {
+			del(tx, r.s.data.attachments, attID)
+		}
+	}
+	del(tx, r.s.data.members, id)
+	del(tx, r.s.data.readPos, id)
+	del(tx, r.s.data.conversations, id)
+	return nil
+}
+
+func (r *ConversationRepo) AddMember(ctx context.Context, member *model.ConversationMember) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	members, ok := r.s.data.members[member.ConversationID]
+	if !ok {
+		return fmt.Errorf("conversation %s does not exist", member.ConversationID)
+	}
+	if _, ok := members[member.UserID]; ok {
+		return fmt.Errorf("user %s is already a member", member.UserID)
+	}
+	put(tx, members, member.UserID, *member)
+	if member.LastReadMessageID != nil {
+		r.s.data.setReadPos(tx, member.ConversationID, member.UserID)
+	}
+	return nil
+}
+
+func (r *ConversationRepo) GetNewestMessage(ctx context.Context, conversationID uuid.UUID) (*model.Cursor, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	var newest *model.Cursor
+	for _, msg := range r.s.data.messages {
+		if msg.ConversationID != conversationID {
+			continue
+		}
+		pos := model.Cursor{CreatedAt: msg.CreatedAt, ID: msg.ID}
+		if newest == nil || pos.Compare(*newest) > 0 {
+			newest = &pos
+		}
+	}
+	return newest, nil
+}
+
+func (r *ConversationRepo) GetMember(ctx context.Context, conversationID, userID uuid.UUID) (*model.ConversationMember, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	member, ok := r.s.data.members[conversationID][userID]
+	if !ok {
+		return nil, nil
+	}
+	return &member, nil
+}
+
+func (r *ConversationRepo) GetMembers(ctx context.Context, conversationID uuid.UUID) ([]model.ConversationMember, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	members := []model.ConversationMember{}
+	for _, m := range r.s.data.members[conversationID] {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].JoinedAt.Before(members[j].JoinedAt) })
+	return members, nil
+}
+
+func (r *ConversationRepo) GetMemberIDs(ctx context.Context, conversationID uuid.UUID) ([]uuid.UUID, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	ids := []uuid.UUID{}
+	for id := range r.s.data.members[conversationID] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (r *ConversationRepo) GetContactIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	seen := make(map[uuid.UUID]bool)
+	ids := []uuid.UUID{}
+	for _, members := range r.s.data.members {
+		if _, ok := members[userID]; !ok {
+			continue
+		}
+		for id := range members {
+			if id != userID && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (r *ConversationRepo) UpdateMemberRole(ctx context.Context, conversationID, userID uuid.UUID, role string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if member, ok := r.s.data.members[conversationID][userID]; ok {
+		member.Role = model.ConversationRole(role)
+		put(tx, r.s.data.members[conversationID], userID, member)
+	}
+	return nil
+}
+
+func (r *ConversationRepo) RemoveMember(ctx context.Context, conversationID, userID uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	del(tx, r.s.data.members[conversationID], userID)
+	del(tx, r.s.data.readPos[conversationID], userID)
+	return nil
+}
+
+type CallRepo struct {
+	s *Storage
+}
+
+func (r *CallRepo) Create(ctx context.Context, call *model.Call) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.calls[call.ID]; ok {
+		return fmt.Errorf("call %s already exists", call.ID)
+	}
+	call.SyncPos = r.s.data.nextSyncPos()
+	put(tx, r.s.data.calls, call.ID, *call)
+	put(tx, r.s.data.participants, call.ID, make(map[uuid.UUID]model.CallParticipant))
+	return nil
+}
+
+func (r *CallRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Call, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	call, ok := r.s.data.calls[id]
+	if !ok {
+		return nil, nil
+	}
+	return &call, nil
+}
+
+// GetByIDForUpdate needs no lock of its own: transactions are serialized already
+func (r *CallRepo) GetByIDForUpdate(ctx context.Context, id uuid.UUID) (*model.Call, error) {
+	return r.GetByID(ctx, id)
+}
+
+func (r *CallRepo) GetByStatus(ctx context.Context, status string) ([]model.Call, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	calls := []model.Call{}
+	for _, call := range r.s.data.calls {
+		if string(call.Status) == status {
+			calls = append(calls, call)
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].CreatedAt.After(calls[j].CreatedAt) })
+	return calls, nil
+}
+
+// updateCall applies fn to a stored call; missing calls are ignored like an UPDATE matching no rows
+func (r *CallRepo) updateCall(ctx context.Context, id uuid.UUID, fn func(*model.Call)) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if call, ok := r.s.data.calls[id]; ok {
+		fn(&call)
+		call.UpdatedAt = time.Now()
+		call.SyncPos = r.s.data.nextSyncPos()
+		put(tx, r.s.data.calls, id, call)
+	}
+	return nil
+}
+
+func (r *CallRepo) UpdateStatus(ctx context.Context, id uuid.UUID, status string) error {
+	return r.updateCall(ctx, id, func(c *model.Call) { c.Status = model.CallStatus(status) })
+}
+
+func (r *CallRepo) UpdateStartedAt(ctx context.Context, id uuid.UUID, startedAt *time.Time) error {
+	return r.updateCall(ctx, id, func(c *model.Call) { c.StartedAt = startedAt })
+}
+
+func (r *CallRepo) UpdateEndedAt(ctx context.Context, id uuid.UUID, endedAt *time.Time) error {
+	return r.updateCall(ctx, id, func(c *model.Call) { c.EndedAt = endedAt })
+}
+
+func (r *CallRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	del(tx, r.s.data.calls, id)
+	del(tx, r.s.data.participants, id)
+	return nil
+}
+
+func (r *CallRepo) CreateParticipant(ctx context.Context, participant *model.CallParticipant) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	participants, ok := r.s.data.participants[participant.CallID]
+	if !ok {
+		return fmt.Errorf("call %s does not exist", participant.CallID)
+	}
+	if _, ok := participants[participant.UserID]; ok {
+		return fmt.Errorf("user %s is already a participant", participant.UserID)
+	}
+	put(tx, participants, participant.UserID, *participant)
+	return nil
+}
+
+func (r *CallRepo) GetParticipantsByCallID(ctx context.Context, callID uuid.UUID) ([]model.CallParticipant, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	participants := []model.CallParticipant{}
+	for _, p := range r.s.data.participants[callID] {
+		participants = append(participants, p)
+	}
+	sort.Slice(participants, func(i, j int) bool { return participants[i].CreatedAt.Before(participants[j].CreatedAt) })
+	return participants, nil
+}
+
+func (r *CallRepo) GetParticipant(ctx context.Context, callID, userID uuid.UUID) (*model.CallParticipant, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	participant, ok := r.s.data.participants[callID][userID]
+	if !ok {
+		return nil, nil
+	}
+	return &participant, nil
+}
+
+// updateParticipant applies fn to a stored participant; missing rows are ignored.
+// With touch set the owning call's UpdatedAt moves too, like postgres touchCall.
+func (r *CallRepo) updateParticipant(ctx context.Context, callID, userID uuid.UUID, touch bool, fn func(*model.CallParticipant)) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if participant, ok := r.s.data.participants[callID][userID]; ok {
+		fn(&participant)
+		put(tx, r.s.data.participants[callID], userID, participant)
+		if call, ok := r.s.data.calls[callID]; ok && touch {
+			call.UpdatedAt = time.Now()
+			call.SyncPos = r.s.data.nextSyncPos()
+			put(tx, r.s.data.calls, callID, call)
+		}
+	}
+	return nil
+}
+
+func (r *CallRepo) UpdateParticipantStatus(ctx context.Context, callID, userID uuid.UUID, status string) error {
+	return r.updateParticipant(ctx, callID, userID, true, func(p *model.CallParticipant) { p.Status = model.CallParticipantStatus(status) })
+}
+
+func (r *CallRepo) UpdateParticipantJoinedAt(ctx context.Context, callID, userID uuid.UUID, joinedAt *time.Time) error {
+	return r.updateParticipant(ctx, callID, userID, true, func(p *model.CallParticipant) { p.JoinedAt = joinedAt })
+}
+
+func (r *CallRepo) UpdateParticipantLeftAt(ctx context.Context, callID, userID uuid.UUID, leftAt *time.Time) error {
+	return r.updateParticipant(ctx, callID, userID, true, func(p *model.CallParticipant) { p.LeftAt = leftAt })
+}
+
+func (r *CallRepo) UpdateParticipantMediaSettings(ctx context.Context, callID, userID uuid.UUID, audioEnabled, videoEnabled bool) error {
+	return r.updateParticipant(ctx, callID, userID, false, func(p *model.CallParticipant) {
+		p.AudioEnabled = audioEnabled
+		p.VideoEnabled = videoEnabled
+	})
+}
+
+func (r *CallRepo) DeleteParticipant(ctx context.Context, callID, userID uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	del(tx, r.s.data.participants[callID], userID)
+	return nil
+}
+
+func (r *CallRepo) GetUpdatedSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.Call, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	calls := []model.Call{}
+	for callID, participants := range r.s.data.participants {
+		if _, ok := participants[userID]; !ok {
+			continue
+		}
+		if call := r.s.data.calls[callID]; between(call.SyncPos, since, until) {
+			calls = append(calls, call)
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].SyncPos.Compare(calls[j].SyncPos) < 0 })
+	return paginate(calls, limit, 0), nil
+}
+
+func (r *CallRepo) GetCallHistoryPage(ctx context.Context, userID uuid.UUID, page model.PageRequest) ([]model.CallHistoryItem, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	history := []model.CallHistoryItem{}
+	for callID, participants := range r.s.data.participants {
+		if _, ok := participants[userID]; !ok {
+			continue
+		}
+		call := r.s.data.calls[callID]
+		item := model.CallHistoryItem{
+			CallID:        call.ID,
+			CallType:      call.CallType,
+			Status:        call.Status,
+			StartedAt:     call.StartedAt,
+			EndedAt:       call.EndedAt,
+			CallCreatedAt: call.CreatedAt,
+			InitiatorID:   call.InitiatorID,
+		}
+		if initiator, ok := r.s.data.users[call.InitiatorID]; ok {
+			item.Initiator = &model.User{ID: initiator.ID, Username: initiator.Username, CreatedAt: initiator.CreatedAt}
+		}
+		history = append(history, item)
+	}
+	key := func(item model.CallHistoryItem) model.Cursor {
+		return model.Cursor{CreatedAt: item.CallCreatedAt, ID: item.CallID}
+	}
+	sort.Slice(history, func(i, j int) bool { return compareCursor(key(history[i]), key(history[j])) > 0 })
+	return keysetPage(history, key, page), nil
+}
+
+type AttachmentRepo struct {
+	s *Storage
+}
+
+func (r *AttachmentRepo) Create(ctx context.Context, att *model.Attachment) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.attachments[att.ID]; ok {
+		return fmt.Errorf("attachment %s already exists", att.ID)
+	}
+	put(tx, r.s.data.attachments, att.ID, *att)
+	return nil
+}
+
+func (r *AttachmentRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Attachment, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	att, ok := r.s.data.attachments[id]
+	if !ok {
+		return nil, nil
+	}
+	return &att, nil
+}
+
+func (r *AttachmentRepo) GetByIDs(ctx context.Context, ids []uuid.UUID) ([]model.Attachment, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	result := []model.Attachment{}
+	for _, id := range ids {
+		if att, ok := r.s.data.attachments[id]; ok {
+			result = append(result, att)
+		}
+	}
+	sortAttachments(result)
+	return result, nil
+}
+
+func (r *AttachmentRepo) GetByMessageIDs(ctx context.Context, messageIDs []uuid.UUID) ([]model.Attachment, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	wanted := make(map[uuid.UUID]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+
+	result := []model.Attachment{}
+	for _, att := range r.s.data.attachments {
+		if att.MessageID != nil && wanted[*att.MessageID] {
+			result = append(result, att)
+		}
+	}
+	sortAttachments(result)
+	return result, nil
+}
+
+func (r *AttachmentRepo) GetAfter(ctx context.Context, after uuid.UUID, limit int) ([]model.Attachment, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	result := []model.Attachment{}
+	for _, att := range r.s.data.attachments {
+		if bytes.Compare(att.ID[:], after[:]) > 0 {
+			result = append(result, att)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return bytes.Compare(result[i].ID[:], result[j].ID[:]) < 0 })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (r *AttachmentRepo) GetByUserID(ctx context.Context, userID uuid.UUID) ([]model.Attachment, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	result := []model.Attachment{}
+	for _, att := range r.s.data.attachments {
+		if att.UploaderID == userID {
+			result = append(result, att)
+			continue
+		}
+		if att.MessageID == nil {
+			continue
+		}
+		if msg, ok := r.s.data.messages[*att.MessageID]; ok && (msg.SenderID == userID || msg.ReceiverID == userID) {
+			result = append(result, att)
+		}
+	}
+	sortAttachments(result)
+	return result, nil
+}
+
+func (r *AttachmentRepo) AttachToMessage(ctx context.Context, ids []uuid.UUID, messageID uuid.UUID) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	linked := 0
+	for _, id := range ids {
+		att, ok := r.s.data.attachments[id]
+		if !ok || att.MessageID != nil {
+			continue
+		}
+		msgID := messageID
+		att.MessageID = &msgID
+		put(tx, r.s.data.attachments, id, att)
+		linked++
+	}
+	return linked, nil
+}
+
+func (r *AttachmentRepo) DeleteByMessageID(ctx context.Context, messageID uuid.UUID) ([]model.Attachment, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	deleted := []model.Attachment{}
+	for id, att := range r.s.data.attachments {
+		if att.MessageID != nil && *att.MessageID == messageID {
+			deleted = append(deleted, att)
+			del(tx, r.s.data.attachments, id)
+		}
+	}
+	sortAttachments(deleted)
+	return deleted, nil
+}
+
+func (r *AttachmentRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	del(tx, r.s.data.attachments, id)
+	return nil
+}
+
+// sortAttachments orders attachments by upload time like the postgres queries
+func sortAttachments(attachments []model.Attachment) {
+	sort.Slice(attachments, func(i, j int) bool {
+		return compareCursor(
+			model.Cursor{CreatedAt: attachments[i].CreatedAt, ID: attachments[i].ID},
+			model.Cursor{CreatedAt: attachments[j].CreatedAt, ID: attachments[j].ID},
+		) < 0
+	})
+}
+
+type SessionRepo struct {
+	s *Storage
+}
+
+func (r *SessionRepo) Create(ctx context.Context, session *model.Session) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.sessions[session.ID]; ok {
+		return fmt.Errorf("session %s already exists", session.ID)
+	}
+	put(tx, r.s.data.sessions, session.ID, *session)
+	return nil
+}
+
+func (r *SessionRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Session, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	session, ok := r.s.data.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func (r *SessionRepo) GetActiveByUserID(ctx context.Context, userID uuid.UUID) ([]model.Session, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	now := time.Now()
+	sessions := []model.Session{}
+	for _, session := range r.s.data.sessions {
+		if session.UserID == userID && session.Active(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return bytes.Compare(sessions[i].ID[:], sessions[j].ID[:]) < 0
+		}
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+func (r *SessionRepo) Rotate(ctx context.Context, id uuid.UUID, oldHash, newHash string, usedAt, expiresAt time.Time) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	session, ok := r.s.data.sessions[id]
+	if !ok || session.RefreshHash != oldHash || session.RevokedAt != nil {
+		return false, nil
+	}
+	session.PreviousHash = session.RefreshHash
+	session.RefreshHash = newHash
+	session.LastUsedAt = usedAt
+	session.ExpiresAt = expiresAt
+	put(tx, r.s.data.sessions, id, session)
+	return true, nil
+}
+
+func (r *SessionRepo) Revoke(ctx context.Context, id uuid.UUID, revokedAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	session, ok := r.s.data.sessions[id]
+	if !ok || session.RevokedAt != nil {
+		return nil
+	}
+	session.RevokedAt = &revokedAt
+	put(tx, r.s.data.sessions, id, session)
+	return nil
+}
+
+func (r *SessionRepo) RevokeByUserID(ctx context.Context, userID, except uuid.UUID, revokedAt time.Time) ([]uuid.UUID, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	ids := []uuid.UUID{}
+	for id, session := range r.s.data.sessions {
+		if session.UserID != userID || id == except || session.RevokedAt != nil {
+			continue
+		}
+		session.RevokedAt = &revokedAt
+		put(tx, r.s.data.sessions, id, session)
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+type KeyRepo struct {
+	s *Storage
+}
+
+func (r *KeyRepo) SaveDevice(ctx context.Context, device *model.Device) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if existing, ok := r.s.data.devices[device.ID]; ok {
+		if existing.UserID != device.UserID {
+			return fmt.Errorf("device %s belongs to another user", device.ID)
+		}
+		device.CreatedAt = existing.CreatedAt
+	}
+	put(tx, r.s.data.devices, device.ID, *device)
+	return nil
+}
+
+func (r *KeyRepo) GetDevice(ctx context.Context, id uuid.UUID) (*model.Device, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	device, ok := r.s.data.devices[id]
+	if !ok {
+		return nil, nil
+	}
+	return &device, nil
+}
+
+func (r *KeyRepo) GetDevicesByUserID(ctx context.Context, userID uuid.UUID) ([]model.Device, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	devices := []model.Device{}
+	for _, device := range r.s.data.devices {
+		if device.UserID == userID {
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return compareCursor(
+			model.Cursor{CreatedAt: devices[i].CreatedAt, ID: devices[i].ID},
+			model.Cursor{CreatedAt: devices[j].CreatedAt, ID: devices[j].ID},
+		) < 0
+	})
+	return devices, nil
+}
+
+func (r *KeyRepo) DeleteDevice(ctx context.Context, id uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	del(tx, r.s.data.devices, id)
+	del(tx, r.s.data.prekeys, id)
+	return nil
+}
+
+func (r *KeyRepo) AddPrekeys(ctx context.Context, deviceID uuid.UUID, prekeys []model.OneTimePrekey) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.devices[deviceID]; !ok {
+		return 0, fmt.Errorf("device %s not found", deviceID)
+	}
+	keys := r.s.data.prekeys[deviceID]
+	if keys == nil {
+		keys = make(map[int][]byte)
+		put(tx, r.s.data.prekeys, deviceID, keys)
+	}
+	added := 0
+	for _, prekey := range prekeys {
+		if _, ok := keys[prekey.KeyID]; ok {
+			continue
+		}
+		put(tx, keys, prekey.KeyID, prekey.PublicKey)
+		added++
+	}
+	return added, nil
+}
+
+func (r *KeyRepo) CountPrekeys(ctx context.Context, deviceID uuid.UUID) (int, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	return len(r.s.data.prekeys[deviceID]), nil
+}
+
+func (r *KeyRepo) ClaimPrekey(ctx context.Context, deviceID uuid.UUID) (*model.OneTimePrekey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	keys := r.s.data.prekeys[deviceID]
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	keyID := 0
+	first := true
+	for id := range keys {
+		if first || id < keyID {
+			keyID, first = id, false
+		}
+	}
+	prekey := &model.OneTimePrekey{KeyID: keyID, PublicKey: keys[keyID]}
+	del(tx, keys, keyID)
+	return prekey, nil
+}
+
+func (r *KeyRepo) DeletePrekeys(ctx context.Context, deviceID uuid.UUID) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	del(tx, r.s.data.prekeys, deviceID)
+	return nil
+}
+
+type DataKeyRepo struct {
+	s *Storage
+}
+
+func (r *DataKeyRepo) GetByID(ctx context.Context, id string) (*model.DataKey, error) {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	key, ok := r.s.data.dataKeys[id]
+	if !ok {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+func (r *DataKeyRepo) Create(ctx context.Context, key *model.DataKey) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tx := txFrom(ctx)
+
+	if _, ok := r.s.data.dataKeys[key.ID]; ok {
+		return false, nil
+	}
+	put(tx, r.s.data.dataKeys, key.ID, *key)
+	return true, nil
+}
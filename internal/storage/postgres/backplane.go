@@ -0,0 +1,88 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxNotifyPayload stays below PostgreSQL's 8000 byte NOTIFY payload limit.
+// Larger payloads are stored in backplane_events and referenced by ID.
+const maxNotifyPayload = 7900
+
+// spillRefPrefix marks a NOTIFY payload that references a backplane_events row.
+// Hub envelopes are JSON objects and never start with it.
+const spillRefPrefix = "@"
+
+// Backplane implements ws.Backplane on top of PostgreSQL LISTEN/NOTIFY
+type Backplane struct {
+	pool    *pgxpool.Pool
+	channel string
+}
+
+func (s *Storage) Backplane(channel string) *Backplane {
+	return &Backplane{pool: s.pool, channel: channel}
+}
+
+func (b *Backplane) Publish(ctx context.Context, payload []byte) error {
+	message := string(payload)
+
+	if len(payload) > maxNotifyPayload {
+		var id int64
+		err := b.pool.QueryRow(ctx, `INSERT INTO backplane_events (payload) VALUES ($1) RETURNING id`, payload).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to store backplane event: %w", err)
+		}
+		message = spillRefPrefix + strconv.FormatInt(id, 10)
+
+		// Subscribers fetch spilled rows immediately, so old ones are safe to drop
+		if _, err := b.pool.Exec(ctx, `DELETE FROM backplane_events WHERE created_at < NOW() - INTERVAL '5 minutes'`); err != nil {
+			return fmt.Errorf("failed to clean up backplane events: %w", err)
+		}
+	}
+
+	if _, err := b.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, b.channel, message); err != nil {
+		return fmt.Errorf("failed to notify: %w", err)
+	}
+	return nil
+}
+
+func (b *Backplane) Subscribe(ctx context.Context, handler func([]byte)) error {
+	conn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire listen connection: %w", err)
+	}
+	// The connection stays in LISTEN state, so close it instead of returning it to the pool as-is
+	defer func() {
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{b.channel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", b.channel, err)
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		payload := []byte(notification.Payload)
+		if strings.HasPrefix(notification.Payload, spillRefPrefix) {
+			id, err := strconv.ParseInt(strings.TrimPrefix(notification.Payload, spillRefPrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := b.pool.QueryRow(ctx, `SELECT payload FROM backplane_events WHERE id = $1`, id).Scan(&payload); err != nil {
+				continue
+			}
+		}
+
+		handler(payload)
+	}
+}
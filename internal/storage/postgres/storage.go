@@ -1,9 +1,11 @@
 package postgres
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -42,10 +44,30 @@ func (s *Storage) Message() storage.MessageRepository {
 	return &MessageRepo{pool: s.pool}
 }
 
+func (s *Storage) Conversation() storage.ConversationRepository {
+	return &ConversationRepo{pool: s.pool}
+}
+
 func (s *Storage) Call() storage.CallRepository {
 	return &CallRepo{pool: s.pool}
 }
 
+func (s *Storage) Attachment() storage.AttachmentRepository {
+	return &AttachmentRepo{pool: s.pool}
+}
+
+func (s *Storage) Session() storage.SessionRepository {
+	return &SessionRepo{pool: s.pool}
+}
+
+func (s *Storage) Key() storage.KeyRepository {
+	return &KeyRepo{pool: s.pool}
+}
+
+func (s *Storage) DataKey() storage.DataKeyRepository {
+	return &DataKeyRepo{pool: s.pool}
+}
+
 func (s *Storage) WithTx(ctx context.Context, fn func(context.Context) error) error {
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
@@ -76,22 +98,49 @@ type pgxConn interface {
 	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
 }
 
+// nullableUUID maps uuid.Nil to SQL NULL for optional foreign keys
+func nullableUUID(id uuid.UUID) interface{} {
+	if id == uuid.Nil {
+		return nil
+	}
+	return id
+}
+
+// directKey builds the canonical key identifying the direct conversation of a user pair
+func directKey(user1, user2 uuid.UUID) string {
+	if bytes.Compare(user1[:], user2[:]) > 0 {
+		user1, user2 = user2, user1
+	}
+	return user1.String() + ":" + user2.String()
+}
+
 type UserRepo struct {
 	pool *pgxpool.Pool
 }
 
+const userColumns = `id, username, password_hash, role, disabled_at, created_at, last_seen_at, hide_last_seen`
+
+func scanUser(row pgx.Row) (*model.User, error) {
+	var user model.User
+	if err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.DisabledAt, &user.CreatedAt,
+		&user.LastSeenAt, &user.HideLastSeen); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (r *UserRepo) Create(ctx context.Context, user *model.User) error {
 	conn := getConn(ctx, r.pool)
-	sql := `INSERT INTO users (id, username, password_hash, created_at) VALUES ($1, $2, $3, $4)`
-	_, err := conn.Exec(ctx, sql, user.ID, user.Username, user.PasswordHash, user.CreatedAt)
+	sql := `INSERT INTO users (` + userColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := conn.Exec(ctx, sql, user.ID, user.Username, user.PasswordHash, user.Role, user.DisabledAt, user.CreatedAt,
+		user.LastSeenAt, user.HideLastSeen)
 	return err
 }
 
 func (r *UserRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.User, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `SELECT id, username, password_hash, created_at FROM users WHERE id = $1`
-	user := &model.User{}
-	err := conn.QueryRow(ctx, sql, id).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
+	sql := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	user, err := scanUser(conn.QueryRow(ctx, sql, id))
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, nil
 	}
@@ -105,9 +154,107 @@ func (r *UserRepo) GetByIDs(ctx context.Context, ids []uuid.UUID) ([]model.User,
 	if len(ids) == 0 {
 		return []model.User{}, nil
 	}
+	sql := `SELECT ` + userColumns + ` FROM users WHERE id = ANY($1)`
+	return r.query(ctx, sql, ids)
+}
+
+func (r *UserRepo) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT ` + userColumns + ` FROM users WHERE LOWER(username) = LOWER($1)`
+	user, err := scanUser(conn.QueryRow(ctx, sql, username))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *UserRepo) GetAll(ctx context.Context) ([]model.User, error) {
+	sql := `SELECT ` + userColumns + ` FROM users ORDER BY username`
+	return r.query(ctx, sql)
+}
+
+func (r *UserRepo) GetPage(ctx context.Context, page model.PageRequest) ([]model.User, error) {
+	bounds, order, args := keyset("u", page, nil)
+	sql := `SELECT ` + userColumns + ` FROM users u WHERE TRUE` + bounds + `
+		` + order + fmt.Sprintf(" LIMIT $%d", len(args)+1)
+	users, err := r.query(ctx, sql, append(args, page.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	if page.Forward() {
+		slices.Reverse(users)
+	}
+	return users, nil
+}
+
+func (r *UserRepo) Count(ctx context.Context) (int, error) {
+	conn := getConn(ctx, r.pool)
+	var count int
+	err := conn.QueryRow(ctx, `SELECT COUNT(*) FROM users`).Scan(&count)
+	return count, err
+}
+
+func (r *UserRepo) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE users SET password_hash = $1 WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, passwordHash, id)
+	return err
+}
+
+func (r *UserRepo) UpdateRole(ctx context.Context, id uuid.UUID, role model.Role) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE users SET role = $1 WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, role, id)
+	return err
+}
+
+func (r *UserRepo) UpdateUsername(ctx context.Context, id uuid.UUID, username string) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE users SET username = $1 WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, username, id)
+	return err
+}
+
+func (r *UserRepo) SetDisabled(ctx context.Context, id uuid.UUID, disabledAt *time.Time) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE users SET disabled_at = $1 WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, disabledAt, id)
+	return err
+}
+
+func (r *UserRepo) UpdateLastSeen(ctx context.Context, id uuid.UUID, seenAt time.Time) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE users SET last_seen_at = $1 WHERE id = $2 AND (last_seen_at IS NULL OR last_seen_at < $1)`
+	_, err := conn.Exec(ctx, sql, seenAt, id)
+	return err
+}
+
+func (r *UserRepo) SetHideLastSeen(ctx context.Context, id uuid.UUID, hide bool) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE users SET hide_last_seen = $1 WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, hide, id)
+	return err
+}
+
+// Delete removes a user; messages, memberships, calls, attachments and sessions go with it via ON DELETE CASCADE
+func (r *UserRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	conn := getConn(ctx, r.pool)
+	sql := `DELETE FROM users WHERE id = $1`
+	_, err := conn.Exec(ctx, sql, id)
+	return err
+}
+
+func (r *UserRepo) SearchUsers(ctx context.Context, prefix string) ([]model.User, error) {
+	sql := `SELECT ` + userColumns + ` FROM users WHERE username ILIKE $1 ORDER BY username LIMIT 10`
+	return r.query(ctx, sql, prefix+"%")
+}
+
+func (r *UserRepo) query(ctx context.Context, sql string, args ...interface{}) ([]model.User, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `SELECT id, username, password_hash, created_at FROM users WHERE id = ANY($1)`
-	rows, err := conn.Query(ctx, sql, ids)
+	rows, err := conn.Query(ctx, sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -115,90 +262,125 @@ func (r *UserRepo) GetByIDs(ctx context.Context, ids []uuid.UUID) ([]model.User,
 
 	var users []model.User
 	for rows.Next() {
-		var user model.User
-		if err := rows.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt); err != nil {
+		user, err := scanUser(rows)
+		if err != nil {
 			return nil, err
 		}
-		users = append(users, user)
+		users = append(users, *user)
 	}
 	return users, rows.Err()
 }
 
-func (r *UserRepo) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+type MessageRepo struct {
+	pool *pgxpool.Pool
+}
+
+func (r *MessageRepo) Create(ctx context.Context, msg *model.Message) error {
+	conn := getConn(ctx, r.pool)
+	sql := `INSERT INTO messages (id, conversation_id, sender_id, receiver_id, payload, e2e, client_msg_id, kind, call_id, created_at) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), COALESCE(NULLIF($8, ''), 'text'), $9, $10)`
+	_, err := conn.Exec(ctx, sql, msg.ID, msg.ConversationID, msg.SenderID, nullableUUID(msg.ReceiverID), msg.Payload, msg.E2E, msg.ClientMsgID, string(msg.Kind), msg.CallID, msg.CreatedAt)
+	return err
+}
+
+func (r *MessageRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Message, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `SELECT id, username, password_hash, created_at FROM users WHERE LOWER(username) = LOWER($1)`
-	user := &model.User{}
-	err := conn.QueryRow(ctx, sql, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
+	sql := `SELECT id, conversation_id, sender_id, receiver_id, payload, e2e, COALESCE(client_msg_id, ''), kind, call_id, created_at, edited_at, deleted_at FROM messages WHERE id = $1`
+	var msg model.Message
+	err := conn.QueryRow(ctx, sql, id).Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.E2E, &msg.ClientMsgID, &msg.Kind, &msg.CallID, &msg.CreatedAt, &msg.EditedAt, &msg.DeletedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return user, nil
+	return &msg, nil
 }
 
-func (r *UserRepo) GetAll(ctx context.Context) ([]model.User, error) {
+func (r *MessageRepo) GetCallEntry(ctx context.Context, callID, receiverID uuid.UUID) (*model.Message, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `SELECT id, username, password_hash, created_at FROM users ORDER BY username`
-	rows, err := conn.Query(ctx, sql)
+	sql := `SELECT id, conversation_id, sender_id, receiver_id, payload, e2e, COALESCE(client_msg_id, ''), kind, call_id, created_at, edited_at, deleted_at FROM messages WHERE call_id = $1 AND receiver_id = $2`
+	var msg model.Message
+	err := conn.QueryRow(ctx, sql, callID, receiverID).Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.E2E, &msg.ClientMsgID, &msg.Kind, &msg.CallID, &msg.CreatedAt, &msg.EditedAt, &msg.DeletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return &msg, nil
+}
 
-	var users []model.User
-	for rows.Next() {
-		var user model.User
-		if err := rows.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt); err != nil {
-			return nil, err
-		}
-		users = append(users, user)
+func (r *MessageRepo) GetByClientMsgID(ctx context.Context, senderID uuid.UUID, clientMsgID string) (*model.Message, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT id, conversation_id, sender_id, receiver_id, payload, e2e, client_msg_id, kind, call_id, created_at, edited_at, deleted_at FROM messages WHERE sender_id = $1 AND client_msg_id = $2`
+	var msg model.Message
+	err := conn.QueryRow(ctx, sql, senderID, clientMsgID).Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.E2E, &msg.ClientMsgID, &msg.Kind, &msg.CallID, &msg.CreatedAt, &msg.EditedAt, &msg.DeletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
 	}
-	return users, rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
 }
 
-func (r *UserRepo) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+func (r *MessageRepo) UpdatePayload(ctx context.Context, id uuid.UUID, payload []byte, editedAt time.Time) error {
 	conn := getConn(ctx, r.pool)
-	sql := `UPDATE users SET password_hash = $1 WHERE id = $2`
-	_, err := conn.Exec(ctx, sql, passwordHash, id)
+	// The CTE reads the row as it was before the UPDATE, so the archived payload is the old one
+	sql := `
+		WITH previous AS (
+			INSERT INTO message_edits (message_id, payload, edited_at)
+			SELECT id, payload, $3 FROM messages WHERE id = $1
+		)
+		UPDATE messages SET payload = $2, edited_at = $3 WHERE id = $1`
+	_, err := conn.Exec(ctx, sql, id, payload, editedAt)
 	return err
 }
 
-func (r *UserRepo) SearchUsers(ctx context.Context, prefix string) ([]model.User, error) {
+func (r *MessageRepo) GetEdits(ctx context.Context, messageID uuid.UUID) ([]model.MessageEdit, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `SELECT id, username, password_hash, created_at FROM users WHERE username ILIKE $1 ORDER BY username LIMIT 10`
-	rows, err := conn.Query(ctx, sql, prefix+"%")
+	sql := `SELECT message_id, payload, edited_at FROM message_edits WHERE message_id = $1 ORDER BY edited_at`
+	rows, err := conn.Query(ctx, sql, messageID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var users []model.User
+	edits := []model.MessageEdit{}
 	for rows.Next() {
-		var user model.User
-		if err := rows.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt); err != nil {
+		var edit model.MessageEdit
+		if err := rows.Scan(&edit.MessageID, &edit.Payload, &edit.EditedAt); err != nil {
 			return nil, err
 		}
-		users = append(users, user)
+		edits = append(edits, edit)
 	}
-	return users, rows.Err()
+	return edits, rows.Err()
 }
 
-type MessageRepo struct {
-	pool *pgxpool.Pool
+func (r *MessageRepo) MarkDeleted(ctx context.Context, id uuid.UUID, deletedAt time.Time) error {
+	conn := getConn(ctx, r.pool)
+	sql := `
+		WITH history AS (
+			DELETE FROM message_edits WHERE message_id = $1
+		)
+		UPDATE messages SET payload = '', deleted_at = $2 WHERE id = $1`
+	_, err := conn.Exec(ctx, sql, id, deletedAt)
+	return err
 }
 
-func (r *MessageRepo) Create(ctx context.Context, msg *model.Message) error {
+func (r *MessageRepo) HideForUser(ctx context.Context, messageID, userID uuid.UUID) error {
 	conn := getConn(ctx, r.pool)
-	sql := `INSERT INTO messages (id, sender_id, receiver_id, payload, created_at) VALUES ($1, $2, $3, $4, $5)`
-	_, err := conn.Exec(ctx, sql, msg.ID, msg.SenderID, msg.ReceiverID, msg.Payload, msg.CreatedAt)
+	sql := `
+		INSERT INTO message_hidden (message_id, user_id, hidden_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (message_id, user_id) DO NOTHING`
+	_, err := conn.Exec(ctx, sql, messageID, userID)
 	return err
 }
 
 func (r *MessageRepo) GetByUserPair(ctx context.Context, user1, user2 uuid.UUID, limit, offset int) ([]model.Message, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `SELECT id, sender_id, receiver_id, payload, created_at FROM messages
+	sql := `SELECT id, conversation_id, sender_id, receiver_id, payload, e2e, kind, call_id, created_at FROM messages
 		WHERE (sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1)
 		ORDER BY created_at DESC LIMIT $3 OFFSET $4`
 	rows, err := conn.Query(ctx, sql, user1, user2, limit, offset)
@@ -210,7 +392,7 @@ func (r *MessageRepo) GetByUserPair(ctx context.Context, user1, user2 uuid.UUID,
 	messages := []model.Message{}
 	for rows.Next() {
 		var msg model.Message
-		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.CreatedAt); err != nil {
+		if err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.E2E, &msg.Kind, &msg.CallID, &msg.CreatedAt); err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
@@ -218,29 +400,59 @@ func (r *MessageRepo) GetByUserPair(ctx context.Context, user1, user2 uuid.UUID,
 	return messages, rows.Err()
 }
 
-func (r *MessageRepo) GetByUserPairWithReadStatus(ctx context.Context, currentUser, partnerID uuid.UUID, limit, offset int) ([]model.MessageWithRead, error) {
+func (r *MessageRepo) GetByUserPairPage(ctx context.Context, currentUser, partnerID uuid.UUID, page model.PageRequest) ([]model.MessageWithRead, error) {
+	conn := getConn(ctx, r.pool)
+	var conversationID uuid.UUID
+	err := conn.QueryRow(ctx, `SELECT id FROM conversations WHERE direct_key = $1`, directKey(currentUser, partnerID)).Scan(&conversationID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return []model.MessageWithRead{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.GetByConversationPage(ctx, conversationID, currentUser, page)
+}
+
+// messageWithReadColumns selects a message together with its read and delivery
+// status as seen by the user bound to $2. A member has read a message when their
+// read watermark is at or after it. Outgoing messages count as read once every
+// other member has read them, incoming ones once $2 has.
+const messageWithReadColumns = `
+		m.id, m.conversation_id, m.sender_id, m.receiver_id, m.payload, m.e2e, m.kind, m.call_id, m.created_at, m.edited_at, m.deleted_at,
+		CASE
+			WHEN m.sender_id = $2 THEN
+				NOT EXISTS (
+					SELECT 1 FROM conversation_members om
+					WHERE om.conversation_id = m.conversation_id AND om.user_id != $2
+					  AND (om.last_read_message_at IS NULL OR (om.last_read_message_at, om.last_read_message_id) < (m.created_at, m.id))
+				)
+			ELSE
+				COALESCE((me.last_read_message_at, me.last_read_message_id) >= (m.created_at, m.id), false)
+		END as is_read,
+		ARRAY(
+			SELECT om.user_id FROM conversation_members om
+			WHERE om.conversation_id = m.conversation_id AND om.user_id != m.sender_id
+			  AND (om.last_read_message_at, om.last_read_message_id) >= (m.created_at, m.id)
+			ORDER BY om.user_id
+		) as read_by,
+		CASE
+			WHEN m.sender_id = $2 THEN
+				EXISTS (SELECT 1 FROM message_deliveries md WHERE md.message_id = m.id)
+			ELSE
+				true
+		END as is_delivered`
+
+func (r *MessageRepo) GetByConversationPage(ctx context.Context, conversationID, currentUser uuid.UUID, page model.PageRequest) ([]model.MessageWithRead, error) {
 	conn := getConn(ctx, r.pool)
+	bounds, order, args := keyset("m", page, []interface{}{conversationID, currentUser})
 	sql := `
-		SELECT m.id, m.sender_id, m.receiver_id, m.payload, m.created_at,
-			CASE 
-				WHEN m.sender_id = $2 THEN 
-					COALESCE(cr.last_read_at >= m.created_at, false)
-				ELSE 
-					COALESCE(cr2.last_read_at >= m.created_at, false)
-			END as is_read,
-			CASE 
-				WHEN m.sender_id = $2 THEN 
-					COALESCE(md.delivered_at IS NOT NULL, false)
-				ELSE 
-					true
-			END as is_delivered
+		SELECT ` + messageWithReadColumns + `
 		FROM messages m
-		LEFT JOIN chat_reads cr ON cr.user_id = m.receiver_id AND cr.partner_id = m.sender_id
-		LEFT JOIN chat_reads cr2 ON cr2.user_id = $2 AND cr2.partner_id = m.sender_id
-		LEFT JOIN message_deliveries md ON md.message_id = m.id AND md.receiver_id = m.receiver_id
-		WHERE (m.sender_id = $2 AND m.receiver_id = $1) OR (m.sender_id = $1 AND m.receiver_id = $2)
-		ORDER BY m.created_at DESC LIMIT $3 OFFSET $4`
-	rows, err := conn.Query(ctx, sql, partnerID, currentUser, limit, offset)
+		LEFT JOIN conversation_members me ON me.conversation_id = m.conversation_id AND me.user_id = $2
+		WHERE m.conversation_id = $1
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $2)` + bounds + `
+		` + order + fmt.Sprintf(" LIMIT $%d", len(args)+1)
+	rows, err := conn.Query(ctx, sql, append(args, page.Limit)...)
 	if err != nil {
 		return nil, err
 	}
@@ -249,66 +461,129 @@ func (r *MessageRepo) GetByUserPairWithReadStatus(ctx context.Context, currentUs
 	messages := []model.MessageWithRead{}
 	for rows.Next() {
 		var msg model.MessageWithRead
-		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.CreatedAt, &msg.IsRead, &msg.IsDelivered); err != nil {
+		if err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.E2E, &msg.Kind, &msg.CallID, &msg.CreatedAt, &msg.EditedAt, &msg.DeletedAt, &msg.IsRead, &msg.ReadBy, &msg.IsDelivered); err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
 	}
+	if page.Forward() {
+		slices.Reverse(messages)
+	}
 	return messages, rows.Err()
 }
 
-func (r *MessageRepo) GetConversationPartners(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+// keyset appends the cursor bounds of page to args and returns the matching
+// WHERE fragment and ORDER BY clause over the (created_at, id) columns of alias.
+// Forward pages are ordered oldest first so LIMIT keeps the rows next to the cursor.
+func keyset(alias string, page model.PageRequest, args []interface{}) (string, string, []interface{}) {
+	var bounds string
+	if page.Before != nil {
+		args = append(args, page.Before.CreatedAt, page.Before.ID)
+		bounds += fmt.Sprintf(" AND (%[1]s.created_at, %[1]s.id) < ($%[2]d, $%[3]d)", alias, len(args)-1, len(args))
+	}
+	if page.After != nil {
+		args = append(args, page.After.CreatedAt, page.After.ID)
+		bounds += fmt.Sprintf(" AND (%[1]s.created_at, %[1]s.id) > ($%[2]d, $%[3]d)", alias, len(args)-1, len(args))
+	}
+	direction := "DESC"
+	if page.Forward() {
+		direction = "ASC"
+	}
+	return bounds, fmt.Sprintf("ORDER BY %[1]s.created_at %[2]s, %[1]s.id %[2]s", alias, direction), args
+}
+
+func (r *MessageRepo) Count(ctx context.Context) (int, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `
-		SELECT DISTINCT CASE 
-			WHEN sender_id = $1 THEN receiver_id 
-			ELSE sender_id 
-		END as partner_id 
-		FROM messages 
-		WHERE sender_id = $1 OR receiver_id = $1`
-	rows, err := conn.Query(ctx, sql, userID)
+	var count int
+	err := conn.QueryRow(ctx, `SELECT COUNT(*) FROM messages WHERE deleted_at IS NULL`).Scan(&count)
+	return count, err
+}
+
+func (r *MessageRepo) GetPayloadsAfter(ctx context.Context, after uuid.UUID, limit int) ([]model.Message, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT id, sender_id, receiver_id, payload FROM messages WHERE id > $1 AND deleted_at IS NULL AND NOT e2e ORDER BY id LIMIT $2`
+	rows, err := conn.Query(ctx, sql, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []model.Message{}
+	for rows.Next() {
+		var msg model.Message
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Payload); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func (r *MessageRepo) ReplacePayload(ctx context.Context, id uuid.UUID, oldPayload, newPayload []byte) (bool, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE messages SET payload = $3 WHERE id = $1 AND payload = $2 AND deleted_at IS NULL AND NOT e2e`
+	tag, err := conn.Exec(ctx, sql, id, oldPayload, newPayload)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *MessageRepo) GetEditsByMessageIDs(ctx context.Context, messageIDs []uuid.UUID) ([]model.MessageEdit, error) {
+	if len(messageIDs) == 0 {
+		return []model.MessageEdit{}, nil
+	}
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT message_id, payload, edited_at FROM message_edits WHERE message_id = ANY($1) ORDER BY message_id, edited_at`
+	rows, err := conn.Query(ctx, sql, messageIDs)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var partners []uuid.UUID
+	edits := []model.MessageEdit{}
 	for rows.Next() {
-		var partnerID uuid.UUID
-		if err := rows.Scan(&partnerID); err != nil {
+		var edit model.MessageEdit
+		if err := rows.Scan(&edit.MessageID, &edit.Payload, &edit.EditedAt); err != nil {
 			return nil, err
 		}
-		partners = append(partners, partnerID)
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
+
+func (r *MessageRepo) ReplaceEditPayload(ctx context.Context, messageID uuid.UUID, oldPayload, newPayload []byte) (bool, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE message_edits SET payload = $3 WHERE message_id = $1 AND payload = $2`
+	tag, err := conn.Exec(ctx, sql, messageID, oldPayload, newPayload)
+	if err != nil {
+		return false, err
 	}
-	return partners, rows.Err()
+	return tag.RowsAffected() > 0, nil
 }
 
 func (r *MessageRepo) GetChatList(ctx context.Context, userID uuid.UUID) ([]storage.ChatInfo, error) {
 	conn := getConn(ctx, r.pool)
 	sql := `
-		WITH last_messages AS (
-			SELECT DISTINCT ON (
-				CASE 
-					WHEN sender_id = $1 THEN receiver_id 
-					ELSE sender_id 
-				END
-			)
-			id,
-			sender_id,
-			receiver_id,
-			payload,
-			created_at,
-			CASE 
-				WHEN sender_id = $1 THEN receiver_id 
-				ELSE sender_id 
-			END as partner_id
-		FROM messages 
-		WHERE sender_id = $1 OR receiver_id = $1
-		ORDER BY partner_id, created_at DESC
-		)
-		SELECT partner_id, id, sender_id, receiver_id, payload, created_at 
-		FROM last_messages 
-		ORDER BY created_at DESC`
+		SELECT c.id, c.type, COALESCE(c.title, ''), c.created_at,
+			COALESCE((
+				SELECT om.user_id FROM conversation_members om
+				WHERE om.conversation_id = c.id AND om.user_id != $1
+				LIMIT 1
+			), $1) as partner_id,
+			lm.id, lm.sender_id, lm.receiver_id, lm.payload, lm.e2e, lm.kind, lm.created_at, lm.edited_at
+		FROM conversations c
+		JOIN conversation_members cm ON cm.conversation_id = c.id AND cm.user_id = $1
+		LEFT JOIN LATERAL (
+			SELECT m.id, m.sender_id, m.receiver_id, m.payload, m.e2e, m.kind, m.created_at, m.edited_at
+			FROM messages m
+			WHERE m.conversation_id = c.id AND m.deleted_at IS NULL
+			  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+			ORDER BY m.created_at DESC
+			LIMIT 1
+		) lm ON true
+		WHERE lm.id IS NOT NULL OR c.type = 'group'
+		ORDER BY COALESCE(lm.created_at, c.created_at) DESC`
 
 	rows, err := conn.Query(ctx, sql, userID)
 	if err != nil {
@@ -319,28 +594,91 @@ func (r *MessageRepo) GetChatList(ctx context.Context, userID uuid.UUID) ([]stor
 	chats := []storage.ChatInfo{}
 	for rows.Next() {
 		var chat storage.ChatInfo
-		var msg model.Message
-		err := rows.Scan(&chat.PartnerID, &msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.CreatedAt)
+		var createdAt time.Time
+		var msgID, senderID *uuid.UUID
+		var receiverID uuid.UUID
+		var payload []byte
+		var e2e *bool
+		var kind *string
+		var msgCreatedAt, msgEditedAt *time.Time
+		err := rows.Scan(&chat.ConversationID, &chat.Type, &chat.Title, &createdAt, &chat.PartnerID,
+			&msgID, &senderID, &receiverID, &payload, &e2e, &kind, &msgCreatedAt, &msgEditedAt)
 		if err != nil {
 			return nil, err
 		}
-		chat.LastMessage = &msg
+		if chat.Type == model.ConversationTypeGroup {
+			chat.PartnerID = uuid.Nil
+		}
+		if msgID != nil {
+			chat.LastMessage = &model.Message{
+				ID:             *msgID,
+				ConversationID: chat.ConversationID,
+				SenderID:       *senderID,
+				ReceiverID:     receiverID,
+				Payload:        payload,
+				E2E:            *e2e,
+				Kind:           model.MessageKind(*kind),
+				CreatedAt:      *msgCreatedAt,
+				EditedAt:       msgEditedAt,
+			}
+		}
 		chats = append(chats, chat)
 	}
 	return chats, rows.Err()
 }
 
-func (r *MessageRepo) MarkAsRead(ctx context.Context, userID, partnerID uuid.UUID) error {
+func (r *MessageRepo) AdvanceReadMarker(ctx context.Context, conversationID, userID uuid.UUID, upTo model.Cursor, readAt time.Time) (bool, error) {
 	conn := getConn(ctx, r.pool)
 	sql := `
-		INSERT INTO chat_reads (user_id, partner_id, last_read_at) 
-		VALUES ($1, $2, NOW()) 
-		ON CONFLICT (user_id, partner_id) 
-		DO UPDATE SET last_read_at = NOW()`
-	_, err := conn.Exec(ctx, sql, userID, partnerID)
+		UPDATE conversation_members
+		SET last_read_message_id = $4, last_read_message_at = $3, last_read_at = $5
+		WHERE conversation_id = $1 AND user_id = $2
+		  AND (last_read_message_at IS NULL OR (last_read_message_at, last_read_message_id) < ($3, $4))`
+	tag, err := conn.Exec(ctx, sql, conversationID, userID, upTo.CreatedAt, upTo.ID, readAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *MessageRepo) AddReadReceipts(ctx context.Context, conversationID, userID uuid.UUID, from *model.Cursor, upTo model.Cursor, readAt time.Time) error {
+	conn := getConn(ctx, r.pool)
+	args := []interface{}{conversationID, userID, readAt, upTo.CreatedAt, upTo.ID}
+	bounds := ""
+	if from != nil {
+		args = append(args, from.CreatedAt, from.ID)
+		bounds = ` AND (m.created_at, m.id) > ($6, $7)`
+	}
+	sql := `
+		INSERT INTO message_reads (message_id, user_id, read_at)
+		SELECT m.id, $2, $3 FROM messages m
+		WHERE m.conversation_id = $1 AND m.sender_id != $2
+		  AND (m.created_at, m.id) <= ($4, $5)` + bounds + `
+		ON CONFLICT (message_id, user_id) DO NOTHING`
+	_, err := conn.Exec(ctx, sql, args...)
 	return err
 }
 
+func (r *MessageRepo) GetReadReceipts(ctx context.Context, messageID uuid.UUID) ([]model.MessageRead, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT message_id, user_id, read_at FROM message_reads WHERE message_id = $1 ORDER BY read_at, user_id`
+	rows, err := conn.Query(ctx, sql, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reads := []model.MessageRead{}
+	for rows.Next() {
+		var read model.MessageRead
+		if err := rows.Scan(&read.MessageID, &read.UserID, &read.ReadAt); err != nil {
+			return nil, err
+		}
+		reads = append(reads, read)
+	}
+	return reads, rows.Err()
+}
+
 func (r *MessageRepo) MarkAsDelivered(ctx context.Context, messageID, receiverID uuid.UUID) error {
 	conn := getConn(ctx, r.pool)
 	sql := `
@@ -355,13 +693,13 @@ func (r *MessageRepo) MarkAsDelivered(ctx context.Context, messageID, receiverID
 func (r *MessageRepo) GetUnreadCounts(ctx context.Context, userID uuid.UUID) (map[uuid.UUID]int, error) {
 	conn := getConn(ctx, r.pool)
 	sql := `
-		SELECT m.sender_id, COUNT(*) 
+		SELECT m.conversation_id, COUNT(*) 
 		FROM messages m
-		LEFT JOIN chat_reads cr ON cr.user_id = $1 AND cr.partner_id = m.sender_id
-		WHERE m.receiver_id = $1 
-		  AND m.sender_id != $1
-		  AND (cr.last_read_at IS NULL OR m.created_at > cr.last_read_at)
-		GROUP BY m.sender_id`
+		JOIN conversation_members cm ON cm.conversation_id = m.conversation_id AND cm.user_id = $1
+		WHERE m.sender_id != $1 AND m.deleted_at IS NULL AND m.kind != 'call'
+		  AND (cm.last_read_message_at IS NULL OR (m.created_at, m.id) > (cm.last_read_message_at, cm.last_read_message_id))
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+		GROUP BY m.conversation_id`
 
 	rows, err := conn.Query(ctx, sql, userID)
 	if err != nil {
@@ -371,80 +709,400 @@ func (r *MessageRepo) GetUnreadCounts(ctx context.Context, userID uuid.UUID) (ma
 
 	counts := make(map[uuid.UUID]int)
 	for rows.Next() {
-		var senderID uuid.UUID
+		var conversationID uuid.UUID
 		var count int
-		if err := rows.Scan(&senderID, &count); err != nil {
+		if err := rows.Scan(&conversationID, &count); err != nil {
 			return nil, err
 		}
-		counts[senderID] = count
+		counts[conversationID] = count
 	}
 	return counts, rows.Err()
 }
 
-type CallRepo struct {
-	pool *pgxpool.Pool
+// SyncHead is the oldest transaction still running: every change of an older one
+// has been committed or rolled back
+func (r *MessageRepo) SyncHead(ctx context.Context) (model.SyncPosition, error) {
+	conn := getConn(ctx, r.pool)
+	var head model.SyncPosition
+	err := conn.QueryRow(ctx, `SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint`).Scan(&head.Txn)
+	return head, err
 }
 
-func (r *CallRepo) Create(ctx context.Context, call *model.Call) error {
+func (r *MessageRepo) GetSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.Message, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `INSERT INTO calls (id, initiator_id, call_type, status, created_at) VALUES ($1, $2, $3, $4, $5)`
-	_, err := conn.Exec(ctx, sql, call.ID, call.InitiatorID, call.CallType, call.Status, call.CreatedAt)
-	return err
+	sql := `
+		SELECT m.id, m.conversation_id, m.sender_id, m.receiver_id, m.payload, m.e2e, m.kind, m.call_id, m.created_at, m.edited_at, m.deleted_at,
+			m.sync_txn, m.sync_seq
+		FROM messages m
+		JOIN conversation_members me ON me.conversation_id = m.conversation_id AND me.user_id = $1
+		WHERE (m.sync_txn, m.sync_seq) > ($2, $3) AND (m.sync_txn, m.sync_seq) < ($4, $5)
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+		ORDER BY m.sync_txn, m.sync_seq LIMIT $6`
+	rows, err := conn.Query(ctx, sql, userID, since.Txn, since.Seq, until.Txn, until.Seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []model.Message{}
+	for rows.Next() {
+		var msg model.Message
+		if err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.ReceiverID, &msg.Payload, &msg.E2E, &msg.Kind, &msg.CallID, &msg.CreatedAt, &msg.EditedAt, &msg.DeletedAt,
+			&msg.SyncPos.Txn, &msg.SyncPos.Seq); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
 }
 
-func (r *CallRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Call, error) {
+// GetReadReceiptsSince includes the user's own watermarks so other devices converge too
+func (r *MessageRepo) GetReadReceiptsSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.ReadReceipt, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `SELECT id, initiator_id, call_type, status, started_at, ended_at, created_at FROM calls WHERE id = $1`
-	call := &model.Call{}
-	err := conn.QueryRow(ctx, sql, id).Scan(&call.ID, &call.InitiatorID, &call.CallType, &call.Status, &call.StartedAt, &call.EndedAt, &call.CreatedAt)
-	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, nil
-	}
+	sql := `
+		SELECT cm.conversation_id, cm.user_id, cm.last_read_message_id, cm.last_read_at, cm.sync_txn, cm.sync_seq
+		FROM conversation_members cm
+		JOIN conversation_members me ON me.conversation_id = cm.conversation_id AND me.user_id = $1
+		WHERE (cm.sync_txn, cm.sync_seq) > ($2, $3) AND (cm.sync_txn, cm.sync_seq) < ($4, $5)
+		  AND cm.last_read_message_id IS NOT NULL AND cm.last_read_at IS NOT NULL
+		ORDER BY cm.sync_txn, cm.sync_seq LIMIT $6`
+	rows, err := conn.Query(ctx, sql, userID, since.Txn, since.Seq, until.Txn, until.Seq, limit)
 	if err != nil {
 		return nil, err
 	}
-	return call, nil
+	defer rows.Close()
+
+	receipts := []model.ReadReceipt{}
+	for rows.Next() {
+		var receipt model.ReadReceipt
+		if err := rows.Scan(&receipt.ConversationID, &receipt.ReaderID, &receipt.MessageID, &receipt.ReadAt, &receipt.SyncPos.Txn, &receipt.SyncPos.Seq); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
 }
 
-func (r *CallRepo) GetByStatus(ctx context.Context, status string) ([]model.Call, error) {
+// GetDeliveryReceiptsSince returns deliveries of messages sent by the user
+func (r *MessageRepo) GetDeliveryReceiptsSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.DeliveryReceipt, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `SELECT id, initiator_id, call_type, status, started_at, ended_at, created_at FROM calls WHERE status = $1 ORDER BY created_at DESC`
-	rows, err := conn.Query(ctx, sql, status)
+	sql := `
+		SELECT md.message_id, m.conversation_id, m.sender_id, md.receiver_id, md.delivered_at, md.sync_txn, md.sync_seq
+		FROM message_deliveries md
+		JOIN messages m ON m.id = md.message_id
+		WHERE m.sender_id = $1
+		  AND (md.sync_txn, md.sync_seq) > ($2, $3) AND (md.sync_txn, md.sync_seq) < ($4, $5)
+		ORDER BY md.sync_txn, md.sync_seq LIMIT $6`
+	rows, err := conn.Query(ctx, sql, userID, since.Txn, since.Seq, until.Txn, until.Seq, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	calls := []model.Call{}
+	receipts := []model.DeliveryReceipt{}
 	for rows.Next() {
-		var call model.Call
-		if err := rows.Scan(&call.ID, &call.InitiatorID, &call.CallType, &call.Status, &call.StartedAt, &call.EndedAt, &call.CreatedAt); err != nil {
+		var receipt model.DeliveryReceipt
+		if err := rows.Scan(&receipt.MessageID, &receipt.ConversationID, &receipt.SenderID, &receipt.ReceiverID, &receipt.DeliveredAt, &receipt.SyncPos.Txn, &receipt.SyncPos.Seq); err != nil {
 			return nil, err
 		}
-		calls = append(calls, call)
+		receipts = append(receipts, receipt)
 	}
-	return calls, rows.Err()
+	return receipts, rows.Err()
 }
 
-func (r *CallRepo) UpdateStatus(ctx context.Context, id uuid.UUID, status string) error {
-	conn := getConn(ctx, r.pool)
-	sql := `UPDATE calls SET status = $1 WHERE id = $2`
-	_, err := conn.Exec(ctx, sql, status, id)
-	return err
+type ConversationRepo struct {
+	pool *pgxpool.Pool
 }
 
-func (r *CallRepo) UpdateStartedAt(ctx context.Context, id uuid.UUID, startedAt *time.Time) error {
+func (r *ConversationRepo) Create(ctx context.Context, conv *model.Conversation) error {
 	conn := getConn(ctx, r.pool)
-	sql := `UPDATE calls SET started_at = $1 WHERE id = $2`
-	_, err := conn.Exec(ctx, sql, startedAt, id)
+	sql := `INSERT INTO conversations (id, type, title, created_by, created_at) VALUES ($1, $2, NULLIF($3, ''), $4, $5)`
+	_, err := conn.Exec(ctx, sql, conv.ID, conv.Type, conv.Title, conv.CreatedBy, conv.CreatedAt)
 	return err
 }
 
-func (r *CallRepo) UpdateEndedAt(ctx context.Context, id uuid.UUID, endedAt *time.Time) error {
+func (r *ConversationRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Conversation, error) {
 	conn := getConn(ctx, r.pool)
-	sql := `UPDATE calls SET ended_at = $1 WHERE id = $2`
-	_, err := conn.Exec(ctx, sql, endedAt, id)
-	return err
+	sql := `SELECT id, type, COALESCE(title, ''), created_by, created_at FROM conversations WHERE id = $1`
+	conv := &model.Conversation{}
+	err := conn.QueryRow(ctx, sql, id).Scan(&conv.ID, &conv.Type, &conv.Title, &conv.CreatedBy, &conv.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+func (r *ConversationRepo) GetOrCreateDirect(ctx context.Context, user1, user2 uuid.UUID) (*model.Conversation, error) {
+	conn := getConn(ctx, r.pool)
+	key := directKey(user1, user2)
+
+	// Idempotent under concurrent first messages thanks to the unique direct_key
+	insertConv := `
+		INSERT INTO conversations (id, type, direct_key, created_at)
+		VALUES ($1, 'direct', $2, NOW())
+		ON CONFLICT (direct_key) DO NOTHING`
+	if _, err := conn.Exec(ctx, insertConv, uuid.New(), key); err != nil {
+		return nil, err
+	}
+
+	conv := &model.Conversation{}
+	sql := `SELECT id, type, COALESCE(title, ''), created_by, created_at FROM conversations WHERE direct_key = $1`
+	if err := conn.QueryRow(ctx, sql, key).Scan(&conv.ID, &conv.Type, &conv.Title, &conv.CreatedBy, &conv.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	insertMembers := `
+		INSERT INTO conversation_members (conversation_id, user_id, role, joined_at)
+		VALUES ($1, $2, 'member', $4), ($1, $3, 'member', $4)
+		ON CONFLICT (conversation_id, user_id) DO NOTHING`
+	if _, err := conn.Exec(ctx, insertMembers, conv.ID, user1, user2, conv.CreatedAt); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+func (r *ConversationRepo) GetByUserID(ctx context.Context, userID uuid.UUID) ([]model.Conversation, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `
+		SELECT c.id, c.type, COALESCE(c.title, ''), c.created_by, c.created_at
+		FROM conversations c
+		JOIN conversation_members cm ON cm.conversation_id = c.id
+		WHERE cm.user_id = $1
+		ORDER BY c.created_at DESC`
+	rows, err := conn.Query(ctx, sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []model.Conversation{}
+	for rows.Next() {
+		var conv model.Conversation
+		if err := rows.Scan(&conv.ID, &conv.Type, &conv.Title, &conv.CreatedBy, &conv.CreatedAt); err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conv)
+	}
+	return conversations, rows.Err()
+}
+
+func (r *ConversationRepo) UpdateTitle(ctx context.Context, id uuid.UUID, title string) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE conversations SET title = NULLIF($1, '') WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, title, id)
+	return err
+}
+
+func (r *ConversationRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	conn := getConn(ctx, r.pool)
+	sql := `DELETE FROM conversations WHERE id = $1`
+	_, err := conn.Exec(ctx, sql, id)
+	return err
+}
+
+const memberColumns = `conversation_id, user_id, role, joined_at, last_read_at, last_read_message_id, last_read_message_at`
+
+func scanMember(row pgx.Row) (*model.ConversationMember, error) {
+	var member model.ConversationMember
+	if err := row.Scan(&member.ConversationID, &member.UserID, &member.Role, &member.JoinedAt, &member.LastReadAt,
+		&member.LastReadMessageID, &member.LastReadMessageAt); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (r *ConversationRepo) AddMember(ctx context.Context, member *model.ConversationMember) error {
+	conn := getConn(ctx, r.pool)
+	sql := `INSERT INTO conversation_members (` + memberColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := conn.Exec(ctx, sql, member.ConversationID, member.UserID, member.Role, member.JoinedAt, member.LastReadAt,
+		member.LastReadMessageID, member.LastReadMessageAt)
+	return err
+}
+
+func (r *ConversationRepo) GetNewestMessage(ctx context.Context, conversationID uuid.UUID) (*model.Cursor, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT created_at, id FROM messages WHERE conversation_id = $1 ORDER BY created_at DESC, id DESC LIMIT 1`
+	var newest model.Cursor
+	err := conn.QueryRow(ctx, sql, conversationID).Scan(&newest.CreatedAt, &newest.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &newest, nil
+}
+
+func (r *ConversationRepo) GetMember(ctx context.Context, conversationID, userID uuid.UUID) (*model.ConversationMember, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT ` + memberColumns + ` FROM conversation_members WHERE conversation_id = $1 AND user_id = $2`
+	member, err := scanMember(conn.QueryRow(ctx, sql, conversationID, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+func (r *ConversationRepo) GetMembers(ctx context.Context, conversationID uuid.UUID) ([]model.ConversationMember, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT ` + memberColumns + ` FROM conversation_members WHERE conversation_id = $1 ORDER BY joined_at`
+	rows, err := conn.Query(ctx, sql, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []model.ConversationMember{}
+	for rows.Next() {
+		member, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, *member)
+	}
+	return members, rows.Err()
+}
+
+func (r *ConversationRepo) GetMemberIDs(ctx context.Context, conversationID uuid.UUID) ([]uuid.UUID, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT user_id FROM conversation_members WHERE conversation_id = $1`
+	rows, err := conn.Query(ctx, sql, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r *ConversationRepo) GetContactIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT DISTINCT other.user_id FROM conversation_members me
+		JOIN conversation_members other ON other.conversation_id = me.conversation_id
+		WHERE me.user_id = $1 AND other.user_id <> $1`
+	rows, err := conn.Query(ctx, sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r *ConversationRepo) UpdateMemberRole(ctx context.Context, conversationID, userID uuid.UUID, role string) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE conversation_members SET role = $1 WHERE conversation_id = $2 AND user_id = $3`
+	_, err := conn.Exec(ctx, sql, role, conversationID, userID)
+	return err
+}
+
+func (r *ConversationRepo) RemoveMember(ctx context.Context, conversationID, userID uuid.UUID) error {
+	conn := getConn(ctx, r.pool)
+	sql := `DELETE FROM conversation_members WHERE conversation_id = $1 AND user_id = $2`
+	_, err := conn.Exec(ctx, sql, conversationID, userID)
+	return err
+}
+
+type CallRepo struct {
+	pool *pgxpool.Pool
+}
+
+func (r *CallRepo) Create(ctx context.Context, call *model.Call) error {
+	conn := getConn(ctx, r.pool)
+	sql := `INSERT INTO calls (id, initiator_id, call_type, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := conn.Exec(ctx, sql, call.ID, call.InitiatorID, call.CallType, call.Status, call.CreatedAt, call.UpdatedAt)
+	return err
+}
+
+func (r *CallRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Call, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT id, initiator_id, call_type, status, started_at, ended_at, created_at, updated_at FROM calls WHERE id = $1`
+	call := &model.Call{}
+	err := conn.QueryRow(ctx, sql, id).Scan(&call.ID, &call.InitiatorID, &call.CallType, &call.Status, &call.StartedAt, &call.EndedAt, &call.CreatedAt, &call.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+func (r *CallRepo) GetByIDForUpdate(ctx context.Context, id uuid.UUID) (*model.Call, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT id, initiator_id, call_type, status, started_at, ended_at, created_at, updated_at FROM calls WHERE id = $1 FOR UPDATE`
+	call := &model.Call{}
+	err := conn.QueryRow(ctx, sql, id).Scan(&call.ID, &call.InitiatorID, &call.CallType, &call.Status, &call.StartedAt, &call.EndedAt, &call.CreatedAt, &call.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+func (r *CallRepo) GetByStatus(ctx context.Context, status string) ([]model.Call, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT id, initiator_id, call_type, status, started_at, ended_at, created_at, updated_at FROM calls WHERE status = $1 ORDER BY created_at DESC`
+	rows, err := conn.Query(ctx, sql, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calls := []model.Call{}
+	for rows.Next() {
+		var call model.Call
+		if err := rows.Scan(&call.ID, &call.InitiatorID, &call.CallType, &call.Status, &call.StartedAt, &call.EndedAt, &call.CreatedAt, &call.UpdatedAt); err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, rows.Err()
+}
+
+func (r *CallRepo) UpdateStatus(ctx context.Context, id uuid.UUID, status string) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE calls SET status = $1, updated_at = NOW() WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, status, id)
+	return err
+}
+
+func (r *CallRepo) UpdateStartedAt(ctx context.Context, id uuid.UUID, startedAt *time.Time) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE calls SET started_at = $1, updated_at = NOW() WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, startedAt, id)
+	return err
+}
+
+func (r *CallRepo) UpdateEndedAt(ctx context.Context, id uuid.UUID, endedAt *time.Time) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE calls SET ended_at = $1, updated_at = NOW() WHERE id = $2`
+	_, err := conn.Exec(ctx, sql, endedAt, id)
+	return err
 }
 
 func (r *CallRepo) Delete(ctx context.Context, id uuid.UUID) error {
@@ -497,21 +1155,21 @@ func (r *CallRepo) GetParticipant(ctx context.Context, callID, userID uuid.UUID)
 
 func (r *CallRepo) UpdateParticipantStatus(ctx context.Context, callID, userID uuid.UUID, status string) error {
 	conn := getConn(ctx, r.pool)
-	sql := `UPDATE call_participants SET status = $1 WHERE call_id = $2 AND user_id = $3`
+	sql := touchCall(`UPDATE call_participants SET status = $1 WHERE call_id = $2 AND user_id = $3 RETURNING call_id`)
 	_, err := conn.Exec(ctx, sql, status, callID, userID)
 	return err
 }
 
 func (r *CallRepo) UpdateParticipantJoinedAt(ctx context.Context, callID, userID uuid.UUID, joinedAt *time.Time) error {
 	conn := getConn(ctx, r.pool)
-	sql := `UPDATE call_participants SET joined_at = $1 WHERE call_id = $2 AND user_id = $3`
+	sql := touchCall(`UPDATE call_participants SET joined_at = $1 WHERE call_id = $2 AND user_id = $3 RETURNING call_id`)
 	_, err := conn.Exec(ctx, sql, joinedAt, callID, userID)
 	return err
 }
 
 func (r *CallRepo) UpdateParticipantLeftAt(ctx context.Context, callID, userID uuid.UUID, leftAt *time.Time) error {
 	conn := getConn(ctx, r.pool)
-	sql := `UPDATE call_participants SET left_at = $1 WHERE call_id = $2 AND user_id = $3`
+	sql := touchCall(`UPDATE call_participants SET left_at = $1 WHERE call_id = $2 AND user_id = $3 RETURNING call_id`)
 	_, err := conn.Exec(ctx, sql, leftAt, callID, userID)
 	return err
 }
@@ -530,18 +1188,49 @@ func (r *CallRepo) DeleteParticipant(ctx context.Context, callID, userID uuid.UU
 	return err
 }
 
-func (r *CallRepo) GetCallHistory(ctx context.Context, userID uuid.UUID, limit, offset int) ([]model.CallHistoryItem, error) {
+// touchCall wraps a participant UPDATE ... RETURNING call_id so the owning
+// call's updated_at moves with it
+func touchCall(update string) string {
+	return `WITH p AS (` + update + `) UPDATE calls SET updated_at = NOW() WHERE id IN (SELECT call_id FROM p)`
+}
+
+func (r *CallRepo) GetUpdatedSince(ctx context.Context, userID uuid.UUID, since, until model.SyncPosition, limit int) ([]model.Call, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `
+		SELECT c.id, c.initiator_id, c.call_type, c.status, c.started_at, c.ended_at, c.created_at, c.updated_at, c.sync_txn, c.sync_seq
+		FROM calls c
+		JOIN call_participants cp ON cp.call_id = c.id AND cp.user_id = $1
+		WHERE (c.sync_txn, c.sync_seq) > ($2, $3) AND (c.sync_txn, c.sync_seq) < ($4, $5)
+		ORDER BY c.sync_txn, c.sync_seq LIMIT $6`
+	rows, err := conn.Query(ctx, sql, userID, since.Txn, since.Seq, until.Txn, until.Seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calls := []model.Call{}
+	for rows.Next() {
+		var call model.Call
+		if err := rows.Scan(&call.ID, &call.InitiatorID, &call.CallType, &call.Status, &call.StartedAt, &call.EndedAt, &call.CreatedAt, &call.UpdatedAt, &call.SyncPos.Txn, &call.SyncPos.Seq); err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, rows.Err()
+}
+
+func (r *CallRepo) GetCallHistoryPage(ctx context.Context, userID uuid.UUID, page model.PageRequest) ([]model.CallHistoryItem, error) {
 	conn := getConn(ctx, r.pool)
+	bounds, order, args := keyset("c", page, []interface{}{userID})
 	sql := `
 		SELECT c.id, c.initiator_id, c.call_type, c.status, c.started_at, c.ended_at, c.created_at,
 			u.id, u.username, u.created_at
 		FROM calls c
 		LEFT JOIN call_participants cp ON cp.call_id = c.id
 		LEFT JOIN users u ON u.id = c.initiator_id
-		WHERE cp.user_id = $1
-		ORDER BY c.created_at DESC
-		LIMIT $2 OFFSET $3`
-	rows, err := conn.Query(ctx, sql, userID, limit, offset)
+		WHERE cp.user_id = $1` + bounds + `
+		` + order + fmt.Sprintf(" LIMIT $%d", len(args)+1)
+	rows, err := conn.Query(ctx, sql, append(args, page.Limit)...)
 	if err != nil {
 		return nil, err
 	}
@@ -558,5 +1247,353 @@ func (r *CallRepo) GetCallHistory(ctx context.Context, userID uuid.UUID, limit,
 		item.Initiator = &user
 		history = append(history, item)
 	}
+	if page.Forward() {
+		slices.Reverse(history)
+	}
 	return history, rows.Err()
 }
+
+type AttachmentRepo struct {
+	pool *pgxpool.Pool
+}
+
+const attachmentColumns = `id, conversation_id, uploader_id, message_id, file_name, content_type, size, created_at`
+
+func scanAttachment(row pgx.Row) (*model.Attachment, error) {
+	var att model.Attachment
+	if err := row.Scan(&att.ID, &att.ConversationID, &att.UploaderID, &att.MessageID, &att.FileName, &att.ContentType, &att.Size, &att.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &att, nil
+}
+
+func (r *AttachmentRepo) Create(ctx context.Context, att *model.Attachment) error {
+	conn := getConn(ctx, r.pool)
+	sql := `INSERT INTO attachments (` + attachmentColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := conn.Exec(ctx, sql, att.ID, att.ConversationID, att.UploaderID, att.MessageID, att.FileName, att.ContentType, att.Size, att.CreatedAt)
+	return err
+}
+
+func (r *AttachmentRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Attachment, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT ` + attachmentColumns + ` FROM attachments WHERE id = $1`
+	att, err := scanAttachment(conn.QueryRow(ctx, sql, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+func (r *AttachmentRepo) GetByIDs(ctx context.Context, ids []uuid.UUID) ([]model.Attachment, error) {
+	if len(ids) == 0 {
+		return []model.Attachment{}, nil
+	}
+	sql := `SELECT ` + attachmentColumns + ` FROM attachments WHERE id = ANY($1) ORDER BY created_at, id`
+	return r.query(ctx, sql, ids)
+}
+
+func (r *AttachmentRepo) GetByMessageIDs(ctx context.Context, messageIDs []uuid.UUID) ([]model.Attachment, error) {
+	if len(messageIDs) == 0 {
+		return []model.Attachment{}, nil
+	}
+	sql := `SELECT ` + attachmentColumns + ` FROM attachments WHERE message_id = ANY($1) ORDER BY created_at, id`
+	return r.query(ctx, sql, messageIDs)
+}
+
+func (r *AttachmentRepo) GetAfter(ctx context.Context, after uuid.UUID, limit int) ([]model.Attachment, error) {
+	sql := `SELECT ` + attachmentColumns + ` FROM attachments WHERE id > $1 ORDER BY id LIMIT $2`
+	return r.query(ctx, sql, after, limit)
+}
+
+func (r *AttachmentRepo) GetByUserID(ctx context.Context, userID uuid.UUID) ([]model.Attachment, error) {
+	sql := `SELECT ` + attachmentColumns + ` FROM attachments
+		WHERE uploader_id = $1
+			OR message_id IN (SELECT id FROM messages WHERE sender_id = $1 OR receiver_id = $1)
+		ORDER BY created_at, id`
+	return r.query(ctx, sql, userID)
+}
+
+func (r *AttachmentRepo) AttachToMessage(ctx context.Context, ids []uuid.UUID, messageID uuid.UUID) (int, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE attachments SET message_id = $2 WHERE id = ANY($1) AND message_id IS NULL`
+	tag, err := conn.Exec(ctx, sql, ids, messageID)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (r *AttachmentRepo) DeleteByMessageID(ctx context.Context, messageID uuid.UUID) ([]model.Attachment, error) {
+	sql := `DELETE FROM attachments WHERE message_id = $1 RETURNING ` + attachmentColumns
+	return r.query(ctx, sql, messageID)
+}
+
+func (r *AttachmentRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	conn := getConn(ctx, r.pool)
+	sql := `DELETE FROM attachments WHERE id = $1`
+	_, err := conn.Exec(ctx, sql, id)
+	return err
+}
+
+func (r *AttachmentRepo) query(ctx context.Context, sql string, args ...interface{}) ([]model.Attachment, error) {
+	conn := getConn(ctx, r.pool)
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []model.Attachment{}
+	for rows.Next() {
+		att, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, *att)
+	}
+	return attachments, rows.Err()
+}
+
+type SessionRepo struct {
+	pool *pgxpool.Pool
+}
+
+const sessionColumns = `id, user_id, refresh_hash, previous_hash, user_agent, ip, created_at, last_used_at, expires_at, revoked_at`
+
+func scanSession(row pgx.Row) (*model.Session, error) {
+	var session model.Session
+	if err := row.Scan(&session.ID, &session.UserID, &session.RefreshHash, &session.PreviousHash, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.RevokedAt); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (r *SessionRepo) Create(ctx context.Context, session *model.Session) error {
+	conn := getConn(ctx, r.pool)
+	sql := `INSERT INTO sessions (` + sessionColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err := conn.Exec(ctx, sql, session.ID, session.UserID, session.RefreshHash, session.PreviousHash, session.UserAgent, session.IP,
+		session.CreatedAt, session.LastUsedAt, session.ExpiresAt, session.RevokedAt)
+	return err
+}
+
+func (r *SessionRepo) GetByID(ctx context.Context, id uuid.UUID) (*model.Session, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT ` + sessionColumns + ` FROM sessions WHERE id = $1`
+	session, err := scanSession(conn.QueryRow(ctx, sql, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (r *SessionRepo) GetActiveByUserID(ctx context.Context, userID uuid.UUID) ([]model.Session, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT ` + sessionColumns + ` FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC, id`
+	rows, err := conn.Query(ctx, sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []model.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+func (r *SessionRepo) Rotate(ctx context.Context, id uuid.UUID, oldHash, newHash string, usedAt, expiresAt time.Time) (bool, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE sessions SET previous_hash = refresh_hash, refresh_hash = $3, last_used_at = $4, expires_at = $5
+		WHERE id = $1 AND refresh_hash = $2 AND revoked_at IS NULL`
+	tag, err := conn.Exec(ctx, sql, id, oldHash, newHash, usedAt, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *SessionRepo) Revoke(ctx context.Context, id uuid.UUID, revokedAt time.Time) error {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE sessions SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL`
+	_, err := conn.Exec(ctx, sql, id, revokedAt)
+	return err
+}
+
+func (r *SessionRepo) RevokeByUserID(ctx context.Context, userID, except uuid.UUID, revokedAt time.Time) ([]uuid.UUID, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `UPDATE sessions SET revoked_at = $3 WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL RETURNING id`
+	rows, err := conn.Query(ctx, sql, userID, except, revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+type KeyRepo struct {
+	pool *pgxpool.Pool
+}
+
+const deviceColumns = `id, user_id, identity_key, signed_prekey_id, signed_prekey, signed_prekey_signature, created_at, updated_at`
+
+func scanDevice(row pgx.Row) (*model.Device, error) {
+	var device model.Device
+	if err := row.Scan(&device.ID, &device.UserID, &device.IdentityKey, &device.SignedPrekeyID, &device.SignedPrekey,
+		&device.SignedPrekeySignature, &device.CreatedAt, &device.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// SaveDevice upserts a device; a device ID registered by another user is left untouched and reported as an error
+func (r *KeyRepo) SaveDevice(ctx context.Context, device *model.Device) error {
+	conn := getConn(ctx, r.pool)
+	sql := `INSERT INTO e2e_devices (` + deviceColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET identity_key = EXCLUDED.identity_key, signed_prekey_id = EXCLUDED.signed_prekey_id,
+			signed_prekey = EXCLUDED.signed_prekey, signed_prekey_signature = EXCLUDED.signed_prekey_signature,
+			updated_at = EXCLUDED.updated_at
+		WHERE e2e_devices.user_id = EXCLUDED.user_id
+		RETURNING created_at`
+	err := conn.QueryRow(ctx, sql, device.ID, device.UserID, device.IdentityKey, device.SignedPrekeyID, device.SignedPrekey,
+		device.SignedPrekeySignature, device.CreatedAt, device.UpdatedAt).Scan(&device.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("device %s belongs to another user", device.ID)
+	}
+	return err
+}
+
+func (r *KeyRepo) GetDevice(ctx context.Context, id uuid.UUID) (*model.Device, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT ` + deviceColumns + ` FROM e2e_devices WHERE id = $1`
+	device, err := scanDevice(conn.QueryRow(ctx, sql, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (r *KeyRepo) GetDevicesByUserID(ctx context.Context, userID uuid.UUID) ([]model.Device, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT ` + deviceColumns + ` FROM e2e_devices WHERE user_id = $1 ORDER BY created_at, id`
+	rows, err := conn.Query(ctx, sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []model.Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *device)
+	}
+	return devices, rows.Err()
+}
+
+func (r *KeyRepo) DeleteDevice(ctx context.Context, id uuid.UUID) error {
+	conn := getConn(ctx, r.pool)
+	_, err := conn.Exec(ctx, `DELETE FROM e2e_devices WHERE id = $1`, id)
+	return err
+}
+
+func (r *KeyRepo) AddPrekeys(ctx context.Context, deviceID uuid.UUID, prekeys []model.OneTimePrekey) (int, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `INSERT INTO e2e_prekeys (device_id, key_id, public_key) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+	added := 0
+	for _, prekey := range prekeys {
+		tag, err := conn.Exec(ctx, sql, deviceID, prekey.KeyID, prekey.PublicKey)
+		if err != nil {
+			return added, err
+		}
+		added += int(tag.RowsAffected())
+	}
+	return added, nil
+}
+
+func (r *KeyRepo) CountPrekeys(ctx context.Context, deviceID uuid.UUID) (int, error) {
+	conn := getConn(ctx, r.pool)
+	var count int
+	err := conn.QueryRow(ctx, `SELECT COUNT(*) FROM e2e_prekeys WHERE device_id = $1`, deviceID).Scan(&count)
+	return count, err
+}
+
+// ClaimPrekey skips rows locked by concurrent claims, so two senders never get the same prekey
+func (r *KeyRepo) ClaimPrekey(ctx context.Context, deviceID uuid.UUID) (*model.OneTimePrekey, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `DELETE FROM e2e_prekeys WHERE (device_id, key_id) = (
+			SELECT device_id, key_id FROM e2e_prekeys WHERE device_id = $1
+			ORDER BY key_id LIMIT 1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING key_id, public_key`
+	var prekey model.OneTimePrekey
+	err := conn.QueryRow(ctx, sql, deviceID).Scan(&prekey.KeyID, &prekey.PublicKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &prekey, nil
+}
+
+func (r *KeyRepo) DeletePrekeys(ctx context.Context, deviceID uuid.UUID) error {
+	conn := getConn(ctx, r.pool)
+	_, err := conn.Exec(ctx, `DELETE FROM e2e_prekeys WHERE device_id = $1`, deviceID)
+	return err
+}
+
+type DataKeyRepo struct {
+	pool *pgxpool.Pool
+}
+
+func (r *DataKeyRepo) GetByID(ctx context.Context, id string) (*model.DataKey, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `SELECT id, provider, wrapped, created_at FROM data_keys WHERE id = $1`
+	var key model.DataKey
+	err := conn.QueryRow(ctx, sql, id).Scan(&key.ID, &key.Provider, &key.Wrapped, &key.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *DataKeyRepo) Create(ctx context.Context, key *model.DataKey) (bool, error) {
+	conn := getConn(ctx, r.pool)
+	sql := `INSERT INTO data_keys (id, provider, wrapped, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO NOTHING`
+	tag, err := conn.Exec(ctx, sql, key.ID, key.Provider, key.Wrapped, key.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,110 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Backplane carries hub events between messenger instances so that a client
+// connected to one instance receives events produced on another.
+// Payloads are opaque to the backplane.
+type Backplane interface {
+	// Publish sends a payload to every subscriber, including other instances
+	Publish(ctx context.Context, payload []byte) error
+	// Subscribe delivers published payloads to handler until ctx is cancelled
+	// or the subscription fails
+	Subscribe(ctx context.Context, handler func(payload []byte)) error
+}
+
+// LocalBackplane is the in-process default: it connects hubs living in the same
+// process and is a no-op for a single hub.
+type LocalBackplane struct {
+	mu       sync.RWMutex
+	handlers map[int]func([]byte)
+	nextID   int
+}
+
+func NewLocalBackplane() *LocalBackplane {
+	return &LocalBackplane{handlers: make(map[int]func([]byte))}
+}
+
+func (b *LocalBackplane) Publish(ctx context.Context, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (b *LocalBackplane) Subscribe(ctx context.Context, handler func([]byte)) error {
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	b.mu.Unlock()
+
+	<-ctx.Done()
+
+	b.mu.Lock()
+	delete(b.handlers, id)
+	b.mu.Unlock()
+	return ctx.Err()
+}
+
+// Distributed reports whether the hub shares events with hubs on other instances
+func (h *Hub) Distributed() bool {
+	_, local := h.backplane.(*LocalBackplane)
+	return !local
+}
+
+const backplanePublishTimeout = 2 * time.Second
+
+// publish forwards an envelope to the other instances. Local delivery is done by the caller.
+func (h *Hub) publish(env Envelope) {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("failed to marshal backplane envelope %s: %v", env.Type, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, backplanePublishTimeout)
+	defer cancel()
+	if err := h.backplane.Publish(ctx, payload); err != nil {
+		log.Printf("failed to publish %s to backplane: %v", env.Type, err)
+	}
+}
+
+// handleBackplane hands an envelope published by another instance to Run, which
+// decodes and routes it like a local one
+func (h *Hub) handleBackplane(payload []byte) {
+	var env Envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		log.Printf("failed to unmarshal backplane envelope: %v", err)
+		return
+	}
+	if env.Origin == h.instanceID {
+		return
+	}
+	h.enqueue(env)
+}
+
+// runBackplane keeps the backplane subscription alive until the hub is stopped
+func (h *Hub) runBackplane() {
+	for {
+		err := h.backplane.Subscribe(h.ctx, h.handleBackplane)
+		if h.ctx.Err() != nil {
+			return
+		}
+		log.Printf("backplane subscription ended: %v - resubscribing", err)
+
+		select {
+		case <-time.After(2 * time.Second):
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
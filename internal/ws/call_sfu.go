@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"messenger/internal/model"
+	"messenger/internal/service"
+	"messenger/internal/sfu"
+)
+
+// SetSFU makes calls of minParticipants or more, the caller included, send their
+// media through the SFU
+func (cs *CallSignaling) SetSFU(s *sfu.SFU, minParticipants int) {
+	cs.sfu = s
+	cs.sfuMinParticipants = minParticipants
+}
+
+// handleSFUOffer connects a participant to the SFU; the answer comes from the SFU
+func (cs *CallSignaling) handleSFUOffer(client *Client, data []byte, msg CallOffer) {
+	if !cs.requireSFU(client, data, msg.CallID) {
+		return
+	}
+	if err := cs.sfu.Publish(msg.CallID, client.userID, client.connID, msg.SDP); err != nil {
+		log.Printf("failed to connect user %s to the SFU of call %s: %v", client.userID, msg.CallID, err)
+		client.replyFailure(data, err)
+	}
+}
+
+// handleSFUAnswer completes a renegotiation the SFU offered
+func (cs *CallSignaling) handleSFUAnswer(client *Client, data []byte, msg CallAnswer) {
+	if cs.sfu == nil {
+		client.replyError(data, ErrCodeUnavailable, "group calls are not available")
+		return
+	}
+	if err := cs.sfu.Answer(msg.CallID, client.userID, client.connID, msg.SDP); err != nil {
+		log.Printf("failed to renegotiate with user %s in call %s: %v", client.userID, msg.CallID, err)
+		client.replyFailure(data, err)
+	}
+}
+
+func (cs *CallSignaling) handleSFUIceCandidate(client *Client, data []byte, msg CallIceCandidate) {
+	if cs.sfu == nil {
+		client.replyError(data, ErrCodeUnavailable, "group calls are not available")
+		return
+	}
+	var candidate webrtc.ICECandidateInit
+	if err := json.Unmarshal(msg.Candidate, &candidate); err != nil {
+		client.replyError(data, ErrCodeBadRequest, "invalid candidate")
+		return
+	}
+	if err := cs.sfu.AddCandidate(msg.CallID, client.userID, client.connID, candidate); err != nil {
+		log.Printf("failed to add ICE candidate of user %s in call %s: %v", client.userID, msg.CallID, err)
+		client.replyFailure(data, err)
+	}
+}
+
+// HandleCallLayer handles call_layer message
+func (cs *CallSignaling) HandleCallLayer(client *Client, data []byte) {
+	var msg CallLayer
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("failed to unmarshal call_layer: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
+		return
+	}
+	if cs.sfu == nil {
+		client.replyError(data, ErrCodeUnavailable, "group calls are not available")
+		return
+	}
+	if err := cs.sfu.SelectLayer(msg.CallID, client.userID, client.connID, msg.UserID, msg.Layer); err != nil {
+		client.replyFailure(data, err)
+	}
+}
+
+// requireSFU checks that the SFU forwards the call and that the client takes part in it
+func (cs *CallSignaling) requireSFU(client *Client, data []byte, callID uuid.UUID) bool {
+	if cs.sfu == nil {
+		client.replyError(data, ErrCodeUnavailable, "group calls are not available")
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cs.contextTimeout)
+	defer cancel()
+
+	participants, err := cs.callService.GetCallParticipants(ctx, callID)
+	if err != nil {
+		log.Printf("failed to get call participants for SFU: %v", err)
+		client.replyFailure(data, err)
+		return false
+	}
+	for _, p := range participants {
+		if p.UserID == client.userID && p.Status == model.CallParticipantStatusActive {
+			return true
+		}
+	}
+	log.Printf("user %s not an active participant of call %s", client.userID, callID)
+	client.replyFailure(data, service.ErrNotCallParticipant)
+	return false
+}
+
+// sfuSignaler sends the SFU's side of the signaling to the connection each participant
+// published from. The SFU only runs with the local backplane, so that connection is
+// always on this instance.
+type sfuSignaler struct {
+	hub *Hub
+}
+
+// NewSFUSignaler returns the signaler of an SFU whose participants connect to hub
+func NewSFUSignaler(hub *Hub) sfu.Signaler {
+	return sfuSignaler{hub: hub}
+}
+
+func (s sfuSignaler) Offer(callID, userID, connID uuid.UUID, sdp string) {
+	s.hub.SendToConnection(userID, connID, CallOffer{
+		Type:         "call_offer",
+		CallID:       callID,
+		SDP:          sdp,
+		TargetUserID: userID,
+		SFU:          true,
+	})
+}
+
+func (s sfuSignaler) Answer(callID, userID, connID uuid.UUID, sdp string) {
+	s.hub.SendToConnection(userID, connID, CallAnswer{
+		Type:     "call_answer",
+		CallID:   callID,
+		CalleeID: userID,
+		SDP:      sdp,
+		SFU:      true,
+	})
+}
+
+func (s sfuSignaler) Candidate(callID, userID, connID uuid.UUID, candidate webrtc.ICECandidateInit) {
+	raw, err := json.Marshal(candidate)
+	if err != nil {
+		log.Printf("failed to marshal SFU candidate: %v", err)
+		return
+	}
+	s.hub.SendToConnection(userID, connID, CallIceCandidate{
+		Type:         "call_ice_candidate",
+		CallID:       callID,
+		TargetUserID: userID,
+		Candidate:    raw,
+		SFU:          true,
+	})
+}
+
+func (s sfuSignaler) Speaker(callID uuid.UUID, participants []uuid.UUID, speakerID uuid.UUID) {
+	s.hub.SendToParticipantsExcluding(participants, uuid.Nil, CallSpeaker{
+		Type:   "call_speaker",
+		CallID: callID,
+		UserID: speakerID,
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/google/uuid"
 	"messenger/internal/model"
 	"messenger/internal/service"
+	"messenger/internal/sfu"
 )
 
 // CallSignaling handles call signaling through WebSocket
@@ -18,6 +19,9 @@ type CallSignaling struct {
 	userService    *service.UserService
 	messageService *service.MessageService
 	contextTimeout time.Duration
+	// sfu forwards the media of calls of sfuMinParticipants or more, if set
+	sfu                *sfu.SFU
+	sfuMinParticipants int
 }
 
 // NewCallSignaling creates a new CallSignaling instance
@@ -39,12 +43,14 @@ func (cs *CallSignaling) HandleCallStart(client *Client, data []byte) {
 	var msg CallStart
 	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Printf("failed to unmarshal call_start: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
 		return
 	}
 
 	// Check if call service is available
 	if cs.callService == nil {
 		log.Printf("call service not available, cannot start call")
+		client.replyError(data, ErrCodeUnavailable, "calls are not available")
 		return
 	}
 
@@ -58,6 +64,7 @@ func (cs *CallSignaling) HandleCallStart(client *Client, data []byte) {
 
 	if len(participantIDs) == 0 {
 		log.Printf("no valid participants for call")
+		client.replyError(data, ErrCodeBadRequest, "participants are required")
 		return
 	}
 
@@ -73,6 +80,7 @@ func (cs *CallSignaling) HandleCallStart(client *Client, data []byte) {
 	call, err := cs.callService.CreateCall(ctx, client.userID, callType, participantIDs)
 	if err != nil {
 		log.Printf("failed to create call: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -80,6 +88,12 @@ func (cs *CallSignaling) HandleCallStart(client *Client, data []byte) {
 	msg.CallID = call.ID
 	msg.CallerID = client.userID
 
+	// Large calls send their media through the SFU instead of a mesh
+	if cs.sfu != nil && len(participantIDs)+1 >= cs.sfuMinParticipants {
+		cs.sfu.Open(call.ID)
+		msg.SFU = true
+	}
+
 	// Send call_start back to caller with the real call ID
 	callerStart := CallStart{
 		Type:         "call_start",
@@ -87,11 +101,9 @@ func (cs *CallSignaling) HandleCallStart(client *Client, data []byte) {
 		CallType:     string(callType),
 		Participants: []uuid.UUID{client.userID},
 		CallerID:     client.userID,
+		SFU:          msg.SFU,
 	}
-	select {
-	case client.sendCallStart <- callerStart:
-	default:
-	}
+	client.sendFrame(callerStart)
 
 	// Filter out caller from participants before broadcasting to avoid duplicate
 	filteredParticipants := make([]uuid.UUID, 0, len(participantIDs))
@@ -113,28 +125,21 @@ func (cs *CallSignaling) HandleCallOffer(client *Client, data []byte) {
 	var msg CallOffer
 	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Printf("failed to unmarshal call_offer: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
+		return
+	}
+
+	if msg.SFU {
+		cs.handleSFUOffer(client, data, msg)
 		return
 	}
 
 	// If target_user_id is specified, send directly to that participant
 	// Otherwise, broadcast to all participants (for backward compatibility)
 	if msg.TargetUserID != uuid.Nil {
-		// Get the target client
-		cs.hub.mu.RLock()
-		targetClient, ok := cs.hub.clients[msg.TargetUserID]
-		cs.hub.mu.RUnlock()
-		
-		if ok {
-			// Send offer directly to the target
-			sent := cs.hub.sendToClientChan(targetClient, msg)
-			if sent {
-				log.Printf("Sent call_offer directly to user %s for call %s", msg.TargetUserID, msg.CallID)
-			} else {
-				log.Printf("WARNING: call_offer channel full, message dropped for user %s in call %s", msg.TargetUserID, msg.CallID)
-			}
-		} else {
-			log.Printf("Target user %s not found for call_offer in call %s", msg.TargetUserID, msg.CallID)
-		}
+		// Send offer directly to the target, wherever it is connected
+		cs.hub.SendToClient(msg.TargetUserID, msg)
+		log.Printf("Sent call_offer directly to user %s for call %s", msg.TargetUserID, msg.CallID)
 		return
 	}
 
@@ -145,6 +150,7 @@ func (cs *CallSignaling) HandleCallOffer(client *Client, data []byte) {
 	participants, err := cs.callService.GetCallParticipants(ctx, msg.CallID)
 	if err != nil {
 		log.Printf("failed to get call participants: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -167,7 +173,7 @@ func (cs *CallSignaling) HandleCallOffer(client *Client, data []byte) {
 	}
 	
 	// Use the exported helper function that explicitly excludes the sender
-	cs.hub.SendToParticipantsExcluding(participantIDs, client.userID, func(c *Client) interface{} { return offer })
+	cs.hub.SendToParticipantsExcluding(participantIDs, client.userID, offer)
 }
 
 // HandleCallAnswer handles call_answer message
@@ -175,6 +181,12 @@ func (cs *CallSignaling) HandleCallAnswer(client *Client, data []byte) {
 	var msg CallAnswer
 	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Printf("failed to unmarshal call_answer: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
+		return
+	}
+
+	if msg.SFU {
+		cs.handleSFUAnswer(client, data, msg)
 		return
 	}
 
@@ -185,6 +197,7 @@ func (cs *CallSignaling) HandleCallAnswer(client *Client, data []byte) {
 	callInfo, err := cs.callService.GetCall(ctx, msg.CallID)
 	if err != nil {
 		log.Printf("failed to get call: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -193,6 +206,7 @@ func (cs *CallSignaling) HandleCallAnswer(client *Client, data []byte) {
 
 	if callerID == uuid.Nil {
 		log.Printf("caller not found for call %s", msg.CallID)
+		client.replyError(data, ErrCodeNotFound, "caller not found")
 		return
 	}
 
@@ -200,6 +214,7 @@ func (cs *CallSignaling) HandleCallAnswer(client *Client, data []byte) {
 	answer := CallAnswer{
 		Type:     "call_answer",
 		CallID:   msg.CallID,
+		CallerID: callerID,
 		CalleeID: client.userID,
 		SDP:      msg.SDP,
 	}
@@ -211,12 +226,19 @@ func (cs *CallSignaling) HandleCallIceCandidate(client *Client, data []byte) {
 	var msg CallIceCandidate
 	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Printf("failed to unmarshal call_ice_candidate: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
+		return
+	}
+
+	if msg.SFU {
+		cs.handleSFUIceCandidate(client, data, msg)
 		return
 	}
 
 	// Validate that target user ID is provided
 	if msg.TargetUserID == uuid.Nil {
 		log.Printf("target_user_id is required for ICE candidate")
+		client.replyError(data, ErrCodeBadRequest, "target_user_id is required")
 		return
 	}
 
@@ -227,6 +249,7 @@ func (cs *CallSignaling) HandleCallIceCandidate(client *Client, data []byte) {
 	participants, err := cs.callService.GetCallParticipants(ctx, msg.CallID)
 	if err != nil {
 		log.Printf("failed to get call participants for ICE candidate: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -240,6 +263,7 @@ func (cs *CallSignaling) HandleCallIceCandidate(client *Client, data []byte) {
 	}
 	if !isParticipant {
 		log.Printf("user %s not authorized to send ICE candidate for call %s", client.userID, msg.CallID)
+		client.replyFailure(data, service.ErrNotCallParticipant)
 		return
 	}
 
@@ -259,6 +283,7 @@ func (cs *CallSignaling) HandleCallJoin(client *Client, data []byte) {
 	var msg CallJoin
 	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Printf("failed to unmarshal call_join: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
 		return
 	}
 
@@ -268,6 +293,7 @@ func (cs *CallSignaling) HandleCallJoin(client *Client, data []byte) {
 
 	if err := cs.callService.JoinCall(ctx, msg.CallID, client.userID); err != nil {
 		log.Printf("failed to join call: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -283,6 +309,7 @@ func (cs *CallSignaling) HandleCallLeave(client *Client, data []byte) {
 	var msg CallLeave
 	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Printf("failed to unmarshal call_leave: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
 		return
 	}
 
@@ -292,6 +319,7 @@ func (cs *CallSignaling) HandleCallLeave(client *Client, data []byte) {
 
 	if err := cs.callService.LeaveCall(ctx, msg.CallID, client.userID); err != nil {
 		log.Printf("failed to leave call: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -300,6 +328,10 @@ func (cs *CallSignaling) HandleCallLeave(client *Client, data []byte) {
 
 	// Send call_leave to all participants
 	cs.hub.SendCallLeave(msg)
+
+	if cs.sfu != nil {
+		cs.sfu.Leave(msg.CallID, client.userID)
+	}
 }
 
 // HandleCallEnd handles call_end message
@@ -307,6 +339,7 @@ func (cs *CallSignaling) HandleCallEnd(client *Client, data []byte) {
 	var msg CallEnd
 	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Printf("failed to unmarshal call_end: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
 		return
 	}
 
@@ -316,6 +349,7 @@ func (cs *CallSignaling) HandleCallEnd(client *Client, data []byte) {
 
 	if err := cs.callService.EndCall(ctx, msg.CallID, client.userID); err != nil {
 		log.Printf("failed to end call: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -324,6 +358,10 @@ func (cs *CallSignaling) HandleCallEnd(client *Client, data []byte) {
 
 	// Send call_end to all participants
 	cs.hub.SendCallEnd(msg)
+
+	if cs.sfu != nil {
+		cs.sfu.End(msg.CallID)
+	}
 }
 
 // HandleCallReject handles call_reject message
@@ -331,6 +369,7 @@ func (cs *CallSignaling) HandleCallReject(client *Client, data []byte) {
 	var msg CallReject
 	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Printf("failed to unmarshal call_reject: %v", err)
+		client.replyError(data, ErrCodeBadRequest, "invalid JSON")
 		return
 	}
 
@@ -340,6 +379,7 @@ func (cs *CallSignaling) HandleCallReject(client *Client, data []byte) {
 
 	if err := cs.callService.RejectCall(ctx, msg.CallID, client.userID); err != nil {
 		log.Printf("failed to reject call: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -347,6 +387,7 @@ func (cs *CallSignaling) HandleCallReject(client *Client, data []byte) {
 	callInfo, err := cs.callService.GetCall(ctx, msg.CallID)
 	if err != nil {
 		log.Printf("failed to get call for reject: %v", err)
+		client.replyFailure(data, err)
 		return
 	}
 
@@ -358,6 +399,6 @@ func (cs *CallSignaling) HandleCallReject(client *Client, data []byte) {
 			CallID:   msg.CallID,
 			UserID:   client.userID,
 		}
-		cs.hub.SendToClient(callInfo.Call.InitiatorID, func(c *Client) interface{} { return reject })
+		cs.hub.SendToClient(callInfo.Call.InitiatorID, reject)
 	}
 }
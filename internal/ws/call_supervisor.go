@@ -0,0 +1,161 @@
+package ws
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/model"
+	"messenger/internal/service"
+)
+
+const (
+	// callSweepInterval is how often the supervisor looks at open calls
+	callSweepInterval = 10 * time.Second
+	// callDisconnectGrace is how long every participant of a call may be disconnected
+	// before the call is ended. It spans two presence heartbeats, so after a restart
+	// participants connected to other instances are known before anything is ended.
+	callDisconnectGrace = 2 * presenceHeartbeat
+	callSweepTimeout    = 30 * time.Second
+)
+
+// Reasons of call_end frames sent by the supervisor
+const (
+	// CallEndTimeout ends a call nobody answered within the ring timeout
+	CallEndTimeout = "timeout"
+	// CallEndMissed tells an invitee that stopped ringing that the call went on without them
+	CallEndMissed = "missed"
+	// CallEndDisconnected ends a call whose participants all disconnected
+	CallEndDisconnected = "disconnected"
+)
+
+// CallSupervisor ends calls nobody looks after anymore: invites nobody answered within
+// the ring timeout, and calls whose participants all disconnected without leaving.
+// Every instance runs one; the call service makes sure each call is ended only once.
+type CallSupervisor struct {
+	hub         *Hub
+	callService *service.CallService
+	ringTimeout time.Duration
+	// disconnected records when each open call was first seen without a connected participant
+	disconnected map[uuid.UUID]time.Time
+}
+
+func NewCallSupervisor(hub *Hub, callSvc *service.CallService, ringTimeout time.Duration) *CallSupervisor {
+	return &CallSupervisor{
+		hub:          hub,
+		callService:  callSvc,
+		ringTimeout:  ringTimeout,
+		disconnected: make(map[uuid.UUID]time.Time),
+	}
+}
+
+// Run sweeps open calls right away, which picks up calls left over from before a
+// restart, and then every callSweepInterval until ctx is cancelled
+func (s *CallSupervisor) Run(ctx context.Context) {
+	ticker := time.NewTicker(callSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		s.sweep(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *CallSupervisor) sweep(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, callSweepTimeout)
+	defer cancel()
+
+	calls, err := s.callService.OpenCalls(ctx)
+	if err != nil {
+		log.Printf("call supervisor: failed to get open calls: %v", err)
+		return
+	}
+
+	now := time.Now()
+	open := make(map[uuid.UUID]bool, len(calls))
+	for _, call := range calls {
+		open[call.ID] = true
+		if err := s.check(ctx, call, now); err != nil {
+			log.Printf("call supervisor: failed to check call %s: %v", call.ID, err)
+		}
+	}
+	for id := range s.disconnected {
+		if !open[id] {
+			delete(s.disconnected, id)
+		}
+	}
+}
+
+// check expires the invites of a call that rang too long and ends it once all of its
+// participants have been disconnected for callDisconnectGrace
+func (s *CallSupervisor) check(ctx context.Context, call model.Call, now time.Time) error {
+	participants, err := s.callService.GetCallParticipants(ctx, call.ID)
+	if err != nil {
+		return err
+	}
+
+	var invited, active []uuid.UUID
+	for _, p := range participants {
+		switch p.Status {
+		case model.CallParticipantStatusInvited:
+			invited = append(invited, p.UserID)
+		case model.CallParticipantStatusActive:
+			active = append(active, p.UserID)
+		}
+	}
+
+	if len(invited) > 0 && now.Sub(call.CreatedAt) >= s.ringTimeout {
+		missed, ended, err := s.callService.ExpireInvites(ctx, call.ID)
+		if err != nil {
+			return err
+		}
+		if ended {
+			delete(s.disconnected, call.ID)
+			s.notify(call.ID, append(missed, active...), CallEndTimeout)
+			return nil
+		}
+		s.notify(call.ID, missed, CallEndMissed)
+	}
+
+	for _, state := range s.hub.Presence(active) {
+		if state != model.PresenceOffline {
+			delete(s.disconnected, call.ID)
+			return nil
+		}
+	}
+
+	since, ok := s.disconnected[call.ID]
+	if !ok {
+		s.disconnected[call.ID] = now
+		return nil
+	}
+	if now.Sub(since) < callDisconnectGrace {
+		return nil
+	}
+
+	userIDs, err := s.callService.EndAbandonedCall(ctx, call.ID)
+	if err != nil {
+		return err
+	}
+	delete(s.disconnected, call.ID)
+	s.notify(call.ID, userIDs, CallEndDisconnected)
+	return nil
+}
+
+// notify sends call_end to the connections of users on every instance
+func (s *CallSupervisor) notify(callID uuid.UUID, userIDs []uuid.UUID, reason string) {
+	if len(userIDs) == 0 {
+		return
+	}
+	log.Printf("call supervisor: call %s over for %d users: %s", callID, len(userIDs), reason)
+	s.hub.SendToParticipantsExcluding(userIDs, uuid.Nil, CallEnd{
+		Type:   "call_end",
+		CallID: callID,
+		Reason: reason,
+	})
+}
@@ -0,0 +1,103 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"messenger/internal/auth"
+	"messenger/internal/service"
+	"messenger/internal/sfu"
+)
+
+// Codes of error frames and nacks
+const (
+	// ErrCodeBadRequest is a frame that is not valid JSON or has a missing or invalid field
+	ErrCodeBadRequest = "bad_request"
+	ErrCodeNotFound   = "not_found"
+	ErrCodeForbidden  = "forbidden"
+	// ErrCodeConflict is a request the current state does not allow, such as
+	// rejoining an ended call
+	ErrCodeConflict = "conflict"
+	// ErrCodeUnavailable is a feature the server is not configured for
+	ErrCodeUnavailable = "unavailable"
+	ErrCodeInternal    = "internal"
+)
+
+// ErrorFrame tells a client that one of its frames failed. Chat message frames are
+// answered with a nack instead, see SendResult.
+type ErrorFrame struct {
+	Type string `json:"type"`
+	Code string `json:"code"`
+	// RequestType is the type of the failed frame
+	RequestType string `json:"request_type"`
+	// RequestID echoes the request_id of the failed frame, if it had one
+	RequestID string `json:"request_id,omitempty"`
+	Message   string `json:"message"`
+}
+
+// errorReply maps a service error to an error code and a message for the client.
+// Unexpected errors are not described, as they may leak server internals.
+func errorReply(err error) (code, message string) {
+	switch {
+	case errors.Is(err, service.ErrInvalidInput),
+		errors.Is(err, service.ErrInvalidAttachment),
+		errors.Is(err, service.ErrAttachmentTooLarge),
+		errors.Is(err, sfu.ErrInvalidSDP),
+		errors.Is(err, sfu.ErrInvalidCandidate),
+		errors.Is(err, sfu.ErrInvalidLayer):
+		return ErrCodeBadRequest, err.Error()
+	case errors.Is(err, service.ErrMessageNotFound),
+		errors.Is(err, service.ErrConversationNotFound),
+		errors.Is(err, service.ErrReceiverNotFound),
+		errors.Is(err, service.ErrUserNotFound),
+		errors.Is(err, service.ErrCallNotFound),
+		errors.Is(err, service.ErrAttachmentNotFound),
+		errors.Is(err, sfu.ErrNoRoom),
+		errors.Is(err, sfu.ErrNoPeer):
+		return ErrCodeNotFound, err.Error()
+	case errors.Is(err, auth.ErrForbidden),
+		errors.Is(err, service.ErrNotConversationMember),
+		errors.Is(err, service.ErrInsufficientRole),
+		errors.Is(err, service.ErrNotMessageSender),
+		errors.Is(err, service.ErrNotCallParticipant):
+		return ErrCodeForbidden, err.Error()
+	case errors.Is(err, service.ErrMessageDeleted),
+		errors.Is(err, service.ErrCallEntry),
+		errors.Is(err, service.ErrCallEnded),
+		errors.Is(err, sfu.ErrUnexpectedAnswer):
+		return ErrCodeConflict, err.Error()
+	default:
+		return ErrCodeInternal, "internal error"
+	}
+}
+
+// replyError answers a failed frame of this client with an error frame
+func (c *Client) replyError(frame []byte, code, message string) {
+	// The request fields are best effort: a frame that is not JSON has neither
+	var request struct {
+		Type      string `json:"type"`
+		RequestID string `json:"request_id"`
+	}
+	_ = json.Unmarshal(frame, &request)
+	if request.Type == "" {
+		request.Type = "message"
+	}
+
+	reply := ErrorFrame{
+		Type:        "error",
+		Code:        code,
+		RequestType: request.Type,
+		RequestID:   request.RequestID,
+		Message:     message,
+	}
+	if !c.sendFrame(reply) {
+		log.Printf("error frame dropped for user %s: send buffer full", c.userID)
+	}
+}
+
+// replyFailure answers a frame that failed with err
+func (c *Client) replyFailure(frame []byte, err error) {
+	code, message := errorReply(err)
+	c.replyError(frame, code, message)
+}
@@ -3,14 +3,19 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"messenger/internal/auth"
+	"messenger/internal/model"
 	"messenger/internal/service"
 )
 
@@ -23,41 +28,70 @@ var upgrader = websocket.Upgrader{
 }
 
 type Client struct {
-	hub                *Hub
-	conn               *websocket.Conn
-	send               chan Message
-	sendReadStatus     chan ReadStatus
-	sendDeliveryStatus chan DeliveryStatus
-	sendTypingStatus   chan TypingStatus
-	sendCallStart      chan CallStart
-	sendCallOffer      chan CallOffer
-	sendCallAnswer     chan CallAnswer
-	sendCallIceCandidate chan CallIceCandidate
-	sendCallJoin       chan CallJoin
-	sendCallLeave      chan CallLeave
-	sendCallEnd        chan CallEnd
-	sendCallReject     chan CallReject
-	userID             uuid.UUID
-	messageService     *service.MessageService
-	userService        *service.UserService
-	callSignaling      *CallSignaling
+	hub  *Hub
+	conn *websocket.Conn
+	// send queues encoded frames for writePump, in the order the client gets them
+	send chan []byte
+	// sendMu guards closing send against concurrent queueing
+	sendMu     sync.Mutex
+	sendClosed bool
+	userID     uuid.UUID
+	sessionID  uuid.UUID
+	// connID tells this connection apart from the other devices of the user
+	connID uuid.UUID
+	// closeMessage is the payload of the close frame sent once send is closed
+	closeMessage        []byte
+	authService         *auth.Service
+	messageService      *service.MessageService
+	userService         *service.UserService
+	conversationService *service.ConversationService
+	syncService         *service.SyncService
+	callSignaling       *CallSignaling
+	// lastActive (unix nanoseconds) and away feed the user's presence, see presence.go
+	lastActive atomic.Int64
+	away       atomic.Bool
 }
 
 type Handler struct {
-	hub            *Hub
-	authService    *auth.Service
-	messageService *service.MessageService
-	userService    *service.UserService
-	callSignaling  *CallSignaling
+	hub                 *Hub
+	authService         *auth.Service
+	messageService      *service.MessageService
+	userService         *service.UserService
+	conversationService *service.ConversationService
+	syncService         *service.SyncService
+	callSignaling       *CallSignaling
 }
 
-func NewHandler(hub *Hub, authSvc *auth.Service, msgSvc *service.MessageService, userSvc *service.UserService, callSig *CallSignaling) *Handler {
+// SyncFrame answers a resume frame with the events the client missed
+type SyncFrame struct {
+	Type string `json:"type"`
+	*service.SyncBatch
+}
+
+// SendResult answers a chat message frame on the connection that sent it: "ack" with
+// the stored message, or "nack" with the reason it was not stored. A client resending
+// a message with the same client_msg_id gets an ack for the original, marked duplicate.
+type SendResult struct {
+	Type           string     `json:"type"`
+	ClientMsgID    string     `json:"client_msg_id,omitempty"`
+	MessageID      *uuid.UUID `json:"message_id,omitempty"`
+	ConversationID *uuid.UUID `json:"conversation_id,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	Duplicate      bool       `json:"duplicate,omitempty"`
+	// Code and Error explain a nack, with the codes of ErrorFrame
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func NewHandler(hub *Hub, authSvc *auth.Service, msgSvc *service.MessageService, userSvc *service.UserService, convSvc *service.ConversationService, syncSvc *service.SyncService, callSig *CallSignaling) *Handler {
 	return &Handler{
-		hub:            hub,
-		authService:    authSvc,
-		messageService: msgSvc,
-		userService:    userSvc,
-		callSignaling:  callSig,
+		hub:                 hub,
+		authService:         authSvc,
+		messageService:      msgSvc,
+		userService:         userSvc,
+		conversationService: convSvc,
+		syncService:         syncSvc,
+		callSignaling:       callSig,
 	}
 }
 
@@ -68,11 +102,15 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, err := h.authService.ValidateToken(token)
-	if err != nil {
+	claims, err := h.authService.Authenticate(r.Context(), token)
+	if errors.Is(err, auth.ErrInvalidToken) {
 		http.Error(w, "invalid token", http.StatusUnauthorized)
 		return
 	}
+	if err != nil {
+		http.Error(w, "failed to authenticate", http.StatusServiceUnavailable)
+		return
+	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -80,26 +118,21 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &Client{
-		hub:                  h.hub,
-		conn:                 conn,
-		send:                 make(chan Message, 256),
-		sendReadStatus:       make(chan ReadStatus, 256),
-		sendDeliveryStatus:   make(chan DeliveryStatus, 256),
-		sendTypingStatus:     make(chan TypingStatus, 256),
-		sendCallStart:        make(chan CallStart, 256),
-		sendCallOffer:        make(chan CallOffer, 256),
-		sendCallAnswer:       make(chan CallAnswer, 256),
-		sendCallIceCandidate: make(chan CallIceCandidate, 256),
-		sendCallJoin:         make(chan CallJoin, 256),
-		sendCallLeave:        make(chan CallLeave, 256),
-		sendCallEnd:          make(chan CallEnd, 256),
-		sendCallReject:       make(chan CallReject, 256),
-		userID:               userID,
-		messageService:       h.messageService,
-		userService:          h.userService,
-		callSignaling:        h.callSignaling,
+		hub:                 h.hub,
+		conn:                conn,
+		send:                make(chan []byte, 512),
+		userID:              claims.UserID,
+		sessionID:           claims.SessionID,
+		connID:              uuid.New(),
+		authService:         h.authService,
+		messageService:      h.messageService,
+		userService:         h.userService,
+		conversationService: h.conversationService,
+		syncService:         h.syncService,
+		callSignaling:       h.callSignaling,
 	}
 
+	client.lastActive.Store(time.Now().UnixNano())
 	h.hub.Register(client)
 
 	go client.writePump()
@@ -131,42 +164,94 @@ func (c *Client) readPump() {
 		var rawMsg map[string]interface{}
 		if err := json.Unmarshal(data, &rawMsg); err != nil {
 			log.Printf("failed to unmarshal message: %v", err)
+			c.replyError(data, ErrCodeBadRequest, "invalid JSON")
 			continue
 		}
 
+		// Keepalive pings are sent by idle clients too, so they do not count as activity
+		if msgType, ok := rawMsg["type"].(string); ok && msgType == "ping" {
+			c.queue([]byte(`{"type":"pong"}`))
+			continue
+		}
+
+		if msgType, ok := rawMsg["type"].(string); ok && msgType == "presence" {
+			state, _ := rawMsg["state"].(string)
+			c.setAway(state == string(model.PresenceAway))
+			continue
+		}
+		c.markActive()
+
 		if msgType, ok := rawMsg["type"].(string); ok && msgType == "read" {
+			if c.messageService == nil {
+				c.replyError(data, ErrCodeUnavailable, "messages are not available")
+				continue
+			}
+			ctx := context.Background()
+
+			// message_id marks everything up to that message as read; without it the
+			// newest message of the conversation or direct chat is used
+			if messageIDStr, ok := rawMsg["message_id"].(string); ok {
+				messageID, err := uuid.Parse(messageIDStr)
+				if err != nil {
+					c.replyError(data, ErrCodeBadRequest, "invalid message_id")
+					continue
+				}
+				receipt, err := c.messageService.MarkRead(ctx, c.userID, messageID)
+				if err != nil {
+					log.Printf("failed to mark as read: %v", err)
+					c.replyFailure(data, err)
+					continue
+				}
+				c.sendReadReceipt(receipt)
+				continue
+			}
+
+			if conversationIDStr, ok := rawMsg["conversation_id"].(string); ok {
+				conversationID, err := uuid.Parse(conversationIDStr)
+				if err != nil {
+					c.replyError(data, ErrCodeBadRequest, "invalid conversation_id")
+					continue
+				}
+				receipt, err := c.messageService.MarkConversationAsRead(ctx, c.userID, conversationID)
+				if err != nil {
+					log.Printf("failed to mark conversation as read: %v", err)
+					c.replyFailure(data, err)
+					continue
+				}
+				c.sendReadReceipt(receipt)
+				continue
+			}
+
 			partnerIDStr, ok := rawMsg["partner_id"].(string)
 			if !ok {
+				c.replyError(data, ErrCodeBadRequest, "message_id, conversation_id or partner_id is required")
 				continue
 			}
 			partnerID, err := uuid.Parse(partnerIDStr)
 			if err != nil {
+				c.replyError(data, ErrCodeBadRequest, "invalid partner_id")
 				continue
 			}
 
-			if c.messageService != nil {
-				ctx := context.Background()
-				if err := c.messageService.MarkChatAsRead(ctx, c.userID, partnerID); err != nil {
-					log.Printf("failed to mark as read: %v", err)
-					go c.retryMarkAsRead(partnerID, 3)
-				}
+			receipt, err := c.messageService.MarkChatAsRead(ctx, c.userID, partnerID)
+			if err != nil {
+				log.Printf("failed to mark as read: %v", err)
+				go c.retryMarkAsRead(data, partnerID, 3)
+				continue
 			}
-
-			c.hub.SendReadStatus(ReadStatus{
-				Type:      "read",
-				ReaderID:  c.userID,
-				PartnerID: partnerID,
-			})
+			c.sendReadReceipt(receipt)
 			continue
 		}
 
 		if msgType, ok := rawMsg["type"].(string); ok && msgType == "delivered" {
 			messageIDStr, ok := rawMsg["message_id"].(string)
 			if !ok {
+				c.replyError(data, ErrCodeBadRequest, "message_id is required")
 				continue
 			}
 			messageID, err := uuid.Parse(messageIDStr)
 			if err != nil {
+				c.replyError(data, ErrCodeBadRequest, "invalid message_id")
 				continue
 			}
 
@@ -174,23 +259,53 @@ func (c *Client) readPump() {
 				ctx := context.Background()
 				if err := c.messageService.MarkMessageAsDelivered(ctx, messageID, c.userID); err != nil {
 					log.Printf("failed to mark as delivered: %v", err)
+					c.replyFailure(data, err)
 				}
 			}
 			continue
 		}
 
+		if msgType, ok := rawMsg["type"].(string); ok && msgType == "resume" {
+			since, _ := rawMsg["since"].(string)
+			c.handleResume(data, since)
+			continue
+		}
+
 		if msgType, ok := rawMsg["type"].(string); ok && msgType == "typing" {
+			text, _ := rawMsg["text"].(string)
+
+			if conversationIDStr, ok := rawMsg["conversation_id"].(string); ok {
+				conversationID, err := uuid.Parse(conversationIDStr)
+				if err != nil {
+					c.replyError(data, ErrCodeBadRequest, "invalid conversation_id")
+					continue
+				}
+				recipients, err := c.conversationRecipients(conversationID)
+				if err != nil {
+					c.replyFailure(data, err)
+					continue
+				}
+				c.hub.SendTypingStatus(TypingStatus{
+					Type:           "typing",
+					SenderID:       c.userID,
+					ConversationID: conversationID,
+					Text:           text,
+					Recipients:     recipients,
+				})
+				continue
+			}
+
 			receiverIDStr, ok := rawMsg["receiver_id"].(string)
 			if !ok {
+				c.replyError(data, ErrCodeBadRequest, "receiver_id or conversation_id is required")
 				continue
 			}
 			receiverID, err := uuid.Parse(receiverIDStr)
 			if err != nil {
+				c.replyError(data, ErrCodeBadRequest, "invalid receiver_id")
 				continue
 			}
 
-			text, _ := rawMsg["text"].(string)
-
 			c.hub.SendTypingStatus(TypingStatus{
 				Type:       "typing",
 				SenderID:   c.userID,
@@ -202,6 +317,10 @@ func (c *Client) readPump() {
 
 		// Call signaling messages
 		if msgType, ok := rawMsg["type"].(string); ok {
+			if strings.HasPrefix(msgType, "call_") && c.callSignaling == nil {
+				c.replyError(data, ErrCodeUnavailable, "calls are not available")
+				continue
+			}
 			switch msgType {
 			case "call_start":
 				if c.callSignaling != nil {
@@ -243,21 +362,41 @@ func (c *Client) readPump() {
 					c.callSignaling.HandleCallReject(c, data)
 				}
 				continue
+			case "call_layer":
+				if c.callSignaling != nil {
+					c.callSignaling.HandleCallLayer(c, data)
+				}
+				continue
+			}
+
+			// Chat messages carry no type, or "message"
+			if msgType != "message" {
+				c.replyError(data, ErrCodeBadRequest, "unknown frame type")
+				continue
 			}
 		}
 
 		var msg Message
 		if err := json.Unmarshal(data, &msg); err != nil {
 			log.Printf("failed to unmarshal message: %v", err)
+			clientMsgID, _ := rawMsg["client_msg_id"].(string)
+			c.nack(clientMsgID, ErrCodeBadRequest, "invalid message")
 			continue
 		}
+		// Call entries are written by the server only
+		msg.Kind, msg.CallID = "", nil
 
 		msg.ID = uuid.New()
 		msg.SenderID = c.userID
 		msg.CreatedAt = time.Now()
 
-		// Check for @all broadcast message
-		if strings.HasPrefix(msg.Payload, "@all ") {
+		if msg.ConversationID != uuid.Nil {
+			c.handleConversationMessage(msg)
+			continue
+		}
+
+		// Check for @all broadcast message; the server cannot read encrypted payloads
+		if !msg.E2E && strings.HasPrefix(msg.Payload, "@all ") {
 			c.handleBroadcastMessage(msg)
 			continue
 		}
@@ -265,12 +404,21 @@ func (c *Client) readPump() {
 		// Save message to database (convert string to []byte)
 		if c.messageService != nil {
 			ctx := context.Background()
-			savedMsg, err := c.messageService.Send(ctx, c.userID, msg.ReceiverID, []byte(msg.Payload))
+			savedMsg, created, err := c.messageService.Send(ctx, c.userID, msg.ReceiverID, []byte(msg.Payload), msg.AttachmentIDs, msg.E2E, msg.ClientMsgID)
 			if err != nil {
 				log.Printf("failed to save message: %v", err)
+				c.nackFailure(msg.ClientMsgID, err)
+				continue
+			}
+			c.ack(savedMsg, created)
+			// A resend was delivered the first time around
+			if !created {
 				continue
 			}
 			msg.ID = savedMsg.ID
+			msg.ConversationID = savedMsg.ConversationID
+			msg.Attachments = savedMsg.Attachments
+			msg.CreatedAt = savedMsg.CreatedAt
 		}
 
 		// Send delivery confirmation to sender
@@ -285,45 +433,175 @@ func (c *Client) readPump() {
 	}
 }
 
-func (c *Client) retryMarkAsRead(partnerID uuid.UUID, maxRetries int) {
+// handleResume replies to this connection only with what the user missed since the cursor
+func (c *Client) handleResume(frame []byte, since string) {
+	if c.syncService == nil {
+		c.replyError(frame, ErrCodeUnavailable, "sync is not available")
+		return
+	}
+
+	var cursor *model.SyncPosition
+	if since != "" {
+		parsed, err := model.ParseSyncPosition(since)
+		if err != nil {
+			log.Printf("invalid resume cursor from %s: %v", c.userID, err)
+			c.replyError(frame, ErrCodeBadRequest, "invalid since cursor")
+			return
+		}
+		cursor = parsed
+	}
+
+	batch, err := c.syncService.Since(context.Background(), c.userID, cursor)
+	if err != nil {
+		log.Printf("failed to sync %s: %v", c.userID, err)
+		c.replyFailure(frame, err)
+		return
+	}
+
+	if !c.sendFrame(SyncFrame{Type: "sync", SyncBatch: batch}) {
+		log.Printf("sync frame dropped for user %s: send buffer full", c.userID)
+	}
+}
+
+// conversationRecipients returns the member IDs of a conversation the client belongs to
+func (c *Client) conversationRecipients(conversationID uuid.UUID) ([]uuid.UUID, error) {
+	if c.conversationService == nil {
+		return nil, fmt.Errorf("conversation service unavailable")
+	}
+
+	ctx := context.Background()
+	memberIDs, err := c.conversationService.GetMemberIDs(ctx, conversationID)
+	if err != nil {
+		log.Printf("failed to get conversation members: %v", err)
+		return nil, err
+	}
+
+	for _, id := range memberIDs {
+		if id == c.userID {
+			return memberIDs, nil
+		}
+	}
+	log.Printf("user %s is not a member of conversation %s", c.userID, conversationID)
+	return nil, service.ErrNotConversationMember
+}
+
+// handleConversationMessage stores a message addressed to a conversation and fans it out to all members
+func (c *Client) handleConversationMessage(msg Message) {
+	if c.messageService == nil {
+		return
+	}
+
+	recipients, err := c.conversationRecipients(msg.ConversationID)
+	if err != nil {
+		c.nackFailure(msg.ClientMsgID, err)
+		return
+	}
+
+	ctx := context.Background()
+	savedMsg, created, err := c.messageService.SendToConversation(ctx, c.userID, msg.ConversationID, []byte(msg.Payload), msg.AttachmentIDs, msg.E2E, msg.ClientMsgID)
+	if err != nil {
+		log.Printf("failed to save conversation message: %v", err)
+		c.nackFailure(msg.ClientMsgID, err)
+		return
+	}
+	c.ack(savedMsg, created)
+	if !created {
+		return
+	}
+
+	msg.ID = savedMsg.ID
+	msg.Attachments = savedMsg.Attachments
+	msg.ReceiverID = savedMsg.ReceiverID
+	msg.CreatedAt = savedMsg.CreatedAt
+	msg.Recipients = recipients
+
+	c.hub.Broadcast(msg)
+}
+
+// ack confirms to this connection that a message it sent is stored
+func (c *Client) ack(msg *model.Message, created bool) {
+	result := SendResult{
+		Type:           "ack",
+		ClientMsgID:    msg.ClientMsgID,
+		MessageID:      &msg.ID,
+		ConversationID: &msg.ConversationID,
+		CreatedAt:      &msg.CreatedAt,
+		Duplicate:      !created,
+	}
+	if !c.sendFrame(result) {
+		log.Printf("ack dropped for user %s: send buffer full", c.userID)
+	}
+}
+
+// nack tells this connection that a message it sent was not stored and why
+func (c *Client) nack(clientMsgID, code, reason string) {
+	result := SendResult{Type: "nack", ClientMsgID: clientMsgID, Code: code, Error: reason}
+	if !c.sendFrame(result) {
+		log.Printf("nack dropped for user %s: send buffer full", c.userID)
+	}
+}
+
+// nackFailure tells this connection that a message it sent failed with err
+func (c *Client) nackFailure(clientMsgID string, err error) {
+	code, reason := errorReply(err)
+	c.nack(clientMsgID, code, reason)
+}
+
+// sendReadReceipt tells every member of the conversation that the user read up to a
+// message. Direct chats also name the partner, as clients address those by user.
+func (c *Client) sendReadReceipt(receipt *model.ReadReceipt) {
+	// A nil receipt means the read did not move the watermark
+	if receipt == nil || c.conversationService == nil {
+		return
+	}
+
+	info, err := c.conversationService.GetConversation(context.Background(), receipt.ConversationID, c.userID)
+	if err != nil {
+		log.Printf("failed to get conversation for read receipt: %v", err)
+		return
+	}
+
+	status := ReadStatus{
+		Type:           "read",
+		ReaderID:       c.userID,
+		ConversationID: receipt.ConversationID,
+		MessageID:      receipt.MessageID,
+	}
+	for _, member := range info.Members {
+		status.Recipients = append(status.Recipients, member.UserID)
+		if info.Conversation.Type == model.ConversationTypeDirect && member.UserID != c.userID {
+			status.PartnerID = member.UserID
+		}
+	}
+	c.hub.SendReadStatus(status)
+}
+
+func (c *Client) retryMarkAsRead(frame []byte, partnerID uuid.UUID, maxRetries int) {
 	for i := 0; i < maxRetries; i++ {
 		time.Sleep(time.Duration(i+1) * 500 * time.Millisecond)
 		
 		if c.messageService != nil {
 			ctx := context.Background()
-			if err := c.messageService.MarkChatAsRead(ctx, c.userID, partnerID); err != nil {
+			receipt, err := c.messageService.MarkChatAsRead(ctx, c.userID, partnerID)
+			if err != nil {
 				log.Printf("retry %d failed to mark as read: %v", i+1, err)
 				continue
 			}
 			
-			c.hub.SendReadStatus(ReadStatus{
-				Type:      "read",
-				ReaderID:  c.userID,
-				PartnerID: partnerID,
-			})
+			c.sendReadReceipt(receipt)
 			return
 		}
 	}
+	c.replyError(frame, ErrCodeInternal, "failed to mark as read")
 }
 
-// handleBroadcastMessage handles @all messages from admin users
+// handleBroadcastMessage handles @all messages from users allowed to broadcast
 // Broadcasts the message to all users without saving to database
 func (c *Client) handleBroadcastMessage(msg Message) {
-	// Get sender info to check if admin
-	if c.messageService == nil {
-		return
-	}
-
 	ctx := context.Background()
-	sender, err := c.messageService.GetSenderInfo(ctx, c.userID)
-	if err != nil {
-		log.Printf("failed to get sender info: %v", err)
-		return
-	}
-
-	// Only admin can broadcast
-	if sender.Username != "admin" {
-		log.Printf("non-admin user %s attempted to broadcast", sender.Username)
+	if err := c.authService.Authorize(ctx, c.userID, model.PermBroadcast); err != nil {
+		log.Printf("user %s may not broadcast: %v", c.userID, err)
+		c.nackFailure(msg.ClientMsgID, err)
 		return
 	}
 
@@ -331,6 +609,7 @@ func (c *Client) handleBroadcastMessage(msg Message) {
 	users, err := c.userService.GetAll(ctx)
 	if err != nil {
 		log.Printf("failed to get users for broadcast: %v", err)
+		c.nackFailure(msg.ClientMsgID, err)
 		return
 	}
 
@@ -353,6 +632,45 @@ func (c *Client) handleBroadcastMessage(msg Message) {
 
 		c.hub.Broadcast(broadcastMsg)
 	}
+
+	// Broadcasts are not stored, so their ack carries no message ID
+	c.sendFrame(SendResult{Type: "ack", ClientMsgID: msg.ClientMsgID})
+}
+
+// queue hands an encoded frame to writePump without blocking. It reports false if
+// the connection is closed or its buffer is full.
+func (c *Client) queue(frame []byte) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendClosed {
+		return false
+	}
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendFrame encodes a frame meant for this connection only and queues it
+func (c *Client) sendFrame(frame interface{}) bool {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("failed to marshal frame %T: %v", frame, err)
+		return false
+	}
+	return c.queue(data)
+}
+
+// closeSend closes the send queue, making writePump send the close frame and exit
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.send)
+	}
 }
 
 func (c *Client) writePump() {
@@ -364,166 +682,14 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case msg, ok := <-c.send:
+		case frame, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			// Convert to API message format
-			apiMsg := struct {
-				ID         uuid.UUID `json:"id"`
-				SenderID   uuid.UUID `json:"sender_id"`
-				ReceiverID uuid.UUID `json:"receiver_id"`
-				Payload    string    `json:"payload"`
-				CreatedAt  string    `json:"created_at"`
-			}{
-				ID:         msg.ID,
-				SenderID:   msg.SenderID,
-				ReceiverID: msg.ReceiverID,
-				Payload:    msg.Payload,
-				CreatedAt:  msg.CreatedAt.Format(time.RFC3339),
-			}
-
-			data, err := json.Marshal(apiMsg)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case status := <-c.sendReadStatus:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(status)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case status := <-c.sendDeliveryStatus:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(status)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case typing := <-c.sendTypingStatus:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(typing)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case start := <-c.sendCallStart:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(start)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case offer := <-c.sendCallOffer:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(offer)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case answer := <-c.sendCallAnswer:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(answer)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case ice := <-c.sendCallIceCandidate:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(ice)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
 				return
 			}
 
-		case join := <-c.sendCallJoin:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(join)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case leave := <-c.sendCallLeave:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(leave)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case end := <-c.sendCallEnd:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(end)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
-				return
-			}
-
-		case reject := <-c.sendCallReject:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-			data, err := json.Marshal(reject)
-			if err != nil {
-				continue
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
 				return
 			}
 
@@ -1,44 +1,87 @@
 package ws
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"messenger/internal/model"
+	"messenger/internal/service"
 )
 
+// CloseSessionRevoked is the WebSocket close code sent to connections of a revoked session
+const CloseSessionRevoked = 4001
+
 type Hub struct {
-	clients        map[uuid.UUID]*Client
-	broadcast      chan Message
-	readStatus     chan ReadStatus
-	deliveryStatus chan DeliveryStatus
-	typingStatus     chan TypingStatus
-	callStart        chan CallStart
-	callOffer        chan CallOffer
-	callAnswer       chan CallAnswer
-	callIceCandidate chan CallIceCandidate
-	callJoin         chan CallJoin
-	callLeave        chan CallLeave
-	callEnd          chan CallEnd
-	callReject       chan CallReject
-	register         chan *Client
-	unregister       chan *Client
-	mu               sync.RWMutex
+	// clients maps a user to all of their live connections (one per device)
+	clients map[uuid.UUID]map[*Client]bool
+	// events feeds Run with envelopes of every type, see router.go
+	events     chan Envelope
+	register   chan *Client
+	unregister chan *Client
+	mu         sync.RWMutex
+
+	// backplane fans events out to hubs on other instances
+	backplane  Backplane
+	instanceID string
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// presence tracks who is online here and on other instances, see presence.go
+	presence        *presenceTracker
+	presenceChanged chan uuid.UUID
+	presenceBeacons chan PresenceBeacon
+	presenceService *service.PresenceService
 }
 
 type Message struct {
-	ID         uuid.UUID `json:"id"`
-	SenderID   uuid.UUID `json:"sender_id"`
-	ReceiverID uuid.UUID `json:"receiver_id"`
-	Payload    string    `json:"payload"`
-	CreatedAt  time.Time `json:"created_at"`
-}
-
+	ID             uuid.UUID `json:"id"`
+	ConversationID uuid.UUID `json:"conversation_id,omitempty"`
+	SenderID       uuid.UUID `json:"sender_id"`
+	ReceiverID     uuid.UUID `json:"receiver_id"`
+	Payload        string    `json:"payload"`
+	CreatedAt      time.Time `json:"created_at"`
+	// AttachmentIDs references uploads sent along with the message (client → server)
+	AttachmentIDs []uuid.UUID        `json:"attachment_ids,omitempty"`
+	Attachments   []model.Attachment `json:"attachments,omitempty"`
+	// E2E marks a payload encrypted by the sender's client, relayed as it is
+	E2E           bool               `json:"e2e,omitempty"`
+	// ClientMsgID is the sender's own ID for the message, see SendResult
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// Kind and CallID mark a call entry of the chat timeline, see NewCallEntry
+	Kind   model.MessageKind `json:"kind,omitempty"`
+	CallID *uuid.UUID        `json:"call_id,omitempty"`
+	// Recipients lists every conversation member for group fan-out (includes the sender)
+	Recipients []uuid.UUID `json:"-"`
+}
+
+// MessageUpdate announces that a message was edited ("message_edited") or
+// deleted ("message_deleted")
+type MessageUpdate struct {
+	Type           string     `json:"type"`
+	MessageID      uuid.UUID  `json:"message_id"`
+	ConversationID uuid.UUID  `json:"conversation_id"`
+	SenderID       uuid.UUID  `json:"sender_id"`
+	Payload        string     `json:"payload,omitempty"`
+	EditedAt       *time.Time `json:"edited_at,omitempty"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+	// ForMe marks a delete-for-me, which only reaches the deleting user's devices
+	ForMe      bool        `json:"for_me,omitempty"`
+	Recipients []uuid.UUID `json:"-"`
+}
+
+// ReadStatus announces that ReaderID read MessageID and every message before it
 type ReadStatus struct {
-	Type      string    `json:"type"`
-	ReaderID  uuid.UUID `json:"reader_id"`
-	PartnerID uuid.UUID `json:"partner_id"`
+	Type           string      `json:"type"`
+	ReaderID       uuid.UUID   `json:"reader_id"`
+	PartnerID      uuid.UUID   `json:"partner_id,omitempty"`
+	ConversationID uuid.UUID   `json:"conversation_id,omitempty"`
+	MessageID      uuid.UUID   `json:"message_id,omitempty"`
+	Recipients     []uuid.UUID `json:"-"`
 }
 
 type DeliveryStatus struct {
@@ -49,10 +92,12 @@ type DeliveryStatus struct {
 }
 
 type TypingStatus struct {
-	Type       string    `json:"type"`
-	SenderID   uuid.UUID `json:"sender_id"`
-	ReceiverID uuid.UUID `json:"receiver_id"`
-	Text       string    `json:"text"`
+	Type           string      `json:"type"`
+	SenderID       uuid.UUID   `json:"sender_id"`
+	ReceiverID     uuid.UUID   `json:"receiver_id,omitempty"`
+	ConversationID uuid.UUID   `json:"conversation_id,omitempty"`
+	Text           string      `json:"text"`
+	Recipients     []uuid.UUID `json:"-"`
 }
 
 type CallStart struct {
@@ -61,6 +106,8 @@ type CallStart struct {
 	CallType     string    `json:"call_type"`
 	Participants []uuid.UUID `json:"participants"`
 	CallerID     uuid.UUID `json:"caller_id"`
+	// SFU tells participants to connect to the server rather than to each other
+	SFU bool `json:"sfu,omitempty"`
 }
 
 type CallOffer struct {
@@ -71,6 +118,8 @@ type CallOffer struct {
 	CallType     string      `json:"call_type"`
 	Participants []uuid.UUID `json:"participants"`
 	TargetUserID uuid.UUID   `json:"target_user_id,omitempty"`
+	// SFU marks offers between a participant and the server's SFU
+	SFU bool `json:"sfu,omitempty"`
 }
 
 type CallAnswer struct {
@@ -79,6 +128,7 @@ type CallAnswer struct {
 	CallerID uuid.UUID `json:"caller_id"`
 	CalleeID uuid.UUID `json:"callee_id"`
 	SDP      string    `json:"sdp"`
+	SFU      bool      `json:"sfu,omitempty"`
 }
 
 type CallIceCandidate struct {
@@ -86,7 +136,9 @@ type CallIceCandidate struct {
 	CallID      uuid.UUID `json:"call_id"`
 	UserID      uuid.UUID `json:"user_id"`
 	TargetUserID uuid.UUID `json:"target_user_id"`
-	Candidate   string    `json:"candidate"`
+	// Candidate is an RTCIceCandidateInit, passed on as the client sent it
+	Candidate json.RawMessage `json:"candidate"`
+	SFU       bool            `json:"sfu,omitempty"`
 }
 
 type CallJoin struct {
@@ -101,10 +153,13 @@ type CallLeave struct {
 	UserID   uuid.UUID `json:"user_id"`
 }
 
+// CallEnd announces that a call is over. Calls ended by the server rather than a
+// user carry no UserID and a Reason, see CallSupervisor.
 type CallEnd struct {
 	Type     string    `json:"type"`
 	CallID   uuid.UUID `json:"call_id"`
 	UserID   uuid.UUID `json:"user_id"`
+	Reason   string    `json:"reason,omitempty"`
 }
 
 type CallReject struct {
@@ -113,307 +168,390 @@ type CallReject struct {
 	UserID   uuid.UUID `json:"user_id"`
 }
 
+// CallSpeaker announces who is speaking in a call the SFU forwards
+type CallSpeaker struct {
+	Type   string    `json:"type"`
+	CallID uuid.UUID `json:"call_id"`
+	UserID uuid.UUID `json:"user_id"`
+}
+
+// CallLayer asks the SFU for a simulcast layer of the video of UserID: "l", "m" or
+// "h", or empty to let the server pick one by the size of the call
+type CallLayer struct {
+	Type   string    `json:"type"`
+	CallID uuid.UUID `json:"call_id"`
+	UserID uuid.UUID `json:"user_id"`
+	Layer  string    `json:"layer"`
+}
+
+// SessionRevoked closes the connections that were opened with any of SessionIDs
+type SessionRevoked struct {
+	UserID     uuid.UUID   `json:"user_id"`
+	SessionIDs []uuid.UUID `json:"session_ids"`
+}
+
+func (m *Message) setRecipients(recipients []uuid.UUID)       { m.Recipients = recipients }
+func (u *MessageUpdate) setRecipients(recipients []uuid.UUID) { u.Recipients = recipients }
+func (s *ReadStatus) setRecipients(recipients []uuid.UUID)    { s.Recipients = recipients }
+func (t *TypingStatus) setRecipients(recipients []uuid.UUID)  { t.Recipients = recipients }
+
+// NewHub creates a hub using the in-process backplane
 func NewHub() *Hub {
+	return NewHubWithBackplane(NewLocalBackplane())
+}
+
+// NewHubWithBackplane creates a hub that shares events with other instances through backplane
+func NewHubWithBackplane(backplane Backplane) *Hub {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Hub{
-		clients:          make(map[uuid.UUID]*Client),
-		broadcast:        make(chan Message, 256),
-		readStatus:       make(chan ReadStatus, 256),
-		deliveryStatus:   make(chan DeliveryStatus, 256),
-		typingStatus:     make(chan TypingStatus, 256),
-		callStart:        make(chan CallStart, 256),
-		callOffer:        make(chan CallOffer, 256),
-		callAnswer:       make(chan CallAnswer, 256),
-		callIceCandidate: make(chan CallIceCandidate, 256),
-		callJoin:         make(chan CallJoin, 256),
-		callLeave:        make(chan CallLeave, 256),
-		callEnd:          make(chan CallEnd, 256),
-		callReject:       make(chan CallReject, 256),
-		register:         make(chan *Client),
-		unregister:       make(chan *Client),
+		clients:         make(map[uuid.UUID]map[*Client]bool),
+		events:          make(chan Envelope, 1024),
+		register:        make(chan *Client),
+		unregister:      make(chan *Client),
+		backplane:       backplane,
+		instanceID:      uuid.New().String(),
+		ctx:             ctx,
+		cancel:          cancel,
+		presence:        newPresenceTracker(),
+		presenceChanged: make(chan uuid.UUID, 256),
+		presenceBeacons: make(chan PresenceBeacon, 256),
 	}
 }
 
+// Stop ends the backplane subscription
+func (h *Hub) Stop() {
+	h.cancel()
+}
+
 func (h *Hub) Run() {
+	go h.runBackplane()
+	go h.runPresence()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
-			h.clients[client.userID] = client
+			devices, ok := h.clients[client.userID]
+			if !ok {
+				devices = make(map[*Client]bool)
+				h.clients[client.userID] = devices
+			}
+			devices[client] = true
 			h.mu.Unlock()
+			h.touchPresence(client.userID)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.userID]; ok {
-				delete(h.clients, client.userID)
-				close(client.send)
-			}
+			h.removeClientLocked(client)
 			h.mu.Unlock()
 
-		case msg := <-h.broadcast:
-			h.mu.RLock()
-			// Send to receiver
-			receiver, receiverOK := h.clients[msg.ReceiverID]
-			// Send to sender (for confirmation with real ID and timestamp)
-			sender, senderOK := h.clients[msg.SenderID]
-			h.mu.RUnlock()
-
-			if receiverOK {
-				select {
-				case receiver.send <- msg:
-				default:
-					h.mu.Lock()
-					close(receiver.send)
-					delete(h.clients, receiver.userID)
-					h.mu.Unlock()
-				}
-			}
+		case env := <-h.events:
+			h.route(env)
+		}
+	}
+}
 
-			if senderOK && msg.SenderID != msg.ReceiverID {
-				select {
-				case sender.send <- msg:
-				default:
-					h.mu.Lock()
-					close(sender.send)
-					delete(h.clients, sender.userID)
-					h.mu.Unlock()
-				}
-			}
+func init() {
+	Handle("message", routeMessage)
+	Handle("message_update", routeMessageUpdate)
+	Handle("read", routeReadStatus)
+	Handle("delivered", routeDeliveryStatus)
+	Handle("typing", routeTypingStatus)
+	Handle("call_start", routeCallStart)
+	Handle("call_offer", routeCallOffer)
+	Handle("call_answer", routeCallAnswer)
+	Handle("call_ice_candidate", routeCallIceCandidate)
+	Handle("call_join", routeCallJoin)
+	Handle("call_leave", routeCallLeave)
+	Handle("call_end", routeCallEnd)
+	Handle("call_reject", routeCallReject)
+	Handle("call_speaker", routeCallSpeaker)
+	Handle("session_revoked", routeSessionRevoked)
+}
+
+func routeMessage(h *Hub, msg Message) {
+	// Every device of the receiver gets the message, and every device of the
+	// sender gets the echo (confirmation with real ID and timestamp)
+	var targets []*Client
+	if len(msg.Recipients) > 0 {
+		targets = h.clientsFor(msg.Recipients...)
+	} else if msg.SenderID == msg.ReceiverID {
+		targets = h.clientsFor(msg.ReceiverID)
+	} else {
+		targets = h.clientsFor(msg.ReceiverID, msg.SenderID)
+	}
 
-		case status := <-h.readStatus:
-			h.mu.RLock()
-			partner, ok := h.clients[status.PartnerID]
-			sender, senderOk := h.clients[status.ReaderID]
-			h.mu.RUnlock()
-
-			if ok {
-				select {
-				case partner.sendReadStatus <- status:
-				default:
-				}
-			}
+	// Convert to API message format
+	apiMsg := struct {
+		ID             uuid.UUID          `json:"id"`
+		ConversationID uuid.UUID          `json:"conversation_id,omitempty"`
+		SenderID       uuid.UUID          `json:"sender_id"`
+		ReceiverID     uuid.UUID          `json:"receiver_id"`
+		Payload        string             `json:"payload"`
+		CreatedAt      string             `json:"created_at"`
+		Attachments    []model.Attachment `json:"attachments,omitempty"`
+		E2E            bool               `json:"e2e,omitempty"`
+		ClientMsgID    string             `json:"client_msg_id,omitempty"`
+		Kind           model.MessageKind  `json:"kind,omitempty"`
+		CallID         *uuid.UUID         `json:"call_id,omitempty"`
+	}{
+		ID:             msg.ID,
+		ConversationID: msg.ConversationID,
+		SenderID:       msg.SenderID,
+		ReceiverID:     msg.ReceiverID,
+		Payload:        msg.Payload,
+		CreatedAt:      msg.CreatedAt.Format(time.RFC3339),
+		Attachments:    msg.Attachments,
+		E2E:            msg.E2E,
+		ClientMsgID:    msg.ClientMsgID,
+		Kind:           msg.Kind,
+		CallID:         msg.CallID,
+	}
+	h.Deliver(apiMsg, targets)
+}
 
-			if senderOk && status.ReaderID != status.PartnerID {
-				select {
-				case sender.sendReadStatus <- status:
-				default:
-				}
-			}
+func routeMessageUpdate(h *Hub, update MessageUpdate) {
+	h.Deliver(update, h.clientsFor(update.Recipients...))
+}
 
-		case status := <-h.deliveryStatus:
-			h.mu.RLock()
-			sender, ok := h.clients[status.SenderID]
-			h.mu.RUnlock()
+func routeReadStatus(h *Hub, status ReadStatus) {
+	// The reader's own devices are notified too so they can clear unread badges
+	var targets []*Client
+	if len(status.Recipients) > 0 {
+		targets = h.clientsFor(status.Recipients...)
+	} else if status.ReaderID == status.PartnerID {
+		targets = h.clientsFor(status.PartnerID)
+	} else {
+		targets = h.clientsFor(status.PartnerID, status.ReaderID)
+	}
+	h.Deliver(status, targets)
+}
 
-			if ok {
-				select {
-				case sender.sendDeliveryStatus <- status:
-				default:
-				}
-			}
+func routeDeliveryStatus(h *Hub, status DeliveryStatus) {
+	h.Deliver(status, h.clientsFor(status.SenderID))
+}
 
-		case typing := <-h.typingStatus:
-			h.mu.RLock()
-			receiver, receiverOK := h.clients[typing.ReceiverID]
-			h.mu.RUnlock()
+func routeTypingStatus(h *Hub, typing TypingStatus) {
+	var targets []*Client
+	if len(typing.Recipients) > 0 {
+		targets = h.clientsFor(excluding(typing.Recipients, typing.SenderID)...)
+	} else {
+		targets = h.clientsFor(typing.ReceiverID)
+	}
+	h.Deliver(typing, targets)
+}
 
-			if receiverOK {
-				select {
-				case receiver.sendTypingStatus <- typing:
-				default:
-				}
-			}
+func routeCallStart(h *Hub, start CallStart) {
+	// The caller already receives a separate call_start with their participant info
+	h.Deliver(start, h.clientsFor(excluding(start.Participants, start.CallerID)...))
+}
 
-		case start := <-h.callStart:
-			// Use SendToParticipantsExcluding to avoid sending call_start back to the caller
-			// The caller already receives a separate call_start with their participant info
-			h.SendToParticipantsExcluding(start.Participants, start.CallerID, func(c *Client) interface{} { return start })
+func routeCallOffer(h *Hub, offer CallOffer) {
+	h.Deliver(offer, h.clientsFor(excluding(offer.Participants, offer.CallerID)...))
+}
 
-		case offer := <-h.callOffer:
-			// Use SendToParticipantsExcluding to avoid sending offer back to the sender
-			h.SendToParticipantsExcluding(offer.Participants, offer.CallerID, func(c *Client) interface{} { return offer })
+func routeCallAnswer(h *Hub, answer CallAnswer) {
+	h.Deliver(answer, h.clientsFor(answer.CallerID))
+}
 
-		case answer := <-h.callAnswer:
-			h.SendToClient(answer.CallerID, func(c *Client) interface{} { return answer })
+func routeCallIceCandidate(h *Hub, ice CallIceCandidate) {
+	// Route ICE candidate to the target user (the peer), not the sender
+	h.Deliver(ice, h.clientsFor(ice.TargetUserID))
+}
 
-		case ice := <-h.callIceCandidate:
-			// Route ICE candidate to the target user (the peer), not the sender
-			h.SendToClient(ice.TargetUserID, func(c *Client) interface{} { return ice })
+func routeCallJoin(h *Hub, join CallJoin) {
+	h.Deliver(join, h.clientsFor(join.UserID))
+}
 
-		case join := <-h.callJoin:
-			h.SendToClient(join.UserID, func(c *Client) interface{} { return join })
+func routeCallLeave(h *Hub, leave CallLeave) {
+	h.Deliver(leave, h.clientsFor(leave.UserID))
+}
 
-		case leave := <-h.callLeave:
-			h.SendToClient(leave.UserID, func(c *Client) interface{} { return leave })
+func routeCallEnd(h *Hub, end CallEnd) {
+	h.Deliver(end, h.clientsFor(end.UserID))
+}
 
-		case end := <-h.callEnd:
-			h.SendToClient(end.UserID, func(c *Client) interface{} { return end })
+func routeCallReject(h *Hub, reject CallReject) {
+	h.Deliver(reject, h.clientsFor(reject.UserID))
+}
 
-		case reject := <-h.callReject:
-			h.SendToClient(reject.UserID, func(c *Client) interface{} { return reject })
+func routeCallSpeaker(h *Hub, speaker CallSpeaker) {
+	h.Deliver(speaker, h.clientsFor(speaker.UserID))
+}
+
+func routeSessionRevoked(h *Hub, revoked SessionRevoked) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients[revoked.UserID] {
+		if slices.Contains(revoked.SessionIDs, client.sessionID) {
+			// Set before the send channel is closed so writePump sees it
+			client.closeMessage = websocket.FormatCloseMessage(CloseSessionRevoked, "session revoked")
+			h.removeClientLocked(client)
 		}
 	}
 }
 
-// SendToClient sends a message to a single client by userID
-// Exported for use by CallSignaling in call_signaling.go
-func (h *Hub) SendToClient(userID uuid.UUID, getMsg func(*Client) interface{}) {
+// clientsFor returns a snapshot of all live connections of the given users
+func (h *Hub) clientsFor(userIDs ...uuid.UUID) []*Client {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	if client, ok := h.clients[userID]; ok {
-		h.sendToClientChan(client, getMsg(client))
+	var result []*Client
+	for _, id := range userIDs {
+		for client := range h.clients[id] {
+			result = append(result, client)
+		}
 	}
+	return result
 }
 
-// sendToParticipants sends a message to multiple participants
-func (h *Hub) sendToParticipants(userIDs []uuid.UUID, getMsg func(*Client) interface{}) {
+// ClientCount returns the number of live connections on this instance and of the users they belong to
+func (h *Hub) ClientCount() (connections, users int) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	for _, pid := range userIDs {
-		if client, ok := h.clients[pid]; ok {
-			h.sendToClientChan(client, getMsg(client))
-		}
+	for _, devices := range h.clients {
+		connections += len(devices)
+	}
+	return connections, len(h.clients)
+}
+
+// removeClientLocked drops a single connection, leaving the user's other devices intact.
+// Caller must hold h.mu for writing.
+func (h *Hub) removeClientLocked(client *Client) {
+	devices, ok := h.clients[client.userID]
+	if !ok || !devices[client] {
+		return
+	}
+	delete(devices, client)
+	client.closeSend()
+	if len(devices) == 0 {
+		delete(h.clients, client.userID)
+	}
+	h.touchPresence(client.userID)
+}
+
+// SendToClient sends a message to every connection of a user by userID, on any instance
+// Exported for use by CallSignaling in call_signaling.go
+func (h *Hub) SendToClient(userID uuid.UUID, msg interface{}) {
+	h.sendDirect([]uuid.UUID{userID}, msg)
+}
+
+// SendToConnection sends a message to a single connection of a user on this instance
+func (h *Hub) SendToConnection(userID, connID uuid.UUID, msg interface{}) {
+	env, ok := h.envelope(msg, []uuid.UUID{userID}, true)
+	if !ok {
+		return
 	}
+	env.connection = connID
+	h.enqueue(env)
 }
 
 // SendToParticipantsExcluding sends a message to multiple participants except the excluded user
 // This is useful for broadcast scenarios where the sender should not receive their own message
 // Exported for use by CallSignaling in call_signaling.go
-func (h *Hub) SendToParticipantsExcluding(userIDs []uuid.UUID, excludeUserID uuid.UUID, getMsg func(*Client) interface{}) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	for _, pid := range userIDs {
-		if pid == excludeUserID {
-			continue
-		}
-		if client, ok := h.clients[pid]; ok {
-			h.sendToClientChan(client, getMsg(client))
-		}
+func (h *Hub) SendToParticipantsExcluding(userIDs []uuid.UUID, excludeUserID uuid.UUID, msg interface{}) {
+	targets := excluding(userIDs, excludeUserID)
+	if len(targets) == 0 {
+		return
 	}
+	h.sendDirect(targets, msg)
 }
 
-// sendToClientChan sends a message to a client's channel based on message type
-// Uses a helper function to reduce repetitive non-blocking send pattern
-// Returns true if message was sent, false if channel was full (message dropped)
-// WARNING: Unknown message types are logged and dropped - ensure all message types are registered
-func (h *Hub) sendToClientChan(client *Client, msg interface{}) bool {
-	switch m := msg.(type) {
-	case CallStart:
-		return trySend(client.sendCallStart, m)
-	case CallOffer:
-		return trySend(client.sendCallOffer, m)
-	case CallAnswer:
-		return trySend(client.sendCallAnswer, m)
-	case CallIceCandidate:
-		return trySend(client.sendCallIceCandidate, m)
-	case CallJoin:
-		return trySend(client.sendCallJoin, m)
-	case CallLeave:
-		return trySend(client.sendCallLeave, m)
-	case CallEnd:
-		return trySend(client.sendCallEnd, m)
-	case CallReject:
-		return trySend(client.sendCallReject, m)
-	default:
-		// This indicates a programming error - a new message type was added
-		// without updating this switch statement. The message is dropped.
-		log.Printf("WARNING: unknown message type in sendToClientChan: %T - message dropped for user %s", msg, client.userID)
-		return false
+// sendDirect sends a message to the connections of userIDs on every instance as it
+// is, bypassing the handler of its type. It still passes through Run, so it keeps
+// its place among routed events.
+func (h *Hub) sendDirect(userIDs []uuid.UUID, msg interface{}) {
+	env, ok := h.envelope(msg, userIDs, true)
+	if !ok {
+		return
 	}
+	h.enqueue(env)
+	h.publish(env)
 }
 
-// trySend performs a non-blocking send to a channel
-// Returns true if message was sent, false if channel was full (message dropped)
-func trySend[T any](ch chan<- T, msg T) bool {
-	select {
-	case ch <- msg:
-		return true
-	default:
-		return false
+func excluding(userIDs []uuid.UUID, excludeUserID uuid.UUID) []uuid.UUID {
+	filtered := make([]uuid.UUID, 0, len(userIDs))
+	for _, pid := range userIDs {
+		if pid != excludeUserID {
+			filtered = append(filtered, pid)
+		}
 	}
+	return filtered
 }
 
 func (h *Hub) Broadcast(msg Message) {
-	select {
-	case h.broadcast <- msg:
-	case <-time.After(time.Second):
+	h.Dispatch(msg, msg.Recipients)
+}
+
+// NewCallEntry turns a call entry written by the call service into a message frame
+// for the caller and the invitee
+func NewCallEntry(entry *model.Message) Message {
+	return Message{
+		ID:             entry.ID,
+		ConversationID: entry.ConversationID,
+		SenderID:       entry.SenderID,
+		ReceiverID:     entry.ReceiverID,
+		Payload:        string(entry.Payload),
+		CreatedAt:      entry.CreatedAt,
+		Kind:           entry.Kind,
+		CallID:         entry.CallID,
 	}
 }
 
+// SendMessageUpdate notifies the update's recipients of an edited or deleted message
+func (h *Hub) SendMessageUpdate(update MessageUpdate) {
+	h.Dispatch(update, update.Recipients)
+}
+
 func (h *Hub) SendReadStatus(status ReadStatus) {
-	select {
-	case h.readStatus <- status:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(status, status.Recipients)
 }
 
 func (h *Hub) SendDeliveryStatus(status DeliveryStatus) {
-	select {
-	case h.deliveryStatus <- status:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(status, nil)
 }
 
 func (h *Hub) SendTypingStatus(status TypingStatus) {
-	select {
-	case h.typingStatus <- status:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(status, status.Recipients)
 }
 
 func (h *Hub) SendCallStart(start CallStart) {
-	select {
-	case h.callStart <- start:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(start, nil)
 }
 
 func (h *Hub) SendCallOffer(offer CallOffer) {
-	select {
-	case h.callOffer <- offer:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(offer, nil)
 }
 
 func (h *Hub) SendCallAnswer(answer CallAnswer) {
-	select {
-	case h.callAnswer <- answer:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(answer, nil)
 }
 
 func (h *Hub) SendCallIceCandidate(ice CallIceCandidate) {
-	select {
-	case h.callIceCandidate <- ice:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(ice, nil)
 }
 
 func (h *Hub) SendCallJoin(join CallJoin) {
-	select {
-	case h.callJoin <- join:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(join, nil)
 }
 
 func (h *Hub) SendCallLeave(leave CallLeave) {
-	select {
-	case h.callLeave <- leave:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(leave, nil)
 }
 
 func (h *Hub) SendCallEnd(end CallEnd) {
-	select {
-	case h.callEnd <- end:
-	case <-time.After(time.Second):
-	}
+	h.Dispatch(end, nil)
 }
 
 func (h *Hub) SendCallReject(reject CallReject) {
-	select {
-	case h.callReject <- reject:
-	case <-time.After(time.Second):
+	h.Dispatch(reject, nil)
+}
+
+// CloseSessions disconnects the connections of revoked sessions on every instance
+func (h *Hub) CloseSessions(userID uuid.UUID, sessionIDs []uuid.UUID) {
+	if len(sessionIDs) == 0 {
+		return
 	}
+	h.Dispatch(SessionRevoked{UserID: userID, SessionIDs: sessionIDs}, []uuid.UUID{userID})
 }
 
 func (h *Hub) Register(client *Client) {
@@ -0,0 +1,371 @@
+package ws
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"messenger/internal/model"
+	"messenger/internal/service"
+)
+
+const (
+	// presenceIdle is how long a connection may send nothing before it counts as away
+	presenceIdle = 5 * time.Minute
+	// presenceHeartbeat is how often each instance republishes the presence of its
+	// users; an instance missing presenceExpiry worth of heartbeats is taken to be gone
+	presenceHeartbeat = 30 * time.Second
+	presenceExpiry    = 3 * presenceHeartbeat
+	presenceTimeout   = 5 * time.Second
+)
+
+// PresenceUpdate tells a client that a contact came online, went away or went offline.
+// Each instance announces changes to its own connections, so updates never travel
+// over the backplane.
+type PresenceUpdate struct {
+	Type       string              `json:"type"`
+	UserID     uuid.UUID           `json:"user_id"`
+	State      model.PresenceState `json:"state"`
+	LastSeenAt *time.Time          `json:"last_seen_at,omitempty"`
+	Recipients []uuid.UUID         `json:"-"`
+}
+
+// PresenceBeacon is the state of a user on one instance, shared over the backplane.
+// Instances publish it on every change and every presenceHeartbeat.
+type PresenceBeacon struct {
+	UserID     uuid.UUID           `json:"user_id"`
+	Instance   string              `json:"instance"`
+	State      model.PresenceState `json:"state"`
+	LastSeenAt *time.Time          `json:"last_seen_at,omitempty"`
+	Recipients []uuid.UUID         `json:"-"`
+}
+
+func init() {
+	Handle("presence", routePresenceBeacon)
+	Handle("presence_update", routePresenceUpdate)
+}
+
+// presenceTracker combines the presence of users on this instance with the beacons
+// of other instances
+type presenceTracker struct {
+	mu sync.Mutex
+	// local is the last published state and the contacts of users connected here
+	local map[uuid.UUID]localPresence
+	// remote is the state of users on other instances, by instance ID
+	remote map[uuid.UUID]map[string]remotePresence
+	// announced is the state last pushed to local contacts; missing means offline
+	announced map[uuid.UUID]model.PresenceState
+}
+
+type localPresence struct {
+	state    model.PresenceState
+	contacts []uuid.UUID
+}
+
+type remotePresence struct {
+	state      model.PresenceState
+	recipients []uuid.UUID
+	expiresAt  time.Time
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		local:     make(map[uuid.UUID]localPresence),
+		remote:    make(map[uuid.UUID]map[string]remotePresence),
+		announced: make(map[uuid.UUID]model.PresenceState),
+	}
+}
+
+// aggregate is the state of a user across instances: online beats away beats offline.
+// Caller must hold t.mu.
+func (t *presenceTracker) aggregate(userID uuid.UUID, now time.Time) model.PresenceState {
+	state := model.PresenceOffline
+	if local, ok := t.local[userID]; ok {
+		state = local.state
+	}
+	for _, remote := range t.remote[userID] {
+		if remote.expiresAt.After(now) && presenceRank(remote.state) > presenceRank(state) {
+			state = remote.state
+		}
+	}
+	return state
+}
+
+func presenceRank(state model.PresenceState) int {
+	switch state {
+	case model.PresenceOnline:
+		return 2
+	case model.PresenceAway:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// SetPresenceService enables last-seen persistence and presence events for contacts.
+// Call it before Run.
+func (h *Hub) SetPresenceService(svc *service.PresenceService) {
+	h.presenceService = svc
+}
+
+// Presence returns the current state of each user across all instances
+func (h *Hub) Presence(userIDs []uuid.UUID) map[uuid.UUID]model.PresenceState {
+	t := h.presence
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	result := make(map[uuid.UUID]model.PresenceState, len(userIDs))
+	for _, id := range userIDs {
+		result[id] = t.aggregate(id, now)
+	}
+	return result
+}
+
+// touchPresence asks the presence loop to recompute the state of a local user.
+// It never blocks; a dropped request is caught up by the next heartbeat.
+func (h *Hub) touchPresence(userID uuid.UUID) {
+	select {
+	case h.presenceChanged <- userID:
+	default:
+	}
+}
+
+// markActive records client activity and wakes presence if the client was idle
+func (c *Client) markActive() {
+	now := time.Now()
+	last := time.Unix(0, c.lastActive.Swap(now.UnixNano()))
+	if now.Sub(last) >= presenceIdle {
+		c.hub.touchPresence(c.userID)
+	}
+}
+
+// setAway handles a client reporting that it went to the background or came back
+func (c *Client) setAway(away bool) {
+	if !away {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	c.away.Store(away)
+	c.hub.touchPresence(c.userID)
+}
+
+// localPresence derives the state of a user from their connections to this instance
+func (h *Hub) localPresence(userID uuid.UUID, now time.Time) model.PresenceState {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	devices := h.clients[userID]
+	if len(devices) == 0 {
+		return model.PresenceOffline
+	}
+	for client := range devices {
+		idle := now.Sub(time.Unix(0, client.lastActive.Load())) >= presenceIdle
+		if !client.away.Load() && !idle {
+			return model.PresenceOnline
+		}
+	}
+	return model.PresenceAway
+}
+
+// runPresence tracks local users, applies beacons of other instances and sends the
+// resulting changes to local contacts until the hub is stopped
+func (h *Hub) runPresence() {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case userID := <-h.presenceChanged:
+			h.updateLocalPresence(userID, false)
+		case beacon := <-h.presenceBeacons:
+			h.applyBeacon(beacon)
+		case <-ticker.C:
+			h.presenceHeartbeat()
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// updateLocalPresence publishes the state of a local user if it changed, or always
+// for a heartbeat. Going online and offline both record the last-seen time, so it
+// stays close even if the instance dies.
+func (h *Hub) updateLocalPresence(userID uuid.UUID, heartbeat bool) {
+	now := time.Now()
+	state := h.localPresence(userID, now)
+
+	t := h.presence
+	t.mu.Lock()
+	prev, known := t.local[userID]
+	t.mu.Unlock()
+	if !known && state == model.PresenceOffline {
+		return
+	}
+	if known && prev.state == state && !heartbeat {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, presenceTimeout)
+	defer cancel()
+
+	contacts := prev.contacts
+	if !known && h.presenceService != nil {
+		var err error
+		if contacts, err = h.presenceService.Contacts(ctx, userID); err != nil {
+			log.Printf("failed to get contacts of %s: %v", userID, err)
+		}
+	}
+
+	var lastSeen *time.Time
+	if (!known || state == model.PresenceOffline) && h.presenceService != nil {
+		if err := h.presenceService.RecordLastSeen(ctx, userID, now); err != nil {
+			log.Printf("failed to record last seen of %s: %v", userID, err)
+		}
+		if state == model.PresenceOffline {
+			lastSeen = h.visibleLastSeen(ctx, userID)
+		}
+	}
+
+	t.mu.Lock()
+	if state == model.PresenceOffline {
+		delete(t.local, userID)
+	} else {
+		t.local[userID] = localPresence{state: state, contacts: contacts}
+	}
+	t.mu.Unlock()
+
+	beacon := PresenceBeacon{
+		UserID:     userID,
+		Instance:   h.instanceID,
+		State:      state,
+		LastSeenAt: lastSeen,
+		Recipients: contacts,
+	}
+	if env, ok := h.envelope(beacon, contacts, false); ok {
+		h.publish(env)
+	}
+	h.announcePresence(userID, contacts, lastSeen)
+}
+
+// applyBeacon records the state of a user on another instance
+func (h *Hub) applyBeacon(beacon PresenceBeacon) {
+	t := h.presence
+	t.mu.Lock()
+	instances := t.remote[beacon.UserID]
+	if beacon.State == model.PresenceOffline {
+		delete(instances, beacon.Instance)
+		if len(instances) == 0 {
+			delete(t.remote, beacon.UserID)
+		}
+	} else {
+		if instances == nil {
+			instances = make(map[string]remotePresence)
+			t.remote[beacon.UserID] = instances
+		}
+		instances[beacon.Instance] = remotePresence{
+			state:      beacon.State,
+			recipients: beacon.Recipients,
+			expiresAt:  time.Now().Add(presenceExpiry),
+		}
+	}
+	t.mu.Unlock()
+
+	h.announcePresence(beacon.UserID, beacon.Recipients, beacon.LastSeenAt)
+}
+
+// presenceHeartbeat republishes local users, catches connections that went idle
+// and forgets users of instances that stopped sending heartbeats
+func (h *Hub) presenceHeartbeat() {
+	now := time.Now()
+	t := h.presence
+
+	t.mu.Lock()
+	local := make([]uuid.UUID, 0, len(t.local))
+	for id := range t.local {
+		local = append(local, id)
+	}
+	expired := make(map[uuid.UUID][]uuid.UUID)
+	for id, instances := range t.remote {
+		for instance, remote := range instances {
+			if !remote.expiresAt.After(now) {
+				expired[id] = remote.recipients
+				delete(instances, instance)
+			}
+		}
+		if len(instances) == 0 {
+			delete(t.remote, id)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, id := range local {
+		h.updateLocalPresence(id, true)
+	}
+	for id, recipients := range expired {
+		ctx, cancel := context.WithTimeout(h.ctx, presenceTimeout)
+		h.announcePresence(id, recipients, h.visibleLastSeen(ctx, id))
+		cancel()
+	}
+}
+
+// announcePresence sends the state of a user to the local connections of recipients
+// if it differs from what was last sent
+func (h *Hub) announcePresence(userID uuid.UUID, recipients []uuid.UUID, lastSeen *time.Time) {
+	t := h.presence
+	t.mu.Lock()
+	state := t.aggregate(userID, time.Now())
+	announced, ok := t.announced[userID]
+	if !ok {
+		announced = model.PresenceOffline
+	}
+	if state == announced {
+		t.mu.Unlock()
+		return
+	}
+	if state == model.PresenceOffline {
+		delete(t.announced, userID)
+	} else {
+		t.announced[userID] = state
+		lastSeen = nil
+	}
+	t.mu.Unlock()
+
+	// Run delivers it, keeping its place among other events and dropping connections
+	// too slow to take it rather than skipping them
+	update := PresenceUpdate{Type: "presence", UserID: userID, State: state, LastSeenAt: lastSeen, Recipients: recipients}
+	h.dispatchLocal(update, recipients)
+}
+
+func (u *PresenceUpdate) setRecipients(recipients []uuid.UUID) { u.Recipients = recipients }
+
+func routePresenceUpdate(h *Hub, update PresenceUpdate) {
+	h.Deliver(update, h.clientsFor(update.Recipients...))
+}
+
+func (b *PresenceBeacon) setRecipients(recipients []uuid.UUID) { b.Recipients = recipients }
+
+// routePresenceBeacon passes the beacon of another instance to the presence loop
+func routePresenceBeacon(h *Hub, beacon PresenceBeacon) {
+	select {
+	case h.presenceBeacons <- beacon:
+	case <-time.After(time.Second):
+	}
+}
+
+// visibleLastSeen returns the last-seen time of a user unless they hide it
+func (h *Hub) visibleLastSeen(ctx context.Context, userID uuid.UUID) *time.Time {
+	if h.presenceService == nil {
+		return nil
+	}
+	lastSeen, err := h.presenceService.LastSeen(ctx, []uuid.UUID{userID})
+	if err != nil {
+		log.Printf("failed to get last seen of %s: %v", userID, err)
+		return nil
+	}
+	if at, ok := lastSeen[userID]; ok {
+		return &at
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Envelope carries one hub event, of any type, from Dispatch through the backplane
+// to the Run loop of every instance. Run loops route envelopes one at a time, so
+// each connection receives events in the order they were dispatched.
+type Envelope struct {
+	// Type names the handler that routes the event, see Handle
+	Type string `json:"type"`
+	// ID identifies the event across instances
+	ID      uuid.UUID       `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+	// Recipients are the users the event is for, where the event does not say so itself
+	Recipients []uuid.UUID `json:"recipients,omitempty"`
+	// Direct envelopes skip their handler: Payload goes as it is to every connection
+	// of Recipients
+	Direct bool `json:"direct,omitempty"`
+	// Origin is the instance that dispatched the event
+	Origin string `json:"origin"`
+
+	// event is the decoded payload, kept for envelopes dispatched on this instance
+	event interface{}
+	// connection limits a direct envelope to one connection of its recipient; such
+	// envelopes never leave this instance
+	connection uuid.UUID
+}
+
+// handler routes the events of one type
+type handler struct {
+	name   string
+	decode func(env Envelope) (interface{}, error)
+	route  func(h *Hub, event interface{})
+}
+
+// recipientSetter is implemented by events that keep their recipients out of their
+// JSON, so clients do not see them; the envelope carries them instead
+type recipientSetter interface {
+	setRecipients(recipients []uuid.UUID)
+}
+
+var (
+	handlersMu     sync.RWMutex
+	handlersByName = make(map[string]*handler)
+	handlersByType = make(map[reflect.Type]*handler)
+)
+
+// Handle registers route for events of type T under name, which identifies them in
+// envelopes and must be unique. route runs on the Run loop of every instance the
+// event reaches and decides which local connections get it, usually via Hub.Deliver.
+// Register handlers from init functions, before any hub runs.
+func Handle[T any](name string, route func(h *Hub, event T)) {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if _, ok := handlersByName[name]; ok {
+		panic(fmt.Sprintf("ws: duplicate handler for event type %q", name))
+	}
+	if _, ok := handlersByType[typ]; ok {
+		panic(fmt.Sprintf("ws: duplicate handler for %v", typ))
+	}
+
+	hd := &handler{
+		name: name,
+		decode: func(env Envelope) (interface{}, error) {
+			var event T
+			if err := json.Unmarshal(env.Payload, &event); err != nil {
+				return nil, err
+			}
+			if setter, ok := interface{}(&event).(recipientSetter); ok {
+				setter.setRecipients(env.Recipients)
+			}
+			return event, nil
+		},
+		route: func(h *Hub, event interface{}) {
+			route(h, event.(T))
+		},
+	}
+	handlersByName[name] = hd
+	handlersByType[typ] = hd
+}
+
+func handlerByName(name string) (*handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	hd, ok := handlersByName[name]
+	return hd, ok
+}
+
+func handlerFor(event interface{}) (*handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	hd, ok := handlersByType[reflect.TypeOf(event)]
+	return hd, ok
+}
+
+// envelope wraps an event of a registered type for routing
+func (h *Hub) envelope(event interface{}, recipients []uuid.UUID, direct bool) (Envelope, bool) {
+	hd, ok := handlerFor(event)
+	if !ok {
+		log.Printf("WARNING: no handler registered for event type %T - event dropped", event)
+		return Envelope{}, false
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to marshal event %s: %v", hd.name, err)
+		return Envelope{}, false
+	}
+
+	return Envelope{
+		Type:       hd.name,
+		ID:         uuid.New(),
+		Payload:    payload,
+		Recipients: recipients,
+		Direct:     direct,
+		Origin:     h.instanceID,
+		event:      event,
+	}, true
+}
+
+// Dispatch routes an event to the connections of every instance through the handler
+// registered for its type. recipients travel with the event for types that keep
+// them out of their JSON.
+func (h *Hub) Dispatch(event interface{}, recipients []uuid.UUID) {
+	env, ok := h.envelope(event, recipients, false)
+	if !ok {
+		return
+	}
+	h.enqueue(env)
+	h.publish(env)
+}
+
+// dispatchLocal routes an event like Dispatch, but to the connections of this
+// instance only
+func (h *Hub) dispatchLocal(event interface{}, recipients []uuid.UUID) {
+	env, ok := h.envelope(event, recipients, false)
+	if !ok {
+		return
+	}
+	h.enqueue(env)
+}
+
+// enqueue hands an envelope to Run
+func (h *Hub) enqueue(env Envelope) {
+	select {
+	case h.events <- env:
+	case <-time.After(time.Second):
+		log.Printf("hub busy: event %s %s dropped", env.Type, env.ID)
+	}
+}
+
+// route delivers an envelope to local connections. It runs on the Run loop.
+func (h *Hub) route(env Envelope) {
+	if env.Direct {
+		targets := h.clientsFor(env.Recipients...)
+		if env.connection != uuid.Nil {
+			targets = slices.DeleteFunc(targets, func(c *Client) bool { return c.connID != env.connection })
+		}
+		h.Deliver(env.Payload, targets)
+		return
+	}
+
+	hd, ok := handlerByName(env.Type)
+	if !ok {
+		log.Printf("WARNING: no handler registered for event type %q - event dropped", env.Type)
+		return
+	}
+	event := env.event
+	if event == nil {
+		var err error
+		if event, err = hd.decode(env); err != nil {
+			log.Printf("failed to decode event %s: %v", env.Type, err)
+			return
+		}
+	}
+	hd.route(h, event)
+}
+
+// Deliver queues a frame, encoded once, on each of targets. A connection whose
+// buffer is full is dropped rather than skipped, since it would otherwise miss an
+// event and then receive later ones; the client catches up with a resume after
+// reconnecting. Deliver must only be called from the Run loop, i.e. from handlers.
+func (h *Hub) Deliver(frame interface{}, targets []*Client) {
+	if len(targets) == 0 {
+		return
+	}
+
+	data, ok := frame.(json.RawMessage)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(frame); err != nil {
+			log.Printf("failed to marshal frame %T: %v", frame, err)
+			return
+		}
+	}
+
+	for _, client := range targets {
+		if !client.queue(data) {
+			// Slow consumer: drop only this device
+			h.mu.Lock()
+			h.removeClientLocked(client)
+			h.mu.Unlock()
+		}
+	}
+}
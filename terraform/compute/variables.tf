@@ -70,9 +70,9 @@ variable "http_addr" {
 }
 
 variable "jwt_duration" {
-  description = "Token lifetime"
+  description = "Access token lifetime"
   type        = string
-  default     = "24h"
+  default     = "15m"
 }
 
 variable "db_host" {
@@ -55,9 +55,9 @@ variable "jwt_secret" {
 }
 
 variable "jwt_duration" {
-  description = "Token lifetime"
+  description = "Access token lifetime"
   type        = string
-  default     = "24h"
+  default     = "15m"
 }
 
 variable "db_password" {
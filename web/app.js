@@ -11,6 +11,8 @@
 
 // Global State
 let token = localStorage.getItem('token');
+let refreshToken = localStorage.getItem('refreshToken');
+let refreshPromise = null;
 let userId = localStorage.getItem('userId');
 let currentUser = null;
 let ws = null;
@@ -20,6 +22,8 @@ let allUsers = [];
 let conversationPartners = new Set();
 let messagesMap = new Map(); // userId -> messages array
 let messageStatus = new Map(); // messageId -> 'sending' | 'delivered' | 'read'
+let pendingMessages = new Map(); // client_msg_id -> frame sent but not yet acked
+let presence = new Map(); // userId -> { state, last_seen_at }
 let viewMode = 'sidebar'; // 'sidebar' | 'chat' - for mobile
 let lastDataRefresh = 0;
 let refreshDebounceTimer = null;
@@ -99,16 +103,28 @@ function getCsrfToken() {
 }
 
 async function apiRequest(endpoint, options = {}) {
+    const send = () => fetch(`${API_URL}${endpoint}`, {
+        ...options,
+        headers: {
+            'Authorization': `Bearer ${token}`,
+            'X-CSRF-Token': getCsrfToken(),
+            ...options.headers
+        },
+        signal: options.signal || AbortSignal.timeout(10000)
+    });
+
     try {
-        const res = await fetch(`${API_URL}${endpoint}`, {
-            ...options,
-            headers: {
-                'Authorization': `Bearer ${token}`,
-                'X-CSRF-Token': getCsrfToken(),
-                ...options.headers
-            },
-            signal: options.signal || AbortSignal.timeout(10000)
-        });
+        const res = await send();
+        // Access tokens are short-lived: refresh once and retry
+        if (res.status === 401 && refreshToken) {
+            const result = await refreshAccessToken();
+            if (result === 'ok') {
+                return await send();
+            }
+            if (result === 'invalid') {
+                logout();
+            }
+        }
         return res;
     } catch (e) {
         if (e.name === 'AbortError') {
@@ -118,9 +134,103 @@ async function apiRequest(endpoint, options = {}) {
     }
 }
 
+// saveTokens stores the token pair returned by login, register and refresh
+function saveTokens(data) {
+    token = data.token;
+    refreshToken = data.refresh_token;
+    localStorage.setItem('token', token);
+    localStorage.setItem('refreshToken', refreshToken);
+}
+
+// refreshAccessToken exchanges the refresh token for a new pair and resolves to
+// 'ok', 'invalid' (the session is over) or 'error' (try again later).
+// Concurrent callers share one request since a refresh token can only be used once.
+function refreshAccessToken() {
+    // Another tab may have rotated the tokens already
+    const stored = localStorage.getItem('refreshToken');
+    if (stored && stored !== refreshToken) {
+        token = localStorage.getItem('token');
+        refreshToken = stored;
+        return Promise.resolve('ok');
+    }
+    if (!refreshToken) {
+        return Promise.resolve('invalid');
+    }
+
+    if (!refreshPromise) {
+        refreshPromise = fetch(`${API_URL}/auth/refresh`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': getCsrfToken()
+            },
+            body: JSON.stringify({ refresh_token: refreshToken }),
+            signal: AbortSignal.timeout(10000)
+        }).then(async res => {
+            if (res.status === 403) {
+                // The account has been disabled
+                return 'invalid';
+            }
+            if (res.status === 401) {
+                // Lost a race against another tab refreshing the same token
+                const latest = localStorage.getItem('refreshToken');
+                if (latest && latest !== refreshToken) {
+                    token = localStorage.getItem('token');
+                    refreshToken = latest;
+                    return 'ok';
+                }
+                return 'invalid';
+            }
+            if (!res.ok) {
+                return 'error';
+            }
+            saveTokens(await res.json());
+            return 'ok';
+        }).catch(() => 'error').finally(() => {
+            refreshPromise = null;
+        });
+    }
+    return refreshPromise;
+}
+
+// tokenExpiresSoon reports whether the access token expires within the next 30 seconds
+function tokenExpiresSoon() {
+    try {
+        const payload = JSON.parse(atob(token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/')));
+        return payload.exp * 1000 - Date.now() < 30000;
+    } catch (e) {
+        return true;
+    }
+}
+
+// logoutEverywhere ends all sessions of the user, including this one
+async function logoutEverywhere() {
+    if (!confirm('Log out on all devices?')) {
+        return;
+    }
+    try {
+        await apiRequest('/sessions', { method: 'DELETE' });
+    } catch (e) {
+        console.error('Failed to revoke sessions:', e);
+    }
+    logout();
+}
+
 function logout() {
+    // End the session on the server; best effort since the token may already be invalid
+    if (token) {
+        fetch(`${API_URL}/auth/logout`, {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${token}`,
+                'X-CSRF-Token': getCsrfToken()
+            }
+        }).catch(() => {});
+    }
+
     // Clear localStorage
     localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
     localStorage.removeItem('userId');
     
     // Close WebSocket
@@ -136,6 +246,7 @@ function logout() {
     
     // Reset state
     token = null;
+    refreshToken = null;
     userId = null;
     currentUser = null;
     currentChat = null;
@@ -215,9 +326,7 @@ async function login() {
             return;
         }
 
-        const data = await res.json();
-        token = data.token;
-        localStorage.setItem('token', token);
+        saveTokens(await res.json());
 
         document.getElementById('auth-section').style.display = 'none';
 
@@ -263,9 +372,7 @@ async function register() {
             return;
         }
 
-        const data = await res.json();
-        token = data.token;
-        localStorage.setItem('token', token);
+        saveTokens(await res.json());
 
         document.getElementById('auth-section').style.display = 'none';
 
@@ -318,10 +425,23 @@ async function initApp() {
 
 // ==================== WEBSOCKET ====================
 
-function initWebSocket() {
+async function initWebSocket() {
     if (ws) {
         ws.close();
     }
+    // Logged out while a reconnect was pending
+    if (!token) {
+        return;
+    }
+
+    // The socket is authenticated once at connect time, so connect with a fresh token
+    if (tokenExpiresSoon()) {
+        const result = await refreshAccessToken();
+        if (result === 'invalid') {
+            logout();
+            return;
+        }
+    }
     
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
     ws = new WebSocket(`${protocol}//${window.location.host}/ws?token=${token}`);
@@ -330,6 +450,11 @@ function initWebSocket() {
         console.log('WebSocket connected');
         reconnectAttempts = 0;
         setupPing();
+        if (document.visibilityState !== 'visible') {
+            ws.send(JSON.stringify({ type: 'presence', state: 'away' }));
+        }
+        // Resending is safe: the server recognizes the client_msg_id of a stored message
+        pendingMessages.forEach(frame => ws.send(JSON.stringify(frame)));
     };
 
     ws.onmessage = (event) => {
@@ -341,10 +466,16 @@ function initWebSocket() {
         handleIncomingMessage(msg);
     };
 
-    ws.onclose = () => {
+    ws.onclose = (event) => {
         console.log('WebSocket disconnected');
         clearInterval(pingInterval);
         clearTimeout(pongTimeout);
+
+        // The session was revoked from another device
+        if (event.code === 4001) {
+            logout();
+            return;
+        }
         
         const delay = Math.min(1000 * Math.pow(2, reconnectAttempts), MAX_RECONNECT_DELAY);
         console.log(`Reconnecting in ${delay}ms...`);
@@ -376,7 +507,7 @@ function setupPing() {
 function handleIncomingMessage(msg) {
     // Handle call messages first
     if (['call_start', 'call_offer', 'call_answer', 'call_ice_candidate', 
-         'call_join', 'call_leave', 'call_end', 'call_reject'].includes(msg.type)) {
+         'call_join', 'call_leave', 'call_end', 'call_reject', 'call_speaker'].includes(msg.type)) {
         handleCallMessage(msg);
         return;
     }
@@ -391,11 +522,36 @@ function handleIncomingMessage(msg) {
         return;
     }
 
+    if (msg.type === 'ack' || msg.type === 'nack') {
+        handleSendResult(msg);
+        return;
+    }
+
+    if (msg.type === 'error') {
+        handleErrorFrame(msg);
+        return;
+    }
+
     if (msg.type === 'typing') {
         handleTypingStatus(msg);
         return;
     }
 
+    if (msg.type === 'presence') {
+        handlePresence(msg);
+        return;
+    }
+
+    if (msg.type === 'message_edited' || msg.type === 'message_deleted') {
+        handleMessageUpdate(msg);
+        return;
+    }
+
+    // Chat messages carry no type; ignore other events this client does not know
+    if (msg.type) {
+        return;
+    }
+
     const partnerId = msg.sender_id === userId ? msg.receiver_id : msg.sender_id;
     const isIncoming = msg.sender_id !== userId;
 
@@ -405,12 +561,13 @@ function handleIncomingMessage(msg) {
     }
     messagesMap.get(partnerId).push(msg);
 
-    // Update chat list (includes unread count increment for non-active chats)
-    updateChatFromMessage(partnerId, msg, isIncoming && currentChat !== partnerId);
+    // Update chat list (includes unread count increment for non-active chats);
+    // of the call entries only missed calls count as unread
+    updateChatFromMessage(partnerId, msg, isIncoming && currentChat !== partnerId && msg.kind !== 'call');
 
     // Show push notification for incoming messages
     if (isIncoming) {
-        const text = decodePayload(msg.payload);
+        const text = messageText(msg);
         const chat = chats.get(partnerId);
         const senderName = chat ? chat.username : 'User';
         showNotification(senderName, text, partnerId);
@@ -446,6 +603,23 @@ function handleIncomingMessage(msg) {
     }
 }
 
+function handleMessageUpdate(msg) {
+    const div = document.querySelector(`.message[data-message-id="${msg.message_id}"]`);
+    if (div) {
+        if (msg.type === 'message_deleted') {
+            div.remove();
+        } else {
+            const textEl = div.querySelector('.message-text');
+            if (textEl && !div.classList.contains('e2e')) {
+                textEl.textContent = decodePayload(msg.payload);
+            }
+        }
+    }
+
+    // Refresh previews, which skip deleted messages and show edited text
+    loadChats();
+}
+
 function handleTypingStatus(msg) {
     if (!currentChat || currentChat !== msg.sender_id) {
         return;
@@ -464,6 +638,41 @@ function handleTypingStatus(msg) {
     }, TYPING_HIDE_DELAY);
 }
 
+function handlePresence(msg) {
+    presence.set(msg.user_id, msg);
+    if (currentChat === msg.user_id) {
+        renderChatStatus();
+    }
+}
+
+async function loadPresence(chatUserId) {
+    try {
+        const res = await apiRequest(`/presence?ids=${chatUserId}`);
+        if (res.ok) {
+            const [state] = await res.json();
+            presence.set(chatUserId, state);
+            if (currentChat === chatUserId) {
+                renderChatStatus();
+            }
+        }
+    } catch (e) {
+        console.error('Failed to load presence:', e);
+    }
+}
+
+function renderChatStatus() {
+    const state = presence.get(currentChat);
+    let status = '';
+    if (state && state.state === 'online') {
+        status = 'online';
+    } else if (state && state.state === 'away') {
+        status = 'away';
+    } else if (state && state.last_seen_at) {
+        status = 'last seen ' + formatMessageTime(new Date(state.last_seen_at));
+    }
+    document.getElementById('chat-status').textContent = status;
+}
+
 function showTypingPreview(text) {
     const container = document.getElementById('messages');
     if (!container) return;
@@ -502,6 +711,32 @@ function handleDeliveryStatus(msg) {
     });
 }
 
+function handleSendResult(msg) {
+    if (!msg.client_msg_id) return;
+    pendingMessages.delete(msg.client_msg_id);
+
+    const div = document.querySelector(`.message[data-client-msg-id="${msg.client_msg_id}"]`);
+    if (!div) return;
+    if (msg.type === 'ack') {
+        div.dataset.messageId = msg.message_id;
+    } else {
+        console.warn('Message not sent:', msg.error);
+        div.classList.remove('sending');
+        div.classList.add('failed');
+        div.title = msg.error || 'Not sent';
+    }
+}
+
+function handleErrorFrame(msg) {
+    console.warn(`${msg.request_type} failed (${msg.code}): ${msg.message}`);
+
+    // A call that could not be started or joined would otherwise ring forever
+    if (msg.request_type === 'call_start' || msg.request_type === 'call_join') {
+        endCall();
+        alert('Call failed: ' + msg.message);
+    }
+}
+
 function handleReadStatus(msg) {
     if (msg.partner_id === userId) {
         markOutgoingAsRead(msg.reader_id);
@@ -540,7 +775,7 @@ async function loadChats() {
             chats.set(chat.user_id, {
                 userId: chat.user_id,
                 username: chat.username || chat.user_id,
-                lastMessage: chat.last_message,
+                lastMessage: chat.last_message_e2e ? ENCRYPTED_PLACEHOLDER : chat.last_message_undecryptable ? UNDECRYPTABLE_PLACEHOLDER : callEntryIcon(chat.last_message_kind) + (chat.last_message || ''),
                 lastMessageTime: chat.last_message_time ? new Date(chat.last_message_time) : new Date(0),
                 unreadCount: chat.unread_count || 0
             });
@@ -575,7 +810,10 @@ async function refreshAllData(options = {}) {
 }
 
 function updateChatFromMessage(partnerId, msg, incrementUnread = false) {
-    const text = decodePayload(msg.payload);
+    let text = messageText(msg);
+    if (!text && msg.attachments && msg.attachments.length > 0) {
+        text = '📎 ' + msg.attachments[0].file_name;
+    }
     const chat = chats.get(partnerId);
 
     if (chat) {
@@ -695,7 +933,8 @@ async function selectChat(chatUserId) {
     document.getElementById('active-chat').classList.remove('hidden');
     
     document.getElementById('chat-username').textContent = chat.username;
-    document.getElementById('chat-status').textContent = '';
+    renderChatStatus();
+    loadPresence(chatUserId);
     
     chat.unreadCount = 0;
     renderChatList();
@@ -729,7 +968,14 @@ function goToSidebar() {
 
 function sendReadStatus(partnerId) {
     if (ws && ws.readyState === WebSocket.OPEN) {
-        ws.send(JSON.stringify({
+        // Read up to the newest message we have; the server falls back to the
+        // newest message of the chat if we have none yet
+        const messages = messagesMap.get(partnerId) || [];
+        const latest = messages[messages.length - 1];
+        ws.send(JSON.stringify(latest && latest.id ? {
+            type: 'read',
+            message_id: latest.id
+        } : {
             type: 'read',
             partner_id: partnerId
         }));
@@ -772,7 +1018,7 @@ async function loadMessages(chatUserId, preserveScroll = false) {
             throw new Error('Failed to load messages: ' + res.statusText);
         }
         
-        const messages = await res.json();
+        const { messages } = await res.json();
         
         messagesMap.set(chatUserId, messages);
         
@@ -813,13 +1059,23 @@ function displayMessage(msg, status = '', forcedStatus = '') {
     const actualStatus = forcedStatus || status || (isOutgoing ? 'sending' : '');
     
     const div = document.createElement('div');
-    div.className = `message ${isOutgoing ? 'outgoing' : 'incoming'} ${actualStatus}`;
+    if (isCallEntry(msg)) {
+        div.className = `message call-entry ${msg.kind === 'missed_call' ? 'missed' : ''}`;
+    } else {
+        div.className = `message ${isOutgoing ? 'outgoing' : 'incoming'} ${actualStatus}`;
+    }
     div.dataset.messageId = msg.id;
+    if (msg.client_msg_id) {
+        div.dataset.clientMsgId = msg.client_msg_id;
+    }
     if (isOutgoing) {
         div.dataset.receiverId = msg.receiver_id;
     }
     
-    const text = decodePayload(msg.payload);
+    if (msg.e2e) {
+        div.classList.add('e2e');
+    }
+    const text = messageText(msg);
     const time = formatMessageTime(new Date(msg.created_at));
     
     div.innerHTML = `
@@ -827,12 +1083,145 @@ function displayMessage(msg, status = '', forcedStatus = '') {
         <div class="message-time">${time}</div>
     `;
     
+    if (msg.attachments && msg.attachments.length > 0) {
+        div.insertBefore(renderAttachments(msg.attachments), div.firstChild);
+    }
+    
     container.appendChild(div);
 }
 
+// ==================== ATTACHMENTS ====================
+
+// Object URLs of downloaded attachments, keyed by attachment ID
+const attachmentUrls = new Map();
+
+function renderAttachments(attachments) {
+    const list = document.createElement('div');
+    list.className = 'message-attachments';
+    
+    attachments.forEach(att => {
+        // SVG can carry scripts, so it is offered as a file like any other document
+        if (att.content_type.startsWith('image/') && att.content_type !== 'image/svg+xml') {
+            const img = document.createElement('img');
+            img.className = 'message-image';
+            img.alt = att.file_name;
+            img.onclick = () => downloadAttachment(att);
+            getAttachmentUrl(att.id).then(url => { img.src = url; }).catch(e => {
+                console.error('Failed to load attachment:', e);
+            });
+            list.appendChild(img);
+            return;
+        }
+        
+        const link = document.createElement('a');
+        link.href = '#';
+        link.className = 'message-file';
+        link.textContent = '📎 ' + att.file_name;
+        const size = document.createElement('span');
+        size.className = 'message-file-size';
+        size.textContent = formatFileSize(att.size);
+        link.appendChild(size);
+        link.onclick = (e) => {
+            e.preventDefault();
+            downloadAttachment(att);
+        };
+        list.appendChild(link);
+    });
+    
+    return list;
+}
+
+async function getAttachmentUrl(attachmentId) {
+    if (attachmentUrls.has(attachmentId)) {
+        return attachmentUrls.get(attachmentId);
+    }
+    
+    // Downloads need the Authorization header, so they go through fetch instead of a plain link
+    const res = await apiRequest(`/attachments/${attachmentId}`, {
+        signal: AbortSignal.timeout(120000)
+    });
+    if (!res.ok) {
+        throw new Error('Failed to download attachment: ' + res.statusText);
+    }
+    const url = URL.createObjectURL(await res.blob());
+    attachmentUrls.set(attachmentId, url);
+    return url;
+}
+
+async function downloadAttachment(att) {
+    try {
+        const url = await getAttachmentUrl(att.id);
+        const a = document.createElement('a');
+        a.href = url;
+        a.download = att.file_name;
+        document.body.appendChild(a);
+        a.click();
+        a.remove();
+    } catch (e) {
+        console.error('Failed to download attachment:', e);
+        alert('Failed to download file');
+    }
+}
+
+async function sendAttachment(file) {
+    if (!file || !currentChat) return;
+    
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+        console.warn('WebSocket not connected, attachment not sent');
+        return;
+    }
+    
+    const form = new FormData();
+    form.append('receiver_id', currentChat);
+    form.append('file', file);
+    
+    try {
+        const res = await apiRequest('/attachments', {
+            method: 'POST',
+            body: form,
+            signal: AbortSignal.timeout(120000)
+        });
+        const data = await res.json();
+        if (!res.ok) {
+            alert(data.error || 'Failed to upload file');
+            return;
+        }
+        
+        // The typed text becomes the caption; the message echoes back over the WebSocket
+        const input = document.getElementById('message-input');
+        ws.send(JSON.stringify({
+            receiver_id: currentChat,
+            payload: input.value.trim(),
+            attachment_ids: [data.id]
+        }));
+        input.value = '';
+        input.style.height = 'auto';
+        smartScrollToBottom(500);
+    } catch (e) {
+        console.error('Failed to upload attachment:', e);
+        alert('Failed to upload file');
+    }
+}
+
+function formatFileSize(bytes) {
+    if (bytes < 1024) return bytes + ' B';
+    if (bytes < 1024 * 1024) return (bytes / 1024).toFixed(1) + ' KB';
+    return (bytes / (1024 * 1024)).toFixed(1) + ' MB';
+}
+
 function replaceOptimisticMessage(serverMsg) {
     const container = document.getElementById('messages');
-    const text = decodePayload(serverMsg.payload);
+    const text = messageText(serverMsg);
+
+    if (serverMsg.client_msg_id) {
+        const msgDiv = container.querySelector(`.message[data-client-msg-id="${serverMsg.client_msg_id}"]`);
+        if (msgDiv) {
+            msgDiv.classList.remove('sending', 'failed');
+            msgDiv.classList.add('delivered');
+            msgDiv.dataset.messageId = serverMsg.id;
+            return true;
+        }
+    }
     
     // Find optimistic message by content (sent by current user)
     const sendingMsgs = container.querySelectorAll('.message.sending');
@@ -854,6 +1243,28 @@ function decodePayload(payload) {
     return String(payload);
 }
 
+const ENCRYPTED_PLACEHOLDER = '🔒 Encrypted message';
+// The server lost the key of the message and sends no payload
+const UNDECRYPTABLE_PLACEHOLDER = '⚠️ Message cannot be decrypted';
+
+// This client holds no end-to-end keys, so it cannot show encrypted payloads
+function messageText(msg) {
+    if (msg.e2e) return ENCRYPTED_PLACEHOLDER;
+    if (msg.undecryptable) return UNDECRYPTABLE_PLACEHOLDER;
+    return callEntryIcon(msg.kind) + decodePayload(msg.payload);
+}
+
+// Call entries are written by the server when a call ends or is declined
+function isCallEntry(msg) {
+    return msg.kind === 'call' || msg.kind === 'missed_call';
+}
+
+function callEntryIcon(kind) {
+    if (kind === 'missed_call') return '📵 ';
+    if (kind === 'call') return '📞 ';
+    return '';
+}
+
 // ==================== PUSH NOTIFICATIONS ====================
 
 function requestNotificationPermission() {
@@ -901,6 +1312,13 @@ function showNotification(title, body, chatUserId) {
     setTimeout(() => notification.close(), 5000);
 }
 
+function newClientMsgId() {
+    if (window.crypto && crypto.randomUUID) {
+        return crypto.randomUUID();
+    }
+    return Date.now().toString(36) + '-' + Math.random().toString(36).slice(2);
+}
+
 function sendMessage() {
     const input = document.getElementById('message-input');
     const text = input.value.trim();
@@ -909,11 +1327,13 @@ function sendMessage() {
     
     const msg = {
         receiver_id: currentChat,
-        payload: text
+        payload: text,
+        client_msg_id: newClientMsgId()
     };
     
     if (ws && ws.readyState === WebSocket.OPEN) {
         ws.send(JSON.stringify(msg));
+        pendingMessages.set(msg.client_msg_id, msg);
     } else {
         console.warn('WebSocket not connected, message not sent');
         return;
@@ -928,6 +1348,7 @@ function sendMessage() {
     
     const optimisticMsg = {
         id: 'temp-' + Date.now(),
+        client_msg_id: msg.client_msg_id,
         sender_id: userId,
         receiver_id: currentChat,
         payload: text,
@@ -1405,6 +1826,14 @@ function sendTypingStopped() {
 
 // Setup all event listeners when DOM is ready
 function setupEventListeners() {
+    const attachmentInput = document.getElementById('attachment-input');
+    if (attachmentInput) {
+        attachmentInput.addEventListener('change', function() {
+            sendAttachment(this.files[0]);
+            this.value = '';
+        });
+    }
+    
     // Enter key listener for login inputs
     const usernameInput = document.getElementById('username');
     const passwordInput = document.getElementById('password');
@@ -1492,6 +1921,11 @@ function setupEventListeners() {
     
 // Refresh on tab visibility change (debounced)
 document.addEventListener('visibilitychange', function() {
+    // Contacts see this device as away while the tab is in the background
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: 'presence', state: document.visibilityState === 'visible' ? 'online' : 'away' }));
+    }
+
     if (document.visibilityState === 'visible' && token) {
         clearTimeout(refreshDebounceTimer);
         refreshDebounceTimer = setTimeout(() => {
@@ -1676,6 +2110,8 @@ function endCall() {
     // Stop timer
     stopCallTimer();
     
+    clearRemoteVideos();
+    
     // Stop local stream
     if (mediaUtils) {
         mediaUtils.stopLocalStream();
@@ -1715,7 +2151,7 @@ async function acceptCall() {
         console.log('[DEBUG] acceptCall: Stored stream in callManager.localStream');
         
         // Join the call
-        await callManager.joinCall(incomingCall.callId);
+        await callManager.joinCall(incomingCall.callId, incomingCall.sfu, incomingCall.callType);
         activeCall = incomingCall;
         
         // Clear incoming call
@@ -1826,12 +2262,18 @@ function handleCallMessage(msg) {
                 incomingCall = {
                     callId: msg.call_id,
                     callerId: msg.caller_id,
-                    callType: msg.call_type
+                    callType: msg.call_type,
+                    sfu: !!msg.sfu
                 };
                 showCallInviteModal(msg.caller_id, msg.call_type);
             }
             break;
         case 'call_offer':
+            // The SFU renegotiates the call we are in
+            if (msg.sfu) {
+                callManager.handleOffer(msg);
+                break;
+            }
             if (!incomingCall) {
                 incomingCall = {
                     callId: msg.call_id,
@@ -1865,8 +2307,12 @@ function handleCallMessage(msg) {
                 console.log(`${participantName} left the call`);
                 // Close peer connection for this participant
                 callManager.peerConnections.delete(msg.user_id);
+                removeRemoteVideo(msg.user_id);
             }
             break;
+        case 'call_speaker':
+            setActiveSpeaker(msg.user_id);
+            break;
         case 'call_end':
             endCall();
             break;
@@ -1891,11 +2337,19 @@ function setupCallEventListeners() {
     window.addEventListener('remoteStream', (e) => {
         console.log('Remote stream received:', e.detail);
         const videoEl = document.getElementById('remote-video');
-        if (videoEl) {
-            videoEl.srcObject = e.detail.stream;
+        if (!videoEl) {
+            console.error('Remote video element not found');
+            return;
+        }
+        // The first participant plays in the main video, everyone else of a
+        // group call gets a tile of their own
+        const { userId: participantId, stream } = e.detail;
+        if (!videoEl.srcObject || videoEl.dataset.userId === participantId) {
+            videoEl.srcObject = stream;
+            videoEl.dataset.userId = participantId;
             console.log('Remote video element updated');
         } else {
-            console.error('Remote video element not found');
+            showRemoteTile(participantId, stream);
         }
     });
     
@@ -1905,6 +2359,49 @@ function setupCallEventListeners() {
     });
 }
 
+// Show the stream of a group call participant in a tile of its own
+function showRemoteTile(participantId, stream) {
+    const container = document.getElementById('video-container');
+    let tile = container.querySelector(`video.remote-tile[data-user-id="${participantId}"]`);
+    if (!tile) {
+        tile = document.createElement('video');
+        tile.className = 'remote-tile';
+        tile.autoplay = true;
+        tile.playsInline = true;
+        tile.dataset.userId = participantId;
+        container.appendChild(tile);
+    }
+    tile.srcObject = stream;
+}
+
+// Remove the video of a participant that left
+function removeRemoteVideo(participantId) {
+    const videoEl = document.getElementById('remote-video');
+    if (videoEl && videoEl.dataset.userId === participantId) {
+        videoEl.srcObject = null;
+        delete videoEl.dataset.userId;
+    }
+    document.querySelectorAll(`video.remote-tile[data-user-id="${participantId}"]`).forEach(tile => tile.remove());
+}
+
+// Reset the remote videos for the next call
+function clearRemoteVideos() {
+    const videoEl = document.getElementById('remote-video');
+    if (videoEl) {
+        videoEl.srcObject = null;
+        delete videoEl.dataset.userId;
+        videoEl.classList.remove('speaking');
+    }
+    document.querySelectorAll('video.remote-tile').forEach(tile => tile.remove());
+}
+
+// Highlight the video of the participant the SFU hears speaking
+function setActiveSpeaker(participantId) {
+    document.querySelectorAll('#video-container video').forEach(video => {
+        video.classList.toggle('speaking', video.dataset.userId === participantId);
+    });
+}
+
 // Setup call event listeners when DOM is ready
 document.addEventListener('DOMContentLoaded', setupCallEventListeners);
 
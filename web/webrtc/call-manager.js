@@ -14,10 +14,15 @@ class CallManager {
     this.pendingOffers = []; // Offers waiting for real call ID
     this.callIdResolve = null; // Promise resolver for call ID
     this.localStream = null; // Local media stream for calls
+    this.sfuConnection = null; // Single connection to the server in SFU calls
+    this.pendingSFUCandidates = []; // Server candidates that arrived before its description
   }
 
   async getICEConfig() {
-    if (this.iceConfig) return this.iceConfig;
+    // Minted TURN credentials expire after ttl seconds; fetch new ones halfway through
+    if (this.iceConfig && (!this.iceConfigExpiresAt || Date.now() < this.iceConfigExpiresAt)) {
+      return this.iceConfig;
+    }
     
     try {
       console.log('Fetching ICE config from /calls/ice-config');
@@ -27,6 +32,7 @@ class CallManager {
       console.log('ICE config response headers:', [...response.headers.entries()]);
       if (response.ok) {
         this.iceConfig = await response.json();
+        this.iceConfigExpiresAt = this.iceConfig.ttl ? Date.now() + this.iceConfig.ttl * 500 : 0;
         console.log('ICE config:', this.iceConfig);
       } else {
         const errorText = await response.text();
@@ -98,6 +104,22 @@ class CallManager {
       caller_id: this.userId
     }));
 
+    // Wait for the real call ID from the server, which also tells whether the
+    // call goes through the SFU
+    try {
+      await this.waitForCallId();
+    } catch (err) {
+      console.error('Failed to get call ID from server:', err);
+      // Clean up and fail the call - cannot proceed without valid call ID
+      this.activeCall = null;
+      throw new Error('Failed to establish call - server did not respond. Please try again.');
+    }
+
+    if (this.activeCall.sfu) {
+      await this.connectToSFU(externalStream);
+      return this.activeCall;
+    }
+
     // Get ICE config from server
     const iceConfig = await this.getICEConfig();
 
@@ -176,17 +198,6 @@ class CallManager {
       offers.push({ participantId: pid, offer });
     }
 
-    // Wait for real call ID from server before sending offers
-    try {
-      await this.waitForCallId();
-    } catch (err) {
-      console.error('Failed to get call ID from server:', err);
-      // Clean up and fail the call - cannot proceed without valid call ID
-      this.closeAllPeerConnections();
-      this.activeCall = null;
-      throw new Error('Failed to establish call - server did not respond. Please try again.');
-    }
-
     // Send offers with the real call ID
     for (const { participantId, offer } of offers) {
       this.sendOffer(participantId, offer);
@@ -195,12 +206,14 @@ class CallManager {
     return this.activeCall;
   }
 
-  async joinCall(callId) {
+  async joinCall(callId, sfu = false, callType = this.callType) {
+    this.callType = callType;
     this.activeCall = {
       id: callId,
-      type: this.callType,
+      type: callType,
       participants: [],
-      callerId: null
+      callerId: null,
+      sfu: sfu
     };
 
     // Send call_join to server via WebSocket (server handles both signaling and persistence)
@@ -209,6 +222,141 @@ class CallManager {
       call_id: callId,
       user_id: this.userId
     }));
+
+    // In SFU calls everyone connects to the server instead of waiting for offers
+    if (sfu) {
+      await this.connectToSFU(this.localStream);
+    }
+  }
+
+  /**
+   * Connect to the server's SFU: one connection sends the local stream and
+   * receives everyone else's, which the server adds by renegotiating
+   * @param {MediaStream|null} stream - Local stream, acquired here if missing
+   */
+  async connectToSFU(stream) {
+    const iceConfig = await this.getICEConfig();
+    const pc = new PeerConnection('sfu', this.callType, iceConfig);
+    await pc.createPeerConnection();
+    this.sfuConnection = pc;
+    this.pendingSFUCandidates = [];
+
+    if (stream) {
+      this.addSFUTracks(pc.connection, stream);
+      this.localStream = stream;
+    } else {
+      try {
+        // getLocalStream() will add tracks to the connection internally
+        this.localStream = await pc.getLocalStream();
+      } catch (err) {
+        console.error('Failed to get local stream:', err);
+        window.dispatchEvent(new CustomEvent('mediaError', {
+          detail: { userId: this.userId, error: err.message, callType: this.callType }
+        }));
+      }
+    }
+
+    pc.connection.onicecandidate = (event) => {
+      if (event.candidate) {
+        this.sendSFU('call_ice_candidate', { candidate: event.candidate.toJSON() });
+      }
+    };
+
+    // The server names each stream after the user whose media it carries
+    pc.connection.ontrack = (event) => {
+      const stream = event.streams[0];
+      if (stream) {
+        window.dispatchEvent(new CustomEvent('remoteStream', {
+          detail: { userId: stream.id, stream: stream }
+        }));
+      }
+    };
+
+    const offer = await pc.createOffer();
+    this.sendSFU('call_offer', { sdp: offer.sdp, call_type: this.callType });
+  }
+
+  /**
+   * Add the local tracks to the SFU connection. Video is sent in three simulcast
+   * layers, the server forwards each participant the one that suits the call.
+   */
+  addSFUTracks(connection, stream) {
+    stream.getAudioTracks().forEach(track => connection.addTrack(track, stream));
+    stream.getVideoTracks().forEach(track => {
+      connection.addTransceiver(track, {
+        direction: 'sendrecv',
+        streams: [stream],
+        sendEncodings: [
+          { rid: 'l', scaleResolutionDownBy: 4, maxBitrate: 150000 },
+          { rid: 'm', scaleResolutionDownBy: 2, maxBitrate: 500000 },
+          { rid: 'h', maxBitrate: 1500000 }
+        ]
+      });
+    });
+  }
+
+  /**
+   * Ask the SFU for a simulcast layer of a participant's video
+   * @param {string} participantId - The participant whose video to receive
+   * @param {string} layer - 'l', 'm' or 'h', or '' to let the server choose
+   */
+  selectLayer(participantId, layer) {
+    if (!this.activeCall || !this.activeCall.sfu) return;
+    this.sendSFU('call_layer', { user_id: participantId, layer: layer });
+  }
+
+  sendSFU(type, fields) {
+    if (!this.activeCall || !this.ws || this.ws.readyState !== WebSocket.OPEN) {
+      console.error('Cannot send', type, 'to SFU: no active call or WebSocket not connected');
+      return;
+    }
+    this.ws.send(JSON.stringify({ type: type, call_id: this.activeCall.id, sfu: true, ...fields }));
+  }
+
+  async handleSFUOffer(data) {
+    const pc = this.sfuConnection;
+    if (!pc || !this.activeCall || data.call_id !== this.activeCall.id) return;
+
+    await pc.setRemoteDescription({ type: 'offer', sdp: data.sdp });
+    await this.flushSFUCandidates();
+    const answer = await pc.createAnswer();
+    this.sendSFU('call_answer', { sdp: answer.sdp });
+  }
+
+  async handleSFUAnswer(data) {
+    const pc = this.sfuConnection;
+    if (!pc || !this.activeCall || data.call_id !== this.activeCall.id) return;
+
+    await pc.setRemoteDescription({ type: 'answer', sdp: data.sdp });
+    await this.flushSFUCandidates();
+  }
+
+  async handleSFUIceCandidate(data) {
+    const pc = this.sfuConnection;
+    if (!pc || !this.activeCall || data.call_id !== this.activeCall.id) return;
+
+    // Candidates may overtake the server's answer
+    if (!pc.connection.remoteDescription) {
+      this.pendingSFUCandidates.push(data.candidate);
+      return;
+    }
+    try {
+      await pc.addIceCandidate(data.candidate);
+    } catch (err) {
+      console.error('[WebRTC] Failed to add SFU ICE candidate:', err);
+    }
+  }
+
+  async flushSFUCandidates() {
+    const candidates = this.pendingSFUCandidates;
+    this.pendingSFUCandidates = [];
+    for (const candidate of candidates) {
+      try {
+        await this.sfuConnection.addIceCandidate(candidate);
+      } catch (err) {
+        console.error('[WebRTC] Failed to add SFU ICE candidate:', err);
+      }
+    }
   }
 
   async leaveCall() {
@@ -331,9 +479,18 @@ class CallManager {
       pc.close();
     }
     this.peerConnections.clear();
+    if (this.sfuConnection) {
+      this.sfuConnection.close();
+      this.sfuConnection = null;
+    }
+    this.pendingSFUCandidates = [];
   }
 
   async handleOffer(data) {
+    if (data.sfu) {
+      return this.handleSFUOffer(data);
+    }
+
     const { call_id, caller_id, sdp, call_type } = data;
     this.callType = call_type;
 
@@ -452,6 +609,10 @@ class CallManager {
   }
 
   async handleAnswer(data) {
+    if (data.sfu) {
+      return this.handleSFUAnswer(data);
+    }
+
     const { call_id, callee_id, sdp } = data;
     console.log('[DEBUG] handleAnswer: Received answer from', callee_id, 'SDP contains audio:', sdp.includes('m=audio'), 'video:', sdp.includes('m=video'));
 
@@ -466,6 +627,10 @@ class CallManager {
   }
 
   async handleIceCandidate(data) {
+    if (data.sfu) {
+      return this.handleSFUIceCandidate(data);
+    }
+
     const { call_id, user_id: senderUserId, candidate } = data;
     console.log('[WebRTC] handleIceCandidate: Received ICE candidate from', senderUserId, 'type:', candidate?.candidate?.split(' ')[7] || 'unknown');
 
@@ -499,6 +664,7 @@ class CallManager {
     // If we're the caller, update our active call with the real call ID
     if (this.activeCall && caller_id === this.userId) {
       this.activeCall.id = call_id;
+      this.activeCall.sfu = !!data.sfu;
       
       // Resolve the promise if someone is waiting for the call ID
       if (this.callIdResolve) {
@@ -509,7 +675,7 @@ class CallManager {
     
     // Dispatch event for UI
     window.dispatchEvent(new CustomEvent('callStart', {
-      detail: { callId: call_id, callerId: caller_id, callType: call_type, participants }
+      detail: { callId: call_id, callerId: caller_id, callType: call_type, participants, sfu: !!data.sfu }
     }));
   }
 }